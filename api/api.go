@@ -77,13 +77,14 @@ func NewCustom(db *database.DB, mf *metafetcher.MetaFetcher, logger *logrus.Logg
 	tierLimits := make([]TierLimitsPublic, len(database.UserLimits))
 	for i, t := range database.UserLimits {
 		tierLimits[i] = TierLimitsPublic{
-			TierName:          t.TierName,
-			UploadBandwidth:   t.UploadBandwidth * 8,   // convert from bytes
-			DownloadBandwidth: t.DownloadBandwidth * 8, // convert from bytes
-			MaxUploadSize:     t.MaxUploadSize,
-			MaxNumberUploads:  t.MaxNumberUploads,
-			RegistryDelay:     t.RegistryDelay,
-			Storage:           t.Storage,
+			TierName:              t.TierName,
+			UploadBandwidth:       t.UploadBandwidth * 8,   // convert from bytes
+			DownloadBandwidth:     t.DownloadBandwidth * 8, // convert from bytes
+			MaxUploadSize:         t.MaxUploadSize,
+			MaxNumberUploads:      t.MaxNumberUploads,
+			RegistryDelay:         t.RegistryDelay,
+			Storage:               t.Storage,
+			MaxConcurrentRequests: t.MaxConcurrentRequests,
 		}
 	}
 	api := &API{
@@ -22,6 +22,8 @@ type (
 		Name     string   `json:"name,omitempty"`
 		Public   bool     `json:"public,string,omitempty"`
 		Skylinks []string `json:"skylinks,omitempty"`
+		// ExpiresAt is optional. Keys without it never expire.
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 	}
 	// APIKeyPUT describes the request body for updating an API key
 	APIKeyPUT struct {
@@ -42,6 +44,7 @@ type (
 		Key       database.APIKey    `json:"-"`
 		Skylinks  []string           `json:"skylinks"`
 		CreatedAt time.Time          `json:"createdAt"`
+		ExpiresAt *time.Time         `json:"expiresAt,omitempty"`
 	}
 	// APIKeyResponseWithKey is an API DTO which mirrors database.APIKey but
 	// also reveals the value of the Key field. This should only be used on key
@@ -59,6 +62,9 @@ func (akp APIKeyPOST) Validate() error {
 	if !akp.Public && len(akp.Skylinks) > 0 {
 		return errors.New("public API keys cannot refer to skylinks")
 	}
+	if akp.ExpiresAt != nil && !akp.ExpiresAt.After(time.Now().UTC()) {
+		return errors.New("expiration time must be in the future")
+	}
 	var errs []error
 	for _, s := range akp.Skylinks {
 		if !database.ValidSkylink(s) {
@@ -83,6 +89,7 @@ func APIKeyResponseFromAPIKey(ak database.APIKeyRecord) *APIKeyResponse {
 		Key:       ak.Key,
 		Skylinks:  ak.Skylinks,
 		CreatedAt: ak.CreatedAt,
+		ExpiresAt: ak.ExpiresAt,
 	}
 }
 
@@ -98,6 +105,7 @@ func APIKeyResponseWithKeyFromAPIKey(ak database.APIKeyRecord) *APIKeyResponseWi
 			Key:       ak.Key,
 			Skylinks:  ak.Skylinks,
 			CreatedAt: ak.CreatedAt,
+			ExpiresAt: ak.ExpiresAt,
 		},
 		Key: ak.Key,
 	}
@@ -117,12 +125,20 @@ func (api *API) userAPIKeyPOST(u *database.User, w http.ResponseWriter, req *htt
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	ak, err := api.staticDB.APIKeyCreate(req.Context(), *u, body.Name, body.Public, body.Skylinks)
+	ak, err := api.staticDB.APIKeyCreate(req.Context(), *u, body.Name, body.Public, body.Skylinks, body.ExpiresAt)
 	if errors.Contains(err, database.ErrMaxNumAPIKeysExceeded) {
-		err = errors.AddContext(err, "the maximum number of API keys a user can create is "+strconv.Itoa(database.MaxNumAPIKeysPerUser))
+		err = errors.AddContext(err, "the maximum number of API keys a user can create is "+strconv.Itoa(u.MaxAPIKeys()))
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if errors.Contains(err, database.ErrInvalidSkylink) {
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
+	if errors.Contains(err, database.ErrAPIKeyTierTooLow) {
+		api.WriteError(w, err, http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -201,6 +217,10 @@ func (api *API) userAPIKeyPUT(u *database.User, w http.ResponseWriter, req *http
 		api.WriteError(w, err, http.StatusNotFound)
 		return
 	}
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -228,6 +248,10 @@ func (api *API) userAPIKeyPATCH(u *database.User, w http.ResponseWriter, req *ht
 		api.WriteError(w, err, http.StatusNotFound)
 		return
 	}
+	if errors.Contains(err, database.ErrInvalidSkylink) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
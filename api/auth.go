@@ -26,6 +26,9 @@ func (api *API) userAndTokenByRequestToken(req *http.Request) (*database.User, j
 	if err != nil {
 		return nil, nil, errors.AddContext(err, "error fetching user from database")
 	}
+	if !u.IsTokenValid(token.IssuedAt()) {
+		return nil, nil, ErrTokenInvalidated
+	}
 	return u, token, nil
 }
 
@@ -54,10 +57,20 @@ func (api *API) userAndTokenByAPIKey(req *http.Request, ak database.APIKey) (*da
 	if err != nil {
 		return nil, nil, err
 	}
+	api.markAPIKeyUsed(req, akr)
 	t, err := jwt.TokenForUser(u.Email, u.Sub, 0)
 	return u, t, err
 }
 
+// markAPIKeyUsed records that the given API key was used. Failing to do so
+// shouldn't fail the request, so we only log the error.
+func (api *API) markAPIKeyUsed(req *http.Request, akr database.APIKeyRecord) {
+	err := api.staticDB.APIKeyMarkUsed(req.Context(), akr.ID)
+	if err != nil {
+		api.staticLogger.Debugf("Failed to mark API key %s as used: %s", akr.ID.Hex(), err)
+	}
+}
+
 // apiKeyFromRequest extracts the API key from the request headers and returns
 // it.
 func apiKeyFromRequest(r *http.Request) (*database.APIKey, error) {
@@ -22,8 +22,10 @@ type (
 	// userTierCacheEntry allows us to cache some basic information about the
 	// user, so we don't need to hit the DB to fetch data that rarely changes.
 	userTierCacheEntry struct {
-		Sub           string
-		Tier          int
+		Sub  string
+		Tier int
+		// QuotaExceeded is also set for suspended users, since they get the
+		// same limits as users who exceeded their quota.
 		QuotaExceeded bool
 		ExpiresAt     time.Time
 	}
@@ -57,7 +59,7 @@ func (utc *userTierCache) Set(key string, u *database.User) {
 	utc.cache[key] = userTierCacheEntry{
 		Sub:           u.Sub,
 		Tier:          u.Tier,
-		QuotaExceeded: u.QuotaExceeded,
+		QuotaExceeded: u.IsRestricted(),
 		ExpiresAt:     time.Now().UTC().Add(userTierCacheTTL).Truncate(time.Millisecond),
 	}
 	utc.mu.Unlock()
@@ -14,7 +14,6 @@ import (
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
-	"github.com/SkynetLabs/skynet-accounts/hash"
 	"github.com/SkynetLabs/skynet-accounts/jwt"
 	"github.com/SkynetLabs/skynet-accounts/lib"
 	"github.com/SkynetLabs/skynet-accounts/metafetcher"
@@ -96,13 +95,14 @@ type (
 	// TierLimitsPublic is a DTO specifically designed to inform the public
 	// about the different limits of each account tier.
 	TierLimitsPublic struct {
-		TierName          string `json:"tierName"`
-		UploadBandwidth   int    `json:"uploadBandwidth"`   // bits per second
-		DownloadBandwidth int    `json:"downloadBandwidth"` // bits per second
-		MaxUploadSize     int64  `json:"maxUploadSize"`     // the max size of a single upload in bytes
-		MaxNumberUploads  int    `json:"maxNumberUploads"`
-		RegistryDelay     int    `json:"registryDelay"` // ms
-		Storage           int64  `json:"storageLimit"`
+		TierName              string `json:"tierName"`
+		UploadBandwidth       int    `json:"uploadBandwidth"`   // bits per second
+		DownloadBandwidth     int    `json:"downloadBandwidth"` // bits per second
+		MaxUploadSize         int64  `json:"maxUploadSize"`     // the max size of a single upload in bytes
+		MaxNumberUploads      int    `json:"maxNumberUploads"`
+		RegistryDelay         int    `json:"registryDelay"` // ms
+		Storage               int64  `json:"storageLimit"`
+		MaxConcurrentRequests int    `json:"maxConcurrentRequests"`
 	}
 	// UploadsGET is the response of GET /user/uploads
 	UploadsGET struct {
@@ -122,15 +122,16 @@ type (
 	// The returned speeds might be in bits or bytes per second, depending on
 	// the client's request.
 	UserLimitsGET struct {
-		Sub               string `json:"sub"`
-		TierID            int    `json:"tierID"`
-		TierName          string `json:"tierName"`
-		UploadBandwidth   int    `json:"upload"`        // bits or bytes per second
-		DownloadBandwidth int    `json:"download"`      // bits or bytes per second
-		MaxUploadSize     int64  `json:"maxUploadSize"` // the max size of a single upload in bytes
-		MaxNumberUploads  int    `json:"-"`
-		RegistryDelay     int    `json:"registry"` // ms delay
-		Storage           int64  `json:"-"`
+		Sub                   string `json:"sub"`
+		TierID                int    `json:"tierID"`
+		TierName              string `json:"tierName"`
+		UploadBandwidth       int    `json:"upload"`        // bits or bytes per second
+		DownloadBandwidth     int    `json:"download"`      // bits or bytes per second
+		MaxUploadSize         int64  `json:"maxUploadSize"` // the max size of a single upload in bytes
+		MaxNumberUploads      int    `json:"-"`
+		RegistryDelay         int    `json:"registry"` // ms delay
+		Storage               int64  `json:"-"`
+		MaxConcurrentRequests int    `json:"maxConcurrentRequests"`
 	}
 
 	// accountRecoveryPOST defines the payload we expect when a user is trying
@@ -307,7 +308,11 @@ func (api *API) loginPOSTCredentials(w http.ResponseWriter, req *http.Request, e
 		return
 	}
 	// Check if the password matches.
-	err = hash.Compare(password, []byte(u.PasswordHash))
+	err = api.staticDB.UserVerifyPassword(req.Context(), u, password)
+	if errors.Contains(err, database.ErrAccountLocked) {
+		api.WriteError(w, err, http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, ErrInvalidCredentials, http.StatusUnauthorized)
 		return
@@ -528,9 +533,10 @@ func (api *API) userLimitsGET(_ *database.User, w http.ResponseWriter, req *http
 			api.WriteJSON(w, respAnon)
 			return
 		}
+		api.markAPIKeyUsed(req, akr)
 		// Cache the user under the API key they used.
 		api.staticUserTierCache.Set(ak.String(), u)
-		api.WriteJSON(w, userLimitsGetFromTier(u.Sub, u.Tier, u.QuotaExceeded, inBytes))
+		api.WriteJSON(w, userLimitsGetFromTier(u.Sub, u.Tier, u.IsRestricted(), inBytes))
 		return
 	}
 	// Next check for a token.
@@ -631,9 +637,10 @@ func (api *API) userLimitsSkylinkGET(_ *database.User, w http.ResponseWriter, re
 		api.WriteJSON(w, respAnon)
 		return
 	}
+	api.markAPIKeyUsed(req, akr)
 	// Store the user in the cache with a custom key.
 	api.staticUserTierCache.Set(ak.String()+skylink, user)
-	api.WriteJSON(w, userLimitsGetFromTier(user.Sub, user.Tier, user.QuotaExceeded, inBytes))
+	api.WriteJSON(w, userLimitsGetFromTier(user.Sub, user.Tier, user.IsRestricted(), inBytes))
 }
 
 // userStatsGET returns statistics about an existing user.
@@ -748,13 +755,6 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 			api.WriteError(w, errors.New("registrations are currently disabled"), http.StatusNotImplemented)
 			return
 		}
-
-		pwHash, err := hash.Generate(payload.Password)
-		if err != nil {
-			api.WriteError(w, errors.AddContext(err, "failed to hash password"), http.StatusInternalServerError)
-			return
-		}
-		u.PasswordHash = string(pwHash)
 	}
 
 	if payload.StripeID != "" {
@@ -799,7 +799,7 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 		}
 		// Set the new email and set it up for a confirmation.
 		u.Email = payload.Email
-		u.EmailConfirmationTokenExpiration = time.Now().UTC().Add(database.EmailConfirmationTokenTTL).Truncate(time.Millisecond)
+		u.EmailConfirmationTokenExpiration = time.Now().UTC().Add(api.staticDB.EmailConfirmationTokenTTL()).Truncate(time.Millisecond)
 		u.EmailConfirmationToken, err = lib.GenerateUUID()
 		if err != nil {
 			api.WriteError(w, errors.AddContext(err, "failed to generate a token"), http.StatusInternalServerError)
@@ -814,10 +814,23 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 
 	// Save the changes.
 	err = api.staticDB.UserSave(ctx, u)
+	if errors.Contains(err, database.ErrUserAlreadyExists) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
+	// Change the password last, so it only changes if everything else
+	// succeeded. This also invalidates all tokens issued to the user so far.
+	if payload.Password != "" {
+		err = api.staticDB.UserChangePassword(ctx, u, payload.Password)
+		if err != nil {
+			api.WriteError(w, errors.AddContext(err, "failed to change password"), http.StatusInternalServerError)
+			return
+		}
+	}
 	// Send a confirmation email if the user's email address was changed.
 	if changedEmail {
 		err = api.staticMailer.SendAddressConfirmationEmail(ctx, u.Email, u.EmailConfirmationToken)
@@ -825,6 +838,8 @@ func (api *API) userPUT(u *database.User, w http.ResponseWriter, req *http.Reque
 			api.staticLogger.Debugln(errors.AddContext(err, "failed to send address confirmation email"))
 		}
 	}
+	// Issue a fresh token. Changing the password invalidated the one used for
+	// this request, so the user would be logged out otherwise.
 	api.loginUser(w, u, 0, true)
 }
 
@@ -844,8 +859,8 @@ func (api *API) userPubKeyDELETE(u *database.User, w http.ResponseWriter, req *h
 		api.WriteError(w, errors.New("the given pubkey is not associated with this user"), http.StatusBadRequest)
 		return
 	}
-	err = api.staticDB.UserPubKeyRemove(ctx, *u, pk)
-	if errors.Contains(err, mongo.ErrNoDocuments) {
+	err = api.staticDB.UserRemovePubKey(ctx, u, pk)
+	if errors.Contains(err, database.ErrPubKeyNotFound) {
 		api.WriteError(w, err, http.StatusNotFound)
 		return
 	}
@@ -939,7 +954,11 @@ func (api *API) userPubKeyRegisterPOST(u *database.User, w http.ResponseWriter,
 		api.WriteError(w, errors.New("user's sub doesn't match update sub"), http.StatusBadRequest)
 		return
 	}
-	err = api.staticDB.UserPubKeyAdd(ctx, *u, pk)
+	err = api.staticDB.UserAddPubKey(ctx, u, pk)
+	if errors.Contains(err, database.ErrPubKeyInUse) {
+		api.WriteError(w, err, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -1101,12 +1120,13 @@ func (api *API) userRecoverRequestPOST(_ *database.User, w http.ResponseWriter,
 		return
 	}
 	// Generate a new recovery token and add it to the user's account.
-	u.RecoveryToken, err = lib.GenerateUUID()
-	if err != nil {
-		api.WriteError(w, errors.AddContext(err, "failed to generate a token"), http.StatusInternalServerError)
+	_, err = api.staticDB.UserGenerateRecoveryToken(req.Context(), u)
+	if errors.Contains(err, database.ErrRecoveryTokenCooldown) {
+		// The user already got a recovery email moments ago. We don't send
+		// another one but we also don't reveal that the account exists.
+		api.WriteSuccess(w)
 		return
 	}
-	err = api.staticDB.UserSave(req.Context(), u)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to create a token"), http.StatusInternalServerError)
 		return
@@ -1164,13 +1184,13 @@ func (api *API) userRecoverPOST(_ *database.User, w http.ResponseWriter, req *ht
 		api.WriteError(w, errors.New("no such user"), http.StatusBadRequest)
 		return
 	}
-	passHash, err := hash.Generate(payload.Password)
+	err = api.staticDB.UserChangePassword(req.Context(), u, payload.Password)
 	if err != nil {
-		api.WriteError(w, errors.AddContext(err, "failed to hash password"), http.StatusInternalServerError)
+		api.WriteError(w, errors.AddContext(err, "failed to save password"), http.StatusInternalServerError)
 		return
 	}
-	u.PasswordHash = string(passHash)
 	u.RecoveryToken = ""
+	u.RecoveryTokenExpiration = time.Time{}
 	err = api.staticDB.UserSave(req.Context(), u)
 	if err != nil {
 		api.WriteError(w, errors.AddContext(err, "failed to save password"), http.StatusInternalServerError)
@@ -1201,7 +1221,7 @@ func (api *API) trackUploadPOST(_ *database.User, w http.ResponseWriter, req *ht
 		u = &database.AnonUser
 	}
 	ip := validateIP(req.FormValue("ip"))
-	_, err = api.staticDB.UploadCreate(req.Context(), *u, ip, *skylink)
+	_, err = api.staticDB.UploadCreate(req.Context(), *u, ip, *skylink, trafficMeta(req))
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -1262,7 +1282,7 @@ func (api *API) trackDownloadPOST(u *database.User, w http.ResponseWriter, req *
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
-	_, err = api.staticDB.DownloadCreate(req.Context(), *u, *skylink, downloadedBytes)
+	_, err = api.staticDB.DownloadCreate(req.Context(), *u, *skylink, downloadedBytes, trafficMeta(req))
 	if err != nil {
 		api.WriteError(w, err, http.StatusInternalServerError)
 		return
@@ -1331,8 +1351,7 @@ func (api *API) checkUserQuotas(ctx context.Context, u *database.User) {
 		api.staticLogger.Debugln("Failed to get user's upload bandwidth used:", err)
 		return
 	}
-	quota := database.UserLimits[u.Tier]
-	quotaExceeded := upStats.CountTotal > int64(quota.MaxNumberUploads) || upStats.SizeTotal > quota.Storage
+	quotaExceeded := userQuotaExceeded(u, upStats)
 	if quotaExceeded != u.QuotaExceeded {
 		u.QuotaExceeded = quotaExceeded
 		err = api.staticDB.UserSave(ctx, u)
@@ -1343,6 +1362,14 @@ func (api *API) checkUserQuotas(ctx context.Context, u *database.User) {
 	}
 }
 
+// userQuotaExceeded tells us whether the given upload stats exceed the user's
+// quota, taking into account any extra storage the user has bought. Users are
+// allowed to exceed their storage limit by the configured tolerance.
+func userQuotaExceeded(u *database.User, upStats database.UserStatsUpload) bool {
+	p, _ := database.UserUploadPermission(u, upStats)
+	return p == database.UploadDenied
+}
+
 // userFromRequest checks the requests for various forms of authentication (API
 // key, cookie, authorization header) and returns user information based on
 // those.
@@ -1380,7 +1407,7 @@ func UserGETFromUser(u *database.User) *UserGET {
 	}
 	return &UserGET{
 		User:           *u,
-		EmailConfirmed: u.EmailConfirmationToken == "",
+		EmailConfirmed: u.IsEmailConfirmed(),
 	}
 }
 
@@ -1440,9 +1467,21 @@ func userLimitsGetFromTier(sub string, tierID int, quotaExceeded, inBytes bool)
 		MaxNumberUploads: t.MaxNumberUploads,
 		// If the user exceeds their quota, their speed will be brought down to
 		// anonymous levels.
-		UploadBandwidth:   limitsTier.UploadBandwidth * bpsMul,
-		DownloadBandwidth: limitsTier.DownloadBandwidth * bpsMul,
-		RegistryDelay:     limitsTier.RegistryDelay,
+		UploadBandwidth:       limitsTier.UploadBandwidth * bpsMul,
+		DownloadBandwidth:     limitsTier.DownloadBandwidth * bpsMul,
+		RegistryDelay:         limitsTier.RegistryDelay,
+		MaxConcurrentRequests: limitsTier.MaxConcurrentRequests,
+	}
+}
+
+// trafficMeta extracts the details the portal reports about an upload or a
+// download from the request's form.
+func trafficMeta(req *http.Request) database.TrafficMeta {
+	return database.TrafficMeta{
+		UserAgent:   req.FormValue("user_agent"),
+		Server:      req.FormValue("server"),
+		Referrer:    database.Referrer(req.FormValue("referrer")),
+		AnonymousID: req.FormValue("anonymous_id"),
 	}
 }
 
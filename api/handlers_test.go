@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"gitlab.com/NebulousLabs/errors"
 )
 
@@ -139,3 +140,76 @@ func TestUserLimitsGetFromTier(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestUserQuotaExceeded ensures that userQuotaExceeded takes the user's extra
+// storage into account.
+func TestUserQuotaExceeded(t *testing.T) {
+	freeStorage := database.UserLimits[database.TierFree].Storage
+	u := &database.User{Tier: database.TierFree}
+	stats := database.UserStatsUpload{CountTotal: 1, SizeTotal: freeStorage + 1}
+	if !userQuotaExceeded(u, stats) {
+		t.Fatal("Expected the quota to be exceeded.")
+	}
+	// Buy some extra storage.
+	u.ExtraStorage = 1
+	if userQuotaExceeded(u, stats) {
+		t.Fatal("Expected the quota not to be exceeded.")
+	}
+	// Exceed the combined limit.
+	stats.SizeTotal++
+	if !userQuotaExceeded(u, stats) {
+		t.Fatal("Expected the quota to be exceeded.")
+	}
+	// Exceed the number of uploads.
+	stats = database.UserStatsUpload{CountTotal: int64(database.UserLimits[database.TierFree].MaxNumberUploads) + 1}
+	if !userQuotaExceeded(u, stats) {
+		t.Fatal("Expected the quota to be exceeded.")
+	}
+}
+
+// TestUserQuotaExceededSuspended ensures that suspending a user doesn't mark
+// them as having exceeded their quota.
+func TestUserQuotaExceededSuspended(t *testing.T) {
+	u := &database.User{Tier: database.TierFree, Suspended: true}
+	if userQuotaExceeded(u, database.UserStatsUpload{CountTotal: 1, SizeTotal: 1}) {
+		t.Fatal("Expected the quota not to be exceeded.")
+	}
+}
+
+// TestUserQuotaExceededTolerance ensures that userQuotaExceeded respects the
+// configured quota tolerance.
+func TestUserQuotaExceededTolerance(t *testing.T) {
+	defer func(b int64, p float64) {
+		database.QuotaToleranceBytes = b
+		database.QuotaTolerancePercent = p
+	}(database.QuotaToleranceBytes, database.QuotaTolerancePercent)
+
+	limit := database.UserLimits[database.TierPremium5].Storage
+	u := &database.User{Tier: database.TierPremium5}
+	justOver := database.UserStatsUpload{CountTotal: 1, SizeTotal: limit + skynet.MiB}
+	wellOver := database.UserStatsUpload{CountTotal: 1, SizeTotal: limit + 10*skynet.GiB}
+
+	// No tolerance.
+	database.QuotaToleranceBytes = 0
+	database.QuotaTolerancePercent = 0
+	if !userQuotaExceeded(u, justOver) {
+		t.Fatal("Expected the quota to be exceeded.")
+	}
+	// Absolute tolerance.
+	database.QuotaToleranceBytes = skynet.GiB
+	if userQuotaExceeded(u, justOver) {
+		t.Fatal("Expected the user to be within tolerance.")
+	}
+	if !userQuotaExceeded(u, wellOver) {
+		t.Fatal("Expected the quota to be exceeded.")
+	}
+	// Percentage tolerance.
+	database.QuotaToleranceBytes = 0
+	database.QuotaTolerancePercent = 0.5
+	if userQuotaExceeded(u, justOver) {
+		t.Fatal("Expected the user to be within tolerance.")
+	}
+	if !userQuotaExceeded(u, wellOver) {
+		t.Fatal("Expected the quota to be exceeded.")
+	}
+}
@@ -11,9 +11,10 @@ import (
 
 type (
 	// PromoterSetTierPOST describes the body of a POST request that sets the
-	// user's tier.
+	// user's tier. The tier can be given either by number or by name.
 	PromoterSetTierPOST struct {
-		Tier int `json:"tier"`
+		Tier     int    `json:"tier"`
+		TierName string `json:"tierName,omitempty"`
 	}
 )
 
@@ -26,7 +27,19 @@ func (api *API) promoterSetTierPOST(_ *database.User, w http.ResponseWriter, req
 		api.WriteError(w, err, http.StatusBadRequest)
 		return
 	}
-	if body.Tier < database.TierFree || body.Tier >= database.TierMaxReserved {
+	if body.TierName != "" {
+		tier, _, ok := database.TierByName(body.TierName)
+		if !ok {
+			api.WriteError(w, fmt.Errorf("unknown tier name '%s'", body.TierName), http.StatusBadRequest)
+			return
+		}
+		if body.Tier != 0 && body.Tier != tier {
+			api.WriteError(w, fmt.Errorf("tier %d does not match tier name '%s'", body.Tier, body.TierName), http.StatusBadRequest)
+			return
+		}
+		body.Tier = tier
+	}
+	if !database.ValidTier(body.Tier) {
 		api.WriteError(w, fmt.Errorf("invalid tier %d", body.Tier), http.StatusBadRequest)
 		return
 	}
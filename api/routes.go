@@ -23,6 +23,9 @@ var (
 	// ErrNoToken is returned when we expected a JWT token to be provided but it
 	// was not.
 	ErrNoToken = errors.New("no authorisation token found")
+	// ErrTokenInvalidated is returned when the token was issued before the
+	// user's last password change.
+	ErrTokenInvalidated = errors.New("token was issued before the user's last password change")
 )
 
 type (
@@ -112,7 +115,7 @@ func (api *API) withAuth(h HandlerWithUser, allowsAPIKey bool) httprouter.Handle
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		api.logRequest(req)
 		u, token, err := api.userFromRequest(req, allowsAPIKey)
-		if errors.Contains(err, ErrNoAPIKey) || errors.Contains(err, database.ErrInvalidAPIKey) || errors.Contains(err, database.ErrUserNotFound) || errors.Contains(err, ErrAPIKeyNotAllowed) {
+		if errors.Contains(err, ErrNoAPIKey) || errors.Contains(err, database.ErrInvalidAPIKey) || errors.Contains(err, database.ErrAPIKeyExpired) || errors.Contains(err, database.ErrUserNotFound) || errors.Contains(err, ErrAPIKeyNotAllowed) || errors.Contains(err, ErrTokenInvalidated) {
 			api.WriteError(w, err, http.StatusUnauthorized)
 			return
 		}
@@ -155,21 +155,20 @@ func (api *API) processStripeSub(ctx context.Context, s *stripe.Subscription) er
 			mostRecentSub = subsc
 		}
 	}
+	var su database.SubscriptionUpdate
 	if mostRecentSub == nil {
 		// No active sub, set the default values.
-		u.Tier = database.TierFree
-		u.SubscribedUntil = time.Time{}
-		u.SubscriptionStatus = ""
-		u.SubscriptionCancelAt = time.Time{}
-		u.SubscriptionCancelAtPeriodEnd = false
+		su = database.SubscriptionUpdate{Tier: database.TierFree}
 	} else {
 		// It seems weird that the Plan.ID is actually a price id but this
 		// is what we get from Stripe.
-		u.Tier = StripePrices()[mostRecentSub.Plan.ID]
-		u.SubscribedUntil = time.Unix(mostRecentSub.CurrentPeriodEnd, 0).UTC().Truncate(time.Millisecond)
-		u.SubscriptionStatus = string(mostRecentSub.Status)
-		u.SubscriptionCancelAt = time.Unix(mostRecentSub.CancelAt, 0).UTC().Truncate(time.Millisecond)
-		u.SubscriptionCancelAtPeriodEnd = mostRecentSub.CancelAtPeriodEnd
+		su = database.SubscriptionUpdate{
+			Tier:                          StripePrices()[mostRecentSub.Plan.ID],
+			SubscribedUntil:               time.Unix(mostRecentSub.CurrentPeriodEnd, 0).UTC().Truncate(time.Millisecond),
+			SubscriptionStatus:            string(mostRecentSub.Status),
+			SubscriptionCancelAt:          time.Unix(mostRecentSub.CancelAt, 0).UTC().Truncate(time.Millisecond),
+			SubscriptionCancelAtPeriodEnd: mostRecentSub.CancelAtPeriodEnd,
+		}
 	}
 	// Cancel all subs aside from the latest one.
 	p := stripe.SubscriptionCancelParams{
@@ -192,7 +191,7 @@ func (api *API) processStripeSub(ctx context.Context, s *stripe.Subscription) er
 			api.staticLogger.Tracef("Successfully cancelled sub with id '%s' for user '%s' with Stripe customer id '%s'.", subsc.ID, u.ID.Hex(), s.Customer.ID)
 		}
 	}
-	err = api.staticDB.UserSave(ctx, u)
+	err = api.staticDB.UserSetSubscription(ctx, u, su)
 	if err == nil {
 		api.staticLogger.Tracef("Subscribed user id '%s', tier %d, until %s.", u.ID, u.Tier, u.SubscribedUntil.String())
 	}
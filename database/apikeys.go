@@ -12,14 +12,16 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 /**
-API keys are authentication tokens generated by users. They do not expire, thus
-allowing users to use them for a long time and to embed them in apps and on
-machines. API keys can be revoked when they are no longer needed or if they get
-compromised or are no longer needed. This is done by deleting them from this
-service.
+API keys are authentication tokens generated by users. By default, they do not
+expire, thus allowing users to use them for a long time and to embed them in
+apps and on machines. Users can optionally set an expiration time on creation,
+e.g. for keys used in CI, after which the key stops working. API keys can be
+revoked when they are no longer needed or if they get compromised. This is done
+by deleting them from this service.
 
 There are two kinds of API keys - public and private. We differentiate between
 them by the `public` flag.
@@ -34,29 +36,43 @@ array within the API key record.
 
 var (
 	// MaxNumAPIKeysPerUser sets the limit for number of API keys a single user
-	// can create. If a user reaches that limit they can always delete some API
-	// keys in order to make space for new ones. This value is configurable via
-	// the ACCOUNTS_MAX_NUM_API_KEYS_PER_USER environment variable.
+	// can create, unless their tier defines its own limit via
+	// TierLimits.MaxAPIKeys. If a user reaches that limit they can always
+	// delete some API keys in order to make space for new ones. This value is
+	// configurable via the ACCOUNTS_MAX_NUM_API_KEYS_PER_USER environment
+	// variable.
 	MaxNumAPIKeysPerUser = 1000
+	// MinTierForAPIKeys is the lowest tier which is allowed to create API
+	// keys. By default, all tiers can create API keys. This value is
+	// configurable via the ACCOUNTS_MIN_TIER_FOR_API_KEYS environment variable.
+	MinTierForAPIKeys = TierAnonymous
 	// ErrMaxNumAPIKeysExceeded is returned when a user tries to create a new
 	// API key after already having the maximum allowed number.
 	ErrMaxNumAPIKeysExceeded = errors.New("maximum number of api keys exceeded")
 	// ErrInvalidAPIKey is an error returned when the given API key is invalid.
 	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrAPIKeyExpired is returned when the given API key has expired.
+	ErrAPIKeyExpired = errors.New("api key expired")
+	// ErrAPIKeyTierTooLow is returned when a user whose tier is below
+	// MinTierForAPIKeys tries to create an API key.
+	ErrAPIKeyTierTooLow = errors.New("the user's tier does not allow creating api keys")
 	// ErrInvalidAPIKeyOperation covers a range of invalid operations on API
 	// keys. Some examples include: defining a list of skylinks on a private
 	// API key, editing a private API key. This error should be used with
 	// additional context, specifying the exact operation that failed.
 	ErrInvalidAPIKeyOperation = errors.New("invalid api key operation")
+	// MaxAPIKeysBatchSize is the largest number of API keys we can fetch with
+	// a single call to APIKeysByKeys.
+	MaxAPIKeysBatchSize = 1000
 )
 
 type (
 	// APIKey is the hex representation of a base32-encoded random 32-byte slice
 	// length PubKeySize
 	APIKey string
-	// APIKeyRecord is a non-expiring authentication token generated on user
-	// demand. Public API keys allow downloading a given set of skylinks, while
-	// private API keys give full API access.
+	// APIKeyRecord is an authentication token generated on user demand.
+	// Public API keys allow downloading a given set of skylinks, while private
+	// API keys give full API access. Keys without an ExpiresAt never expire.
 	APIKeyRecord struct {
 		ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 		UserID    primitive.ObjectID `bson:"user_id" json:"-"`
@@ -65,6 +81,27 @@ type (
 		Key       APIKey             `bson:"key" json:"-"`
 		Skylinks  []string           `bson:"skylinks" json:"skylinks"`
 		CreatedAt time.Time          `bson:"created_at" json:"createdAt"`
+		// LastUsedAt is the last time the key was used for authenticating a
+		// request. It's zero for keys which have never been used.
+		LastUsedAt time.Time  `bson:"last_used_at,omitempty" json:"lastUsedAt"`
+		ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expiresAt,omitempty"`
+	}
+	// APIKeyExport is the portable representation of a public API key. It
+	// holds everything needed to recreate an equivalent key on another portal
+	// but not the key itself.
+	APIKeyExport struct {
+		Name      string     `json:"name"`
+		Skylinks  []string   `json:"skylinks"`
+		CreatedAt time.Time  `json:"createdAt"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
+	// APIKeyGlobalStats holds platform-wide statistics about API keys.
+	APIKeyGlobalStats struct {
+		Public  int64 `json:"public"`
+		Private int64 `json:"private"`
+		// SkylinksHistogram maps the number of skylinks covered by a public
+		// API key to the number of public API keys with that many skylinks.
+		SkylinksHistogram map[int]int64 `json:"skylinksHistogram"`
 	}
 )
 
@@ -120,6 +157,11 @@ func (ak APIKey) String() string {
 	return string(ak)
 }
 
+// IsExpired tells us whether the API key has expired at the given moment.
+func (akr APIKeyRecord) IsExpired(now time.Time) bool {
+	return akr.ExpiresAt != nil && !now.Before(*akr.ExpiresAt)
+}
+
 // CoversSkylink tells us whether a given API key covers a given skylink.
 // Private API keys cover all skylinks while public ones - only a limited set.
 func (akr APIKeyRecord) CoversSkylink(sl string) bool {
@@ -134,21 +176,34 @@ func (akr APIKeyRecord) CoversSkylink(sl string) bool {
 	return false
 }
 
-// APIKeyCreate creates a new API key.
-func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public bool, skylinks []string) (*APIKeyRecord, error) {
+// APIKeyCreate creates a new API key. The key expires at the given time,
+// unless that's nil, in which case it never expires.
+func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public bool, skylinks []string, expiresAt *time.Time) (*APIKeyRecord, error) {
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
+	if user.Tier < MinTierForAPIKeys {
+		return nil, ErrAPIKeyTierTooLow
+	}
 	n, err := db.staticAPIKeys.CountDocuments(ctx, bson.M{"user_id": user.ID})
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to ensure user can create a new API key")
 	}
-	if n > int64(MaxNumAPIKeysPerUser) {
+	if n >= int64(user.MaxAPIKeys()) {
 		return nil, ErrMaxNumAPIKeysExceeded
 	}
 	if !public && len(skylinks) > 0 {
 		return nil, errors.AddContext(ErrInvalidAPIKeyOperation, "cannot define skylinks for a private api key")
 	}
+	if expiresAt != nil && !expiresAt.After(time.Now().UTC()) {
+		return nil, errors.AddContext(ErrInvalidAPIKeyOperation, "cannot create an api key which has already expired")
+	}
+	// Validate all given skylinks.
+	for _, s := range skylinks {
+		if !validSkylinkForMode(s) {
+			return nil, errors.AddContext(ErrInvalidSkylink, "offending skylink: "+s)
+		}
+	}
 	akr := APIKeyRecord{
 		UserID:    user.ID,
 		Name:      name,
@@ -157,6 +212,10 @@ func (db *DB) APIKeyCreate(ctx context.Context, user User, name string, public b
 		Skylinks:  skylinks,
 		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
 	}
+	if expiresAt != nil {
+		exp := expiresAt.UTC().Truncate(time.Millisecond)
+		akr.ExpiresAt = &exp
+	}
 	ior, err := db.staticAPIKeys.InsertOne(ctx, akr)
 	if err != nil {
 		return nil, err
@@ -184,8 +243,13 @@ func (db *DB) APIKeyDelete(ctx context.Context, user User, akID primitive.Object
 	return nil
 }
 
-// APIKeyByKey returns a specific API key.
+// APIKeyByKey returns a specific API key. It returns ErrInvalidAPIKey without
+// querying the DB if the key is malformed and ErrAPIKeyExpired if the key has
+// expired.
 func (db *DB) APIKeyByKey(ctx context.Context, key string) (APIKeyRecord, error) {
+	if !APIKey(key).IsValid() {
+		return APIKeyRecord{}, ErrInvalidAPIKey
+	}
 	sr := db.staticAPIKeys.FindOne(ctx, bson.M{"key": key})
 	if sr.Err() != nil {
 		return APIKeyRecord{}, sr.Err()
@@ -195,9 +259,153 @@ func (db *DB) APIKeyByKey(ctx context.Context, key string) (APIKeyRecord, error)
 	if err != nil {
 		return APIKeyRecord{}, err
 	}
+	if akr.IsExpired(time.Now().UTC()) {
+		return APIKeyRecord{}, ErrAPIKeyExpired
+	}
 	return akr, nil
 }
 
+// APIKeysByKeys fetches the records of all given API keys with a single query.
+// The result maps the given keys to their records. Malformed, unknown and
+// expired keys are omitted from the result.
+func (db *DB) APIKeysByKeys(ctx context.Context, keys []string) (map[string]APIKeyRecord, error) {
+	if len(keys) > MaxAPIKeysBatchSize {
+		return nil, fmt.Errorf("too many API keys, %d > %d", len(keys), MaxAPIKeysBatchSize)
+	}
+	// Map the normalized keys to the keys we were given.
+	given := make(map[APIKey][]string, len(keys))
+	valid := make([]APIKey, 0, len(keys))
+	for _, k := range keys {
+		ak, err := NewAPIKeyFromString(k)
+		if err != nil {
+			continue
+		}
+		if _, exists := given[*ak]; !exists {
+			valid = append(valid, *ak)
+		}
+		given[*ak] = append(given[*ak], k)
+	}
+	records := make(map[string]APIKeyRecord)
+	if len(valid) == 0 {
+		return records, nil
+	}
+	c, err := db.staticAPIKeys.Find(ctx, bson.M{"key": bson.M{"$in": valid}})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch API keys")
+	}
+	var akrs []APIKeyRecord
+	err = c.All(ctx, &akrs)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	now := time.Now().UTC()
+	for _, akr := range akrs {
+		if akr.IsExpired(now) {
+			continue
+		}
+		for _, k := range given[akr.Key] {
+			records[k] = akr
+		}
+	}
+	return records, nil
+}
+
+// StreamAPIKeys calls fn with each API key record in the DB, one at a time.
+// It stops at the first error returned by fn, which it returns, or when the
+// context is cancelled.
+func (db *DB) StreamAPIKeys(ctx context.Context, fn func(APIKeyRecord) error) error {
+	c, err := db.staticAPIKeys.Find(ctx, bson.M{})
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch API keys")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Debugln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	for c.Next(ctx) {
+		var akr APIKeyRecord
+		if err = c.Decode(&akr); err != nil {
+			return errors.AddContext(err, "failed to decode DB data")
+		}
+		if err = fn(akr); err != nil {
+			return err
+		}
+	}
+	if err = c.Err(); err != nil {
+		return errors.AddContext(err, "failed to iterate over API keys")
+	}
+	return ctx.Err()
+}
+
+// APIKeyMarkUsed records that the given API key was just used.
+func (db *DB) APIKeyMarkUsed(ctx context.Context, akID primitive.ObjectID) error {
+	filter := bson.M{"_id": akID}
+	update := bson.M{"$set": bson.M{"last_used_at": time.Now().UTC().Truncate(time.Millisecond)}}
+	ur, err := db.staticAPIKeys.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// UsersWithStaleAPIKeys returns the API keys which haven't been used for
+// longer than staleFor, grouped by the users who own them. Keys which have
+// never been used are considered stale once they are older than staleFor.
+func (db *DB) UsersWithStaleAPIKeys(ctx context.Context, staleFor time.Duration) (map[primitive.ObjectID][]APIKeyRecord, error) {
+	if staleFor <= 0 {
+		return nil, errors.New("invalid staleness threshold")
+	}
+	threshold := time.Now().UTC().Add(-staleFor)
+	filter := bson.M{"$or": bson.A{
+		bson.M{"last_used_at": bson.M{"$lt": threshold}},
+		bson.M{
+			"last_used_at": bson.M{"$exists": false},
+			"created_at":   bson.M{"$lt": threshold},
+		},
+	}}
+	c, err := db.staticAPIKeys.Find(ctx, filter)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch API keys")
+	}
+	var akrs []APIKeyRecord
+	err = c.All(ctx, &akrs)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	stale := make(map[primitive.ObjectID][]APIKeyRecord)
+	for _, akr := range akrs {
+		stale[akr.UserID] = append(stale[akr.UserID], akr)
+	}
+	return stale, nil
+}
+
+// ExpiredAPIKeys returns up to limit API keys, across all users, which have
+// expired but are still in the DB. The keys are sorted by expiration time, so
+// the ones which expired first are returned first.
+func (db *DB) ExpiredAPIKeys(ctx context.Context, limit int) ([]APIKeyRecord, error) {
+	if limit <= 0 {
+		return nil, errors.New("invalid limit")
+	}
+	filter := bson.M{"expires_at": bson.M{"$lte": time.Now().UTC()}}
+	opts := options.Find().SetSort(bson.M{"expires_at": 1}).SetLimit(int64(limit))
+	c, err := db.staticAPIKeys.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch API keys")
+	}
+	// We want this to be a make in order to make sure its JSON representation
+	// is a valid JSONArray and not a null.
+	akrs := make([]APIKeyRecord, 0)
+	err = c.All(ctx, &akrs)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	return akrs, nil
+}
+
 // APIKeyGet returns a specific API key.
 func (db *DB) APIKeyGet(ctx context.Context, akID primitive.ObjectID) (APIKeyRecord, error) {
 	sr := db.staticAPIKeys.FindOne(ctx, bson.M{"_id": akID})
@@ -231,6 +439,100 @@ func (db *DB) APIKeyList(ctx context.Context, user User) ([]APIKeyRecord, error)
 	return aks, nil
 }
 
+// UserExportAPIKeys exports the user's public API keys in a portable format,
+// so the user can recreate them on another portal. The exports don't contain
+// the keys themselves. Private API keys are not exported.
+func (db *DB) UserExportAPIKeys(ctx context.Context, user User) ([]APIKeyExport, error) {
+	aks, err := db.APIKeyList(ctx, user)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch the user's API keys")
+	}
+	exports := make([]APIKeyExport, 0, len(aks))
+	for _, ak := range aks {
+		if !ak.Public {
+			continue
+		}
+		exports = append(exports, APIKeyExport{
+			Name:      ak.Name,
+			Skylinks:  ak.Skylinks,
+			CreatedAt: ak.CreatedAt,
+			ExpiresAt: ak.ExpiresAt,
+		})
+	}
+	return exports, nil
+}
+
+// UserCoversSkylink tells us whether any of the user's API keys covers the
+// given skylink. Private API keys cover all skylinks, so the user having any
+// private API key means that the skylink is covered. Expired keys don't cover
+// anything.
+func (db *DB) UserCoversSkylink(ctx context.Context, userID primitive.ObjectID, skylink string) (bool, error) {
+	if userID.IsZero() {
+		return false, errors.New("invalid user")
+	}
+	if !ValidSkylink(skylink) {
+		return false, ErrInvalidSkylink
+	}
+	filter := bson.M{
+		"user_id": userID,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"public": false},
+				bson.M{"public": true, "skylinks": skylink},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"expires_at": bson.M{"$exists": false}},
+				bson.M{"expires_at": bson.M{"$gt": time.Now().UTC()}},
+			}},
+		},
+	}
+	n, err := db.staticAPIKeys.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// APIKeyGlobalStats returns the number of public and private API keys across
+// all users, as well as the distribution of the number of skylinks covered by
+// public API keys.
+func (db *DB) APIKeyGlobalStats(ctx context.Context) (*APIKeyGlobalStats, error) {
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", bson.D{
+			{"public", "$public"},
+			{"skylinks", bson.D{{"$size", bson.D{{"$ifNull", bson.A{"$skylinks", bson.A{}}}}}}},
+		}},
+		{"count", bson.D{{"$sum", 1}}},
+	}}}
+	c, err := db.staticAPIKeys.Aggregate(ctx, mongo.Pipeline{groupStage})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate API keys")
+	}
+	var groups []struct {
+		ID struct {
+			Public   bool `bson:"public"`
+			Skylinks int  `bson:"skylinks"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	err = c.All(ctx, &groups)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	stats := &APIKeyGlobalStats{
+		SkylinksHistogram: make(map[int]int64),
+	}
+	for _, g := range groups {
+		if !g.ID.Public {
+			stats.Private += g.Count
+			continue
+		}
+		stats.Public += g.Count
+		stats.SkylinksHistogram[g.ID.Skylinks] += g.Count
+	}
+	return stats, nil
+}
+
 // APIKeyUpdate updates an existing API key. This works by replacing the
 // list of Skylinks within the API key record. Only valid for public API keys.
 func (db *DB) APIKeyUpdate(ctx context.Context, user User, akID primitive.ObjectID, skylinks []string) error {
@@ -239,7 +541,7 @@ func (db *DB) APIKeyUpdate(ctx context.Context, user User, akID primitive.Object
 	}
 	// Validate all given skylinks.
 	for _, s := range skylinks {
-		if !ValidSkylink(s) {
+		if !validSkylinkForMode(s) {
 			return errors.AddContext(ErrInvalidSkylink, "offending skylink: "+s)
 		}
 	}
@@ -265,15 +567,23 @@ func (db *DB) APIKeyPatch(ctx context.Context, user User, akID primitive.ObjectI
 	if user.ID.IsZero() {
 		return errors.New("invalid user")
 	}
-	// Validate all given skylinks.
-	for _, s := range append(addSkylinks, removeSkylinks...) {
+	// Validate all given skylinks. Only new skylinks need to match the
+	// current validation mode, so users can still remove skylinks which were
+	// added under a different one.
+	for _, s := range addSkylinks {
+		if !validSkylinkForMode(s) {
+			return errors.AddContext(ErrInvalidSkylink, "offending skylink: "+s)
+		}
+	}
+	for _, s := range removeSkylinks {
 		if !ValidSkylink(s) {
 			return errors.AddContext(ErrInvalidSkylink, "offending skylink: "+s)
 		}
 	}
 	filter := bson.M{
-		"_id":    akID,
-		"public": true,
+		"_id":     akID,
+		"public":  true,
+		"user_id": user.ID,
 	}
 	var update bson.M
 	// First, all new skylinks to the record.
@@ -1,7 +1,10 @@
 package database
 
 import (
+	"context"
 	"testing"
+
+	"gitlab.com/NebulousLabs/errors"
 )
 
 // TestNewAPIKeyFromString validates that NewAPIKeyFromString properly handles
@@ -84,3 +87,35 @@ func TestCoversSkylink(t *testing.T) {
 		}
 	}
 }
+
+// TestAPIKeyByKeyMalformed ensures that APIKeyByKey rejects malformed keys
+// without querying the DB. The DB used here has no collections, so any query
+// would panic.
+func TestAPIKeyByKeyMalformed(t *testing.T) {
+	db := &DB{}
+	keys := []string{
+		"",
+		"not an api key",
+		"6TAOK0RVVKKK25PIA33FHDBD1G04DLO015DAAD6OM2J33KCD5CL",
+		"!TAOK0RVVKKK25PIA33FHDBD1G04DLO015DAAD6OM2J33KCD5CL0",
+	}
+	for _, k := range keys {
+		_, err := db.APIKeyByKey(context.Background(), k)
+		if !errors.Contains(err, ErrInvalidAPIKey) {
+			t.Fatalf("Key '%s': expected error %v, got %v", k, ErrInvalidAPIKey, err)
+		}
+	}
+}
+
+// BenchmarkAPIKeyByKeyMalformed measures how fast APIKeyByKey rejects
+// malformed keys.
+func BenchmarkAPIKeyByKeyMalformed(b *testing.B) {
+	db := &DB{}
+	ctx := context.Background()
+	key := "!TAOK0RVVKKK25PIA33FHDBD1G04DLO015DAAD6OM2J33KCD5CL0"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = db.APIKeyByKey(ctx, key)
+	}
+}
@@ -57,6 +57,11 @@ var (
 	// DefaultPageSize defines the default number of records to return.
 	DefaultPageSize = 10
 
+	// SkipDBSchema tells the service not to ensure the DB schema on startup.
+	// This is useful when connecting to a read-only replica where creating
+	// collections and indexes is not possible.
+	SkipDBSchema = false
+
 	// mongoCompressors defines the compressors we are going to use for the
 	// connection to MongoDB
 	mongoCompressors = "zstd,zlib,snappy"
@@ -77,6 +82,9 @@ var (
 	ErrGeneralInternalFailure = errors.New("general internal failure")
 	// ErrUserNotFound is returned when we can't find the user in question.
 	ErrUserNotFound = errors.New("user not found")
+	// ErrMultipleUsersFound is returned when we expect a single user to match
+	// a query but find more than one. This indicates a data integrity problem.
+	ErrMultipleUsersFound = errors.New("more than one user found")
 	// ErrUserAlreadyExists is returned when we try to use a sub to create a
 	// user and a user already exists with this identity.
 	ErrUserAlreadyExists = errors.New("identity already belongs to an existing user")
@@ -102,6 +110,10 @@ type (
 		staticAPIKeys                *mongo.Collection
 		staticDeps                   lib.Dependencies
 		staticLogger                 *logrus.Logger
+
+		// staticEmailConfirmationTokenTTL is the lifetime of the email
+		// confirmation tokens we issue.
+		staticEmailConfirmationTokenTTL time.Duration
 	}
 
 	// DBCredentials is a helper struct that binds together all values needed for
@@ -127,16 +139,24 @@ type (
 	}
 )
 
-// New returns a new DB connection based on the passed parameters.
-func New(ctx context.Context, creds DBCredentials, logger *logrus.Logger) (*DB, error) {
-	return NewCustomDB(ctx, dbName, creds, logger, nil)
+// New returns a new DB connection based on the passed parameters. A zero
+// emailConfTokenTTL means EmailConfirmationTokenTTL.
+func New(ctx context.Context, creds DBCredentials, logger *logrus.Logger, emailConfTokenTTL time.Duration) (*DB, error) {
+	return NewCustomDB(ctx, dbName, creds, logger, nil, emailConfTokenTTL)
 }
 
-// NewCustomDB returns a new DB connection based on the passed parameters.
-func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger *logrus.Logger, deps lib.Dependencies) (*DB, error) {
+// NewCustomDB returns a new DB connection based on the passed parameters. A
+// zero emailConfTokenTTL means EmailConfirmationTokenTTL.
+func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger *logrus.Logger, deps lib.Dependencies, emailConfTokenTTL time.Duration) (*DB, error) {
 	if deps == nil {
 		deps = &lib.ProductionDependencies{}
 	}
+	if emailConfTokenTTL < 0 {
+		return nil, errors.New("the email confirmation token TTL cannot be negative")
+	}
+	if emailConfTokenTTL == 0 {
+		emailConfTokenTTL = EmailConfirmationTokenTTL
+	}
 	connStr := connectionString(creds)
 	c, err := mongo.NewClient(options.Client().ApplyURI(connStr))
 	if err != nil {
@@ -150,9 +170,11 @@ func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger
 	if logger == nil {
 		logger = &logrus.Logger{}
 	}
-	err = ensureDBSchema(ctx, db, Schema, logger)
-	if err != nil {
-		return nil, err
+	if !SkipDBSchema {
+		err = ensureDBSchema(ctx, db, Schema, logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &DB{
 		staticDB:                     db,
@@ -169,9 +191,23 @@ func NewCustomDB(ctx context.Context, dbName string, creds DBCredentials, logger
 		staticAPIKeys:                db.Collection(collAPIKeys),
 		staticDeps:                   deps,
 		staticLogger:                 logger,
+
+		staticEmailConfirmationTokenTTL: emailConfTokenTTL,
 	}, nil
 }
 
+// EmailConfirmationTokenTTL returns the lifetime of the email confirmation
+// tokens issued by this DB.
+func (db *DB) EmailConfirmationTokenTTL() time.Duration {
+	return db.staticEmailConfirmationTokenTTL
+}
+
+// IndexNames returns the names of all indexes that exist on the given
+// collection.
+func (db *DB) IndexNames(ctx context.Context, collName string) ([]string, error) {
+	return indexNames(ctx, db.staticDB.Collection(collName))
+}
+
 // Disconnect closes the connection to the database in an orderly fashion.
 func (db *DB) Disconnect(ctx context.Context) error {
 	return db.staticDB.Client().Disconnect(ctx)
@@ -267,17 +303,54 @@ func ensureDBSchema(ctx context.Context, db *mongo.Database, schema map[string][
 		if err != nil {
 			return err
 		}
-		iv := coll.Indexes()
-		var names []string
-		names, err = iv.CreateMany(ctx, models)
+		existing, err := indexNames(ctx, coll)
 		if err != nil {
-			return errors.AddContext(err, "failed to create indexes")
+			return errors.AddContext(err, "failed to list indexes")
+		}
+		// We create the indexes one by one because a single failure would
+		// fail the entire batch. Failures, e.g. unique indexes which existing
+		// duplicates prevent us from creating, are logged but they don't
+		// prevent the service from running. The duplicates need to be
+		// resolved manually.
+		iv := coll.Indexes()
+		for _, model := range models {
+			name, err := iv.CreateOne(ctx, model)
+			if err != nil {
+				log.Errorf("Failed to create index %v on collection '%s': %v", model.Keys, collName, err)
+				continue
+			}
+			log.Debugf("Ensured index exists: %v", name)
+			if !contains(existing, name) {
+				log.Infof("Created index '%s' on collection '%s'.", name, collName)
+			}
 		}
-		log.Debugf("Ensured index exists: %v", names)
 	}
 	return nil
 }
 
+// indexNames returns the names of all indexes on the given collection.
+func indexNames(ctx context.Context, coll *mongo.Collection) ([]string, error) {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	return names, nil
+}
+
+// contains returns true if the given slice contains the given string.
+func contains(s []string, str string) bool {
+	for _, v := range s {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
+
 // ensureCollection gets the given collection from the
 // database and creates it if it doesn't exist.
 func ensureCollection(ctx context.Context, db *mongo.Database, collName string) (*mongo.Collection, error) {
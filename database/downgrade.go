@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// DowngradePolicyGracePeriod lets users who downgrade below the content
+	// they own keep uploading for DowngradeGracePeriod. After that their
+	// account becomes read-only until they get back under their limits.
+	DowngradePolicyGracePeriod = "grace-period"
+	// DowngradePolicyImmediateReadOnly makes the accounts of users who
+	// downgrade below the content they own read-only right away.
+	DowngradePolicyImmediateReadOnly = "immediate-readonly"
+	// DowngradePolicyFlagOnly only marks users who downgrade below the content
+	// they own as being over quota.
+	DowngradePolicyFlagOnly = "flag-only"
+
+	// TierChangeReasonSubscriptionLapsed marks tier changes made because the
+	// user's subscription lapsed without being renewed.
+	TierChangeReasonSubscriptionLapsed = "subscription_lapsed"
+)
+
+var (
+	// DowngradePolicy defines what happens when a user downgrades to a tier
+	// whose storage limit is lower than the content they already own. Its
+	// value is controlled by the ACCOUNTS_DOWNGRADE_POLICY environment
+	// variable.
+	DowngradePolicy = DowngradePolicyFlagOnly
+	// DowngradeGracePeriod is how long users stay writable after downgrading
+	// below their content when the DowngradePolicyGracePeriod policy is used.
+	DowngradeGracePeriod = 30 * 24 * time.Hour
+	// SubscriptionLapseGracePeriod is how long after the end of their paid
+	// period users keep their tier, so renewals which are processed late don't
+	// cause spurious downgrades. Its value is controlled by the
+	// ACCOUNTS_SUBSCRIPTION_LAPSE_GRACE_PERIOD environment variable.
+	SubscriptionLapseGracePeriod = 3 * 24 * time.Hour
+
+	// subscriptionStatusesRenewing are the Stripe subscription statuses
+	// under which a subscription is still going to be renewed.
+	subscriptionStatusesRenewing = bson.A{"active", "trialing", "past_due"}
+)
+
+// DowngradeResult describes the outcome of a downgrade.
+type DowngradeResult struct {
+	// Tier is the tier the user was moved to.
+	Tier int `json:"tier"`
+	// Policy is the downgrade policy that was applied.
+	Policy string `json:"policy"`
+	// Overage is the number of bytes by which the user exceeds the storage
+	// limit of their new tier. Zero if they are within limits.
+	Overage int64 `json:"overage"`
+	// ReadOnlyFrom is the moment the user's account becomes read-only. It's
+	// zero if the account doesn't become read-only.
+	ReadOnlyFrom time.Time `json:"readOnlyFrom"`
+}
+
+// ValidDowngradePolicy returns true if the given string is a known downgrade
+// policy.
+func ValidDowngradePolicy(policy string) bool {
+	return policy == DowngradePolicyGracePeriod || policy == DowngradePolicyImmediateReadOnly || policy == DowngradePolicyFlagOnly
+}
+
+// ApplyDowngrade moves the user to the given tier and, if the content they
+// already own exceeds the storage limit of that tier, records the enforcement
+// defined by DowngradePolicy. Users who remain within their limits have any
+// previously scheduled read-only period lifted.
+func (db *DB) ApplyDowngrade(ctx context.Context, u *User, newTier int) (*DowngradeResult, error) {
+	if !ValidTier(newTier) {
+		return nil, ErrInvalidTier
+	}
+	stats, err := db.UserStatsUpload(ctx, u.ID, time.Now().UTC())
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch upload stats")
+	}
+	downgraded := *u
+	downgraded.Tier = newTier
+	res := planDowngrade(DowngradePolicy, newTier, stats.SizeTotal, downgraded.EffectiveStorageLimit(), time.Now().UTC())
+	ur, err := db.staticUsers.UpdateOne(ctx, bson.M{"_id": u.ID}, downgradeUpdate(res))
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	u.Tier = newTier
+	u.QuotaExceeded = u.QuotaExceeded || res.Overage > 0
+	u.ReadOnlyFrom = res.ReadOnlyFrom
+	return res, nil
+}
+
+// ExpireLapsedSubscriptions moves all premium users whose subscription ended
+// more than SubscriptionLapseGracePeriod ago and isn't going to be renewed to
+// the free tier. The storage enforcement defined by DowngradePolicy is applied
+// and the change is recorded in the users' tier history. Returns the number of
+// downgraded users.
+func (db *DB) ExpireLapsedSubscriptions(ctx context.Context) (int64, error) {
+	now := time.Now().UTC()
+	cutoff := now.Add(-SubscriptionLapseGracePeriod)
+	// Users without a subscription end, e.g. ones promoted manually, never
+	// lapse.
+	filter := bson.M{
+		"tier":             bson.M{"$gt": TierFree},
+		"subscribed_until": bson.M{"$gt": time.Time{}, "$lt": cutoff},
+		"$or": bson.A{
+			bson.M{"subscription_status": bson.M{"$nin": subscriptionStatusesRenewing}},
+			bson.M{"subscription_cancel_at_period_end": true},
+			bson.M{"subscription_cancel_at": bson.M{"$gt": time.Time{}, "$lt": cutoff}},
+		},
+	}
+	c, err := db.staticUsers.Find(ctx, filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch lapsed users")
+	}
+	var users []User
+	if err = c.All(ctx, &users); err != nil {
+		return 0, errors.AddContext(err, "failed to decode lapsed users")
+	}
+	var n int64
+	for _, u := range users {
+		stats, err := db.UserStatsUpload(ctx, u.ID, now)
+		if err != nil {
+			return n, errors.AddContext(err, "failed to fetch upload stats")
+		}
+		downgraded := u
+		downgraded.Tier = TierFree
+		res := planDowngrade(DowngradePolicy, TierFree, stats.SizeTotal, downgraded.EffectiveStorageLimit(), now)
+		update := downgradeUpdate(res)
+		update["$push"] = bson.M{"tier_changes": TierChange{
+			From:   u.Tier,
+			To:     TierFree,
+			Reason: TierChangeReasonSubscriptionLapsed,
+			At:     now,
+		}}
+		// Repeat the lapse conditions, so we don't downgrade users whose
+		// subscription was renewed in the meantime.
+		userFilter := bson.M{"_id": u.ID, "tier": u.Tier}
+		for k, v := range filter {
+			if k != "tier" {
+				userFilter[k] = v
+			}
+		}
+		ur, err := db.staticUsers.UpdateOne(ctx, userFilter, update)
+		if err != nil {
+			return n, errors.AddContext(err, "failed to downgrade user")
+		}
+		n += ur.ModifiedCount
+	}
+	return n, nil
+}
+
+// downgradeUpdate builds the update which moves a user to the tier of the
+// given downgrade result and records its enforcement.
+func downgradeUpdate(res *DowngradeResult) bson.M {
+	set := bson.M{"tier": res.Tier}
+	update := bson.M{"$set": set}
+	if res.Overage > 0 {
+		set["quota_exceeded"] = true
+	}
+	if res.ReadOnlyFrom.IsZero() {
+		update["$unset"] = bson.M{"read_only_from": ""}
+	} else {
+		set["read_only_from"] = res.ReadOnlyFrom
+	}
+	return update
+}
+
+// planDowngrade determines the enforcement the given policy requires for a
+// user who uses used bytes of storage and is moving to a tier that allows them
+// limit bytes.
+func planDowngrade(policy string, tier int, used, limit int64, now time.Time) *DowngradeResult {
+	res := &DowngradeResult{
+		Tier:   tier,
+		Policy: policy,
+	}
+	if used <= limit {
+		return res
+	}
+	res.Overage = used - limit
+	switch policy {
+	case DowngradePolicyGracePeriod:
+		res.ReadOnlyFrom = now.Add(DowngradeGracePeriod)
+	case DowngradePolicyImmediateReadOnly:
+		res.ReadOnlyFrom = now
+	}
+	return res
+}
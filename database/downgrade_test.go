@@ -0,0 +1,52 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPlanDowngrade ensures that planDowngrade records the enforcement each
+// policy requires.
+func TestPlanDowngrade(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		policy       string
+		used         int64
+		limit        int64
+		overage      int64
+		readOnlyFrom time.Time
+	}{
+		{policy: DowngradePolicyGracePeriod, used: 10, limit: 10},
+		{policy: DowngradePolicyImmediateReadOnly, used: 5, limit: 10},
+		{policy: DowngradePolicyFlagOnly, used: 0, limit: 10},
+		{policy: DowngradePolicyGracePeriod, used: 15, limit: 10, overage: 5, readOnlyFrom: now.Add(DowngradeGracePeriod)},
+		{policy: DowngradePolicyImmediateReadOnly, used: 15, limit: 10, overage: 5, readOnlyFrom: now},
+		{policy: DowngradePolicyFlagOnly, used: 15, limit: 10, overage: 5},
+	}
+	for _, tt := range tests {
+		res := planDowngrade(tt.policy, TierPremium5, tt.used, tt.limit, now)
+		if res.Tier != TierPremium5 || res.Policy != tt.policy {
+			t.Fatalf("Unexpected tier or policy: %+v", res)
+		}
+		if res.Overage != tt.overage {
+			t.Fatalf("Policy %s, used %d: expected overage %d, got %d.", tt.policy, tt.used, tt.overage, res.Overage)
+		}
+		if !res.ReadOnlyFrom.Equal(tt.readOnlyFrom) {
+			t.Fatalf("Policy %s, used %d: expected read-only from %v, got %v.", tt.policy, tt.used, tt.readOnlyFrom, res.ReadOnlyFrom)
+		}
+	}
+}
+
+// TestValidDowngradePolicy ensures that only known policies are accepted.
+func TestValidDowngradePolicy(t *testing.T) {
+	for _, p := range []string{DowngradePolicyGracePeriod, DowngradePolicyImmediateReadOnly, DowngradePolicyFlagOnly} {
+		if !ValidDowngradePolicy(p) {
+			t.Fatalf("Expected %s to be valid.", p)
+		}
+	}
+	for _, p := range []string{"", "readonly", "Flag-Only"} {
+		if ValidDowngradePolicy(p) {
+			t.Fatalf("Expected %s to be invalid.", p)
+		}
+	}
+}
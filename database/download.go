@@ -4,9 +4,11 @@ import (
 	"context"
 	"time"
 
+	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -23,8 +25,14 @@ type Download struct {
 	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
 	SkylinkID primitive.ObjectID `bson:"skylink_id,omitempty" json:"skylinkId"`
 	Bytes     int64              `bson:"bytes" json:"bytes"`
-	CreatedAt time.Time          `bson:"created_at" json:"timestamp"`
-	UpdatedAt time.Time          `bson:"updated_at" json:"-"`
+	UserAgent string             `bson:"user_agent,omitempty" json:"-"`
+	Server    string             `bson:"server,omitempty" json:"-"`
+	Referrer  Referrer           `bson:"referrer,omitempty" json:"-"`
+	// AnonymousID is a synthetic key, e.g. derived from the IP or a cookie,
+	// which identifies the source of an anonymous download.
+	AnonymousID string    `bson:"anonymous_id,omitempty" json:"-"`
+	CreatedAt   time.Time `bson:"created_at" json:"timestamp"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"-"`
 }
 
 // DownloadResponse  is the representation of a download we send as response
@@ -49,8 +57,11 @@ func (db *DB) DownloadByID(ctx context.Context, id primitive.ObjectID) (*Downloa
 }
 
 // DownloadCreate registers a new download. Marks partial downloads by supplying
-// the `bytes` param. If `bytes` is 0 we assume a full download.
-func (db *DB) DownloadCreate(ctx context.Context, user User, skylink Skylink, bytes int64) (*Download, error) {
+// the `bytes` param. If `bytes` is 0 we assume a full download. The metadata
+// describes the download request. Recent downloads of the same skylink are
+// merged into one record, so they are attributed to the referrer of the first
+// one.
+func (db *DB) DownloadCreate(ctx context.Context, user User, skylink Skylink, bytes int64, meta TrafficMeta) (*Download, error) {
 	if skylink.ID.IsZero() {
 		return nil, ErrInvalidSkylink
 	}
@@ -69,9 +80,15 @@ func (db *DB) DownloadCreate(ctx context.Context, user User, skylink Skylink, by
 		UserID:    user.ID,
 		SkylinkID: skylink.ID,
 		Bytes:     bytes,
+		UserAgent: meta.UserAgent,
+		Server:    meta.Server,
+		Referrer:  meta.Referrer,
 		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
 		UpdatedAt: time.Now().UTC().Truncate(time.Millisecond),
 	}
+	if user.ID.IsZero() {
+		down.AnonymousID = meta.AnonymousID
+	}
 	ior, err := db.staticDownloads.InsertOne(ctx, down)
 	if err != nil {
 		return nil, err
@@ -158,3 +175,107 @@ func (db *DB) DownloadIncrement(ctx context.Context, d *Download, additionalByte
 	}
 	return nil
 }
+
+// UserSkylinkDownloads reports the number of downloads of the given skylink
+// since the given time and the bandwidth they used. This allows creators to
+// see the download activity of their content, so we only report downloads of
+// skylinks the user has pinned. For all other skylinks we report zero.
+func (db *DB) UserSkylinkDownloads(ctx context.Context, userID primitive.ObjectID, skylink string, since time.Time) (count int, bandwidth int64, err error) {
+	skylinkStr, err := normalizeSkylink(skylink)
+	if err != nil {
+		return 0, 0, err
+	}
+	var sl Skylink
+	err = db.staticSkylinks.FindOne(ctx, bson.M{"skylink": skylinkStr}).Decode(&sl)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to fetch skylink")
+	}
+	filter := bson.M{
+		"user_id":    userID,
+		"skylink_id": sl.ID,
+		"unpinned":   false,
+	}
+	n, err := db.staticUploads.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to check the user's uploads")
+	}
+	if n == 0 {
+		return 0, 0, nil
+	}
+	filter = bson.M{
+		"skylink_id": sl.ID,
+		"created_at": bson.M{"$gt": since},
+	}
+	c, err := db.staticDownloads.Find(ctx, filter)
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to fetch downloads")
+	}
+	var downloads []Download
+	err = c.All(ctx, &downloads)
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	for _, d := range downloads {
+		// Downloads without a size are full downloads of the skylink.
+		size := d.Bytes
+		if size <= 0 {
+			size = sl.Size
+		}
+		bandwidth += skynet.BandwidthDownloadCost(size)
+	}
+	return len(downloads), bandwidth, nil
+}
+
+// UserDownloadedSkylinks returns up to limit distinct skylinks the user has
+// downloaded since the given time, the most recently downloaded first.
+func (db *DB) UserDownloadedSkylinks(ctx context.Context, userID primitive.ObjectID, since time.Time, limit int) ([]string, error) {
+	if userID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	if limit <= 0 {
+		return nil, errors.New("invalid limit")
+	}
+	// Downloads of the same skylink made close together share a record, so
+	// updated_at holds the time of the latest one.
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"updated_at", bson.D{{"$gt", since}}},
+	}}}
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", "$skylink_id"},
+		{"last_download", bson.D{{"$max", "$updated_at"}}},
+	}}}
+	sortStage := bson.D{{"$sort", bson.D{{"last_download", -1}, {"_id", 1}}}}
+	limitStage := bson.D{{"$limit", limit}}
+	lookupStage := bson.D{{"$lookup", bson.D{
+		{"from", "skylinks"},
+		{"localField", "_id"},
+		{"foreignField", "_id"},
+		{"as", "skylink_data"},
+	}}}
+	projectStage := bson.D{{"$project", bson.D{
+		{"skylink", bson.D{{"$arrayElemAt", bson.A{"$skylink_data.skylink", 0}}}},
+	}}}
+	pipeline := mongo.Pipeline{matchStage, groupStage, sortStage, limitStage, lookupStage, projectStage}
+	c, err := db.staticDownloads.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "DB query failed")
+	}
+	var results []struct {
+		Skylink string `bson:"skylink"`
+	}
+	err = c.All(ctx, &results)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	skylinks := make([]string, 0, len(results))
+	for _, r := range results {
+		if r.Skylink != "" {
+			skylinks = append(skylinks, r.Skylink)
+		}
+	}
+	return skylinks, nil
+}
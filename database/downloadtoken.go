@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// DownloadTokenSecret is the secret we use to sign download tokens. The
+	// CDN needs to know it, so it can verify the tokens offline. Issuing
+	// download tokens is disabled while the secret is empty. Its value is
+	// controlled by the ACCOUNTS_DOWNLOAD_TOKEN_SECRET environment variable.
+	DownloadTokenSecret = ""
+
+	// ErrDownloadTokensDisabled is returned when we try to issue or verify a
+	// download token without having a secret to sign it with.
+	ErrDownloadTokensDisabled = errors.New("download tokens are disabled")
+	// ErrInvalidDownloadToken is returned when a download token is malformed
+	// or its signature doesn't match.
+	ErrInvalidDownloadToken = errors.New("invalid download token")
+	// ErrDownloadTokenExpired is returned when a download token is past its
+	// expiration time.
+	ErrDownloadTokenExpired = errors.New("download token expired")
+	// ErrSkylinkNotAccessible is returned when the user is not allowed to
+	// access the given skylink.
+	ErrSkylinkNotAccessible = errors.New("skylink not accessible")
+)
+
+// DownloadClaims describes the download authorized by a download token.
+//
+// Download tokens are JWTs signed with HS256, using DownloadTokenSecret as the
+// key, so the CDN can verify them with any JWT library. Their claims are:
+//   - `sub`: the sub of the user
+//   - `skylink`: the skylink the user is allowed to download
+//   - `tier`: the user's tier
+//   - `iss`: the portal which issued the token, i.e. PortalName
+//   - `iat`: when the token was issued, in seconds since the epoch
+//   - `exp`: when the token expires, in seconds since the epoch
+type DownloadClaims struct {
+	Sub       string
+	Skylink   string
+	Tier      int
+	ExpiresAt time.Time
+}
+
+// IssueDownloadToken issues a signed token which authorizes the user to
+// download the given skylink until the token expires. Users can access the
+// skylinks they have pinned and the ones covered by their API keys. Suspended
+// users can't get download tokens.
+func (db *DB) IssueDownloadToken(ctx context.Context, user User, skylink string, ttl time.Duration) (string, error) {
+	if DownloadTokenSecret == "" {
+		return "", ErrDownloadTokensDisabled
+	}
+	if ttl <= 0 {
+		return "", errors.New("ttl must be positive")
+	}
+	if err := UserCanDownload(&user); err != nil {
+		return "", err
+	}
+	skylinkStr, err := normalizeSkylink(skylink)
+	if err != nil {
+		return "", err
+	}
+	ok, err := db.userCanAccessSkylink(ctx, user, skylinkStr)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrSkylinkNotAccessible
+	}
+	claims := DownloadClaims{
+		Sub:       user.Sub,
+		Skylink:   skylinkStr,
+		Tier:      user.Tier,
+		ExpiresAt: time.Now().UTC().Add(ttl).Truncate(time.Second),
+	}
+	return signDownloadClaims(claims)
+}
+
+// VerifyDownloadToken verifies the signature and expiration of the given
+// download token and returns its claims.
+func (db *DB) VerifyDownloadToken(token string) (*DownloadClaims, error) {
+	if DownloadTokenSecret == "" {
+		return nil, ErrDownloadTokensDisabled
+	}
+	t, err := jwt.Parse([]byte(token), jwt.WithVerify(jwa.HS256, []byte(DownloadTokenSecret)))
+	if err != nil {
+		return nil, ErrInvalidDownloadToken
+	}
+	skylink, ok1 := t.PrivateClaims()["skylink"].(string)
+	// Numbers are decoded as float64.
+	tier, ok2 := t.PrivateClaims()["tier"].(float64)
+	if !ok1 || !ok2 || t.Expiration().IsZero() {
+		return nil, ErrInvalidDownloadToken
+	}
+	if time.Now().UTC().After(t.Expiration()) {
+		return nil, ErrDownloadTokenExpired
+	}
+	claims := DownloadClaims{
+		Sub:       t.Subject(),
+		Skylink:   skylink,
+		Tier:      int(tier),
+		ExpiresAt: t.Expiration().UTC(),
+	}
+	return &claims, nil
+}
+
+// userCanAccessSkylink checks whether the user has pinned the given skylink or
+// has an API key which covers it.
+func (db *DB) userCanAccessSkylink(ctx context.Context, user User, skylink string) (bool, error) {
+	covered, err := db.UserCoversSkylink(ctx, user.ID, skylink)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to check the user's API keys")
+	}
+	if covered {
+		return true, nil
+	}
+	var sl Skylink
+	err = db.staticSkylinks.FindOne(ctx, bson.M{"skylink": skylink}).Decode(&sl)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.AddContext(err, "failed to fetch skylink")
+	}
+	filter := bson.M{
+		"user_id":    user.ID,
+		"skylink_id": sl.ID,
+		"unpinned":   false,
+	}
+	n, err := db.staticUploads.CountDocuments(ctx, filter)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to check the user's uploads")
+	}
+	return n > 0, nil
+}
+
+// signDownloadClaims puts the given claims in a JWT and signs it with
+// DownloadTokenSecret.
+func signDownloadClaims(claims DownloadClaims) (string, error) {
+	t := jwt.New()
+	err1 := t.Set(jwt.SubjectKey, claims.Sub)
+	err2 := t.Set("skylink", claims.Skylink)
+	err3 := t.Set("tier", claims.Tier)
+	err4 := t.Set(jwt.IssuerKey, PortalName)
+	err5 := t.Set(jwt.IssuedAtKey, time.Now().UTC())
+	err6 := t.Set(jwt.ExpirationKey, claims.ExpiresAt)
+	err := errors.Compose(err1, err2, err3, err4, err5, err6)
+	if err != nil {
+		return "", errors.AddContext(err, "failed to set claims")
+	}
+	token, err := jwt.Sign(t, jwa.HS256, []byte(DownloadTokenSecret))
+	if err != nil {
+		return "", errors.AddContext(err, "failed to sign token")
+	}
+	return string(token), nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestVerifyDownloadToken ensures that download tokens can be verified and
+// that expired and tampered tokens are rejected.
+func TestVerifyDownloadToken(t *testing.T) {
+	var db *DB
+	defer func(s string) {
+		DownloadTokenSecret = s
+	}(DownloadTokenSecret)
+	DownloadTokenSecret = "test secret"
+
+	claims := DownloadClaims{
+		Sub:       "sub",
+		Skylink:   "AQAh2vxStoSJ_M9tWcTgqebUWerCAbpMfn9xxa9E29UOuw",
+		Tier:      TierFree,
+		ExpiresAt: time.Now().UTC().Add(time.Hour).Truncate(time.Second),
+	}
+	token, err := signDownloadClaims(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Round trip.
+	c, err := db.VerifyDownloadToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Sub != claims.Sub || c.Skylink != claims.Skylink || c.Tier != claims.Tier || !c.ExpiresAt.Equal(claims.ExpiresAt) {
+		t.Fatalf("Expected %+v, got %+v", claims, c)
+	}
+	// The token is a standard JWT with a numeric expiration time.
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a JWT with 3 parts, got '%s'.", token)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	err = json.Unmarshal(payload, &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, ok := raw["exp"].(float64); !ok || int64(exp) != claims.ExpiresAt.Unix() {
+		t.Fatalf("Expected a numeric exp of %d, got %v", claims.ExpiresAt.Unix(), raw["exp"])
+	}
+	if raw["sub"] != claims.Sub || raw["skylink"] != claims.Skylink || raw["iss"] != PortalName {
+		t.Fatalf("Unexpected claims %+v", raw)
+	}
+	// Tampered tokens.
+	other, err := signDownloadClaims(DownloadClaims{Sub: "other", ExpiresAt: claims.ExpiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherParts := strings.Split(other, ".")
+	tampered := parts[0] + "." + otherParts[1] + "." + parts[2]
+	unsigned := parts[0] + "." + parts[1] + "."
+	for _, tk := range []string{"", parts[0], unsigned, tampered, token + "x"} {
+		_, err = db.VerifyDownloadToken(tk)
+		if !errors.Contains(err, ErrInvalidDownloadToken) {
+			t.Fatalf("Expected error '%v' for token '%s', got '%v'.", ErrInvalidDownloadToken, tk, err)
+		}
+	}
+	// A different secret invalidates the token.
+	DownloadTokenSecret = "another secret"
+	_, err = db.VerifyDownloadToken(token)
+	if !errors.Contains(err, ErrInvalidDownloadToken) {
+		t.Fatalf("Expected error '%v', got '%v'.", ErrInvalidDownloadToken, err)
+	}
+	// Expired token.
+	DownloadTokenSecret = "test secret"
+	claims.ExpiresAt = time.Now().UTC().Add(-time.Second)
+	token, err = signDownloadClaims(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.VerifyDownloadToken(token)
+	if !errors.Contains(err, ErrDownloadTokenExpired) {
+		t.Fatalf("Expected error '%v', got '%v'.", ErrDownloadTokenExpired, err)
+	}
+	// No secret.
+	DownloadTokenSecret = ""
+	_, err = db.VerifyDownloadToken(token)
+	if !errors.Contains(err, ErrDownloadTokensDisabled) {
+		t.Fatalf("Expected error '%v', got '%v'.", ErrDownloadTokensDisabled, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/SkynetLabs/skynet-accounts/types"
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -28,6 +29,17 @@ const (
 	// the lock expires the record will be unlocked and free for other servers
 	// to lock and send.
 	emailLockTTL = 5 * time.Minute
+
+	// EmailStatusPending describes a message which is still waiting to be sent.
+	EmailStatusPending = "pending"
+	// EmailStatusSent describes a message which was sent successfully.
+	EmailStatusSent = "sent"
+	// EmailStatusDryRun describes a message which was processed by a dry run
+	// and therefore never delivered.
+	EmailStatusDryRun = "dry_run"
+	// EmailStatusFailed describes a message which we gave up on sending after
+	// EmailMaxSendAttempts failed attempts.
+	EmailStatusFailed = "failed"
 )
 
 type (
@@ -43,11 +55,29 @@ type (
 		LockedAt       time.Time          `bson:"locked_at,omitempty"`
 		SentAt         time.Time          `bson:"sent_at,omitempty"`
 		FailedAttempts int                `bson:"failed_attempts"`
+		DryRun         bool               `bson:"dry_run,omitempty"`
+		SendAt         time.Time          `bson:"send_at"`
+	}
+	// EmailReconcileReport describes the inconsistent email records which
+	// ReconcileEmails repaired.
+	EmailReconcileReport struct {
+		// StaleLocks is the number of unsent messages whose lock was either
+		// expired or missing its lock time, so it would never expire.
+		StaleLocks int64
+		// SentLocks is the number of sent messages which were still locked.
+		SentLocks int64
+		// InvalidAttempts is the number of messages with a negative or
+		// missing failed attempts counter.
+		InvalidAttempts int64
 	}
 )
 
 // EmailCreate creates an email message in the DB which is waiting to be sent.
+// Messages without a SendAt time are sent as soon as possible.
 func (db *DB) EmailCreate(ctx context.Context, m EmailMessage) error {
+	if m.SendAt.IsZero() {
+		m.SendAt = time.Now().UTC()
+	}
 	_, err := db.staticEmails.InsertOne(ctx, m)
 	if err != nil {
 		return errors.AddContext(err, "failed to Insert")
@@ -55,6 +85,51 @@ func (db *DB) EmailCreate(ctx context.Context, m EmailMessage) error {
 	return nil
 }
 
+// EmailCountSince returns the number of emails to the given address which were
+// queued since the given time.
+func (db *DB) EmailCountSince(ctx context.Context, to string, since time.Time) (int64, error) {
+	filter := bson.M{
+		"to":  to,
+		"_id": bson.M{"$gte": primitive.NewObjectIDFromTimestamp(since)},
+	}
+	n, err := db.staticEmails.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to count emails")
+	}
+	return n, nil
+}
+
+// EmailsSentTo returns the history of emails to the given address, newest
+// first. The bodies of the messages are redacted because they might contain
+// sensitive data, such as account recovery tokens.
+func (db *DB) EmailsSentTo(ctx context.Context, address string) ([]EmailMessage, error) {
+	filter := bson.M{"to": types.NewEmail(address).String()}
+	opts := options.Find().SetSort(bson.D{{"_id", -1}})
+	_, msgs, err := db.FindEmails(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch emails")
+	}
+	for i := range msgs {
+		msgs[i].Body = ""
+		msgs[i].BodyMime = ""
+	}
+	return msgs, nil
+}
+
+// Status returns the delivery status of the message, e.g. EmailStatusSent.
+func (m EmailMessage) Status() string {
+	switch {
+	case m.DryRun:
+		return EmailStatusDryRun
+	case !m.SentAt.IsZero():
+		return EmailStatusSent
+	case m.FailedAttempts >= EmailMaxSendAttempts:
+		return EmailStatusFailed
+	default:
+		return EmailStatusPending
+	}
+}
+
 // EmailLockAndFetch locks up to batchSize records with the given lockId and
 // returns up to batchSize locked entries. Some of the returned entries might
 // not have been locked during the current execution.
@@ -75,9 +150,12 @@ func (db *DB) EmailLockAndFetch(ctx context.Context, lockID string, batchSize in
 	//  - haven't failed more times than the limit
 	//  - aren't sent, yet
 	//  - are either unlocked or their lock has expired
+	//  - are due for sending (messages created before we introduced
+	//    scheduling don't have a send_at field and are always due)
 	filterLock := bson.M{
 		"failed_attempts": bson.M{"$lt": EmailMaxSendAttempts},
 		"sent_at":         nil,
+		"send_at":         bson.M{"$not": bson.M{"$gt": time.Now().UTC()}},
 		"$or": bson.A{
 			bson.M{"locked_by": ""},
 			bson.M{"locked_at": bson.M{"$lt": time.Now().UTC().Add(-emailLockTTL)}},
@@ -133,18 +211,32 @@ func (db *DB) FindEmails(ctx context.Context, filter bson.M, opts *options.FindO
 
 // MarkAsSent unlocks all given messages and marks them as sent.
 func (db *DB) MarkAsSent(ctx context.Context, ids []primitive.ObjectID) error {
+	return db.markAsSent(ctx, ids, false)
+}
+
+// MarkAsSentDryRun unlocks all given messages and marks them as processed by a
+// dry run. Such messages are not going to be sent again but they are clearly
+// marked as not delivered.
+func (db *DB) MarkAsSentDryRun(ctx context.Context, ids []primitive.ObjectID) error {
+	return db.markAsSent(ctx, ids, true)
+}
+
+// markAsSent unlocks all given messages and marks them as sent, optionally
+// flagging them as processed by a dry run.
+func (db *DB) markAsSent(ctx context.Context, ids []primitive.ObjectID, dryRun bool) error {
 	if len(ids) == 0 {
 		return nil
 	}
 	filter := bson.M{"_id": bson.M{"$in": ids}}
-	update := bson.M{
-		"$set": bson.M{
-			"locked_by": "",
-			"locked_at": time.Time{},
-			"sent_at":   time.Now().UTC(),
-		},
+	set := bson.M{
+		"locked_by": "",
+		"locked_at": time.Time{},
+		"sent_at":   time.Now().UTC(),
 	}
-	_, err := db.staticEmails.UpdateMany(ctx, filter, update)
+	if dryRun {
+		set["dry_run"] = true
+	}
+	_, err := db.staticEmails.UpdateMany(ctx, filter, bson.M{"$set": set})
 	if err != nil {
 		return errors.AddContext(err, "failed to mark emails as sent")
 	}
@@ -174,6 +266,55 @@ func (db *DB) MarkAsFailed(ctx context.Context, msgs []*EmailMessage) error {
 	return err
 }
 
+// ReconcileEmails repairs email records left in an inconsistent state, e.g. by
+// a server which died in the middle of sending a batch. It's meant to be run
+// before a sender starts scanning for messages.
+func (db *DB) ReconcileEmails(ctx context.Context) (*EmailReconcileReport, error) {
+	var report EmailReconcileReport
+	unlock := bson.M{"$set": bson.M{
+		"locked_by": "",
+		"locked_at": time.Time{},
+	}}
+	// Release the locks of unsent messages which have either expired or can
+	// never expire because they lack a lock time.
+	filter := bson.M{
+		"locked_by": bson.M{"$nin": bson.A{"", nil}},
+		"sent_at":   nil,
+		"$or": bson.A{
+			bson.M{"locked_at": nil},
+			bson.M{"locked_at": bson.M{"$lt": time.Now().UTC().Add(-emailLockTTL)}},
+		},
+	}
+	ur, err := db.staticEmails.UpdateMany(ctx, filter, unlock)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to release stale locks")
+	}
+	report.StaleLocks = ur.ModifiedCount
+	// Release the locks of messages which were sent but never unlocked.
+	filter = bson.M{
+		"locked_by": bson.M{"$nin": bson.A{"", nil}},
+		"sent_at":   bson.M{"$ne": nil},
+	}
+	ur, err = db.staticEmails.UpdateMany(ctx, filter, unlock)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to release the locks of sent messages")
+	}
+	report.SentLocks = ur.ModifiedCount
+	// Reset failed attempt counters which are negative or missing. Those
+	// would either give the message extra attempts or exclude it from
+	// sending altogether.
+	filter = bson.M{"$or": bson.A{
+		bson.M{"failed_attempts": bson.M{"$lt": 0}},
+		bson.M{"failed_attempts": nil},
+	}}
+	ur, err = db.staticEmails.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"failed_attempts": 0}})
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to reset failed attempts")
+	}
+	report.InvalidAttempts = ur.ModifiedCount
+	return &report, nil
+}
+
 // PurgeEmailCollection is a helper method for testing purposes. It removes all
 // records from the email database collection.
 func (db *DB) PurgeEmailCollection(ctx context.Context) (int64, error) {
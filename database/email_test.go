@@ -0,0 +1,29 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// TestEmailMessageStatus ensures that EmailMessage.Status reports the correct
+// delivery status.
+func TestEmailMessageStatus(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		msg    EmailMessage
+		status string
+	}{
+		{EmailMessage{}, EmailStatusPending},
+		{EmailMessage{FailedAttempts: EmailMaxSendAttempts - 1}, EmailStatusPending},
+		{EmailMessage{FailedAttempts: EmailMaxSendAttempts}, EmailStatusFailed},
+		{EmailMessage{SentAt: now}, EmailStatusSent},
+		// A message sent after some failed attempts.
+		{EmailMessage{SentAt: now, FailedAttempts: 2}, EmailStatusSent},
+		{EmailMessage{SentAt: now, DryRun: true}, EmailStatusDryRun},
+	}
+	for i, tt := range tests {
+		if s := tt.msg.Status(); s != tt.status {
+			t.Errorf("Test %d: expected status %s, got %s", i, tt.status, s)
+		}
+	}
+}
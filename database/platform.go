@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PlatformBandwidth returns the bandwidth billed for uploads, downloads and
+// registry operations across all users (including anonymous ones) between
+// from (inclusive) and to (exclusive). The numbers are computed in the same
+// way as the users' individual stats.
+//
+// This goes over all traffic records in the given period, so it can take a
+// long time on a busy portal. Callers should pass a context with a timeout,
+// after which the method gives up and returns the context's error.
+func (db *DB) PlatformBandwidth(ctx context.Context, from, to time.Time) (upload, download, registry int64, err error) {
+	if from.After(to) {
+		return 0, 0, 0, ErrInvalidTimePeriod
+	}
+	period := func(field string) bson.D {
+		return bson.D{{"$match", bson.D{{field, bson.D{
+			{"$gte", from},
+			{"$lt", to},
+		}}}}}
+	}
+	lookupStage := bson.D{{"$lookup", bson.D{
+		{"from", "skylinks"},
+		{"localField", "skylink_id"},
+		{"foreignField", "_id"},
+		{"as", "skylink_data"},
+	}}}
+
+	// All uploads are billed, regardless of their pinned status.
+	uploadSizes := mongo.Pipeline{
+		period("timestamp"),
+		lookupStage,
+		bson.D{{"$project", bson.D{
+			{"size", bson.D{{"$arrayElemAt", bson.A{"$skylink_data.size", 0}}}},
+		}}},
+	}
+	upload, err = db.sumBandwidthCosts(ctx, db.staticUploads, uploadSizes, skynet.BandwidthUploadCost)
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to sum upload bandwidth")
+	}
+	// Downloads use the number of bytes reported by nginx, if we have it, and
+	// the size of the skylink otherwise.
+	downloadSizes := mongo.Pipeline{
+		period("created_at"),
+		lookupStage,
+		bson.D{{"$project", bson.D{
+			{"size", bson.D{{"$cond", bson.A{
+				bson.D{{"$gt", bson.A{"$bytes", 0}}},
+				"$bytes",
+				bson.D{{"$arrayElemAt", bson.A{"$skylink_data.size", 0}}},
+			}}}},
+		}}},
+	}
+	download, err = db.sumBandwidthCosts(ctx, db.staticDownloads, downloadSizes, skynet.BandwidthDownloadCost)
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to sum download bandwidth")
+	}
+	reads, err := db.count(ctx, db.staticRegistryReads, period("timestamp"))
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to count registry reads")
+	}
+	writes, err := db.count(ctx, db.staticRegistryWrites, period("timestamp"))
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to count registry writes")
+	}
+	registry = reads*skynet.CostBandwidthRegistryRead + writes*skynet.CostBandwidthRegistryWrite
+	return upload, download, registry, nil
+}
+
+// PlatformMRR returns the monthly recurring revenue in cents for each paid
+// tier, based on the tier's MonthlyPrice. Only active subscriptions which are
+// neither expired nor scheduled to be cancelled, either at the end of the
+// period or at a given time, are counted.
+func (db *DB) PlatformMRR(ctx context.Context) (map[int]int64, error) {
+	now := time.Now().UTC()
+	matchStage := bson.D{{"$match", bson.D{
+		{"tier", bson.D{{"$gt", TierFree}}},
+		{"subscription_status", "active"},
+		{"subscribed_until", bson.D{{"$gt", now}}},
+		{"subscription_cancel_at_period_end", bson.D{{"$ne", true}}},
+		// Subscriptions without a scheduled cancellation have a zero or an
+		// epoch cancel_at, as that's what Stripe reports for "none", so only
+		// future values count as scheduled.
+		{"subscription_cancel_at", bson.D{{"$not", bson.D{{"$gt", now}}}}},
+	}}}
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", "$tier"},
+		{"count", bson.D{{"$sum", 1}}},
+	}}}
+	c, err := db.staticUsers.Aggregate(ctx, mongo.Pipeline{matchStage, groupStage})
+	if err != nil {
+		return nil, errors.AddContext(err, "DB query failed")
+	}
+	var groups []struct {
+		Tier  int   `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	err = c.All(ctx, &groups)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	mrr := make(map[int]int64)
+	for _, g := range groups {
+		mrr[g.Tier] = g.Count * UserLimits[g.Tier].MonthlyPrice
+	}
+	return mrr, nil
+}
+
+// sumBandwidthCosts runs the given pipeline, which needs to produce records
+// with a `size` field, and sums the bandwidth costs of those sizes.
+func (db *DB) sumBandwidthCosts(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, cost func(int64) int64) (int64, error) {
+	c, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	// We need this struct, so we can safely decode both int32 and int64.
+	result := struct {
+		Size int64 `bson:"size"`
+	}{}
+	var total int64
+	for c.Next(ctx) {
+		if err = c.Decode(&result); err != nil {
+			return 0, errors.AddContext(err, "failed to decode DB data")
+		}
+		total += cost(result.Size)
+	}
+	if err = c.Err(); err != nil {
+		return 0, errors.AddContext(err, "failed to iterate over DB data")
+	}
+	return total, nil
+}
@@ -12,6 +12,7 @@ import (
 type RegistryRead struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
+	Referrer  Referrer           `bson:"referrer,omitempty" json:"-"`
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
 }
 
@@ -19,16 +20,19 @@ type RegistryRead struct {
 type RegistryWrite struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
+	Referrer  Referrer           `bson:"referrer,omitempty" json:"-"`
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
 }
 
-// RegistryReadCreate registers a new registry read.
-func (db *DB) RegistryReadCreate(ctx context.Context, user User) (*RegistryRead, error) {
+// RegistryReadCreate registers a new registry read. The referrer is the site
+// which made the read, if known.
+func (db *DB) RegistryReadCreate(ctx context.Context, user User, referrer Referrer) (*RegistryRead, error) {
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
 	rr := RegistryRead{
 		UserID:    user.ID,
+		Referrer:  referrer,
 		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
 	}
 	ior, err := db.staticRegistryReads.InsertOne(ctx, rr)
@@ -39,13 +43,15 @@ func (db *DB) RegistryReadCreate(ctx context.Context, user User) (*RegistryRead,
 	return &rr, nil
 }
 
-// RegistryWriteCreate registers a new registry write.
-func (db *DB) RegistryWriteCreate(ctx context.Context, user User) (*RegistryWrite, error) {
+// RegistryWriteCreate registers a new registry write. The referrer is the site
+// which made the write, if known.
+func (db *DB) RegistryWriteCreate(ctx context.Context, user User, referrer Referrer) (*RegistryWrite, error) {
 	if user.ID.IsZero() {
 		return nil, errors.New("invalid user")
 	}
 	rw := RegistryWrite{
 		UserID:    user.ID,
+		Referrer:  referrer,
 		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
 	}
 	ior, err := db.staticRegistryWrites.InsertOne(ctx, rw)
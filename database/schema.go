@@ -15,6 +15,24 @@ var (
 				Keys:    bson.M{"sub": 1},
 				Options: options.Index().SetName("sub_unique").SetUnique(true),
 			},
+			// Users without an email address are allowed, so we only enforce
+			// uniqueness on non-empty emails.
+			{
+				Keys: bson.M{"email": 1},
+				Options: options.Index().
+					SetName("email_unique_nonempty").
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"email": bson.M{"$gt": ""}}),
+			},
+			// A pubkey can belong to a single user only. Users without any
+			// pubkeys are not indexed, so they don't collide with each other.
+			{
+				Keys: bson.M{"pub_keys": 1},
+				Options: options.Index().
+					SetName(indexPubKeysUnique).
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"pub_keys": bson.M{"$type": "binData"}}),
+			},
 		},
 		collSkylinks: {
 			{
@@ -31,6 +49,10 @@ var (
 				Keys:    bson.M{"skylink_id": 1},
 				Options: options.Index().SetName("skylink_id"),
 			},
+			{
+				Keys:    bson.D{{"user_id", 1}, {"timestamp", 1}},
+				Options: options.Index().SetName("user_id_timestamp"),
+			},
 		},
 		collDownloads: {
 			{
@@ -41,6 +63,22 @@ var (
 				Keys:    bson.M{"skylink_id": 1},
 				Options: options.Index().SetName("skylink_id"),
 			},
+			{
+				Keys:    bson.D{{"user_id", 1}, {"created_at", 1}},
+				Options: options.Index().SetName("user_id_created_at"),
+			},
+		},
+		collRegistryReads: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"timestamp", 1}},
+				Options: options.Index().SetName("user_id_timestamp"),
+			},
+		},
+		collRegistryWrites: {
+			{
+				Keys:    bson.D{{"user_id", 1}, {"timestamp", 1}},
+				Options: options.Index().SetName("user_id_timestamp"),
+			},
 		},
 		collEmails: {
 			{
@@ -59,6 +97,10 @@ var (
 				Keys:    bson.M{"sent_by": 1},
 				Options: options.Index().SetName("sent_by"),
 			},
+			{
+				Keys:    bson.D{{"to", 1}, {"_id", 1}},
+				Options: options.Index().SetName("to_id"),
+			},
 		},
 		collChallenges: {
 			{
@@ -99,6 +141,10 @@ var (
 				Keys:    bson.M{"user_id": 1},
 				Options: options.Index().SetName("user_id"),
 			},
+			{
+				Keys:    bson.M{"expires_at": 1},
+				Options: options.Index().SetName("expires_at").SetSparse(true),
+			},
 		},
 	}
 )
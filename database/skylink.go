@@ -11,7 +11,21 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const (
+	// SkylinkValidationBoth accepts both v1 and v2 skylinks.
+	SkylinkValidationBoth = "both"
+	// SkylinkValidationV1 only accepts v1 skylinks.
+	SkylinkValidationV1 = "v1"
+	// SkylinkValidationV2 only accepts v2 skylinks.
+	SkylinkValidationV2 = "v2"
+)
+
 var (
+	// SkylinkValidationMode defines which skylink versions we accept when
+	// managing API keys. Its value is controlled by the
+	// ACCOUNTS_SKYLINK_VALIDATION_MODE environment variable.
+	SkylinkValidationMode = SkylinkValidationBoth
+
 	// extractSkylinkRE extracts a skylink from the given string. It matches
 	// both base32 and base64 skylinks.
 	//
@@ -26,23 +40,18 @@ type Skylink struct {
 	ID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
 	Skylink string             `bson:"skylink" json:"skylink"`
 	Size    int64              `bson:"size" json:"size"`
+	// QuotaExempt marks featured or system content which doesn't count
+	// towards the storage used by the users who pinned it.
+	QuotaExempt bool `bson:"quota_exempt,omitempty" json:"-"`
 }
 
 // Skylink gets the DB object for the given skylink.
 // If it doesn't exist it creates it.
 func (db *DB) Skylink(ctx context.Context, skylink string) (*Skylink, error) {
-	skylinkStr, err := ExtractSkylink(skylink)
+	skylinkStr, err := normalizeSkylink(skylink)
 	if err != nil {
-		return nil, ErrInvalidSkylink
-	}
-	// Normalise the skylink. We want skylinks to appear in the same format in
-	// the DB, regardless of them being passed as base32 or base64.
-	var sl skymodules.Skylink
-	err = sl.LoadString(skylinkStr)
-	if err != nil {
-		return nil, ErrInvalidSkylink
+		return nil, err
 	}
-	skylinkStr = sl.String()
 	// Provisional skylink object.
 	skylinkRec := Skylink{
 		Skylink: skylinkStr,
@@ -59,6 +68,22 @@ func (db *DB) Skylink(ctx context.Context, skylink string) (*Skylink, error) {
 	return &skylinkRec, nil
 }
 
+// normalizeSkylink extracts the skylink from the given string and normalises
+// it. We want skylinks to appear in the same format in the DB, regardless of
+// them being passed as base32 or base64.
+func normalizeSkylink(skylink string) (string, error) {
+	skylinkStr, err := ExtractSkylink(skylink)
+	if err != nil {
+		return "", ErrInvalidSkylink
+	}
+	var sl skymodules.Skylink
+	err = sl.LoadString(skylinkStr)
+	if err != nil {
+		return "", ErrInvalidSkylink
+	}
+	return sl.String(), nil
+}
+
 // SkylinkByID finds a skylink by its ID.
 func (db *DB) SkylinkByID(ctx context.Context, id primitive.ObjectID) (*Skylink, error) {
 	sr := db.staticSkylinks.FindOne(ctx, bson.M{"_id": id})
@@ -88,6 +113,21 @@ func (db *DB) SkylinkUpdate(ctx context.Context, id primitive.ObjectID, name str
 	return nil
 }
 
+// SkylinkSetQuotaExempt sets whether the given skylink counts towards the
+// storage used by the users who pinned it.
+func (db *DB) SkylinkSetQuotaExempt(ctx context.Context, id primitive.ObjectID, exempt bool) error {
+	filter := bson.M{"_id": id}
+	update := bson.M{"$set": bson.M{"quota_exempt": exempt}}
+	ur, err := db.staticSkylinks.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrInvalidSkylink
+	}
+	return nil
+}
+
 // SkylinkDownloadsUpdate changes the size of the full downloads of this
 // skylink. Those should have zero `bytes` in the DB. This method should be
 // called from the fetcher.
@@ -121,3 +161,26 @@ func ValidSkylink(skylink string) bool {
 	err := sl.LoadString(skylink)
 	return err == nil
 }
+
+// ValidSkylinkValidationMode returns true if the given string is a known
+// skylink validation mode.
+func ValidSkylinkValidationMode(mode string) bool {
+	return mode == SkylinkValidationBoth || mode == SkylinkValidationV1 || mode == SkylinkValidationV2
+}
+
+// validSkylinkForMode returns true if the given string is a valid skylink of a
+// version allowed by the current SkylinkValidationMode.
+func validSkylinkForMode(skylink string) bool {
+	var sl skymodules.Skylink
+	if err := sl.LoadString(skylink); err != nil {
+		return false
+	}
+	switch SkylinkValidationMode {
+	case SkylinkValidationV1:
+		return sl.IsSkylinkV1()
+	case SkylinkValidationV2:
+		return sl.IsSkylinkV2()
+	default:
+		return true
+	}
+}
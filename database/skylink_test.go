@@ -139,3 +139,35 @@ func TestValidSkylink(t *testing.T) {
 		}
 	}
 }
+
+// TestValidSkylinkForMode ensures that validSkylinkForMode respects the
+// configured skylink validation mode.
+func TestValidSkylinkForMode(t *testing.T) {
+	defer func(mode string) {
+		SkylinkValidationMode = mode
+	}(SkylinkValidationMode)
+
+	v1 := "AAABAgMAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	v2 := "AQCNzrtSo1UPTkhz1D8ojp2l9pG9CQ6yg-p7jHyIHTTpow"
+	tests := []struct {
+		mode string
+		v1   bool
+		v2   bool
+	}{
+		{mode: SkylinkValidationBoth, v1: true, v2: true},
+		{mode: SkylinkValidationV1, v1: true, v2: false},
+		{mode: SkylinkValidationV2, v1: false, v2: true},
+	}
+	for _, tt := range tests {
+		SkylinkValidationMode = tt.mode
+		if validSkylinkForMode(v1) != tt.v1 {
+			t.Errorf("Mode '%s': expected v1 skylink validity %t.", tt.mode, tt.v1)
+		}
+		if validSkylinkForMode(v2) != tt.v2 {
+			t.Errorf("Mode '%s': expected v2 skylink validity %t.", tt.mode, tt.v2)
+		}
+		if validSkylinkForMode("not a skylink") {
+			t.Errorf("Mode '%s': expected an invalid skylink to be rejected.", tt.mode)
+		}
+	}
+}
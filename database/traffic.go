@@ -0,0 +1,752 @@
+package database
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// UserAgentClassBrowser describes traffic coming from web browsers.
+	UserAgentClassBrowser = "browser"
+	// UserAgentClassCLI describes traffic coming from command line tools.
+	UserAgentClassCLI = "cli"
+	// UserAgentClassSDK describes traffic coming from the Skynet SDKs.
+	UserAgentClassSDK = "sdk"
+	// UserAgentClassOther describes traffic coming from a client we don't
+	// recognise.
+	UserAgentClassOther = "other"
+	// UserAgentClassUnknown describes traffic for which we don't have a
+	// user agent recorded.
+	UserAgentClassUnknown = "unknown"
+
+	// ServerUnknown groups traffic for which we don't know which server
+	// handled it, e.g. records created before we started tracking that.
+	ServerUnknown = "unknown"
+	// ReferrerUnknown groups downloads for which we don't know the referrer,
+	// e.g. direct downloads or records created before we started tracking it.
+	ReferrerUnknown Referrer = "unknown"
+	// TrafficComponentUploads identifies the uploads component of a user's
+	// traffic.
+	TrafficComponentUploads = "uploads"
+	// TrafficComponentDownloads identifies the downloads component of a
+	// user's traffic.
+	TrafficComponentDownloads = "downloads"
+	// TrafficComponentRegistryReads identifies the registry reads component
+	// of a user's traffic.
+	TrafficComponentRegistryReads = "registryReads"
+	// TrafficComponentRegistryWrites identifies the registry writes component
+	// of a user's traffic.
+	TrafficComponentRegistryWrites = "registryWrites"
+	// AnonymousIDGlobal groups anonymous traffic for which we don't have an
+	// anonymous ID, e.g. because the portal didn't supply one.
+	AnonymousIDGlobal = "global"
+)
+
+var (
+	// ReferrerAliases maps canonical referrers to the referrer they should be
+	// reported as, e.g. to group the CDN hostnames of an app under the app.
+	// Its value is controlled by the ACCOUNTS_REFERRER_ALIASES environment
+	// variable.
+	ReferrerAliases = map[string]string{}
+	// ReferrerDenylist holds the canonical referrers whose traffic is not
+	// billed to users, e.g. the referrer of our internal monitoring. Its value
+	// is controlled by the ACCOUNTS_REFERRER_DENYLIST environment variable.
+	ReferrerDenylist = map[string]struct{}{}
+
+	// userAgentSDKMarkers are substrings which identify the Skynet SDKs.
+	userAgentSDKMarkers = []string{"skynet-js", "skynet-nodejs", "skynet-python", "skynet-go", "go-skynet"}
+	// userAgentCLIMarkers are substrings which identify command line tools.
+	userAgentCLIMarkers = []string{"curl/", "wget/", "httpie/", "skynet-cli"}
+	// userAgentBrowserMarkers are substrings which identify web browsers.
+	userAgentBrowserMarkers = []string{"mozilla/", "opera/"}
+)
+
+type (
+	// Referrer identifies the site which linked to a downloaded skylink, as
+	// reported by the portal.
+	Referrer string
+	// TrafficMeta holds the details the portal reports about the request
+	// which generated an upload or a download.
+	TrafficMeta struct {
+		// UserAgent is the one reported by the client.
+		UserAgent string
+		// Server is the one which handled the request.
+		Server string
+		// Referrer is the site from which the request was made.
+		Referrer Referrer
+		// AnonymousID identifies the source of an anonymous request. It's only
+		// recorded for requests made by anonymous users.
+		AnonymousID string
+	}
+	// Traffic describes the traffic generated by a group of requests, e.g.
+	// the ones made by a given class of clients.
+	Traffic struct {
+		Uploads         int64 `json:"uploads"`
+		Downloads       int64 `json:"downloads"`
+		DownloadedBytes int64 `json:"downloadedBytes"`
+	}
+	// TrafficDTO describes the traffic a user generated via a given referrer.
+	// RegistryBandwidth is the combined bandwidth of the registry reads and
+	// writes, kept for backwards compatibility.
+	TrafficDTO struct {
+		Referrer               Referrer `json:"referrer"`
+		Uploads                int64    `json:"uploads"`
+		Downloads              int64    `json:"downloads"`
+		DownloadedBytes        int64    `json:"downloadedBytes"`
+		RegistryReads          int64    `json:"registryReads"`
+		RegistryWrites         int64    `json:"registryWrites"`
+		RegistryReadBandwidth  int64    `json:"registryReadBandwidth"`
+		RegistryWriteBandwidth int64    `json:"registryWriteBandwidth"`
+		RegistryBandwidth      int64    `json:"registryBandwidth"`
+	}
+	// ReferrerRegistryStats describes the registry operations made via a
+	// given referrer.
+	ReferrerRegistryStats struct {
+		Referrer Referrer `json:"referrer"`
+		Reads    int64    `json:"reads"`
+		Writes   int64    `json:"writes"`
+	}
+	// trafficGroup is a single row of traffic grouped by a given field, e.g.
+	// the user agent.
+	trafficGroup struct {
+		Key   string `bson:"_id"`
+		Count int64  `bson:"count"`
+		Bytes int64  `bson:"bytes"`
+	}
+)
+
+// Canonical returns the canonical form of the referrer, so the different pages
+// and spellings of the same site are grouped together. That's the lowercase
+// host of the referrer without a `www.` prefix. Referrers which don't parse as
+// URLs are only lowercased. Empty referrers become ReferrerUnknown.
+func (r Referrer) Canonical() Referrer {
+	s := strings.ToLower(strings.TrimSpace(string(r)))
+	if s == "" {
+		return ReferrerUnknown
+	}
+	// Referrers without a scheme would be parsed as paths.
+	raw := s
+	if !strings.Contains(raw, "://") {
+		raw = "//" + raw
+	}
+	if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+		s = u.Hostname()
+	}
+	return Referrer(strings.TrimPrefix(s, "www."))
+}
+
+// ApplyAliases returns the canonical form of the referrer, replaced by its
+// alias, if the given aliases contain one. The keys of the aliases need to be
+// canonical referrers, see ParseReferrerAliases.
+func (r Referrer) ApplyAliases(aliases map[string]string) Referrer {
+	c := r.Canonical()
+	if alias, ok := aliases[string(c)]; ok {
+		return Referrer(alias)
+	}
+	return c
+}
+
+// ParseReferrerAliases parses a comma-separated list of `referrer=alias`
+// pairs, e.g. `cdn1.app.com=app.com,cdn2.app.com=app.com`. Both sides of each
+// pair are canonicalized.
+func ParseReferrerAliases(s string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("invalid referrer alias: " + pair)
+		}
+		aliases[string(Referrer(parts[0]).Canonical())] = string(Referrer(parts[1]).Canonical())
+	}
+	return aliases, nil
+}
+
+// IsDenied returns true if the canonical form of the referrer is in the given
+// denylist. The keys of the denylist need to be canonical referrers, see
+// ParseReferrerDenylist.
+func (r Referrer) IsDenied(denylist map[string]struct{}) bool {
+	_, denied := denylist[string(r.Canonical())]
+	return denied
+}
+
+// ParseReferrerDenylist parses a comma-separated list of referrers, e.g.
+// `monitor.siasky.net,status.siasky.net`. Each referrer is canonicalized.
+func ParseReferrerDenylist(s string) map[string]struct{} {
+	denylist := make(map[string]struct{})
+	for _, r := range strings.Split(s, ",") {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+		denylist[string(Referrer(r).Canonical())] = struct{}{}
+	}
+	return denylist
+}
+
+// Total returns the total number of registry operations.
+func (rs ReferrerRegistryStats) Total() int64 {
+	return rs.Reads + rs.Writes
+}
+
+// UserAgentClass returns the class of client which reported the given user
+// agent, e.g. browser, CLI or SDK.
+func UserAgentClass(ua string) string {
+	ua = strings.ToLower(strings.TrimSpace(ua))
+	if ua == "" {
+		return UserAgentClassUnknown
+	}
+	// The SDKs need to be checked first because they might run in a browser.
+	classes := []struct {
+		class   string
+		markers []string
+	}{
+		{UserAgentClassSDK, userAgentSDKMarkers},
+		{UserAgentClassCLI, userAgentCLIMarkers},
+		{UserAgentClassBrowser, userAgentBrowserMarkers},
+	}
+	for _, c := range classes {
+		for _, m := range c.markers {
+			if strings.Contains(ua, m) {
+				return c.class
+			}
+		}
+	}
+	return UserAgentClassOther
+}
+
+// UserTrafficByClient returns the user's upload and download traffic since the
+// given time, grouped by the class of the client that generated it. Records
+// without a user agent are grouped under UserAgentClassUnknown.
+func (db *DB) UserTrafficByClient(ctx context.Context, userID primitive.ObjectID, since time.Time) (map[string]Traffic, error) {
+	if userID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	traffic := make(map[string]Traffic)
+
+	uploadsMatch := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"timestamp", bson.D{{"$gt", since}}},
+	}}}
+	uploads, err := db.trafficByField(ctx, db.staticUploads, mongo.Pipeline{uploadsMatch}, "user_agent")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group uploads by user agent")
+	}
+	for _, r := range uploads {
+		class := UserAgentClass(r.Key)
+		ct := traffic[class]
+		ct.Uploads += r.Count
+		traffic[class] = ct
+	}
+
+	downloadsMatch := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"created_at", bson.D{{"$gt", since}}},
+	}}}
+	downloads, err := db.trafficByField(ctx, db.staticDownloads, downloadBytesPipeline(downloadsMatch), "user_agent")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group downloads by user agent")
+	}
+	for _, r := range downloads {
+		class := UserAgentClass(r.Key)
+		ct := traffic[class]
+		ct.Downloads += r.Count
+		ct.DownloadedBytes += r.Bytes
+		traffic[class] = ct
+	}
+	return traffic, nil
+}
+
+// TrafficByServer returns the portal's upload and download traffic since the
+// given time, grouped by the server which handled it. Records without a server
+// are grouped under ServerUnknown.
+func (db *DB) TrafficByServer(ctx context.Context, since time.Time) (map[string]Traffic, error) {
+	traffic := make(map[string]Traffic)
+
+	uploadsMatch := bson.D{{"$match", bson.D{
+		{"timestamp", bson.D{{"$gt", since}}},
+	}}}
+	uploads, err := db.trafficByField(ctx, db.staticUploads, mongo.Pipeline{uploadsMatch}, "server")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group uploads by server")
+	}
+	for _, r := range uploads {
+		server := serverOrUnknown(r.Key)
+		t := traffic[server]
+		t.Uploads += r.Count
+		traffic[server] = t
+	}
+
+	downloadsMatch := bson.D{{"$match", bson.D{
+		{"created_at", bson.D{{"$gt", since}}},
+	}}}
+	downloads, err := db.trafficByField(ctx, db.staticDownloads, downloadBytesPipeline(downloadsMatch), "server")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group downloads by server")
+	}
+	for _, r := range downloads {
+		server := serverOrUnknown(r.Key)
+		t := traffic[server]
+		t.Downloads += r.Count
+		t.DownloadedBytes += r.Bytes
+		traffic[server] = t
+	}
+	return traffic, nil
+}
+
+// UserDownloadBandwidthByReferrer returns the download bandwidth billed to the
+// user since the given time, grouped by the referrer of the downloads. Unlike
+// the bandwidth reported by UserStats, it doesn't include registry traffic.
+// Referrers are canonicalized and aliased, see ReferrerAliases, and downloads
+// without a referrer are grouped under ReferrerUnknown. Downloads via
+// denylisted referrers are not billed, so they are left out, see
+// ReferrerDenylist.
+func (db *DB) UserDownloadBandwidthByReferrer(ctx context.Context, userID primitive.ObjectID, since time.Time) (map[Referrer]int64, error) {
+	if userID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"created_at", bson.D{{"$gt", since}}},
+	}}}
+	c, err := db.staticDownloads.Aggregate(ctx, downloadSizePipeline(matchStage))
+	if err != nil {
+		return nil, errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	bandwidth := make(map[Referrer]int64)
+	for c.Next(ctx) {
+		// Declare the struct in the loop, so the referrer doesn't carry over
+		// to downloads which don't have one.
+		var result struct {
+			Size     int64    `bson:"size"`
+			Referrer Referrer `bson:"referrer"`
+		}
+		if err = c.Decode(&result); err != nil {
+			return nil, errors.AddContext(err, "failed to decode DB data")
+		}
+		if result.Referrer.IsDenied(ReferrerDenylist) {
+			continue
+		}
+		ref := result.Referrer.ApplyAliases(ReferrerAliases)
+		// The cost of each download is rounded up separately, so we can't
+		// sum the sizes first.
+		bandwidth[ref] += skynet.BandwidthDownloadCost(result.Size)
+	}
+	if err = c.Err(); err != nil {
+		return nil, errors.AddContext(err, "failed to iterate over downloads")
+	}
+	return bandwidth, nil
+}
+
+// StreamUserTraffic calls fn with the traffic each user generated via each
+// referrer since the given time, one (user, referrer) pair at a time. It only
+// holds a single user's traffic in memory. It stops at the first error
+// returned by fn, which it returns, or when the context is cancelled.
+func (db *DB) StreamUserTraffic(ctx context.Context, since time.Time, fn func(userID primitive.ObjectID, r Referrer, t TrafficDTO) error) error {
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	c, err := db.staticUsers.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return errors.AddContext(err, "failed to fetch users")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Debugln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	for c.Next(ctx) {
+		var u struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err = c.Decode(&u); err != nil {
+			return errors.AddContext(err, "failed to decode DB data")
+		}
+		var traffic map[Referrer]TrafficDTO
+		traffic, err = db.userTraffic(ctx, u.ID, since)
+		if err != nil {
+			return errors.AddContext(err, "failed to fetch traffic of user "+u.ID.Hex())
+		}
+		// Report the referrers in a stable order.
+		refs := make([]Referrer, 0, len(traffic))
+		for r := range traffic {
+			refs = append(refs, r)
+		}
+		sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+		for _, r := range refs {
+			if err = fn(u.ID, r, traffic[r]); err != nil {
+				return err
+			}
+		}
+	}
+	if err = c.Err(); err != nil {
+		return errors.AddContext(err, "failed to iterate over users")
+	}
+	return ctx.Err()
+}
+
+// UserDownloadReach returns the number of distinct referrers via which the
+// content pinned by the user was downloaded since the given time, by anyone.
+// Downloads without a referrer are not counted.
+func (db *DB) UserDownloadReach(ctx context.Context, userID primitive.ObjectID, since time.Time) (int, error) {
+	if userID.IsZero() {
+		return 0, errors.New("invalid user")
+	}
+	skylinkIDs, err := db.userPinnedSkylinkIDs(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if len(skylinkIDs) == 0 {
+		return 0, nil
+	}
+	filter := bson.M{
+		"skylink_id": bson.M{"$in": skylinkIDs},
+		"created_at": bson.M{"$gt": since},
+		"referrer":   bson.M{"$gt": ""},
+	}
+	refs, err := db.staticDownloads.Distinct(ctx, "referrer", filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch download referrers")
+	}
+	// Different spellings and aliases of the same referrer count once.
+	canonical := make(map[Referrer]struct{})
+	for _, r := range refs {
+		if s, ok := r.(string); ok {
+			canonical[Referrer(s).ApplyAliases(ReferrerAliases)] = struct{}{}
+		}
+	}
+	return len(canonical), nil
+}
+
+// UserTopDownloadReferrers returns the n referrers via which the content pinned
+// by the user was downloaded the most times since the given time, by anyone.
+// Referrers are canonicalized and aliased and downloads without a referrer are
+// grouped under ReferrerUnknown. Only the downloads of the returned TrafficDTOs
+// are set.
+func (db *DB) UserTopDownloadReferrers(ctx context.Context, userID primitive.ObjectID, since time.Time, n int) ([]TrafficDTO, error) {
+	if userID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	if n <= 0 {
+		return nil, errors.New("invalid limit")
+	}
+	skylinkIDs, err := db.userPinnedSkylinkIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	// We want this to be a make in order to make sure its JSON representation
+	// is a valid JSONArray and not a null.
+	top := make([]TrafficDTO, 0)
+	if len(skylinkIDs) == 0 {
+		return top, nil
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"skylink_id", bson.D{{"$in", skylinkIDs}}},
+		{"created_at", bson.D{{"$gt", since}}},
+	}}}
+	downloads, err := db.trafficByField(ctx, db.staticDownloads, downloadBytesPipeline(matchStage), "referrer")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group downloads by referrer")
+	}
+	byRef := make(map[Referrer]TrafficDTO)
+	for _, g := range downloads {
+		ref := Referrer(g.Key).ApplyAliases(ReferrerAliases)
+		t := byRef[ref]
+		t.Referrer = ref
+		t.Downloads += g.Count
+		t.DownloadedBytes += g.Bytes
+		byRef[ref] = t
+	}
+	for _, t := range byRef {
+		top = append(top, t)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Downloads != top[j].Downloads {
+			return top[i].Downloads > top[j].Downloads
+		}
+		return top[i].Referrer < top[j].Referrer
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top, nil
+}
+
+// RegistryOpsByReferrer returns the topN referrers with the most registry
+// operations since the given time, across all users, together with the number
+// of registry reads and writes made via each of them. Referrers are
+// canonicalized and aliased first and operations without a referrer are
+// grouped under
+// ReferrerUnknown.
+func (db *DB) RegistryOpsByReferrer(ctx context.Context, since time.Time, topN int) ([]ReferrerRegistryStats, error) {
+	if topN <= 0 {
+		return nil, errors.New("invalid limit")
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"timestamp", bson.D{{"$gt", since}}},
+	}}}
+	reads, err := db.trafficByField(ctx, db.staticRegistryReads, mongo.Pipeline{matchStage}, "referrer")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group registry reads by referrer")
+	}
+	writes, err := db.trafficByField(ctx, db.staticRegistryWrites, mongo.Pipeline{matchStage}, "referrer")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group registry writes by referrer")
+	}
+	byRef := make(map[Referrer]ReferrerRegistryStats)
+	for _, g := range reads {
+		ref := Referrer(g.Key).ApplyAliases(ReferrerAliases)
+		rs := byRef[ref]
+		rs.Referrer = ref
+		rs.Reads += g.Count
+		byRef[ref] = rs
+	}
+	for _, g := range writes {
+		ref := Referrer(g.Key).ApplyAliases(ReferrerAliases)
+		rs := byRef[ref]
+		rs.Referrer = ref
+		rs.Writes += g.Count
+		byRef[ref] = rs
+	}
+	stats := make([]ReferrerRegistryStats, 0, len(byRef))
+	for _, rs := range byRef {
+		stats = append(stats, rs)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total() != stats[j].Total() {
+			return stats[i].Total() > stats[j].Total()
+		}
+		return stats[i].Referrer < stats[j].Referrer
+	})
+	if len(stats) > topN {
+		stats = stats[:topN]
+	}
+	return stats, nil
+}
+
+// AnonymousTrafficByID returns the anonymous upload and download traffic since
+// the given time, grouped by the anonymous ID of the records. Anonymous records
+// without an anonymous ID are grouped under AnonymousIDGlobal.
+func (db *DB) AnonymousTrafficByID(ctx context.Context, since time.Time) (map[string]Traffic, error) {
+	traffic := make(map[string]Traffic)
+
+	uploadsMatch := bson.D{{"$match", bson.D{
+		{"user_id", bson.D{{"$exists", false}}},
+		{"timestamp", bson.D{{"$gt", since}}},
+	}}}
+	uploads, err := db.trafficByField(ctx, db.staticUploads, mongo.Pipeline{uploadsMatch}, "anonymous_id")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group uploads by anonymous ID")
+	}
+	for _, r := range uploads {
+		id := anonymousIDOrGlobal(r.Key)
+		t := traffic[id]
+		t.Uploads += r.Count
+		traffic[id] = t
+	}
+
+	downloadsMatch := bson.D{{"$match", bson.D{
+		{"user_id", bson.D{{"$exists", false}}},
+		{"created_at", bson.D{{"$gt", since}}},
+	}}}
+	downloads, err := db.trafficByField(ctx, db.staticDownloads, downloadBytesPipeline(downloadsMatch), "anonymous_id")
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to group downloads by anonymous ID")
+	}
+	for _, r := range downloads {
+		id := anonymousIDOrGlobal(r.Key)
+		t := traffic[id]
+		t.Downloads += r.Count
+		t.DownloadedBytes += r.Bytes
+		traffic[id] = t
+	}
+	return traffic, nil
+}
+
+// UserTrafficBestEffort returns the user's billed uploads, downloads, registry
+// reads and registry writes since the given time, grouped by canonical, aliased
+// referrer. Unlike userTraffic, it doesn't fail when some of these components
+// can't be fetched. Instead, it returns the traffic of the components which
+// were fetched, together with the errors of the ones which failed, keyed by
+// component, e.g. TrafficComponentRegistryReads. Records without a referrer are
+// grouped under ReferrerUnknown. Traffic via denylisted referrers isn't billed,
+// so it's left out, see ReferrerDenylist.
+func (db *DB) UserTrafficBestEffort(ctx context.Context, userID primitive.ObjectID, since time.Time) (map[Referrer]TrafficDTO, map[string]error, error) {
+	if userID.IsZero() {
+		return nil, nil, errors.New("invalid user")
+	}
+	match := func(timeField string) bson.D {
+		return bson.D{{"$match", bson.D{
+			{"user_id", userID},
+			{timeField, bson.D{{"$gt", since}}},
+		}}}
+	}
+	components := []struct {
+		name     string
+		coll     *mongo.Collection
+		pipeline mongo.Pipeline
+		add      func(t *TrafficDTO, g trafficGroup)
+	}{
+		{TrafficComponentUploads, db.staticUploads, mongo.Pipeline{match("timestamp")}, func(t *TrafficDTO, g trafficGroup) {
+			t.Uploads += g.Count
+		}},
+		{TrafficComponentDownloads, db.staticDownloads, downloadBytesPipeline(match("created_at")), func(t *TrafficDTO, g trafficGroup) {
+			t.Downloads += g.Count
+			t.DownloadedBytes += g.Bytes
+		}},
+		{TrafficComponentRegistryReads, db.staticRegistryReads, mongo.Pipeline{match("timestamp")}, func(t *TrafficDTO, g trafficGroup) {
+			t.RegistryReads += g.Count
+			t.RegistryReadBandwidth += g.Count * skynet.CostBandwidthRegistryRead
+			t.RegistryBandwidth += g.Count * skynet.CostBandwidthRegistryRead
+		}},
+		{TrafficComponentRegistryWrites, db.staticRegistryWrites, mongo.Pipeline{match("timestamp")}, func(t *TrafficDTO, g trafficGroup) {
+			t.RegistryWrites += g.Count
+			t.RegistryWriteBandwidth += g.Count * skynet.CostBandwidthRegistryWrite
+			t.RegistryBandwidth += g.Count * skynet.CostBandwidthRegistryWrite
+		}},
+	}
+
+	traffic := make(map[Referrer]TrafficDTO)
+	failed := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, comp := range components {
+		wg.Add(1)
+		go func(name string, coll *mongo.Collection, pipeline mongo.Pipeline, add func(*TrafficDTO, trafficGroup)) {
+			defer wg.Done()
+			var groups []trafficGroup
+			var err error
+			if db.staticDeps.Disrupt("DependencyTrafficComponentFailure" + name) {
+				err = errors.New("traffic component failure caused by DependencyTrafficComponentFailure")
+			} else {
+				groups, err = db.trafficByField(ctx, coll, pipeline, "referrer")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				db.staticLogger.Infof("Failed to group user's %s by referrer: %v", name, err)
+				failed[name] = errors.AddContext(err, "failed to group "+name+" by referrer")
+				return
+			}
+			for _, g := range groups {
+				if Referrer(g.Key).IsDenied(ReferrerDenylist) {
+					continue
+				}
+				ref := Referrer(g.Key).ApplyAliases(ReferrerAliases)
+				t := traffic[ref]
+				t.Referrer = ref
+				add(&t, g)
+				traffic[ref] = t
+			}
+		}(comp.name, comp.coll, comp.pipeline, comp.add)
+	}
+	wg.Wait()
+	return traffic, failed, nil
+}
+
+// userTraffic returns the user's billed uploads, downloads, registry reads and
+// registry writes since the given time, grouped by canonical, aliased
+// referrer. Like UserTrafficBestEffort, it leaves out traffic via denylisted
+// referrers. It fails if any of these components can't be fetched, see
+// UserTrafficBestEffort for a variant which doesn't.
+func (db *DB) userTraffic(ctx context.Context, userID primitive.ObjectID, since time.Time) (map[Referrer]TrafficDTO, error) {
+	traffic, failed, err := db.UserTrafficBestEffort(ctx, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		errs := make([]error, 0, len(failed))
+		for _, e := range failed {
+			errs = append(errs, e)
+		}
+		return nil, errors.Compose(errs...)
+	}
+	return traffic, nil
+}
+
+// userPinnedSkylinkIDs returns the IDs of the skylinks the user currently has
+// pinned.
+func (db *DB) userPinnedSkylinkIDs(ctx context.Context, userID primitive.ObjectID) ([]interface{}, error) {
+	filter := bson.M{
+		"user_id":  userID,
+		"unpinned": false,
+	}
+	ids, err := db.staticUploads.Distinct(ctx, "skylink_id", filter)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch the user's pinned skylinks")
+	}
+	return ids, nil
+}
+
+// anonymousIDOrGlobal returns the given anonymous ID or AnonymousIDGlobal, if
+// it's empty.
+func anonymousIDOrGlobal(id string) string {
+	if id == "" {
+		return AnonymousIDGlobal
+	}
+	return id
+}
+
+// serverOrUnknown returns the given server or ServerUnknown, if it's empty.
+func serverOrUnknown(server string) string {
+	if server == "" {
+		return ServerUnknown
+	}
+	return server
+}
+
+// downloadBytesPipeline selects the downloads which match the given stage and
+// sets the `bytes` of full downloads, which are recorded with zero bytes, to
+// the size of the downloaded skylink.
+func downloadBytesPipeline(matchStage bson.D) mongo.Pipeline {
+	lookupStage := bson.D{{"$lookup", bson.D{
+		{"from", "skylinks"},
+		{"localField", "skylink_id"},
+		{"foreignField", "_id"},
+		{"as", "fromSkylinks"},
+	}}}
+	setStage := bson.D{{"$set", bson.D{
+		{"bytes", bson.D{{"$cond", bson.A{
+			bson.D{{"$gt", bson.A{"$bytes", 0}}},
+			"$bytes",
+			bson.D{{"$ifNull", bson.A{bson.D{{"$arrayElemAt", bson.A{"$fromSkylinks.size", 0}}}, 0}}},
+		}}}},
+	}}}
+	return mongo.Pipeline{matchStage, lookupStage, setStage}
+}
+
+// trafficByField groups the records in the given collection which are selected
+// by the given pipeline by the raw value of the given field. Records without
+// that field are grouped under an empty string.
+func (db *DB) trafficByField(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, field string) ([]trafficGroup, error) {
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", bson.D{{"$ifNull", bson.A{"$" + field, ""}}}},
+		{"count", bson.D{{"$sum", 1}}},
+		{"bytes", bson.D{{"$sum", "$bytes"}}},
+	}}}
+	c, err := coll.Aggregate(ctx, append(pipeline, groupStage))
+	if err != nil {
+		return nil, err
+	}
+	var groups []trafficGroup
+	err = c.All(ctx, &groups)
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestUserAgentClass ensures UserAgentClass correctly classifies user agents.
+func TestUserAgentClass(t *testing.T) {
+	tests := []struct {
+		ua    string
+		class string
+	}{
+		{ua: "", class: UserAgentClassUnknown},
+		{ua: "   ", class: UserAgentClassUnknown},
+		{ua: "Mozilla/5.0 (X11; Linux x86_64; rv:102.0) Gecko/20100101 Firefox/102.0", class: UserAgentClassBrowser},
+		{ua: "curl/7.79.1", class: UserAgentClassCLI},
+		{ua: "Wget/1.21.2", class: UserAgentClassCLI},
+		{ua: "skynet-nodejs/2.1.0", class: UserAgentClassSDK},
+		{ua: "Mozilla/5.0 skynet-js/4.0.0", class: UserAgentClassSDK},
+		{ua: "Sia-Agent", class: UserAgentClassOther},
+	}
+	for _, tt := range tests {
+		if c := UserAgentClass(tt.ua); c != tt.class {
+			t.Errorf("Expected class '%s' for '%s', got '%s'.", tt.class, tt.ua, c)
+		}
+	}
+}
+
+// TestReferrerCanonical ensures Referrer.Canonical groups the different
+// spellings of the same site together.
+func TestReferrerCanonical(t *testing.T) {
+	tests := []struct {
+		referrer  Referrer
+		canonical Referrer
+	}{
+		{referrer: "", canonical: ReferrerUnknown},
+		{referrer: "   ", canonical: ReferrerUnknown},
+		{referrer: "example.com", canonical: "example.com"},
+		{referrer: "www.example.com", canonical: "example.com"},
+		{referrer: "https://www.Example.com/some/Page?q=1", canonical: "example.com"},
+		{referrer: "http://example.com:8080/", canonical: "example.com"},
+		{referrer: "Example.com/", canonical: "example.com"},
+		{referrer: "blog.example.com", canonical: "blog.example.com"},
+		{referrer: "skyapp.hns", canonical: "skyapp.hns"},
+	}
+	for _, tt := range tests {
+		if c := tt.referrer.Canonical(); c != tt.canonical {
+			t.Errorf("Expected canonical referrer '%s' for '%s', got '%s'.", tt.canonical, tt.referrer, c)
+		}
+	}
+}
+
+// TestReferrerApplyAliases ensures Referrer.ApplyAliases replaces referrers by
+// their aliases and that ParseReferrerAliases parses the aliases correctly.
+func TestReferrerApplyAliases(t *testing.T) {
+	aliases, err := ParseReferrerAliases(" https://CDN1.app.com/=app.com, www.cdn2.app.com=App.com ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"cdn1.app.com": "app.com",
+		"cdn2.app.com": "app.com",
+	}
+	if !reflect.DeepEqual(aliases, expected) {
+		t.Fatalf("Expected aliases %+v, got %+v", expected, aliases)
+	}
+	tests := []struct {
+		referrer Referrer
+		result   Referrer
+	}{
+		{referrer: "https://cdn1.app.com/some/file", result: "app.com"},
+		{referrer: "CDN2.app.com/", result: "app.com"},
+		{referrer: "app.com", result: "app.com"},
+		{referrer: "cdn3.app.com", result: "cdn3.app.com"},
+		{referrer: "", result: ReferrerUnknown},
+	}
+	for _, tt := range tests {
+		if r := tt.referrer.ApplyAliases(aliases); r != tt.result {
+			t.Errorf("Expected referrer '%s' for '%s', got '%s'.", tt.result, tt.referrer, r)
+		}
+	}
+	// Without aliases we get the canonical referrer.
+	if r := Referrer("www.cdn1.app.com").ApplyAliases(nil); r != "cdn1.app.com" {
+		t.Fatalf("Expected referrer 'cdn1.app.com', got '%s'.", r)
+	}
+	// Invalid pairs are rejected.
+	for _, s := range []string{"cdn1.app.com", "cdn1.app.com=", "=app.com", "a=b=c"} {
+		if _, err = ParseReferrerAliases(s); err == nil {
+			t.Errorf("Expected an error for '%s'.", s)
+		}
+	}
+}
+
+// TestReferrerIsDenied ensures Referrer.IsDenied matches referrers against the
+// denylist by their canonical form and that ParseReferrerDenylist parses the
+// denylist correctly.
+func TestReferrerIsDenied(t *testing.T) {
+	denylist := ParseReferrerDenylist(" https://Monitor.siasky.net/, www.status.siasky.net ,")
+	expected := map[string]struct{}{
+		"monitor.siasky.net": {},
+		"status.siasky.net":  {},
+	}
+	if !reflect.DeepEqual(denylist, expected) {
+		t.Fatalf("Expected denylist %+v, got %+v", expected, denylist)
+	}
+	tests := []struct {
+		referrer Referrer
+		denied   bool
+	}{
+		{referrer: "https://monitor.siasky.net/check", denied: true},
+		{referrer: "STATUS.siasky.net", denied: true},
+		{referrer: "siasky.net", denied: false},
+		{referrer: "", denied: false},
+	}
+	for _, tt := range tests {
+		if d := tt.referrer.IsDenied(denylist); d != tt.denied {
+			t.Errorf("Expected denied %t for '%s', got %t.", tt.denied, tt.referrer, d)
+		}
+	}
+	// An empty denylist denies nothing.
+	if Referrer("monitor.siasky.net").IsDenied(ParseReferrerDenylist("")) {
+		t.Fatal("Expected an empty denylist to deny nothing.")
+	}
+}
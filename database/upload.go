@@ -8,6 +8,8 @@ import (
 	"gitlab.com/NebulousLabs/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -21,9 +23,20 @@ type Upload struct {
 	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID     primitive.ObjectID `bson:"user_id,omitempty" json:"userId"`
 	UploaderIP string             `bson:"uploader_ip" json:"uploaderIP"`
+	UserAgent  string             `bson:"user_agent,omitempty" json:"-"`
+	Server     string             `bson:"server,omitempty" json:"-"`
+	Referrer   Referrer           `bson:"referrer,omitempty" json:"-"`
 	SkylinkID  primitive.ObjectID `bson:"skylink_id,omitempty" json:"skylinkId"`
 	Timestamp  time.Time          `bson:"timestamp" json:"timestamp"`
 	Unpinned   bool               `bson:"unpinned" json:"-"`
+	UnpinnedAt time.Time          `bson:"unpinned_at,omitempty" json:"-"`
+	// PinnedFrom holds the ID of the skylink's original upload when that
+	// upload was made by someone else, i.e. when the user pinned content
+	// somebody else uploaded. Uploads without it are the user's own.
+	PinnedFrom primitive.ObjectID `bson:"pinned_from,omitempty" json:"-"`
+	// AnonymousID is a synthetic key, e.g. derived from the IP or a cookie,
+	// which identifies the source of an anonymous upload.
+	AnonymousID string `bson:"anonymous_id,omitempty" json:"-"`
 }
 
 // UploadResponse is the representation of an upload we send as response to
@@ -49,17 +62,34 @@ func (db *DB) UploadByID(ctx context.Context, id primitive.ObjectID) (*Upload, e
 }
 
 // UploadCreate registers a new upload and counts it towards the user's used
-// storage.
-func (db *DB) UploadCreate(ctx context.Context, user User, ip string, skylink Skylink) (*Upload, error) {
+// storage. The metadata describes the upload request. If the skylink was
+// originally uploaded by someone else, the upload is recorded as pinned from
+// that original upload.
+func (db *DB) UploadCreate(ctx context.Context, user User, ip string, skylink Skylink, meta TrafficMeta) (*Upload, error) {
 	if skylink.ID.IsZero() {
 		return nil, errors.New("skylink doesn't exist")
 	}
 	up := Upload{
 		UserID:     user.ID,
 		UploaderIP: ip,
+		UserAgent:  meta.UserAgent,
+		Server:     meta.Server,
+		Referrer:   meta.Referrer,
 		SkylinkID:  skylink.ID,
 		Timestamp:  time.Now().UTC().Truncate(time.Millisecond),
 	}
+	if user.ID.IsZero() {
+		up.AnonymousID = meta.AnonymousID
+	}
+	var original Upload
+	opts := options.FindOne().SetSort(bson.D{{"timestamp", 1}})
+	err := db.staticUploads.FindOne(ctx, bson.M{"skylink_id": skylink.ID}, opts).Decode(&original)
+	if err != nil && !errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, errors.AddContext(err, "failed to fetch the skylink's original upload")
+	}
+	if err == nil && original.UserID != user.ID {
+		up.PinnedFrom = original.ID
+	}
 	ior, err := db.staticUploads.InsertOne(ctx, up)
 	if err != nil {
 		return nil, err
@@ -115,7 +145,10 @@ func (db *DB) UnpinUploads(ctx context.Context, skylink Skylink, user User) (int
 		"user_id":    user.ID,
 		"unpinned":   false,
 	}
-	update := bson.M{"$set": bson.M{"unpinned": true}}
+	update := bson.M{"$set": bson.M{
+		"unpinned":    true,
+		"unpinned_at": time.Now().UTC().Truncate(time.Millisecond),
+	}}
 	ur, err := db.staticUploads.UpdateMany(ctx, filter, update)
 	if err != nil {
 		return 0, err
@@ -132,6 +165,130 @@ func (db *DB) UpdateUpload(ctx context.Context, id primitive.ObjectID, update bs
 	return ur.ModifiedCount, nil
 }
 
+// SkylinkOwner returns the user who owns the given skylink. We define the
+// owner as the user with the earliest upload of the skylink which is still
+// pinned. Anonymous uploads are not taken into account. Returns
+// ErrUserNotFound if no such user exists.
+func (db *DB) SkylinkOwner(ctx context.Context, skylink string) (*User, error) {
+	skylinkStr, err := normalizeSkylink(skylink)
+	if err != nil {
+		return nil, err
+	}
+	var sl Skylink
+	err = db.staticSkylinks.FindOne(ctx, bson.M{"skylink": skylinkStr}).Decode(&sl)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch skylink")
+	}
+	filter := bson.M{
+		"skylink_id": sl.ID,
+		"unpinned":   false,
+		"user_id":    bson.M{"$exists": true},
+	}
+	opts := options.FindOne().SetSort(bson.M{"timestamp": 1})
+	var up Upload
+	err = db.staticUploads.FindOne(ctx, filter, opts).Decode(&up)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch upload")
+	}
+	return db.UserByID(ctx, up.UserID)
+}
+
+// UserPinChurn returns the number of uploads the user has pinned and unpinned
+// since the given time. Uploads unpinned before we started recording the time
+// of unpinning are not counted as unpinned.
+func (db *DB) UserPinChurn(ctx context.Context, userID primitive.ObjectID, since time.Time) (pinned, unpinned int, err error) {
+	p, err := db.staticUploads.CountDocuments(ctx, bson.M{
+		"user_id":   userID,
+		"timestamp": bson.M{"$gt": since},
+	})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to count pins")
+	}
+	u, err := db.staticUploads.CountDocuments(ctx, bson.M{
+		"user_id":     userID,
+		"unpinned":    true,
+		"unpinned_at": bson.M{"$gt": since},
+	})
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to count unpins")
+	}
+	return int(p), int(u), nil
+}
+
+// UserUploadsToday returns the number of pinned uploads the user has made
+// since midnight in the given timezone. A nil timezone means UTC.
+func (db *DB) UserUploadsToday(ctx context.Context, userID primitive.ObjectID, tz *time.Location) (int, error) {
+	if tz == nil {
+		tz = time.UTC
+	}
+	now := time.Now().In(tz)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, tz)
+	filter := bson.M{
+		"user_id":   userID,
+		"unpinned":  false,
+		"timestamp": bson.M{"$gte": midnight.UTC()},
+	}
+	n, err := db.staticUploads.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to count uploads")
+	}
+	return int(n), nil
+}
+
+// UserUploadRateBreaches reports whether the user's uploads over the trailing
+// window exceed what their tier's upload bandwidth allows over that window,
+// i.e. whether the user has been uploading faster than their rate for the
+// entire window.
+func (db *DB) UserUploadRateBreaches(ctx context.Context, userID primitive.ObjectID, window time.Duration) (bool, error) {
+	if window <= 0 {
+		return false, errors.New("window must be positive")
+	}
+	u, err := db.UserByID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	limits, ok := UserLimits[u.Tier]
+	if !ok || u.QuotaExceeded {
+		limits = UserLimits[TierAnonymous]
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"timestamp", bson.D{{"$gt", time.Now().UTC().Add(-window)}}},
+	}}}
+	lookupStage := bson.D{{"$lookup", bson.D{
+		{"from", "skylinks"},
+		{"localField", "skylink_id"},
+		{"foreignField", "_id"},
+		{"as", "skylink_data"},
+	}}}
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", nil},
+		{"size", bson.D{{"$sum", bson.D{{"$sum", "$skylink_data.size"}}}}},
+	}}}
+	c, err := db.staticUploads.Aggregate(ctx, mongo.Pipeline{matchStage, lookupStage, groupStage})
+	if err != nil {
+		return false, errors.AddContext(err, "failed to sum uploaded bytes")
+	}
+	var result []struct {
+		Size int64 `bson:"size"`
+	}
+	err = c.All(ctx, &result)
+	if err != nil {
+		return false, errors.AddContext(err, "failed to decode DB data")
+	}
+	if len(result) == 0 {
+		return false, nil
+	}
+	allowed := int64(float64(limits.UploadBandwidth) * window.Seconds())
+	return result[0].Size > allowed, nil
+}
+
 // UploadsByUser fetches a page of uploads by this user and the total number of
 // such uploads.
 func (db *DB) UploadsByUser(ctx context.Context, user User, offset, pageSize int) ([]UploadResponse, int64, error) {
@@ -200,3 +357,58 @@ func validateOffsetPageSize(offset, pageSize int) error {
 	}
 	return errors.Compose(errs...)
 }
+
+// SkylinkUsage describes a skylink pinned by a user and the storage it takes.
+type SkylinkUsage struct {
+	Skylink        string    `bson:"skylink" json:"skylink"`
+	Size           int64     `bson:"size" json:"size"`
+	LastUploadedAt time.Time `bson:"last_uploaded_at" json:"lastUploadedAt"`
+}
+
+// UserStaleUploads lists the skylinks the user has pinned which haven't been
+// uploaded in the given amount of time and are at least minSize bytes large.
+// Each skylink is listed once and the largest skylinks come first. Unpinning
+// those is the easiest way for the user to free up storage.
+func (db *DB) UserStaleUploads(ctx context.Context, userID primitive.ObjectID, olderThan time.Duration, minSize int64) ([]SkylinkUsage, error) {
+	if userID.IsZero() {
+		return nil, errors.New("invalid user")
+	}
+	cutoff := time.Now().UTC().Add(-olderThan)
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.D{
+			{"user_id", userID},
+			{"unpinned", false},
+		}}},
+		// A skylink is only stale if none of its uploads are recent.
+		bson.D{{"$group", bson.D{
+			{"_id", "$skylink_id"},
+			{"last_uploaded_at", bson.D{{"$max", "$timestamp"}}},
+		}}},
+		bson.D{{"$match", bson.D{{"last_uploaded_at", bson.D{{"$lt", cutoff}}}}}},
+		bson.D{{"$lookup", bson.D{
+			{"from", "skylinks"},
+			{"localField", "_id"},
+			{"foreignField", "_id"},
+			{"as", "skylink_data"},
+		}}},
+		bson.D{{"$unwind", "$skylink_data"}},
+		bson.D{{"$project", bson.D{
+			{"_id", 0},
+			{"skylink", "$skylink_data.skylink"},
+			{"size", "$skylink_data.size"},
+			{"last_uploaded_at", 1},
+		}}},
+		bson.D{{"$match", bson.D{{"size", bson.D{{"$gte", minSize}}}}}},
+		bson.D{{"$sort", bson.D{{"size", -1}, {"skylink", 1}}}},
+	}
+	c, err := db.staticUploads.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch stale uploads")
+	}
+	usage := make([]SkylinkUsage, 0)
+	err = c.All(ctx, &usage)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	return usage, nil
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math"
 	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/hash"
@@ -31,18 +33,40 @@ const (
 	TierPremium20
 	// TierPremium80 80
 	TierPremium80
-	// TierMaxReserved is a guard value that helps us validate tier values.
+	// TierMaxReserved is a guard value which marks the end of the built-in
+	// tiers. Custom tiers registered via RegisterTier start here.
 	TierMaxReserved
 
 	// filesAllowedPerTiB defines a limit of number of uploaded files we impose
 	// on users. While we define it per TiB, we impose it based on their entire
-	// quota, so an Extreme user will be able to upload up to 400_000 files
+	// quota, so an Extreme user will be able to upload up to 500_000 files
 	// before being hit with a speed limit.
 	filesAllowedPerTiB = 25_000
 
 	// mbpsToBytesPerSecond is a multiplier to get from mebibits per second to
 	// bytes per second.
 	mbpsToBytesPerSecond = 1024 * 1024 / 8
+
+	// unlimitedFreeBandwidth is the free download allowance of tiers which
+	// are not billed for their downloads.
+	unlimitedFreeBandwidth = math.MaxInt64
+
+	// mongoDuplicateKeyErrorCode is the code of the error MongoDB reports
+	// when a write violates a unique index.
+	mongoDuplicateKeyErrorCode = 11000
+
+	// indexPubKeysUnique is the name of the unique index on users' pubkeys.
+	indexPubKeysUnique = "pub_keys_unique"
+)
+
+const (
+	// UploadAllowed means that the user is well within their limits.
+	UploadAllowed UploadPermission = iota
+	// UploadAllowedWithWarning means that the user is allowed to upload but
+	// is close to or slightly over their limits.
+	UploadAllowedWithWarning
+	// UploadDenied means that the user is over their limits.
+	UploadDenied
 )
 
 var (
@@ -50,61 +74,151 @@ var (
 	// user, e.g. when an upload is made by an anonymous user.
 	AnonUser = User{}
 	// UserLimits defines the speed limits for each tier.
-	// RegistryDelay delay is in ms.
+	// RegistryDelay delay is in ms. The monthly prices of the paid tiers are
+	// controlled by the ACCOUNTS_MONTHLY_PRICE_* environment variables.
 	UserLimits = map[int]TierLimits{
 		TierAnonymous: {
-			TierName:          "anonymous",
-			UploadBandwidth:   5 * mbpsToBytesPerSecond,
-			DownloadBandwidth: 5 * mbpsToBytesPerSecond,
-			MaxUploadSize:     1 * skynet.GiB,
-			MaxNumberUploads:  0,
-			RegistryDelay:     250,
-			Storage:           0,
+			TierName:              "anonymous",
+			UploadBandwidth:       5 * mbpsToBytesPerSecond,
+			DownloadBandwidth:     5 * mbpsToBytesPerSecond,
+			MaxUploadSize:         1 * skynet.GiB,
+			MaxNumberUploads:      0,
+			RegistryDelay:         250,
+			Storage:               0,
+			MaxConcurrentRequests: 2,
+			FreeDownloadBandwidth: unlimitedFreeBandwidth,
 		},
 		TierFree: {
-			TierName:          "free",
-			UploadBandwidth:   10000 * mbpsToBytesPerSecond,
-			DownloadBandwidth: 10000 * mbpsToBytesPerSecond,
-			MaxUploadSize:     100 * skynet.TiB,
-			MaxNumberUploads:  1000 * filesAllowedPerTiB,
-			RegistryDelay:     0,
-			Storage:           1000 * skynet.TiB,
+			TierName:              "free",
+			UploadBandwidth:       10000 * mbpsToBytesPerSecond,
+			DownloadBandwidth:     10000 * mbpsToBytesPerSecond,
+			MaxUploadSize:         100 * skynet.TiB,
+			MaxNumberUploads:      1000 * filesAllowedPerTiB,
+			RegistryDelay:         0,
+			Storage:               1000 * skynet.TiB,
+			MaxConcurrentRequests: 5,
+			FreeDownloadBandwidth: unlimitedFreeBandwidth,
 		},
 		TierPremium5: {
-			TierName:          "plus",
-			UploadBandwidth:   20 * mbpsToBytesPerSecond,
-			DownloadBandwidth: 80 * mbpsToBytesPerSecond,
-			MaxUploadSize:     1 * skynet.TiB,
-			MaxNumberUploads:  1 * filesAllowedPerTiB,
-			RegistryDelay:     0,
-			Storage:           1 * skynet.TiB,
+			TierName:              "plus",
+			UploadBandwidth:       20 * mbpsToBytesPerSecond,
+			DownloadBandwidth:     80 * mbpsToBytesPerSecond,
+			MaxUploadSize:         1 * skynet.TiB,
+			MaxNumberUploads:      1 * filesAllowedPerTiB,
+			RegistryDelay:         0,
+			Storage:               1 * skynet.TiB,
+			MaxConcurrentRequests: 10,
+			FreeDownloadBandwidth: unlimitedFreeBandwidth,
+			MonthlyPrice:          500,
 		},
 		TierPremium20: {
-			TierName:          "pro",
-			UploadBandwidth:   40 * mbpsToBytesPerSecond,
-			DownloadBandwidth: 160 * mbpsToBytesPerSecond,
-			MaxUploadSize:     4 * skynet.TiB,
-			MaxNumberUploads:  4 * filesAllowedPerTiB,
-			RegistryDelay:     0,
-			Storage:           4 * skynet.TiB,
+			TierName:              "pro",
+			UploadBandwidth:       40 * mbpsToBytesPerSecond,
+			DownloadBandwidth:     160 * mbpsToBytesPerSecond,
+			MaxUploadSize:         4 * skynet.TiB,
+			MaxNumberUploads:      4 * filesAllowedPerTiB,
+			RegistryDelay:         0,
+			Storage:               4 * skynet.TiB,
+			MaxConcurrentRequests: 20,
+			FreeDownloadBandwidth: unlimitedFreeBandwidth,
+			MonthlyPrice:          2000,
 		},
 		TierPremium80: {
-			TierName:          "extreme",
-			UploadBandwidth:   80 * mbpsToBytesPerSecond,
-			DownloadBandwidth: 320 * mbpsToBytesPerSecond,
-			MaxUploadSize:     10 * skynet.TiB,
-			MaxNumberUploads:  20 * filesAllowedPerTiB,
-			RegistryDelay:     0,
-			Storage:           20 * skynet.TiB,
+			TierName:              "extreme",
+			UploadBandwidth:       80 * mbpsToBytesPerSecond,
+			DownloadBandwidth:     320 * mbpsToBytesPerSecond,
+			MaxUploadSize:         10 * skynet.TiB,
+			MaxNumberUploads:      20 * filesAllowedPerTiB,
+			RegistryDelay:         0,
+			Storage:               20 * skynet.TiB,
+			MaxConcurrentRequests: 50,
+			FreeDownloadBandwidth: unlimitedFreeBandwidth,
+			MonthlyPrice:          8000,
 		},
 	}
 
+	// QuotaToleranceBytes is the number of bytes by which a user can exceed
+	// their storage limit before we flag them as having exceeded their quota.
+	// Its value is controlled by the ACCOUNTS_QUOTA_TOLERANCE_BYTES
+	// environment variable.
+	QuotaToleranceBytes int64 = 0
+	// QuotaTolerancePercent is the percentage of their storage limit by which
+	// a user can exceed it before we flag them as having exceeded their quota.
+	// If both QuotaToleranceBytes and QuotaTolerancePercent are set, we use the
+	// larger tolerance. Its value is controlled by the
+	// ACCOUNTS_QUOTA_TOLERANCE_PERCENT environment variable.
+	QuotaTolerancePercent float64 = 0
+	// UploadWarningThreshold is the fraction of the user's storage and file
+	// limits above which we still allow uploads but warn the user that they
+	// are approaching their hard limit. The hard limit is the tier's limit plus
+	// the quota tolerance. Its value is controlled by the
+	// ACCOUNTS_UPLOAD_WARNING_THRESHOLD environment variable.
+	UploadWarningThreshold = 1.0
+	// MaxFailedLoginAttempts is the number of consecutive failed logins after
+	// which we lock the user's account for LoginLockoutDuration. Zero disables
+	// the lockout. Its value is controlled by the ACCOUNTS_MAX_FAILED_LOGINS
+	// environment variable.
+	MaxFailedLoginAttempts = 0
+	// LoginLockoutDuration defines for how long we lock a user's account after
+	// too many failed logins. Its value is controlled by the
+	// ACCOUNTS_LOGIN_LOCKOUT_DURATION environment variable.
+	LoginLockoutDuration = 15 * time.Minute
+	// EmailConfirmationGracePeriod defines for how long after signing up users
+	// can use their account without having confirmed their email address. Its
+	// value is controlled by the ACCOUNTS_EMAIL_CONFIRMATION_GRACE_PERIOD
+	// environment variable.
+	EmailConfirmationGracePeriod = 7 * 24 * time.Hour
+	// RecoveryTokenCooldown defines how long users need to wait after
+	// requesting an account recovery token before they can request a new
+	// one. Its value is controlled by the ACCOUNTS_RECOVERY_TOKEN_COOLDOWN
+	// environment variable.
+	RecoveryTokenCooldown = time.Minute
+	// RecoveryTokenTTL defines the lifetime of an account recovery token. Its
+	// value is controlled by the ACCOUNTS_RECOVERY_TOKEN_TTL environment
+	// variable.
+	RecoveryTokenTTL = 24 * time.Hour
+
 	// ErrInvalidToken is returned when the token is found to be invalid for any
 	// reason, including expiration.
 	ErrInvalidToken = errors.New("invalid token")
+	// ErrPubKeyNotFound is returned when the user doesn't have the given
+	// pubkey.
+	ErrPubKeyNotFound = errors.New("pubkey not found")
+	// ErrPubKeyInUse is returned when we try to add a pubkey to a user while
+	// another user already has it.
+	ErrPubKeyInUse = errors.New("pubkey already belongs to another user")
+	// ErrEmailNotConfirmed is returned when the user needs to have confirmed
+	// their email address but hasn't.
+	ErrEmailNotConfirmed = errors.New("email address not confirmed")
+	// ErrEmailAlreadyConfirmed is returned when we try to issue a new email
+	// confirmation token for a user who has already confirmed their email.
+	ErrEmailAlreadyConfirmed = errors.New("email address already confirmed")
+	// ErrAccountLocked is returned when the user's account is temporarily
+	// locked because of too many failed logins.
+	ErrAccountLocked = errors.New("account temporarily locked because of too many failed logins")
+	// ErrAccountSuspended is returned when a suspended user tries to upload
+	// or download. Suspended users can still access their own data.
+	ErrAccountSuspended = errors.New("account suspended")
+	// ErrAccountReadOnly is returned when a user whose account became
+	// read-only after a downgrade tries to upload. See DowngradePolicy.
+	ErrAccountReadOnly = errors.New("account is read-only")
+	// ErrInvalidTier is returned when the given tier is neither a built-in
+	// tier nor a registered custom one.
+	ErrInvalidTier = errors.New("invalid tier value")
+	// ErrNegativeReferralCredits is returned when applying a referral credit
+	// would leave the user with a negative balance.
+	ErrNegativeReferralCredits = errors.New("referral credits cannot be negative")
+	// ErrNoPendingCancellation is returned when we try to revert the
+	// cancellation of a subscription which is not scheduled for cancellation.
+	ErrNoPendingCancellation = errors.New("subscription has no pending cancellation")
+	// ErrRecoveryTokenCooldown is returned when the user requests a new
+	// recovery token too soon after the previous one.
+	ErrRecoveryTokenCooldown = errors.New("a recovery token was issued recently, please try again later")
 )
 
 type (
+	// UploadPermission describes whether a user is allowed to upload files.
+	UploadPermission int
 	// User represents a Skynet user.
 	User struct {
 		// ID is auto-generated by Mongo on insert. We will usually use it in
@@ -115,6 +229,8 @@ type (
 		EmailConfirmationTokenExpiration time.Time          `bson:"email_confirmation_token_expiration,omitempty" json:"-"`
 		PasswordHash                     string             `bson:"password_hash" json:"-"`
 		RecoveryToken                    string             `bson:"recovery_token,omitempty" json:"-"`
+		RecoveryTokenCreatedAt           time.Time          `bson:"recovery_token_created_at,omitempty" json:"-"`
+		RecoveryTokenExpiration          time.Time          `bson:"recovery_token_expiration,omitempty" json:"-"`
 		Sub                              string             `bson:"sub" json:"sub"`
 		Tier                             int                `bson:"tier" json:"tier"`
 		CreatedAt                        time.Time          `bson:"created_at" json:"createdAt"`
@@ -125,33 +241,278 @@ type (
 		SubscriptionCancelAtPeriodEnd    bool               `bson:"subscription_cancel_at_period_end" json:"subscriptionCancelAtPeriodEnd"`
 		StripeID                         string             `bson:"stripe_id" json:"stripeCustomerId"`
 		QuotaExceeded                    bool               `bson:"quota_exceeded" json:"quotaExceeded"`
+		ExtraStorage                     int64              `bson:"extra_storage" json:"extraStorage"`
+		ReferralCredits                  int64              `bson:"referral_credits" json:"referralCredits"`
+		RegistryDelayOverride            *int               `bson:"registry_delay_override,omitempty" json:"-"`
+		LastNotifiedThreshold            float64            `bson:"last_notified_threshold" json:"-"`
+		FailedLoginAttempts              int                `bson:"failed_login_attempts" json:"-"`
+		LockedUntil                      time.Time          `bson:"locked_until,omitempty" json:"-"`
 		PubKeys                          []PubKey           `bson:"pub_keys" json:"-"`
+		AssociatedPubKeys                []PubKey           `bson:"associated_pub_keys,omitempty" json:"-"`
+		// Deleted marks deactivated users. They keep all their data but
+		// the UserBy* lookups don't return them, unless explicitly asked to.
+		Deleted   bool      `bson:"deleted,omitempty" json:"-"`
+		DeletedAt time.Time `bson:"deleted_at,omitempty" json:"-"`
+		// Suspended marks users who are temporarily not allowed to upload or
+		// download, e.g. because of abuse. Unlike deactivated users, they can
+		// still log in and access their data.
+		Suspended       bool   `bson:"suspended,omitempty" json:"-"`
+		SuspendedReason string `bson:"suspended_reason,omitempty" json:"-"`
+		// TokensValidAfter invalidates all JWTs issued to the user before
+		// it, e.g. after they change their password.
+		TokensValidAfter time.Time `bson:"tokens_valid_after,omitempty" json:"-"`
+		// ReadOnlyFrom is the moment the user's account becomes read-only
+		// because they downgraded below the content they own. See
+		// DowngradePolicy.
+		ReadOnlyFrom time.Time `bson:"read_only_from,omitempty" json:"-"`
+		// TierChanges is the history of the user's tier changes which were
+		// made by the system, e.g. because their subscription lapsed.
+		TierChanges []TierChange `bson:"tier_changes,omitempty" json:"-"`
+	}
+	// TierChange records a single change of a user's tier.
+	TierChange struct {
+		From   int       `bson:"from" json:"from"`
+		To     int       `bson:"to" json:"to"`
+		Reason string    `bson:"reason" json:"reason"`
+		At     time.Time `bson:"at" json:"at"`
+	}
+	// SubscriptionUpdate holds the subscription-related fields of a user, so
+	// they can be updated without touching the rest of the user's record.
+	SubscriptionUpdate struct {
+		Tier                          int
+		SubscribedUntil               time.Time
+		SubscriptionStatus            string
+		SubscriptionCancelAt          time.Time
+		SubscriptionCancelAtPeriodEnd bool
+	}
+	// Period is a billing period. It starts at Start (inclusive) and ends at
+	// End (exclusive).
+	Period struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
 	}
 	// TierLimits defines the speed limits imposed on the user based on their
 	// tier.
 	TierLimits struct {
-		TierName          string `json:"tierName"`
-		UploadBandwidth   int    `json:"upload"`        // bytes per second
-		DownloadBandwidth int    `json:"download"`      // bytes per second
-		MaxUploadSize     int64  `json:"maxUploadSize"` // the max size of a single upload in bytes
-		MaxNumberUploads  int    `json:"-"`
-		RegistryDelay     int    `json:"registry"` // ms delay
-		Storage           int64  `json:"-"`
+		TierName              string `json:"tierName"`
+		UploadBandwidth       int    `json:"upload"`        // bytes per second
+		DownloadBandwidth     int    `json:"download"`      // bytes per second
+		MaxUploadSize         int64  `json:"maxUploadSize"` // the max size of a single upload in bytes
+		MaxNumberUploads      int    `json:"-"`
+		RegistryDelay         int    `json:"registry"` // ms delay
+		Storage               int64  `json:"-"`
+		MaxConcurrentRequests int    `json:"maxConcurrentRequests"` // max requests in flight
+		MaxAPIKeys            int    `json:"-"`                     // 0 means MaxNumAPIKeysPerUser
+		FreeDownloadBandwidth int64  `json:"-"`                     // free download bytes per period
+		MonthlyPrice          int64  `json:"-"`                     // in cents, zero for free tiers
 	}
 )
 
-// UserByEmail returns the user with the given username.
+// RegisterTier registers a custom tier above the built-in ones with the given
+// limits. Custom tiers need to be registered in order, starting with
+// TierMaxReserved, and before the service starts handling requests.
+func RegisterTier(tier int, limits TierLimits) error {
+	if tier != len(UserLimits) {
+		return errors.AddContext(ErrInvalidTier, fmt.Sprintf("the next available tier is %d", len(UserLimits)))
+	}
+	UserLimits[tier] = limits
+	return nil
+}
+
+// ValidTier checks whether users can be assigned the given tier, i.e. whether
+// it's a built-in or registered tier other than the anonymous one.
+func ValidTier(t int) bool {
+	_, ok := UserLimits[t]
+	return ok && t > TierAnonymous
+}
+
+// TierByName returns the tier with the given name, e.g. "pro", together with
+// its limits. The name is matched case-insensitively. The returned bool is
+// false if there is no such tier.
+func TierByName(name string) (int, TierLimits, bool) {
+	name = strings.TrimSpace(name)
+	for tier, limits := range UserLimits {
+		if strings.EqualFold(limits.TierName, name) {
+			return tier, limits, true
+		}
+	}
+	return 0, TierLimits{}, false
+}
+
+// EffectiveStorageLimit returns the storage the user is allowed to use. That's
+// their tier's storage limit plus any extra storage they have bought or earned
+// through referrals.
+func (u User) EffectiveStorageLimit() int64 {
+	return UserLimits[u.Tier].Storage + u.ExtraStorage + u.ReferralCredits
+}
+
+// MaxAPIKeys returns the number of API keys the user is allowed to have. Tiers
+// which don't define their own limit use the global MaxNumAPIKeysPerUser.
+func (u User) MaxAPIKeys() int {
+	if t, ok := UserLimits[u.Tier]; ok && t.MaxAPIKeys > 0 {
+		return t.MaxAPIKeys
+	}
+	return MaxNumAPIKeysPerUser
+}
+
+// StorageQuotaTolerance returns the number of bytes by which a user can exceed
+// the given storage limit before we flag them as having exceeded their quota.
+func StorageQuotaTolerance(limit int64) int64 {
+	tolerance := QuotaToleranceBytes
+	if pct := int64(float64(limit) * QuotaTolerancePercent / 100); pct > tolerance {
+		tolerance = pct
+	}
+	return tolerance
+}
+
+// UserUploadPermission tells us whether a user with the given upload stats is
+// allowed to upload more files and, if they are not or are close to not being
+// allowed, why. It only considers the user's quota, so it can be used to
+// compute their QuotaExceeded flag. Use UserCanUpload for the full check.
+func UserUploadPermission(u *User, stats UserStatsUpload) (UploadPermission, string) {
+	limits := UserLimits[u.Tier]
+	storageLimit := u.EffectiveStorageLimit()
+	if stats.CountTotal > int64(limits.MaxNumberUploads) {
+		return UploadDenied, "maximum number of files exceeded"
+	}
+	if stats.SizeTotal > storageLimit+StorageQuotaTolerance(storageLimit) {
+		return UploadDenied, "storage limit exceeded"
+	}
+	if float64(stats.CountTotal) > float64(limits.MaxNumberUploads)*UploadWarningThreshold {
+		return UploadAllowedWithWarning, "approaching the maximum number of files"
+	}
+	if float64(stats.SizeTotal) > float64(storageLimit)*UploadWarningThreshold {
+		return UploadAllowedWithWarning, "approaching the storage limit"
+	}
+	return UploadAllowed, ""
+}
+
+// UserCanUpload tells us whether the user is allowed to upload more files
+// based on their current usage. It returns ErrAccountSuspended if the user is
+// suspended and ErrAccountReadOnly if their account is read-only.
+func (db *DB) UserCanUpload(ctx context.Context, u *User) (UploadPermission, string, error) {
+	if u.Suspended {
+		return UploadDenied, ErrAccountSuspended.Error(), ErrAccountSuspended
+	}
+	if u.IsReadOnly(time.Now().UTC()) {
+		return UploadDenied, ErrAccountReadOnly.Error(), ErrAccountReadOnly
+	}
+	stats, err := db.UserStatsUpload(ctx, u.ID, time.Now().UTC())
+	if err != nil {
+		return UploadDenied, "", errors.AddContext(err, "failed to fetch upload stats")
+	}
+	p, reason := UserUploadPermission(u, stats)
+	return p, reason, nil
+}
+
+// UserFileCountStatus returns the number of files the user has pinned, the
+// number of files their tier allows and whether they are over that limit and
+// therefore speed-limited.
+func (db *DB) UserFileCountStatus(ctx context.Context, u User) (used, limit int, throttled bool, err error) {
+	stats, err := db.UserStatsUpload(ctx, u.ID, time.Now().UTC())
+	if err != nil {
+		return 0, 0, false, errors.AddContext(err, "failed to fetch upload stats")
+	}
+	used, limit, throttled = fileCountStatus(u, stats.CountTotal)
+	return used, limit, throttled, nil
+}
+
+// fileCountStatus compares the given number of pinned files against the file
+// limit of the user's tier. Unknown tiers get the anonymous tier's limit.
+func fileCountStatus(u User, count int64) (used, limit int, throttled bool) {
+	limits, ok := UserLimits[u.Tier]
+	if !ok {
+		limits = UserLimits[TierAnonymous]
+	}
+	return int(count), limits.MaxNumberUploads, count > int64(limits.MaxNumberUploads)
+}
+
+// UserCanDownload returns ErrAccountSuspended if the user is suspended and
+// therefore not allowed to download.
+func UserCanDownload(u *User) error {
+	if u != nil && u.Suspended {
+		return ErrAccountSuspended
+	}
+	return nil
+}
+
+// IsRestricted returns true if the user should get the anonymous tier's
+// limits, either because they exceeded their quota or because their account
+// is suspended or read-only.
+func (u User) IsRestricted() bool {
+	return u.QuotaExceeded || u.Suspended || u.IsReadOnly(time.Now().UTC())
+}
+
+// UserConcurrencyLimit returns the maximum number of concurrent requests the
+// given user is allowed to have in flight. Restricted users, as well as
+// anonymous users, get the anonymous tier's limit.
+func (db *DB) UserConcurrencyLimit(u *User) int {
+	if u == nil || u.IsRestricted() {
+		return UserLimits[TierAnonymous].MaxConcurrentRequests
+	}
+	t, ok := UserLimits[u.Tier]
+	if !ok {
+		return UserLimits[TierAnonymous].MaxConcurrentRequests
+	}
+	return t.MaxConcurrentRequests
+}
+
+// UserRegistryDelay returns the registry delay in ms that applies to the given
+// user. A user's custom registry delay takes precedence over their tier's
+// delay. Restricted users, as well as anonymous users, get the anonymous
+// tier's delay.
+func (db *DB) UserRegistryDelay(u *User) int {
+	if u == nil || u.IsRestricted() {
+		return UserLimits[TierAnonymous].RegistryDelay
+	}
+	if u.RegistryDelayOverride != nil {
+		return *u.RegistryDelayOverride
+	}
+	t, ok := UserLimits[u.Tier]
+	if !ok {
+		return UserLimits[TierAnonymous].RegistryDelay
+	}
+	return t.RegistryDelay
+}
+
+// UserByEmail returns the user with the given username. Emails stored before
+// we started normalizing them might differ from their normalized form in case,
+// so if there is no exact match we fall back to a case-insensitive one.
 func (db *DB) UserByEmail(ctx context.Context, email types.Email) (*User, error) {
-	users, err := db.managedUsersByField(ctx, "email", email.String())
+	normalized := lib.NormalizeEmail(email.String())
+	// This returns ErrUserNotFound when there are no matches.
+	users, err := db.managedUsersByField(ctx, "email", normalized, false)
+	if errors.Contains(err, ErrUserNotFound) && normalized != "" {
+		// The collation makes the match case-insensitive. Such queries can't
+		// use the email index, so we only run them when the exact match fails.
+		opts := options.Find().SetCollation(&options.Collation{Locale: "en", Strength: 2})
+		users, err = db.managedUsersByFilter(ctx, userFilter(bson.M{"email": normalized}, false), opts)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if len(users) > 1 {
+		db.staticLogger.Errorf("More than one user found for email '%s', %d in total.", email.String(), len(users))
+		return nil, ErrMultipleUsersFound
+	}
 	return users[0], nil
 }
 
 // UserByID finds a user by their ID.
 func (db *DB) UserByID(ctx context.Context, id primitive.ObjectID) (*User, error) {
-	c, err := db.staticUsers.Find(ctx, bson.M{"_id": id})
+	return db.managedUserByID(ctx, id, false)
+}
+
+// UserByIDIncludingDeactivated finds a user by their ID, even if they are
+// deactivated. It's meant for administrative use.
+func (db *DB) UserByIDIncludingDeactivated(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	return db.managedUserByID(ctx, id, true)
+}
+
+// managedUserByID finds a user by their ID, optionally including deactivated
+// users.
+func (db *DB) managedUserByID(ctx context.Context, id primitive.ObjectID, includeDeactivated bool) (*User, error) {
+	c, err := db.staticUsers.Find(ctx, userFilter(bson.M{"_id": id}, includeDeactivated))
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to Find")
 	}
@@ -176,9 +537,115 @@ func (db *DB) UserByID(ctx context.Context, id primitive.ObjectID) (*User, error
 	return &u, nil
 }
 
+// UserByIDConfirmed finds a user by their ID and makes sure that they have
+// confirmed their email address.
+func (db *DB) UserByIDConfirmed(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	u, err := db.UserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsEmailConfirmed() {
+		return nil, ErrEmailNotConfirmed
+	}
+	return u, nil
+}
+
+// UserEmailConfirmationFunnel counts the users who have confirmed their email
+// address, the ones who have a pending confirmation and the ones who don't
+// have an email address at all.
+func (db *DB) UserEmailConfirmationFunnel(ctx context.Context) (confirmed, pending, noEmail int64, err error) {
+	groupStage := bson.D{{"$group", bson.D{
+		{"_id", bson.D{{"$switch", bson.D{
+			{"branches", bson.A{
+				bson.D{
+					{"case", bson.D{{"$eq", bson.A{bson.D{{"$ifNull", bson.A{"$email", ""}}}, ""}}}},
+					{"then", "no_email"},
+				},
+				bson.D{
+					{"case", bson.D{{"$eq", bson.A{bson.D{{"$ifNull", bson.A{"$email_confirmation_token", ""}}}, ""}}}},
+					{"then", "confirmed"},
+				},
+			}},
+			{"default", "pending"},
+		}}}},
+		{"count", bson.D{{"$sum", 1}}},
+	}}}
+	c, err := db.staticUsers.Aggregate(ctx, mongo.Pipeline{groupStage})
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to group users by confirmation state")
+	}
+	var groups []struct {
+		State string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	err = c.All(ctx, &groups)
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	for _, g := range groups {
+		switch g.State {
+		case "confirmed":
+			confirmed = g.Count
+		case "pending":
+			pending = g.Count
+		case "no_email":
+			noEmail = g.Count
+		}
+	}
+	return confirmed, pending, noEmail, nil
+}
+
+// FindSharedPubKeys finds pubkeys which are attached to more than one user and
+// returns the IDs of the users sharing each such pubkey. A pubkey should only
+// ever belong to a single user, so any result points to a bug or to abuse.
+func (db *DB) FindSharedPubKeys(ctx context.Context) ([][]primitive.ObjectID, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{"$unwind", "$pub_keys"}},
+		bson.D{{"$group", bson.D{
+			{"_id", "$pub_keys"},
+			{"users", bson.D{{"$addToSet", "$_id"}}},
+		}}},
+		bson.D{{"$match", bson.D{{"users.1", bson.D{{"$exists", true}}}}}},
+	}
+	c, err := db.staticUsers.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate pubkeys")
+	}
+	var result []struct {
+		Users []primitive.ObjectID `bson:"users"`
+	}
+	err = c.All(ctx, &result)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	clusters := make([][]primitive.ObjectID, 0, len(result))
+	for _, r := range result {
+		clusters = append(clusters, r.Users)
+	}
+	return clusters, nil
+}
+
+// UserByAnyPubKey returns the user who has the given pubkey, either as one of
+// their current pubkeys or as a pubkey they have removed in the past.
+func (db *DB) UserByAnyPubKey(ctx context.Context, pk PubKey) (*User, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"pub_keys": pk},
+		bson.M{"associated_pub_keys": pk},
+	}}
+	var u User
+	err := db.staticUsers.FindOne(ctx, userFilter(filter, false)).Decode(&u)
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch user")
+	}
+	return &u, nil
+}
+
 // UserByPubKey returns the user with the given pubkey.
 func (db *DB) UserByPubKey(ctx context.Context, pk PubKey) (*User, error) {
-	sr := db.staticUsers.FindOne(ctx, bson.M{"pub_keys": pk})
+	sr := db.staticUsers.FindOne(ctx, userFilter(bson.M{"pub_keys": pk}, false))
 	var u User
 	err := sr.Decode(&u)
 	if err != nil {
@@ -187,18 +654,31 @@ func (db *DB) UserByPubKey(ctx context.Context, pk PubKey) (*User, error) {
 	return &u, nil
 }
 
-// UserByRecoveryToken returns the user with the given recovery token.
+// UserByRecoveryToken returns the user with the given recovery token. It
+// returns ErrInvalidToken if the token is empty or expired.
 func (db *DB) UserByRecoveryToken(ctx context.Context, token string) (*User, error) {
-	users, err := db.managedUsersByField(ctx, "recovery_token", token)
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	// This returns ErrUserNotFound when there are no matches.
+	users, err := db.managedUsersByField(ctx, "recovery_token", token, false)
 	if err != nil {
 		return nil, err
 	}
+	if len(users) > 1 {
+		// We don't log the token because it's a secret.
+		db.staticLogger.Errorf("More than one user found for a recovery token, %d in total.", len(users))
+		return nil, ErrMultipleUsersFound
+	}
+	if time.Now().UTC().After(users[0].RecoveryTokenExpiration) {
+		return nil, errors.AddContext(ErrInvalidToken, "token expired")
+	}
 	return users[0], nil
 }
 
 // UserByStripeID finds a user by their Stripe customer id.
 func (db *DB) UserByStripeID(ctx context.Context, id string) (*User, error) {
-	c, err := db.staticUsers.Find(ctx, bson.M{"stripe_id": id})
+	c, err := db.staticUsers.Find(ctx, userFilter(bson.M{"stripe_id": id}, false))
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to Find")
 	}
@@ -225,7 +705,13 @@ func (db *DB) UserByStripeID(ctx context.Context, id string) (*User, error) {
 
 // UserBySub returns the user with the given sub.
 func (db *DB) UserBySub(ctx context.Context, sub string) (*User, error) {
-	return db.managedUserBySub(ctx, sub)
+	return db.managedUserBySub(ctx, sub, false)
+}
+
+// UserBySubIncludingDeactivated returns the user with the given sub, even if
+// they are deactivated. It's meant for administrative use.
+func (db *DB) UserBySubIncludingDeactivated(ctx context.Context, sub string) (*User, error) {
+	return db.managedUserBySub(ctx, sub, true)
 }
 
 // UserConfirmEmail confirms that the email to which the passed confirmation
@@ -234,7 +720,7 @@ func (db *DB) UserConfirmEmail(ctx context.Context, token string) (*User, error)
 	if token == "" {
 		return nil, errors.AddContext(ErrInvalidToken, "token cannot be empty")
 	}
-	users, err := db.managedUsersByField(ctx, "email_confirmation_token", token)
+	users, err := db.managedUsersByField(ctx, "email_confirmation_token", token, false)
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to read users from DB")
 	}
@@ -271,22 +757,25 @@ func (db *DB) UserCreate(ctx context.Context, emailAddr types.Email, pass, sub s
 		if err != nil {
 			return nil, errors.AddContext(err, "invalid email address")
 		}
-		emailAddr = types.NewEmail(addr.Address)
+		emailAddr = types.NewEmail(lib.NormalizeEmail(addr.Address))
 	}
 	if sub == "" {
 		return nil, errors.New("empty sub is not allowed")
 	}
 
-	// Check for an existing user with this email.
-	_, err := db.UserByEmail(ctx, emailAddr)
-	if err != nil && !errors.Contains(err, ErrUserNotFound) {
-		return nil, errors.AddContext(err, "failed to query DB")
-	}
-	if !errors.Contains(err, ErrUserNotFound) {
-		return nil, ErrUserAlreadyExists
+	// Check for an existing user with this email, including deactivated
+	// ones. Any number of users can be without an email.
+	if emailAddr != "" {
+		users, err := db.managedUsersByField(ctx, "email", emailAddr.String(), true)
+		if err != nil && !errors.Contains(err, ErrUserNotFound) {
+			return nil, errors.AddContext(err, "failed to query DB")
+		}
+		if len(users) > 0 {
+			return nil, ErrUserAlreadyExists
+		}
 	}
 	// Check for an existing user with this sub.
-	_, err = db.managedUserBySub(ctx, sub)
+	_, err := db.managedUserBySub(ctx, sub, true)
 	if err != nil && !errors.Contains(err, ErrUserNotFound) {
 		return nil, errors.AddContext(err, "failed to query DB")
 	}
@@ -310,7 +799,7 @@ func (db *DB) UserCreate(ctx context.Context, emailAddr types.Email, pass, sub s
 		ID:                               primitive.ObjectID{},
 		Email:                            emailAddr,
 		EmailConfirmationToken:           emailConfToken,
-		EmailConfirmationTokenExpiration: time.Now().UTC().Add(EmailConfirmationTokenTTL).Truncate(time.Millisecond),
+		EmailConfirmationTokenExpiration: time.Now().UTC().Add(db.staticEmailConfirmationTokenTTL).Truncate(time.Millisecond),
 		PasswordHash:                     string(passHash),
 		RecoveryToken:                    "",
 		Sub:                              sub,
@@ -342,7 +831,7 @@ func (db *DB) UserCreate(ctx context.Context, emailAddr types.Email, pass, sub s
 // UserCreateEmailConfirmation creates a new email confirmation record for this
 // user.
 func (db *DB) UserCreateEmailConfirmation(ctx context.Context, uID primitive.ObjectID) (string, error) {
-	exp := time.Now().UTC().Add(EmailConfirmationTokenTTL).Truncate(time.Millisecond)
+	exp := time.Now().UTC().Add(db.staticEmailConfirmationTokenTTL).Truncate(time.Millisecond)
 	tk, err := lib.GenerateUUID()
 	if err != nil {
 		return "", err
@@ -361,6 +850,77 @@ func (db *DB) UserCreateEmailConfirmation(ctx context.Context, uID primitive.Obj
 	return tk, nil
 }
 
+// UserRegenerateEmailConfirmationToken issues a new email confirmation token
+// for a user who hasn't confirmed their email yet, e.g. because the previous
+// token expired or its email got lost. It returns the new token.
+func (db *DB) UserRegenerateEmailConfirmationToken(ctx context.Context, u *User) (string, error) {
+	if u.IsEmailConfirmed() {
+		return "", ErrEmailAlreadyConfirmed
+	}
+	tk, err := lib.GenerateUUID()
+	if err != nil {
+		return "", errors.AddContext(err, "failed to generate an email confirmation token")
+	}
+	exp := time.Now().UTC().Add(db.staticEmailConfirmationTokenTTL).Truncate(time.Millisecond)
+	// Make sure the user didn't confirm their email in the meantime.
+	filter := bson.M{
+		"_id":                      u.ID,
+		"email_confirmation_token": bson.M{"$ne": ""},
+	}
+	update := bson.M{"$set": bson.M{
+		"email_confirmation_token":            tk,
+		"email_confirmation_token_expiration": exp,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return "", errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return "", ErrEmailAlreadyConfirmed
+	}
+	u.EmailConfirmationToken = tk
+	u.EmailConfirmationTokenExpiration = exp
+	return tk, nil
+}
+
+// UserGenerateRecoveryToken issues a new account recovery token for the user,
+// replacing any previous one, and returns it. It returns
+// ErrRecoveryTokenCooldown if the previous token was issued less than
+// RecoveryTokenCooldown ago.
+func (db *DB) UserGenerateRecoveryToken(ctx context.Context, u *User) (string, error) {
+	tk, err := lib.GenerateUUID()
+	if err != nil {
+		return "", errors.AddContext(err, "failed to generate a recovery token")
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	// Only update the user if they haven't received a token recently. Doing
+	// the check in the filter protects us from concurrent requests.
+	filter := bson.M{
+		"_id": u.ID,
+		"$or": bson.A{
+			bson.M{"recovery_token_created_at": bson.M{"$exists": false}},
+			bson.M{"recovery_token_created_at": bson.M{"$lte": now.Add(-RecoveryTokenCooldown)}},
+		},
+	}
+	exp := now.Add(RecoveryTokenTTL)
+	update := bson.M{"$set": bson.M{
+		"recovery_token":            tk,
+		"recovery_token_created_at": now,
+		"recovery_token_expiration": exp,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return "", errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return "", ErrRecoveryTokenCooldown
+	}
+	u.RecoveryToken = tk
+	u.RecoveryTokenCreatedAt = now
+	u.RecoveryTokenExpiration = exp
+	return tk, nil
+}
+
 // UserCreatePK creates a new user with a pubkey in the DB.
 //
 // The `pass` and `sub` fields are optional.
@@ -373,8 +933,9 @@ func (db *DB) UserCreatePK(ctx context.Context, emailAddr types.Email, pass, sub
 	if err != nil || parsed.Address != emailAddr.String() {
 		return nil, errors.AddContext(err, "invalid email address")
 	}
+	emailAddr = types.NewEmail(lib.NormalizeEmail(parsed.Address))
 	// Check for an existing user with this email.
-	users, err := db.managedUsersByField(ctx, "email", emailAddr.String())
+	users, err := db.managedUsersByField(ctx, "email", emailAddr.String(), true)
 	if err != nil && !errors.Contains(err, ErrUserNotFound) {
 		return nil, errors.AddContext(err, "failed to query DB")
 	}
@@ -388,7 +949,7 @@ func (db *DB) UserCreatePK(ctx context.Context, emailAddr types.Email, pass, sub
 		}
 	}
 	// Check for an existing user with this sub.
-	_, err = db.managedUserBySub(ctx, sub)
+	_, err = db.managedUserBySub(ctx, sub, true)
 	if err != nil && !errors.Contains(err, ErrUserNotFound) {
 		return nil, errors.AddContext(err, "failed to query DB")
 	}
@@ -412,7 +973,7 @@ func (db *DB) UserCreatePK(ctx context.Context, emailAddr types.Email, pass, sub
 		ID:                               primitive.ObjectID{},
 		Email:                            emailAddr,
 		EmailConfirmationToken:           emailConfToken,
-		EmailConfirmationTokenExpiration: time.Now().UTC().Add(EmailConfirmationTokenTTL).Truncate(time.Millisecond),
+		EmailConfirmationTokenExpiration: time.Now().UTC().Add(db.staticEmailConfirmationTokenTTL).Truncate(time.Millisecond),
 		PasswordHash:                     string(passHash),
 		RecoveryToken:                    "",
 		Sub:                              sub,
@@ -440,6 +1001,106 @@ func (db *DB) UserCreatePK(ctx context.Context, emailAddr types.Email, pass, sub
 	return u, nil
 }
 
+// UsersCreateBatch inserts the given users in bulk. It's meant for importing
+// users from other systems, so the records are inserted as given, apart from
+// normalising their emails and setting their creation time, if missing. All
+// users need a sub and a valid or empty email, otherwise none are inserted.
+//
+// The returned slice matches the given one. Users who were skipped because
+// another user, either in the DB or earlier in the batch, already has their
+// email or sub are nil.
+func (db *DB) UsersCreateBatch(ctx context.Context, users []*User) ([]*User, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	emails, subs := bson.A{}, bson.A{}
+	for i, u := range users {
+		if u.Sub == "" {
+			return nil, fmt.Errorf("user %d: empty sub is not allowed", i)
+		}
+		if u.Email != "" {
+			addr, err := mail.ParseAddress(u.Email.String())
+			if err != nil {
+				return nil, errors.AddContext(err, fmt.Sprintf("user %d: invalid email address", i))
+			}
+			u.Email = types.NewEmail(lib.NormalizeEmail(addr.Address))
+			emails = append(emails, u.Email.String())
+		}
+		subs = append(subs, u.Sub)
+	}
+	// Find the emails and subs which are already taken with a single query.
+	filter := bson.M{"$or": bson.A{
+		bson.M{"email": bson.M{"$in": emails}},
+		bson.M{"sub": bson.M{"$in": subs}},
+	}}
+	opts := options.Find().SetProjection(bson.M{"email": 1, "sub": 1})
+	c, err := db.staticUsers.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch existing users")
+	}
+	var existing []User
+	err = c.All(ctx, &existing)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	takenEmails := make(map[types.Email]bool)
+	takenSubs := make(map[string]bool)
+	for _, u := range existing {
+		if u.Email != "" {
+			takenEmails[u.Email] = true
+		}
+		takenSubs[u.Sub] = true
+	}
+	// Collect the users we can insert.
+	created := make([]*User, len(users))
+	var docs []interface{}
+	var docIdx []int
+	for i, u := range users {
+		if takenSubs[u.Sub] || (u.Email != "" && takenEmails[u.Email]) {
+			continue
+		}
+		takenSubs[u.Sub] = true
+		if u.Email != "" {
+			takenEmails[u.Email] = true
+		}
+		if u.ID.IsZero() {
+			u.ID = primitive.NewObjectID()
+		}
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = now
+		}
+		if u.PubKeys == nil {
+			u.PubKeys = make([]PubKey, 0)
+		}
+		docs = append(docs, u)
+		docIdx = append(docIdx, i)
+		created[i] = u
+	}
+	if len(docs) == 0 {
+		return created, nil
+	}
+	// Insert them. Someone might have registered one of these users since we
+	// checked, so we don't stop on errors and we skip the users which violate
+	// a unique index.
+	_, err = db.staticUsers.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if bwe, ok := err.(mongo.BulkWriteException); ok {
+		var errs []error
+		for _, we := range bwe.WriteErrors {
+			if we.Code == mongoDuplicateKeyErrorCode {
+				created[docIdx[we.Index]] = nil
+				continue
+			}
+			errs = append(errs, we)
+		}
+		err = errors.Compose(errs...)
+		if bwe.WriteConcernError != nil {
+			err = errors.Compose(err, bwe.WriteConcernError)
+		}
+	}
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to insert users")
+	}
+	return created, nil
+}
+
 // UserDelete deletes a user by their ID.
 func (db *DB) UserDelete(ctx context.Context, u *User) error {
 	if u.ID.IsZero() {
@@ -483,58 +1144,587 @@ func (db *DB) UserDelete(ctx context.Context, u *User) error {
 	return nil
 }
 
+// UserDeactivate deactivates the user's account. Their data is kept, so the
+// account can be reactivated later, but the UserBy* lookups no longer return
+// them.
+func (db *DB) UserDeactivate(ctx context.Context, u *User) error {
+	deletedAt := time.Now().UTC().Truncate(time.Millisecond)
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{
+		"deleted":    true,
+		"deleted_at": deletedAt,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.Deleted = true
+	u.DeletedAt = deletedAt
+	return nil
+}
+
+// UserReactivate reactivates a previously deactivated account.
+func (db *DB) UserReactivate(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{
+		"$set":   bson.M{"deleted": false},
+		"$unset": bson.M{"deleted_at": ""},
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.Deleted = false
+	u.DeletedAt = time.Time{}
+	return nil
+}
+
+// UserSuspend suspends the user's account for the given reason. Suspended
+// users keep access to their data but can't upload or download.
+func (db *DB) UserSuspend(ctx context.Context, u *User, reason string) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{
+		"suspended":        true,
+		"suspended_reason": reason,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.Suspended = true
+	u.SuspendedReason = reason
+	return nil
+}
+
+// UserUnsuspend lifts the suspension of the user's account.
+func (db *DB) UserUnsuspend(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{
+		"suspended":        "",
+		"suspended_reason": "",
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.Suspended = false
+	u.SuspendedReason = ""
+	return nil
+}
+
 // UserSave saves the user to the DB.
 func (db *DB) UserSave(ctx context.Context, u *User) error {
 	if db.staticDeps.Disrupt("DependencyMongoWriteConflictN") {
 		return errors.New(dependencies.DependencyMongoWriteConflictNMessage)
 	}
+	// Make sure we never store an email in a form in which we can't find it.
+	u.Email = types.NewEmail(lib.NormalizeEmail(u.Email.String()))
 	filter := bson.M{"_id": u.ID}
 	opts := options.Replace().SetUpsert(true)
 	_, err := db.staticUsers.ReplaceOne(ctx, filter, u, opts)
+	// A duplicate key error means that we violated one of the unique indexes,
+	// e.g. another user already has this email or sub. A clash on the pubkeys
+	// index is not about the user's identity, so we report it separately.
+	if isDuplicateKeyOn(err, indexPubKeysUnique) {
+		return ErrPubKeyInUse
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUserAlreadyExists
+	}
 	if err != nil {
 		return errors.AddContext(err, "failed to update")
 	}
 	return nil
 }
 
-// UserPubKeyAdd adds a new PubKey to the given user's set.
-func (db *DB) UserPubKeyAdd(ctx context.Context, u User, pk PubKey) (err error) {
+// UserPubKeyAdd adds a new PubKey to the given user's set. See UserAddPubKey.
+func (db *DB) UserPubKeyAdd(ctx context.Context, u User, pk PubKey) error {
+	return db.UserAddPubKey(ctx, &u, pk)
+}
+
+// UserAddPubKey adds a new PubKey to the end of the given user's set, both in
+// the DB and in the given struct. It returns ErrPubKeyInUse if another user,
+// including a deactivated one, has the pubkey, either currently or among their
+// associated pubkeys. Re-adding a pubkey the user removed in the past removes
+// it from their associated pubkeys.
+func (db *DB) UserAddPubKey(ctx context.Context, u *User, pk PubKey) error {
+	// Current pubkeys are guarded by the pub_keys_unique index, which also
+	// covers concurrent additions. Associated pubkeys are not indexed, so we
+	// check them separately.
+	inUse := bson.M{
+		"_id":                 bson.M{"$ne": u.ID},
+		"associated_pub_keys": pk,
+	}
+	n, err := db.staticUsers.CountDocuments(ctx, inUse, options.Count().SetLimit(1))
+	if err != nil {
+		return errors.AddContext(err, "failed to check whether the pubkey is in use")
+	}
+	if n > 0 {
+		return ErrPubKeyInUse
+	}
 	filter := bson.M{"_id": u.ID}
 	// This update is so complicated because we can't use mutation operations
 	// like $push, $addToSet and so on if the target field is null. That's why
-	// here we check if the field is an array and then merge the key in. If the
-	// field is not an array (i.e. it's null) we set it to an empty array before
-	// performing the merge.
+	// here we treat a null field as an empty array and append the key unless
+	// it's already there. Unlike $setUnion this keeps the order of the keys,
+	// so the active (first) key stays in place. The same goes for removing the
+	// key from the associated pubkeys.
+	pubKeys := bson.M{"$ifNull": bson.A{"$pub_keys", bson.A{}}}
 	update := bson.A{
 		bson.M{
 			"$set": bson.M{
 				"pub_keys": bson.M{
 					"$cond": bson.A{
-						bson.M{"$eq": bson.A{bson.M{"$type": "$pub_keys"}, "array"}},
-						bson.M{"$setUnion": bson.A{"$pub_keys", bson.A{pk}}},
-						bson.A{pk},
+						bson.M{"$in": bson.A{pk, pubKeys}},
+						pubKeys,
+						bson.M{"$concatArrays": bson.A{pubKeys, bson.A{pk}}},
+					}},
+				"associated_pub_keys": bson.M{
+					"$filter": bson.M{
+						"input": bson.M{"$ifNull": bson.A{"$associated_pub_keys", bson.A{}}},
+						"cond":  bson.M{"$ne": bson.A{"$$this", pk}},
 					}},
 			},
 		},
 	}
-	_, err = db.staticUsers.UpdateOne(ctx, filter, update)
-	return err
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrPubKeyInUse
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	if !u.HasKey(pk) {
+		u.PubKeys = append(u.PubKeys, pk)
+	}
+	u.AssociatedPubKeys = withoutPubKey(u.AssociatedPubKeys, pk)
+	return nil
 }
 
-// UserPubKeyRemove removes a PubKey from the given user's set.
+// UserPubKeyRemove removes a PubKey from the given user's set. It returns
+// mongo.ErrNoDocuments if the user doesn't have the pubkey. See
+// UserRemovePubKey.
 func (db *DB) UserPubKeyRemove(ctx context.Context, u User, pk PubKey) error {
+	err := db.UserRemovePubKey(ctx, &u, pk)
+	if errors.Contains(err, ErrPubKeyNotFound) {
+		return mongo.ErrNoDocuments
+	}
+	return err
+}
+
+// UserRemovePubKey removes a PubKey from the given user's set, both in the DB
+// and in the given struct. The removed PubKey is remembered among the user's
+// associated pubkeys. It returns ErrPubKeyNotFound if the user doesn't have
+// the pubkey.
+func (db *DB) UserRemovePubKey(ctx context.Context, u *User, pk PubKey) error {
 	filter := bson.M{
 		"_id":      u.ID,
-		"pub_keys": bson.M{"$ne": nil},
+		"pub_keys": pk,
 	}
 	update := bson.M{
-		"$pull": bson.M{"pub_keys": pk},
+		"$pull":     bson.M{"pub_keys": pk},
+		"$addToSet": bson.M{"associated_pub_keys": pk},
 	}
 	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
-	if err == nil && ur.ModifiedCount == 0 {
-		err = mongo.ErrNoDocuments
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
 	}
-	return err
+	if ur.ModifiedCount == 0 {
+		return ErrPubKeyNotFound
+	}
+	u.PubKeys = withoutPubKey(u.PubKeys, pk)
+	if !containsPubKey(u.AssociatedPubKeys, pk) {
+		u.AssociatedPubKeys = append(u.AssociatedPubKeys, pk)
+	}
+	return nil
+}
+
+// UserPromotePubKey makes the given pubkey the user's active one. See
+// UserSetActivePubKey.
+func (db *DB) UserPromotePubKey(ctx context.Context, u *User, pk PubKey) error {
+	return db.UserSetActivePubKey(ctx, u, pk)
+}
+
+// UserSetActivePubKey makes the given pubkey the user's active one by moving
+// it to the front of their set of pubkeys. The reordering happens in a single
+// update, so concurrent changes to the set are not lost.
+func (db *DB) UserSetActivePubKey(ctx context.Context, u *User, pk PubKey) error {
+	err := db.setFirstPubKey(ctx, u.ID, pk)
+	if err != nil {
+		return err
+	}
+	u.PubKeys = append([]PubKey{pk}, withoutPubKey(u.PubKeys, pk)...)
+	return nil
+}
+
+// RepairPubKeyOrdering makes sure that the given pubkey, which external
+// systems consider to be the user's active one, is the first one in the
+// user's set of pubkeys.
+func (db *DB) RepairPubKeyOrdering(ctx context.Context, userID primitive.ObjectID, active PubKey) error {
+	return db.setFirstPubKey(ctx, userID, active)
+}
+
+// FindUsersWithOrphanedActiveKey finds users whose active (first) pubkey is
+// one they have removed in the past. This happens when a save based on stale
+// user data restores a removed pubkey. Such users need their active pubkey
+// fixed with RepairPubKeyOrdering.
+func (db *DB) FindUsersWithOrphanedActiveKey(ctx context.Context) ([]primitive.ObjectID, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.D{
+			{"pub_keys.0", bson.D{{"$exists", true}}},
+			{"associated_pub_keys.0", bson.D{{"$exists", true}}},
+		}}},
+		bson.D{{"$match", bson.D{{"$expr", bson.D{{"$in", bson.A{
+			bson.D{{"$arrayElemAt", bson.A{"$pub_keys", 0}}},
+			"$associated_pub_keys",
+		}}}}}}},
+		bson.D{{"$project", bson.D{{"_id", 1}}}},
+	}
+	c, err := db.staticUsers.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to aggregate users")
+	}
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = c.All(ctx, &users)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	ids := make([]primitive.ObjectID, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	return ids, nil
+}
+
+// setFirstPubKey moves the given pubkey to the front of the user's set of
+// pubkeys. It returns ErrPubKeyNotFound if the user doesn't have the pubkey.
+func (db *DB) setFirstPubKey(ctx context.Context, userID primitive.ObjectID, pk PubKey) error {
+	filter := bson.M{
+		"_id":      userID,
+		"pub_keys": pk,
+	}
+	update := bson.A{
+		bson.M{
+			"$set": bson.M{
+				"pub_keys": bson.M{
+					"$concatArrays": bson.A{
+						bson.A{pk},
+						bson.M{"$filter": bson.M{
+							"input": "$pub_keys",
+							"cond":  bson.M{"$ne": bson.A{"$$this", pk}},
+						}},
+					},
+				},
+			},
+		},
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrPubKeyNotFound
+	}
+	return nil
+}
+
+// UsersCrossingUsageThreshold returns all paying and free users whose storage
+// usage, as a fraction of their storage limit, is at or above the given
+// threshold and who haven't yet been notified about reaching it. Once the user
+// has been notified, the caller should record that via
+// UserSetLastNotifiedThreshold.
+func (db *DB) UsersCrossingUsageThreshold(ctx context.Context, threshold float64) ([]*User, error) {
+	if threshold <= 0 {
+		return nil, errors.New("threshold must be positive")
+	}
+	filter := bson.M{
+		"tier":                    bson.M{"$gt": TierAnonymous},
+		"last_notified_threshold": bson.M{"$not": bson.M{"$gte": threshold}},
+	}
+	c, err := db.staticUsers.Find(ctx, filter)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch users")
+	}
+	var candidates []*User
+	err = c.All(ctx, &candidates)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	users := make([]*User, 0)
+	for _, u := range candidates {
+		limit := u.EffectiveStorageLimit()
+		if limit <= 0 {
+			continue
+		}
+		stats, err := db.UserStatsUpload(ctx, u.ID, time.Now().UTC())
+		if err != nil {
+			return nil, errors.AddContext(err, "failed to fetch upload stats for user "+u.ID.Hex())
+		}
+		if float64(stats.SizeTotal)/float64(limit) >= threshold {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// UsersByTier returns a page of the users in the given tier, ordered by ID,
+// together with the total number of users in that tier.
+func (db *DB) UsersByTier(ctx context.Context, tier int, offset, pageSize int) ([]*User, int, error) {
+	if !ValidTier(tier) {
+		return nil, 0, ErrInvalidTier
+	}
+	if err := validateOffsetPageSize(offset, pageSize); err != nil {
+		return nil, 0, err
+	}
+	filter := bson.M{"tier": tier}
+	cnt, err := db.staticUsers.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "failed to count users")
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"_id", 1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(pageSize))
+	c, err := db.staticUsers.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "failed to fetch users")
+	}
+	users := make([]*User, 0, pageSize)
+	err = c.All(ctx, &users)
+	if err != nil {
+		return nil, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	return users, int(cnt), nil
+}
+
+// UserSetLastNotifiedThreshold records the highest usage threshold about which
+// the user has been notified. Setting it to zero allows the user to be
+// notified again, e.g. after they've freed up some storage.
+func (db *DB) UserSetLastNotifiedThreshold(ctx context.Context, u *User, threshold float64) error {
+	if threshold < 0 {
+		return errors.New("threshold cannot be negative")
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{"last_notified_threshold": threshold}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	u.LastNotifiedThreshold = threshold
+	return nil
+}
+
+// BackfillMissingSubs assigns a newly generated sub to each user who doesn't
+// have one, e.g. legacy users imported from Kratos. It returns the number of
+// users it fixed.
+func (db *DB) BackfillMissingSubs(ctx context.Context) (int64, error) {
+	missingSub := bson.M{"sub": bson.M{"$in": bson.A{"", nil}}}
+	c, err := db.staticUsers.Find(ctx, missingSub, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch users without a sub")
+	}
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = c.All(ctx, &users)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	var fixed int64
+	for _, u := range users {
+		sub, err := lib.GenerateUUID()
+		if err != nil {
+			return fixed, errors.AddContext(err, "failed to generate a sub")
+		}
+		// We repeat the sub check in the filter, so we don't overwrite a sub
+		// that was set in the meantime.
+		filter := bson.M{"_id": u.ID, "sub": missingSub["sub"]}
+		update := bson.M{"$set": bson.M{"sub": sub}}
+		ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return fixed, errors.AddContext(err, "failed to set the sub of user "+u.ID.Hex())
+		}
+		fixed += ur.ModifiedCount
+	}
+	return fixed, nil
+}
+
+// UserChangePassword sets the user's password and invalidates all JWTs issued
+// to them so far.
+func (db *DB) UserChangePassword(ctx context.Context, u *User, password string) error {
+	if password == "" {
+		return errors.New("empty password")
+	}
+	passHash, err := hash.Generate(password)
+	if err != nil {
+		return errors.AddContext(err, "failed to hash password")
+	}
+	// JWTs record their issue time with a precision of one second, so we
+	// truncate the cutoff to the second. Otherwise, the token we issue right
+	// after the change might be considered as issued before it.
+	validAfter := time.Now().UTC().Truncate(time.Second)
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{
+		"password_hash":      string(passHash),
+		"tokens_valid_after": validAfter,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	u.PasswordHash = string(passHash)
+	u.TokensValidAfter = validAfter
+	return nil
+}
+
+// UserVerifyPassword checks the given password against the user's password
+// hash. Failed attempts count towards locking the user's account and a
+// successful one resets the count. Users with locked accounts are refused
+// with ErrAccountLocked until the lock expires.
+func (db *DB) UserVerifyPassword(ctx context.Context, u *User, password string) error {
+	if u.LockedUntil.After(time.Now().UTC()) {
+		return ErrAccountLocked
+	}
+	err := hash.Compare(password, []byte(u.PasswordHash))
+	if err != nil {
+		if errRec := db.UserRecordFailedLogin(ctx, u); errRec != nil {
+			db.staticLogger.Debugln("Failed to record a failed login:", errRec)
+		}
+		return err
+	}
+	if u.FailedLoginAttempts == 0 && u.LockedUntil.IsZero() {
+		return nil
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{
+		"$set":   bson.M{"failed_login_attempts": 0},
+		"$unset": bson.M{"locked_until": ""},
+	}
+	_, err = db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to reset failed login attempts")
+	}
+	u.FailedLoginAttempts = 0
+	u.LockedUntil = time.Time{}
+	return nil
+}
+
+// UserRecordFailedLogin increments the user's number of consecutive failed
+// logins. Once that number reaches MaxFailedLoginAttempts, the user's account
+// gets locked for LoginLockoutDuration and the count starts over.
+func (db *DB) UserRecordFailedLogin(ctx context.Context, u *User) error {
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$inc": bson.M{"failed_login_attempts": 1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated User
+	err := db.staticUsers.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if err != nil {
+		return errors.AddContext(err, "failed to record failed login")
+	}
+	u.FailedLoginAttempts = updated.FailedLoginAttempts
+	if MaxFailedLoginAttempts <= 0 || updated.FailedLoginAttempts < MaxFailedLoginAttempts {
+		return nil
+	}
+	lockedUntil := time.Now().UTC().Add(LoginLockoutDuration).Truncate(time.Millisecond)
+	update = bson.M{"$set": bson.M{
+		"failed_login_attempts": 0,
+		"locked_until":          lockedUntil,
+	}}
+	_, err = db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to lock account")
+	}
+	u.FailedLoginAttempts = 0
+	u.LockedUntil = lockedUntil
+	return nil
+}
+
+// UserUncancelSubscription reverts a scheduled cancellation of the user's
+// subscription, mirroring what happens when a cancellation is reverted in
+// Stripe.
+func (db *DB) UserUncancelSubscription(ctx context.Context, u *User) error {
+	filter := bson.M{
+		"_id": u.ID,
+		"$or": bson.A{
+			bson.M{"subscription_cancel_at_period_end": true},
+			bson.M{"subscription_cancel_at": bson.M{"$gt": time.Time{}}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"subscription_cancel_at":            time.Time{},
+		"subscription_cancel_at_period_end": false,
+	}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return ErrNoPendingCancellation
+	}
+	u.SubscriptionCancelAt = time.Time{}
+	u.SubscriptionCancelAtPeriodEnd = false
+	return nil
+}
+
+// UserSetSubscription updates the user's tier and subscription details. Unlike
+// UserSave, it only touches the subscription-related fields, so it doesn't
+// overwrite concurrent changes to the rest of the user's record. Upgrading
+// lifts any read-only period scheduled by a previous downgrade.
+func (db *DB) UserSetSubscription(ctx context.Context, u *User, sub SubscriptionUpdate) error {
+	if !ValidTier(sub.Tier) {
+		return ErrInvalidTier
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{
+		"tier":                              sub.Tier,
+		"subscribed_until":                  sub.SubscribedUntil,
+		"subscription_status":               sub.SubscriptionStatus,
+		"subscription_cancel_at":            sub.SubscriptionCancelAt,
+		"subscription_cancel_at_period_end": sub.SubscriptionCancelAtPeriodEnd,
+	}}
+	upgrade := sub.Tier > u.Tier
+	if upgrade {
+		update["$unset"] = bson.M{"read_only_from": ""}
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	u.Tier = sub.Tier
+	u.SubscribedUntil = sub.SubscribedUntil
+	u.SubscriptionStatus = sub.SubscriptionStatus
+	u.SubscriptionCancelAt = sub.SubscriptionCancelAt
+	u.SubscriptionCancelAtPeriodEnd = sub.SubscriptionCancelAtPeriodEnd
+	if upgrade {
+		u.ReadOnlyFrom = time.Time{}
+	}
+	return nil
 }
 
 // UserSetStripeID changes the user's stripe id in the DB.
@@ -549,13 +1739,89 @@ func (db *DB) UserSetStripeID(ctx context.Context, u *User, stripeID string) err
 	return nil
 }
 
-// UserSetTier sets the user's tier to the given value.
+// UserSetExtraStorage sets the amount of extra storage the user has bought on
+// top of their tier's storage limit.
+func (db *DB) UserSetExtraStorage(ctx context.Context, u *User, extraStorage int64) error {
+	if extraStorage < 0 {
+		return errors.New("extra storage cannot be negative")
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$set": bson.M{"extra_storage": extraStorage}}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	u.ExtraStorage = extraStorage
+	return nil
+}
+
+// UserApplyReferralCredit atomically adds the given number of bytes to the
+// user's referral credits, which count towards their storage limit. Negative
+// values revoke credits but never below zero.
+func (db *DB) UserApplyReferralCredit(ctx context.Context, u *User, bytes int64) error {
+	filter := bson.M{"_id": u.ID}
+	if bytes < 0 {
+		filter["referral_credits"] = bson.M{"$gte": -bytes}
+	}
+	update := bson.M{"$inc": bson.M{"referral_credits": bytes}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated User
+	err := db.staticUsers.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if errors.Contains(err, mongo.ErrNoDocuments) && bytes < 0 {
+		// Find out whether the user doesn't exist or doesn't have enough
+		// credits.
+		n, errCount := db.staticUsers.CountDocuments(ctx, bson.M{"_id": u.ID})
+		if errCount == nil && n > 0 {
+			return ErrNegativeReferralCredits
+		}
+	}
+	if errors.Contains(err, mongo.ErrNoDocuments) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	u.ReferralCredits = updated.ReferralCredits
+	return nil
+}
+
+// UserSetRegistryDelay sets a custom registry delay in ms for the given user.
+// Passing a nil delay clears the custom delay, so the tier's delay applies.
+func (db *DB) UserSetRegistryDelay(ctx context.Context, u *User, delay *int) error {
+	if delay != nil && *delay < 0 {
+		return errors.New("registry delay cannot be negative")
+	}
+	filter := bson.M{"_id": u.ID}
+	update := bson.M{"$unset": bson.M{"registry_delay_override": ""}}
+	if delay != nil {
+		update = bson.M{"$set": bson.M{"registry_delay_override": *delay}}
+	}
+	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return errors.AddContext(err, "failed to update")
+	}
+	if ur.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	u.RegistryDelayOverride = delay
+	return nil
+}
+
+// UserSetTier sets the user's tier to the given value. Upgrading lifts any
+// read-only period scheduled by a previous downgrade.
 func (db *DB) UserSetTier(ctx context.Context, u *User, t int) error {
-	if t <= TierAnonymous || t >= TierMaxReserved {
-		return errors.New("invalid tier value")
+	if !ValidTier(t) {
+		return ErrInvalidTier
 	}
 	filter := bson.M{"_id": u.ID}
 	update := bson.M{"$set": bson.M{"tier": t}}
+	upgrade := t > u.Tier
+	if upgrade {
+		update["$unset"] = bson.M{"read_only_from": ""}
+	}
 	ur, err := db.staticUsers.UpdateOne(ctx, filter, update)
 	if err != nil {
 		return errors.AddContext(err, "failed to update")
@@ -564,13 +1830,24 @@ func (db *DB) UserSetTier(ctx context.Context, u *User, t int) error {
 		return mongo.ErrNoDocuments
 	}
 	u.Tier = t
+	if upgrade {
+		u.ReadOnlyFrom = time.Time{}
+	}
 	return nil
 }
 
-// managedUsersByField finds all users that have a given field value.
+// managedUsersByField finds all users that have a given field value,
+// optionally including deactivated users. It returns ErrUserNotFound if there
+// are none, so callers always get at least one user.
 // The calling method is responsible for the validation of the value.
-func (db *DB) managedUsersByField(ctx context.Context, fieldName, fieldValue string) ([]*User, error) {
-	c, err := db.staticUsers.Find(ctx, bson.M{fieldName: fieldValue})
+func (db *DB) managedUsersByField(ctx context.Context, fieldName, fieldValue string, includeDeactivated bool) ([]*User, error) {
+	return db.managedUsersByFilter(ctx, userFilter(bson.M{fieldName: fieldValue}, includeDeactivated))
+}
+
+// managedUsersByFilter finds all users which match the given filter. It
+// returns ErrUserNotFound if there are none.
+func (db *DB) managedUsersByFilter(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]*User, error) {
+	c, err := db.staticUsers.Find(ctx, filter, opts...)
 	if err != nil {
 		return nil, errors.AddContext(err, "failed to find user")
 	}
@@ -594,10 +1871,10 @@ func (db *DB) managedUsersByField(ctx context.Context, fieldName, fieldValue str
 	return users, nil
 }
 
-// managedUserBySub fetches all users that have the given sub. This should
-// normally be up to one user.
-func (db *DB) managedUserBySub(ctx context.Context, sub string) (*User, error) {
-	sr := db.staticUsers.FindOne(ctx, bson.M{"sub": sub})
+// managedUserBySub fetches all users that have the given sub, optionally
+// including deactivated users. This should normally be up to one user.
+func (db *DB) managedUserBySub(ctx context.Context, sub string, includeDeactivated bool) (*User, error) {
+	sr := db.staticUsers.FindOne(ctx, userFilter(bson.M{"sub": sub}, includeDeactivated))
 	if sr.Err() == mongo.ErrNoDocuments {
 		return nil, ErrUserNotFound
 	}
@@ -612,6 +1889,33 @@ func (db *DB) managedUserBySub(ctx context.Context, sub string) (*User, error) {
 	return &u, nil
 }
 
+// IsEmailConfirmed checks whether the user has confirmed their email address.
+func (u User) IsEmailConfirmed() bool {
+	return u.EmailConfirmationToken == ""
+}
+
+// RequiresEmailConfirmation checks whether the user's features should be
+// restricted until they confirm their email address. That's the case for
+// unconfirmed users whose EmailConfirmationGracePeriod has run out by `now`.
+func (u User) RequiresEmailConfirmation(now time.Time) bool {
+	if u.IsEmailConfirmed() {
+		return false
+	}
+	return now.After(u.CreatedAt.Add(EmailConfirmationGracePeriod))
+}
+
+// IsReadOnly returns true if the user's account is read-only at the given
+// moment because they downgraded below the content they own.
+func (u User) IsReadOnly(now time.Time) bool {
+	return !u.ReadOnlyFrom.IsZero() && !now.Before(u.ReadOnlyFrom)
+}
+
+// IsTokenValid returns true if a JWT issued to the user at the given time is
+// still valid, i.e. it wasn't issued before the user's TokensValidAfter.
+func (u User) IsTokenValid(issuedAt time.Time) bool {
+	return !issuedAt.Before(u.TokensValidAfter)
+}
+
 // HasKey checks if the given pubkey is among the pubkeys registered for the
 // user.
 func (u User) HasKey(pk PubKey) bool {
@@ -623,6 +1927,41 @@ func (u User) HasKey(pk PubKey) bool {
 	return false
 }
 
+// UserBillingPeriods returns the user's last `count` billing periods, starting
+// with the current one. The periods are computed from the day of month of the
+// user's subscription, the same way monthStart does it.
+func (db *DB) UserBillingPeriods(_ context.Context, u User, count int) ([]Period, error) {
+	if count <= 0 {
+		return nil, errors.New("count must be positive")
+	}
+	return billingPeriodsWithTime(u.SubscribedUntil, time.Now().UTC(), count), nil
+}
+
+// billingPeriodsWithTime returns the last `count` billing periods in relation
+// to the given `current` time, starting with the current period. This function
+// exists only for testing purposes and implements the desired behaviour of
+// UserBillingPeriods.
+func billingPeriodsWithTime(subscribedUntil time.Time, current time.Time, count int) []Period {
+	start := monthStartWithTime(subscribedUntil, current)
+	// periodStart returns the start of the period which starts `offset` months
+	// after the current one.
+	periodStart := func(offset int) time.Time {
+		// Normalize the year and month before looking up the day, so we
+		// don't get confused by months outside the 1-12 range.
+		m := time.Date(start.Year(), start.Month()+time.Month(offset), 1, 0, 0, 0, 0, time.UTC)
+		day := normalizeDayOfMonth(m.Year(), m.Month(), subscribedUntil.Day())
+		return time.Date(m.Year(), m.Month(), day, 0, 0, 0, 0, time.UTC)
+	}
+	periods := make([]Period, 0, count)
+	for i := 0; i < count; i++ {
+		periods = append(periods, Period{
+			Start: periodStart(-i),
+			End:   periodStart(-i + 1),
+		})
+	}
+	return periods
+}
+
 // monthStart returns the start of the user's subscription month.
 // Users get their bandwidth quota reset at the start of the month.
 //
@@ -669,3 +2008,48 @@ func normalizeDayOfMonth(year int, month time.Month, day int) int {
 	}
 	return t.Day()
 }
+
+// userFilter restricts the given user filter to active users, unless we want
+// to include deactivated ones as well.
+func userFilter(filter bson.M, includeDeactivated bool) bson.M {
+	if !includeDeactivated {
+		filter["deleted"] = bson.M{"$ne": true}
+	}
+	return filter
+}
+
+// isDuplicateKeyOn returns true if the given error is a duplicate key error
+// caused by a violation of the unique index with the given name.
+func isDuplicateKeyOn(err error, index string) bool {
+	we, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+	for _, e := range we.WriteErrors {
+		if e.Code == mongoDuplicateKeyErrorCode && strings.Contains(e.Message, "index: "+index+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPubKey returns true if the given list contains the given pubkey.
+func containsPubKey(pks []PubKey, pk PubKey) bool {
+	for _, k := range pks {
+		if bytes.Equal(k, pk) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutPubKey returns a copy of the given list without the given pubkey.
+func withoutPubKey(pks []PubKey, pk PubKey) []PubKey {
+	res := make([]PubKey, 0, len(pks))
+	for _, k := range pks {
+		if !bytes.Equal(k, pk) {
+			res = append(res, k)
+		}
+	}
+	return res
+}
@@ -1,8 +1,12 @@
 package database
 
 import (
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"gitlab.com/NebulousLabs/errors"
 )
 
 // TestMonthStart ensures we calculate the start of the subscription month
@@ -61,3 +65,322 @@ func TestMonthStart(t *testing.T) {
 		}
 	}
 }
+
+// TestUserConcurrencyLimit ensures each tier maps to its configured limit of
+// concurrent requests.
+func TestUserConcurrencyLimit(t *testing.T) {
+	var db *DB
+	tests := []struct {
+		name     string
+		user     *User
+		expected int
+	}{
+		{name: "nil user", user: nil, expected: 2},
+		{name: "anonymous", user: &User{Tier: TierAnonymous}, expected: 2},
+		{name: "free", user: &User{Tier: TierFree}, expected: 5},
+		{name: "plus", user: &User{Tier: TierPremium5}, expected: 10},
+		{name: "pro", user: &User{Tier: TierPremium20}, expected: 20},
+		{name: "extreme", user: &User{Tier: TierPremium80}, expected: 50},
+		{name: "quota exceeded", user: &User{Tier: TierPremium80, QuotaExceeded: true}, expected: 2},
+		{name: "invalid tier", user: &User{Tier: TierMaxReserved}, expected: 2},
+	}
+	for _, tt := range tests {
+		if l := db.UserConcurrencyLimit(tt.user); l != tt.expected {
+			t.Errorf("Test '%s': expected %d, got %d.", tt.name, tt.expected, l)
+		}
+	}
+}
+
+// TestBillingPeriods ensures that we reconstruct the user's billing periods
+// correctly when the anchor day doesn't exist in every month.
+func TestBillingPeriods(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	subUntil := time.Date(2020, 1, 31, 3, 4, 5, 6, time.UTC)
+	tests := []struct {
+		name      string
+		checkedOn time.Time
+		expected  []Period
+	}{
+		{
+			name:      "spanning February",
+			checkedOn: time.Date(2022, 3, 15, 12, 13, 14, 15, time.UTC),
+			expected: []Period{
+				{Start: date(2022, 2, 28), End: date(2022, 3, 31)},
+				{Start: date(2022, 1, 31), End: date(2022, 2, 28)},
+				{Start: date(2021, 12, 31), End: date(2022, 1, 31)},
+				{Start: date(2021, 11, 30), End: date(2021, 12, 31)},
+			},
+		},
+		{
+			name:      "leap year",
+			checkedOn: time.Date(2024, 3, 5, 12, 13, 14, 15, time.UTC),
+			expected: []Period{
+				{Start: date(2024, 2, 29), End: date(2024, 3, 31)},
+				{Start: date(2024, 1, 31), End: date(2024, 2, 29)},
+			},
+		},
+		{
+			name:      "on the anchor day",
+			checkedOn: time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC),
+			expected: []Period{
+				{Start: date(2022, 2, 28), End: date(2022, 3, 31)},
+				{Start: date(2022, 1, 31), End: date(2022, 2, 28)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		periods := billingPeriodsWithTime(subUntil, tt.checkedOn, len(tt.expected))
+		if len(periods) != len(tt.expected) {
+			t.Fatalf("%s: expected %d periods, got %d.", tt.name, len(tt.expected), len(periods))
+		}
+		for i := range periods {
+			if !periods[i].Start.Equal(tt.expected[i].Start) || !periods[i].End.Equal(tt.expected[i].End) {
+				t.Errorf("%s: expected period %d to be %v - %v, got %v - %v.", tt.name, i,
+					tt.expected[i].Start, tt.expected[i].End, periods[i].Start, periods[i].End)
+			}
+		}
+	}
+}
+
+// TestFileCountStatus ensures that users get speed-limited once they go over
+// their tier's file limit.
+func TestFileCountStatus(t *testing.T) {
+	u := User{Tier: TierPremium80}
+	limit := UserLimits[TierPremium80].MaxNumberUploads
+	used, l, throttled := fileCountStatus(u, int64(limit-1))
+	if used != limit-1 || l != limit || throttled {
+		t.Fatalf("Expected %d used of %d and not throttled, got %d of %d and %t.", limit-1, limit, used, l, throttled)
+	}
+	used, l, throttled = fileCountStatus(u, int64(limit+1))
+	if used != limit+1 || l != limit || !throttled {
+		t.Fatalf("Expected %d used of %d and throttled, got %d of %d and %t.", limit+1, limit, used, l, throttled)
+	}
+	// Unknown tiers get the anonymous tier's limit.
+	_, l, _ = fileCountStatus(User{Tier: TierMaxReserved}, 0)
+	if l != UserLimits[TierAnonymous].MaxNumberUploads {
+		t.Fatalf("Expected limit %d, got %d.", UserLimits[TierAnonymous].MaxNumberUploads, l)
+	}
+}
+
+// TestRequiresEmailConfirmation ensures that unconfirmed users only get
+// restricted once their grace period runs out.
+func TestRequiresEmailConfirmation(t *testing.T) {
+	createdAt := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	withinGrace := createdAt.Add(EmailConfirmationGracePeriod - time.Minute)
+	pastGrace := createdAt.Add(EmailConfirmationGracePeriod + time.Minute)
+
+	unconfirmed := User{CreatedAt: createdAt, EmailConfirmationToken: "token"}
+	if unconfirmed.RequiresEmailConfirmation(withinGrace) {
+		t.Fatal("Expected an unconfirmed user within the grace period not to be restricted.")
+	}
+	if !unconfirmed.RequiresEmailConfirmation(pastGrace) {
+		t.Fatal("Expected an unconfirmed user past the grace period to be restricted.")
+	}
+	confirmed := User{CreatedAt: createdAt}
+	if confirmed.RequiresEmailConfirmation(pastGrace) {
+		t.Fatal("Expected a confirmed user not to be restricted.")
+	}
+}
+
+// TestEffectiveStorageLimit ensures that the user's extra storage is added to
+// their tier's storage limit.
+func TestEffectiveStorageLimit(t *testing.T) {
+	u := User{Tier: TierFree}
+	if l := u.EffectiveStorageLimit(); l != UserLimits[TierFree].Storage {
+		t.Fatalf("Expected %d, got %d.", UserLimits[TierFree].Storage, l)
+	}
+	u.ExtraStorage = 2 * UserLimits[TierFree].Storage
+	if l := u.EffectiveStorageLimit(); l != 3*UserLimits[TierFree].Storage {
+		t.Fatalf("Expected %d, got %d.", 3*UserLimits[TierFree].Storage, l)
+	}
+	u.ReferralCredits = UserLimits[TierFree].Storage
+	if l := u.EffectiveStorageLimit(); l != 4*UserLimits[TierFree].Storage {
+		t.Fatalf("Expected %d, got %d.", 4*UserLimits[TierFree].Storage, l)
+	}
+}
+
+// TestUserRegistryDelay ensures that UserRegistryDelay honours the user's
+// custom registry delay.
+func TestUserRegistryDelay(t *testing.T) {
+	var db *DB
+	anonDelay := UserLimits[TierAnonymous].RegistryDelay
+	override := anonDelay / 2
+	zero := 0
+	tests := []struct {
+		name     string
+		user     *User
+		expected int
+	}{
+		{name: "nil user", user: nil, expected: anonDelay},
+		{name: "anonymous", user: &User{Tier: TierAnonymous}, expected: anonDelay},
+		{name: "anonymous with override", user: &User{Tier: TierAnonymous, RegistryDelayOverride: &override}, expected: override},
+		{name: "free", user: &User{Tier: TierFree}, expected: UserLimits[TierFree].RegistryDelay},
+		{name: "free with zero override", user: &User{Tier: TierFree, RegistryDelayOverride: &zero}, expected: 0},
+		{name: "quota exceeded", user: &User{Tier: TierFree, QuotaExceeded: true, RegistryDelayOverride: &zero}, expected: anonDelay},
+	}
+	for _, tt := range tests {
+		if d := db.UserRegistryDelay(tt.user); d != tt.expected {
+			t.Errorf("Test '%s': expected %d, got %d.", tt.name, tt.expected, d)
+		}
+	}
+}
+
+// TestUserUploadPermission ensures that UserUploadPermission distinguishes
+// between users within their limits, in the warning band and over their hard
+// limits.
+func TestUserUploadPermission(t *testing.T) {
+	defer func(th float64, tol int64) {
+		UploadWarningThreshold = th
+		QuotaToleranceBytes = tol
+	}(UploadWarningThreshold, QuotaToleranceBytes)
+	UploadWarningThreshold = 0.8
+	QuotaToleranceBytes = skynet.GiB
+
+	u := &User{Tier: TierPremium5}
+	limits := UserLimits[TierPremium5]
+	tests := []struct {
+		name     string
+		stats    UserStatsUpload
+		expected UploadPermission
+	}{
+		{name: "empty", stats: UserStatsUpload{}, expected: UploadAllowed},
+		{name: "half", stats: UserStatsUpload{SizeTotal: limits.Storage / 2}, expected: UploadAllowed},
+		{name: "storage warning", stats: UserStatsUpload{SizeTotal: limits.Storage / 10 * 9}, expected: UploadAllowedWithWarning},
+		{name: "within tolerance", stats: UserStatsUpload{SizeTotal: limits.Storage + 1}, expected: UploadAllowedWithWarning},
+		{name: "storage exceeded", stats: UserStatsUpload{SizeTotal: limits.Storage + skynet.GiB + 1}, expected: UploadDenied},
+		{name: "files warning", stats: UserStatsUpload{CountTotal: int64(limits.MaxNumberUploads) / 10 * 9}, expected: UploadAllowedWithWarning},
+		{name: "files exceeded", stats: UserStatsUpload{CountTotal: int64(limits.MaxNumberUploads) + 1}, expected: UploadDenied},
+	}
+	for _, tt := range tests {
+		p, reason := UserUploadPermission(u, tt.stats)
+		if p != tt.expected {
+			t.Errorf("Test '%s': expected %d, got %d.", tt.name, tt.expected, p)
+		}
+		if p != UploadAllowed && reason == "" {
+			t.Errorf("Test '%s': expected a reason.", tt.name)
+		}
+	}
+	// Suspension doesn't affect the user's quota. UserCanUpload takes care
+	// of denying suspended users.
+	suspended := *u
+	suspended.Suspended = true
+	if p, _ := UserUploadPermission(&suspended, UserStatsUpload{}); p != UploadAllowed {
+		t.Fatalf("Expected a suspended user within their quota to be allowed, got %d.", p)
+	}
+}
+
+// TestUserSuspendedRestrictions ensures that suspended users are restricted
+// and can't download.
+func TestUserSuspendedRestrictions(t *testing.T) {
+	u := &User{Tier: TierPremium20}
+	if u.IsRestricted() || UserCanDownload(u) != nil {
+		t.Fatal("Expected the user not to be restricted.")
+	}
+	u.Suspended = true
+	if !u.IsRestricted() {
+		t.Fatal("Expected a suspended user to be restricted.")
+	}
+	if err := UserCanDownload(u); !errors.Contains(err, ErrAccountSuspended) {
+		t.Fatalf("Expected error %v, got %v", ErrAccountSuspended, err)
+	}
+	if UserCanDownload(nil) != nil {
+		t.Fatal("Expected anonymous users to be allowed to download.")
+	}
+	// Read-only users are restricted as well, but only once their read-only
+	// period starts.
+	ro := &User{Tier: TierPremium20, ReadOnlyFrom: time.Now().UTC().Add(time.Hour)}
+	if ro.IsRestricted() {
+		t.Fatal("Expected the user not to be restricted before their read-only period.")
+	}
+	ro.ReadOnlyFrom = time.Now().UTC().Add(-time.Hour)
+	if !ro.IsRestricted() {
+		t.Fatal("Expected a read-only user to be restricted.")
+	}
+}
+
+// TestUserIsTokenValid ensures that tokens issued before the user's
+// TokensValidAfter are rejected.
+func TestUserIsTokenValid(t *testing.T) {
+	u := User{}
+	if !u.IsTokenValid(time.Now().UTC().Add(-time.Hour)) {
+		t.Fatal("Expected all tokens to be valid for a user without a cutoff.")
+	}
+	u.TokensValidAfter = time.Now().UTC().Truncate(time.Second)
+	if u.IsTokenValid(u.TokensValidAfter.Add(-time.Second)) {
+		t.Fatal("Expected a token issued before the cutoff to be invalid.")
+	}
+	if !u.IsTokenValid(u.TokensValidAfter) {
+		t.Fatal("Expected a token issued at the cutoff to be valid.")
+	}
+	if !u.IsTokenValid(u.TokensValidAfter.Add(time.Second)) {
+		t.Fatal("Expected a token issued after the cutoff to be valid.")
+	}
+}
+
+// TestUserMaxAPIKeys ensures that the tier's API key limit overrides the
+// global one.
+func TestUserMaxAPIKeys(t *testing.T) {
+	u := User{Tier: TierFree}
+	if n := u.MaxAPIKeys(); n != MaxNumAPIKeysPerUser {
+		t.Fatalf("Expected %d, got %d.", MaxNumAPIKeysPerUser, n)
+	}
+	defer func(limits TierLimits) {
+		UserLimits[TierFree] = limits
+	}(UserLimits[TierFree])
+	limits := UserLimits[TierFree]
+	limits.MaxAPIKeys = 10
+	UserLimits[TierFree] = limits
+	if n := u.MaxAPIKeys(); n != 10 {
+		t.Fatalf("Expected %d, got %d.", 10, n)
+	}
+	u.Tier = TierPremium5
+	if n := u.MaxAPIKeys(); n != MaxNumAPIKeysPerUser {
+		t.Fatalf("Expected %d, got %d.", MaxNumAPIKeysPerUser, n)
+	}
+}
+
+// TestValidTier ensures that ValidTier accepts built-in and registered tiers
+// other than the anonymous one.
+func TestValidTier(t *testing.T) {
+	for tier := TierFree; tier < TierMaxReserved; tier++ {
+		if !ValidTier(tier) {
+			t.Fatalf("Expected tier %d to be valid.", tier)
+		}
+	}
+	if ValidTier(TierAnonymous) || ValidTier(TierMaxReserved) || ValidTier(-1) {
+		t.Fatal("Expected tier to be invalid.")
+	}
+	if err := RegisterTier(TierMaxReserved, TierLimits{TierName: "enterprise"}); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(UserLimits, TierMaxReserved)
+	if !ValidTier(TierMaxReserved) {
+		t.Fatal("Expected the registered tier to be valid.")
+	}
+}
+
+// TestTierByName ensures that TierByName resolves every known tier name and
+// rejects unknown ones.
+func TestTierByName(t *testing.T) {
+	for tier, limits := range UserLimits {
+		for _, name := range []string{limits.TierName, strings.ToUpper(limits.TierName), " " + limits.TierName + " "} {
+			tn, tl, ok := TierByName(name)
+			if !ok {
+				t.Fatalf("Expected to find tier '%s'.", name)
+			}
+			if tn != tier || tl.TierName != limits.TierName {
+				t.Fatalf("Expected tier %d (%s), got %d (%s).", tier, limits.TierName, tn, tl.TierName)
+			}
+		}
+	}
+	if _, _, ok := TierByName("pro"); !ok {
+		t.Fatal("Expected to find tier 'pro'.")
+	}
+	for _, name := range []string{"", "unknown", "pro plus"} {
+		if _, _, ok := TierByName(name); ok {
+			t.Fatalf("Expected not to find tier '%s'.", name)
+		}
+	}
+}
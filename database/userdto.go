@@ -0,0 +1,58 @@
+package database
+
+import (
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/types"
+)
+
+const (
+	// UserDTOVersion1 is the original JSON representation of the user, which
+	// uses camelCase field names.
+	UserDTOVersion1 = 1
+	// UserDTOVersion2 is the JSON representation of the user which uses
+	// snake_case field names.
+	UserDTOVersion2 = 2
+)
+
+// UserDTOv2 is the second version of the JSON representation of the user.
+type UserDTOv2 struct {
+	Email                         types.Email `json:"email"`
+	Sub                           string      `json:"sub"`
+	Tier                          int         `json:"tier"`
+	CreatedAt                     time.Time   `json:"created_at"`
+	MigratedAt                    time.Time   `json:"migrated_at"`
+	SubscribedUntil               time.Time   `json:"subscribed_until"`
+	SubscriptionStatus            string      `json:"subscription_status"`
+	SubscriptionCancelAt          time.Time   `json:"subscription_cancel_at"`
+	SubscriptionCancelAtPeriodEnd bool        `json:"subscription_cancel_at_period_end"`
+	StripeID                      string      `json:"stripe_customer_id"`
+	QuotaExceeded                 bool        `json:"quota_exceeded"`
+	ExtraStorage                  int64       `json:"extra_storage"`
+	ReferralCredits               int64       `json:"referral_credits"`
+}
+
+// ToDTO returns the representation of the user that the given version of the
+// API expects. Unknown versions get the original representation.
+func (u User) ToDTO(version int) interface{} {
+	switch version {
+	case UserDTOVersion2:
+		return UserDTOv2{
+			Email:                         u.Email,
+			Sub:                           u.Sub,
+			Tier:                          u.Tier,
+			CreatedAt:                     u.CreatedAt,
+			MigratedAt:                    u.MigratedAt,
+			SubscribedUntil:               u.SubscribedUntil,
+			SubscriptionStatus:            u.SubscriptionStatus,
+			SubscriptionCancelAt:          u.SubscriptionCancelAt,
+			SubscriptionCancelAtPeriodEnd: u.SubscriptionCancelAtPeriodEnd,
+			StripeID:                      u.StripeID,
+			QuotaExceeded:                 u.QuotaExceeded,
+			ExtraStorage:                  u.ExtraStorage,
+			ReferralCredits:               u.ReferralCredits,
+		}
+	default:
+		return u
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestUserToDTO ensures that the different versions of the user DTO use the
+// expected field names.
+func TestUserToDTO(t *testing.T) {
+	u := User{
+		Email:           "user@siasky.net",
+		Sub:             "sub",
+		Tier:            TierPremium5,
+		SubscribedUntil: time.Now().UTC(),
+		StripeID:        "stripe",
+		PasswordHash:    "secret",
+	}
+	fields := func(version int) map[string]interface{} {
+		b, err := json.Marshal(u.ToDTO(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]interface{})
+		err = json.Unmarshal(b, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// Version 1 is identical to the User's own JSON.
+	b1, err := json.Marshal(u.ToDTO(UserDTOVersion1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b1) != string(b) {
+		t.Fatalf("Expected v1 to match the user's JSON.\nExpected: %s\nGot: %s", b, b1)
+	}
+	v1 := fields(UserDTOVersion1)
+	v2 := fields(UserDTOVersion2)
+	tests := []struct {
+		v1 string
+		v2 string
+	}{
+		{v1: "subscribedUntil", v2: "subscribed_until"},
+		{v1: "stripeCustomerId", v2: "stripe_customer_id"},
+		{v1: "quotaExceeded", v2: "quota_exceeded"},
+		{v1: "sub", v2: "sub"},
+	}
+	for _, tt := range tests {
+		if _, ok := v1[tt.v1]; !ok {
+			t.Errorf("Expected field '%s' in v1.", tt.v1)
+		}
+		if _, ok := v2[tt.v2]; !ok {
+			t.Errorf("Expected field '%s' in v2.", tt.v2)
+		}
+		if tt.v1 != tt.v2 {
+			if _, ok := v2[tt.v1]; ok {
+				t.Errorf("Unexpected field '%s' in v2.", tt.v1)
+			}
+		}
+	}
+	if len(v1) != len(v2) {
+		t.Fatalf("Expected both versions to have the same number of fields, got %d and %d.", len(v1), len(v2))
+	}
+}
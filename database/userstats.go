@@ -2,6 +2,7 @@ package database
 
 import (
 	"context"
+	"math"
 	"sync"
 	"time"
 
@@ -12,6 +13,19 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+const (
+	// StorageRunwayUnlimited is the runway reported for users whose storage
+	// usage isn't growing, i.e. they'll never run out of storage at their
+	// current pace.
+	StorageRunwayUnlimited = time.Duration(math.MaxInt64)
+)
+
+var (
+	// StorageRunwayWindow is the time window over which we measure the
+	// growth of the user's storage usage when estimating their runway.
+	StorageRunwayWindow = 30 * 24 * time.Hour
+)
+
 type (
 	// UserStats contains statistical information about the user.
 	// "Total" is a prefix in JSON form because of backwards compatibility.
@@ -44,6 +58,12 @@ type (
 		// These are here for backwards compatibility.
 		TotalUploadsSize   int64 `json:"totalUploadsSize"`
 		TotalDownloadsSize int64 `json:"totalDownloadsSize"`
+
+		// These are derived from the user's tier limits and are never
+		// negative. Tiers don't limit the bandwidth used per period, so
+		// there is no remaining bandwidth to report.
+		StorageRemaining int64 `json:"storageRemaining"`
+		UploadsRemaining int   `json:"uploadsRemaining"`
 	}
 	// UserStatsUpload reports the upload stats of a given user. It holds
 	// the stats for the current period, as well as the total stats.
@@ -56,6 +76,11 @@ type (
 		RawStorageUsedTotal int64
 		Bandwidth           int64
 		BandwidthTotal      int64
+		// PinnedSize and PinnedSizeTotal are the parts of Size and SizeTotal
+		// taken by content which someone else uploaded originally and the
+		// user pinned. The rest is the user's own uploads.
+		PinnedSize      int64
+		PinnedSizeTotal int64
 	}
 	// UserStatsDownload reports the download stats of a given user. It holds
 	// the stats for the current period, as well as the total stats.
@@ -87,11 +112,25 @@ type (
 
 // UserStats returns statistical information about the user.
 func (db *DB) UserStats(ctx context.Context, user User) (*UserStats, error) {
-	return db.userStats(ctx, user)
+	return db.userStats(ctx, user, monthStart(user.SubscribedUntil))
+}
+
+// UserLifetimeStats returns statistical information about the user's entire
+// history. Unlike UserStats, the period values are not bound by the current
+// billing period, so they match the total values.
+func (db *DB) UserLifetimeStats(ctx context.Context, userID primitive.ObjectID) (*UserStats, error) {
+	u, err := db.UserByID(ctx, userID)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to fetch user")
+	}
+	return db.userStats(ctx, *u, time.Unix(0, 0).UTC())
 }
 
-// userStats reports statistical information about the user.
-func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
+// userStats reports statistical information about the user. The period values
+// cover all activity after the given time. The remaining quota is derived from
+// the user's tier limits.
+func (db *DB) userStats(ctx context.Context, u User, since time.Time) (*UserStats, error) {
+	userID := u.ID
 	stats := UserStats{}
 	var errs []error
 	var errsMux sync.Mutex
@@ -101,13 +140,12 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 		errs = append(errs, e)
 		errsMux.Unlock()
 	}
-	startOfMonth := monthStart(user.SubscribedUntil)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		upStats, err := db.UserStatsUpload(ctx, user.ID, startOfMonth)
+		upStats, err := db.UserStatsUpload(ctx, userID, since)
 		if err != nil {
 			regErr("Failed to get user's upload stats:", err)
 			return
@@ -121,12 +159,12 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 		stats.BandwidthUploadsTotal = upStats.BandwidthTotal
 		stats.RawStorageUsed = upStats.RawStorageUsed
 		stats.RawStorageUsedTotal = upStats.RawStorageUsedTotal
-		db.staticLogger.Tracef("User %s upload stats: %v", user.ID.Hex(), upStats)
+		db.staticLogger.Tracef("User %s upload stats: %v", userID.Hex(), upStats)
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		downStats, err := db.userDownloadStats(ctx, user.ID, startOfMonth)
+		downStats, err := db.userDownloadStats(ctx, userID, since)
 		if err != nil {
 			regErr("Failed to get user's download stats:", err)
 			return
@@ -138,12 +176,12 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 		stats.TotalDownloadsSize = downStats.SizeTotal
 		stats.BandwidthDownloads = downStats.Bandwidth
 		stats.BandwidthDownloadsTotal = downStats.BandwidthTotal
-		db.staticLogger.Tracef("User %s download stats: %v", user.ID.Hex(), downStats)
+		db.staticLogger.Tracef("User %s download stats: %v", userID.Hex(), downStats)
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		rwStats, err := db.userRegistryWriteStats(ctx, user.ID, startOfMonth)
+		rwStats, err := db.userRegistryWriteStats(ctx, userID, since)
 		if err != nil {
 			regErr("Failed to get user's registry write bandwidth used:", err)
 			return
@@ -152,12 +190,12 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 		stats.NumRegWritesTotal = rwStats.CountTotal
 		stats.BandwidthRegWrites = rwStats.Bandwidth
 		stats.BandwidthRegWrites = rwStats.BandwidthTotal
-		db.staticLogger.Tracef("User %s registry write stats: %v", user.ID.Hex(), rwStats)
+		db.staticLogger.Tracef("User %s registry write stats: %v", userID.Hex(), rwStats)
 	}()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		rrStats, err := db.userRegistryReadStats(ctx, user.ID, startOfMonth)
+		rrStats, err := db.userRegistryReadStats(ctx, userID, since)
 		if err != nil {
 			regErr("Failed to get user's registry read bandwidth used:", err)
 			return
@@ -166,18 +204,39 @@ func (db *DB) userStats(ctx context.Context, user User) (*UserStats, error) {
 		stats.NumRegReadsTotal = rrStats.CountTotal
 		stats.BandwidthRegReads = rrStats.Bandwidth
 		stats.BandwidthRegReadsTotal = rrStats.BandwidthTotal
-		db.staticLogger.Tracef("User %s registry read stats: %v", user.ID.Hex(), rrStats)
+		db.staticLogger.Tracef("User %s registry read stats: %v", userID.Hex(), rrStats)
 	}()
 
 	wg.Wait()
 	if len(errs) > 0 {
 		return nil, errors.Compose(errs...)
 	}
+	stats.setRemaining(u)
 	return &stats, nil
 }
 
+// setRemaining sets the quota the user has left based on their tier limits.
+// Storage and files are counted across the user's entire history. Unknown
+// tiers get the anonymous tier's limits.
+func (s *UserStats) setRemaining(u User) {
+	limits, ok := UserLimits[u.Tier]
+	if !ok {
+		limits = UserLimits[TierAnonymous]
+	}
+	remaining := func(limit, used int64) int64 {
+		if used >= limit {
+			return 0
+		}
+		return limit - used
+	}
+	s.StorageRemaining = remaining(u.EffectiveStorageLimit(), s.UploadsSizeTotal)
+	s.UploadsRemaining = int(remaining(int64(limits.MaxNumberUploads), s.NumUploadsTotal))
+}
+
 // UserStatsUpload reports on the user's uploads - count, total size and total
 // bandwidth used. It uses the total size of the uploaded skyfiles as basis.
+// Uploads via denylisted referrers don't count towards the bandwidth, see
+// ReferrerDenylist. They still count towards the storage used while pinned.
 func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since time.Time) (stats UserStatsUpload, err error) {
 	matchStage := bson.D{{"$match", bson.M{"user_id": id}}}
 	lookupStage := bson.D{
@@ -218,23 +277,31 @@ func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since
 	}()
 
 	// We need this struct, so we can safely decode both int32 and int64.
-	result := struct {
-		Size      int64     `bson:"size"`
-		Skylink   string    `bson:"skylink"`
-		Unpinned  bool      `bson:"unpinned"`
-		Timestamp time.Time `bson:"timestamp"`
-	}{}
+	type uploadRecord struct {
+		Size        int64              `bson:"size"`
+		Skylink     string             `bson:"skylink"`
+		Unpinned    bool               `bson:"unpinned"`
+		Timestamp   time.Time          `bson:"timestamp"`
+		PinnedFrom  primitive.ObjectID `bson:"pinned_from"`
+		QuotaExempt bool               `bson:"quota_exempt"`
+		Referrer    Referrer           `bson:"referrer"`
+	}
 	processedSkylinks := make(map[string]bool)
 	for c.Next(ctx) {
+		// Start from a clean record every time because Decode leaves fields
+		// which are missing from the document, e.g. pinned_from, untouched.
+		var result uploadRecord
 		if err = c.Decode(&result); err != nil {
 			err = errors.AddContext(err, "failed to decode DB data")
 			return
 		}
 		// All bandwidth is counted, regardless of unpinned status and
-		// uniqueness.
-		stats.BandwidthTotal += skynet.BandwidthUploadCost(result.Size)
-		if result.Timestamp.After(since) {
-			stats.Bandwidth += skynet.BandwidthUploadCost(result.Size)
+		// uniqueness, unless it's not billed.
+		if !result.Referrer.IsDenied(ReferrerDenylist) {
+			stats.BandwidthTotal += skynet.BandwidthUploadCost(result.Size)
+			if result.Timestamp.After(since) {
+				stats.Bandwidth += skynet.BandwidthUploadCost(result.Size)
+			}
 		}
 		// Only count unique  uploads that are still pinned towards total count,
 		// size and storage used.
@@ -242,9 +309,19 @@ func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since
 			continue
 		}
 		stats.CountTotal++
+		// Records without a pinned_from field are the user's own uploads.
+		pinned := !result.PinnedFrom.IsZero()
+		// Quota exempt skylinks don't count towards the storage used, so we
+		// treat them as already counted.
+		if result.QuotaExempt {
+			processedSkylinks[result.Skylink] = true
+		}
 		if !processedSkylinks[result.Skylink] {
 			stats.SizeTotal += result.Size
 			stats.RawStorageUsedTotal += skynet.RawStorageUsed(result.Size)
+			if pinned {
+				stats.PinnedSizeTotal += result.Size
+			}
 		}
 		// Check against the time threshold before continuing with the period
 		// counts.
@@ -253,6 +330,9 @@ func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since
 			if !processedSkylinks[result.Skylink] {
 				stats.Size += result.Size
 				stats.RawStorageUsed += skynet.RawStorageUsed(result.Size)
+				if pinned {
+					stats.PinnedSize += result.Size
+				}
 			}
 		}
 		processedSkylinks[result.Skylink] = true
@@ -262,10 +342,54 @@ func (db *DB) UserStatsUpload(ctx context.Context, id primitive.ObjectID, since
 
 // userDownloadStats reports on the user's downloads - count, total size and
 // total bandwidth used. It uses the actual bandwidth used, as reported by nginx.
+// Downloads via denylisted referrers are not billed, so they are left out, see
+// ReferrerDenylist.
 func (db *DB) userDownloadStats(ctx context.Context, id primitive.ObjectID, since time.Time) (stats UserStatsDownload, err error) {
 	matchStage := bson.D{{"$match", bson.D{
 		{"user_id", id},
 	}}}
+	c, err := db.staticDownloads.Aggregate(ctx, downloadSizePipeline(matchStage))
+	if err != nil {
+		err = errors.AddContext(err, "DB query failed")
+		return
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+
+	for c.Next(ctx) {
+		// We need this struct, so we can safely decode both int32 and int64.
+		// Declare it in the loop, so the referrer doesn't carry over to
+		// downloads which don't have one.
+		var result struct {
+			Size      int64     `bson:"size"`
+			CreatedAt time.Time `bson:"created_at"`
+			Referrer  Referrer  `bson:"referrer"`
+		}
+		if err = c.Decode(&result); err != nil {
+			err = errors.AddContext(err, "failed to decode DB data")
+			return
+		}
+		if result.Referrer.IsDenied(ReferrerDenylist) {
+			continue
+		}
+		stats.CountTotal++
+		stats.SizeTotal += result.Size
+		stats.BandwidthTotal += skynet.BandwidthDownloadCost(result.Size)
+		if result.CreatedAt.After(since) {
+			stats.Count++
+			stats.Size += result.Size
+			stats.Bandwidth += skynet.BandwidthDownloadCost(result.Size)
+		}
+	}
+	return stats, nil
+}
+
+// downloadSizePipeline returns a pipeline which reports the size, creation
+// time and referrer of each download matched by the given stage.
+func downloadSizePipeline(matchStage bson.D) mongo.Pipeline {
 	lookupStage := bson.D{
 		{"$lookup", bson.D{
 			{"from", "skylinks"},
@@ -295,40 +419,9 @@ func (db *DB) userDownloadStats(ctx context.Context, id primitive.ObjectID, sinc
 			}},
 		}},
 		{"created_at", "$created_at"},
+		{"referrer", "$referrer"},
 	}}}
-
-	pipeline := mongo.Pipeline{matchStage, lookupStage, replaceStage, projectStage}
-	c, err := db.staticDownloads.Aggregate(ctx, pipeline)
-	if err != nil {
-		err = errors.AddContext(err, "DB query failed")
-		return
-	}
-	defer func() {
-		if errDef := c.Close(ctx); errDef != nil {
-			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
-		}
-	}()
-
-	// We need this struct, so we can safely decode both int32 and int64.
-	result := struct {
-		Size      int64     `bson:"size"`
-		CreatedAt time.Time `bson:"created_at"`
-	}{}
-	for c.Next(ctx) {
-		if err = c.Decode(&result); err != nil {
-			err = errors.AddContext(err, "failed to decode DB data")
-			return
-		}
-		stats.CountTotal++
-		stats.SizeTotal += result.Size
-		stats.BandwidthTotal += skynet.BandwidthDownloadCost(result.Size)
-		if result.CreatedAt.After(since) {
-			stats.Count++
-			stats.Size += result.Size
-			stats.Bandwidth += skynet.BandwidthDownloadCost(result.Size)
-		}
-	}
-	return stats, nil
+	return mongo.Pipeline{matchStage, lookupStage, replaceStage, projectStage}
 }
 
 // userRegistryWriteStats reports the number of registry writes by the user and
@@ -380,3 +473,274 @@ func (db *DB) userRegistryReadStats(ctx context.Context, userID primitive.Object
 	stats.BandwidthTotal = readsTotal * skynet.CostBandwidthRegistryRead
 	return stats, nil
 }
+
+// ValidateUserStats runs all aggregations we use for computing the user's
+// stats and returns the first error it encounters. This allows us to detect
+// users whose data is corrupt.
+func (db *DB) ValidateUserStats(ctx context.Context, userID primitive.ObjectID) error {
+	since := time.Unix(0, 0).UTC()
+	if _, err := db.UserStatsUpload(ctx, userID, since); err != nil {
+		return errors.AddContext(err, "failed to compute upload stats")
+	}
+	if _, err := db.userDownloadStats(ctx, userID, since); err != nil {
+		return errors.AddContext(err, "failed to compute download stats")
+	}
+	if _, err := db.userRegistryWriteStats(ctx, userID, since); err != nil {
+		return errors.AddContext(err, "failed to compute registry write stats")
+	}
+	if _, err := db.userRegistryReadStats(ctx, userID, since); err != nil {
+		return errors.AddContext(err, "failed to compute registry read stats")
+	}
+	return nil
+}
+
+// FindUsersWithBrokenStats validates the stats of a random sample of users
+// and returns the IDs of those whose stats fail to compute.
+func (db *DB) FindUsersWithBrokenStats(ctx context.Context, sample int) ([]primitive.ObjectID, error) {
+	if sample <= 0 {
+		return nil, errors.New("sample size must be positive")
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{"$sample", bson.D{{"size", sample}}}},
+		bson.D{{"$project", bson.D{{"_id", 1}}}},
+	}
+	c, err := db.staticUsers.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to sample users")
+	}
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = c.All(ctx, &users)
+	if err != nil {
+		return nil, errors.AddContext(err, "failed to decode DB data")
+	}
+	broken := make([]primitive.ObjectID, 0)
+	for _, u := range users {
+		err = db.ValidateUserStats(ctx, u.ID)
+		if err != nil {
+			db.staticLogger.Debugf("User %s has broken stats: %v", u.ID.Hex(), err)
+			broken = append(broken, u.ID)
+		}
+	}
+	return broken, nil
+}
+
+// UserUploadCountConsistencyCheck compares the number of unique skylinks the
+// user has pinned with the raw number of pinned upload records they have. The
+// two numbers differ when the user has pinned the same skylink more than once,
+// e.g. after manual edits of the DB.
+func (db *DB) UserUploadCountConsistencyCheck(ctx context.Context, userID primitive.ObjectID) (aggCount, directCount int, err error) {
+	filter := bson.D{
+		{"user_id", userID},
+		{"unpinned", false},
+	}
+	n, err := db.staticUploads.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to count uploads")
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", filter}},
+		bson.D{{"$group", bson.D{{"_id", "$skylink_id"}}}},
+		bson.D{{"$count", "count"}},
+	}
+	c, err := db.staticUploads.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to count unique uploads")
+	}
+	var result []struct {
+		Count int64 `bson:"count"`
+	}
+	err = c.All(ctx, &result)
+	if err != nil {
+		return 0, 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	if len(result) > 0 {
+		aggCount = int(result[0].Count)
+	}
+	return aggCount, int(n), nil
+}
+
+// UserAverageUploadSize returns the average size of the unique skylinks the
+// user has pinned since the given time. Like UserStatsUpload, it counts each
+// skylink once, no matter how many times the user has uploaded it.
+func (db *DB) UserAverageUploadSize(ctx context.Context, userID primitive.ObjectID, since time.Time) (int64, error) {
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"unpinned", false},
+		{"timestamp", bson.D{{"$gt", since}}},
+	}}}
+	uniqueStage := bson.D{{"$group", bson.D{{"_id", "$skylink_id"}}}}
+	lookupStage := bson.D{{"$lookup", bson.D{
+		{"from", "skylinks"},
+		{"localField", "_id"},
+		{"foreignField", "_id"},
+		{"as", "skylink_data"},
+	}}}
+	avgStage := bson.D{{"$group", bson.D{
+		{"_id", nil},
+		{"avg", bson.D{{"$avg", bson.D{{"$arrayElemAt", bson.A{"$skylink_data.size", 0}}}}}},
+	}}}
+	pipeline := mongo.Pipeline{matchStage, uniqueStage, lookupStage, avgStage}
+	c, err := db.staticUploads.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to aggregate upload sizes")
+	}
+	var result []struct {
+		Avg float64 `bson:"avg"`
+	}
+	err = c.All(ctx, &result)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to decode DB data")
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return int64(result[0].Avg), nil
+}
+
+// UserRegistryRatio returns the number of registry reads and writes the user
+// has made since the given time, together with their read:write ratio. If the
+// user has read from the registry but has never written to it the ratio is
+// +Inf. If they haven't used the registry at all the ratio is zero.
+func (db *DB) UserRegistryRatio(ctx context.Context, userID primitive.ObjectID, since time.Time) (reads, writes int64, ratio float64, err error) {
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"timestamp", bson.D{{"$gt", since}}},
+	}}}
+	reads, err = db.count(ctx, db.staticRegistryReads, matchStage)
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to count registry reads")
+	}
+	writes, err = db.count(ctx, db.staticRegistryWrites, matchStage)
+	if err != nil {
+		return 0, 0, 0, errors.AddContext(err, "failed to count registry writes")
+	}
+	switch {
+	case writes > 0:
+		ratio = float64(reads) / float64(writes)
+	case reads > 0:
+		ratio = math.Inf(1)
+	}
+	return reads, writes, ratio, nil
+}
+
+// UserBillableDownloadBandwidth returns the download bandwidth the user has
+// used during the current billing period in excess of their tier's free
+// download allowance.
+func (db *DB) UserBillableDownloadBandwidth(ctx context.Context, u User) (int64, error) {
+	stats, err := db.userDownloadStats(ctx, u.ID, monthStart(u.SubscribedUntil))
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch download bandwidth")
+	}
+	limits, ok := UserLimits[u.Tier]
+	if !ok {
+		limits = UserLimits[TierAnonymous]
+	}
+	if stats.Bandwidth <= limits.FreeDownloadBandwidth {
+		return 0, nil
+	}
+	return stats.Bandwidth - limits.FreeDownloadBandwidth, nil
+}
+
+// UserStorageRunway estimates how long it will take the user to reach their
+// storage limit if they keep uploading at the pace they did during the last
+// StorageRunwayWindow. It returns StorageRunwayUnlimited if the user's usage
+// didn't grow during that window and zero if they're already at or over their
+// limit. Unpins are not taken into account, so the estimate errs on the short
+// side.
+func (db *DB) UserStorageRunway(ctx context.Context, userID primitive.ObjectID) (time.Duration, error) {
+	u, err := db.UserByID(ctx, userID)
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch user")
+	}
+	stats, err := db.UserStatsUpload(ctx, userID, time.Now().UTC().Add(-StorageRunwayWindow))
+	if err != nil {
+		return 0, errors.AddContext(err, "failed to fetch upload stats")
+	}
+	return storageRunway(stats.SizeTotal, u.EffectiveStorageLimit(), stats.Size, StorageRunwayWindow), nil
+}
+
+// UserStorageAsOf returns the raw storage the user was using at the given
+// moment, i.e. the raw storage of the unique skylinks they had uploaded or
+// pinned on or before that moment and hadn't unpinned by then. Quota exempt
+// skylinks are not counted.
+//
+// The result relies on the following assumptions:
+//   - uploads which were unpinned before we started recording the time of
+//     unpinning are considered to have been unpinned before the given moment,
+//     so the result might under-report storage for moments before that;
+//   - skylink sizes and quota exemptions are the current ones because we don't
+//     keep a history of them.
+func (db *DB) UserStorageAsOf(ctx context.Context, userID primitive.ObjectID, at time.Time) (int64, error) {
+	if userID.IsZero() {
+		return 0, errors.New("invalid user")
+	}
+	matchStage := bson.D{{"$match", bson.D{
+		{"user_id", userID},
+		{"timestamp", bson.D{{"$lte", at}}},
+		{"$or", bson.A{
+			bson.D{{"unpinned", false}},
+			bson.D{{"unpinned_at", bson.D{{"$gt", at}}}},
+		}},
+	}}}
+	lookupStage := bson.D{
+		{"$lookup", bson.D{
+			{"from", "skylinks"},
+			{"localField", "skylink_id"},
+			{"foreignField", "_id"},
+			{"as", "skylink_data"},
+		}},
+	}
+	projectStage := bson.D{{"$project", bson.D{
+		{"skylink_id", 1},
+		{"size", bson.D{{"$arrayElemAt", bson.A{"$skylink_data.size", 0}}}},
+		{"quota_exempt", bson.D{{"$arrayElemAt", bson.A{"$skylink_data.quota_exempt", 0}}}},
+	}}}
+	c, err := db.staticUploads.Aggregate(ctx, mongo.Pipeline{matchStage, lookupStage, projectStage})
+	if err != nil {
+		return 0, errors.AddContext(err, "DB query failed")
+	}
+	defer func() {
+		if errDef := c.Close(ctx); errDef != nil {
+			db.staticLogger.Traceln("Error on closing DB cursor.", errDef)
+		}
+	}()
+	var storage int64
+	processedSkylinks := make(map[primitive.ObjectID]bool)
+	for c.Next(ctx) {
+		var result struct {
+			SkylinkID   primitive.ObjectID `bson:"skylink_id"`
+			Size        int64              `bson:"size"`
+			QuotaExempt bool               `bson:"quota_exempt"`
+		}
+		if err = c.Decode(&result); err != nil {
+			return 0, errors.AddContext(err, "failed to decode DB data")
+		}
+		if result.QuotaExempt || processedSkylinks[result.SkylinkID] {
+			continue
+		}
+		processedSkylinks[result.SkylinkID] = true
+		storage += skynet.RawStorageUsed(result.Size)
+	}
+	if err = c.Err(); err != nil {
+		return 0, errors.AddContext(err, "failed to iterate over uploads")
+	}
+	return storage, nil
+}
+
+// storageRunway estimates how long it will take to go from used to limit if
+// usage grows by grown bytes every window.
+func storageRunway(used, limit, grown int64, window time.Duration) time.Duration {
+	if used >= limit {
+		return 0
+	}
+	if grown <= 0 || window <= 0 {
+		return StorageRunwayUnlimited
+	}
+	runway := float64(limit-used) / float64(grown) * float64(window)
+	if runway >= float64(StorageRunwayUnlimited) {
+		return StorageRunwayUnlimited
+	}
+	return time.Duration(runway)
+}
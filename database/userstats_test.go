@@ -0,0 +1,67 @@
+package database
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+)
+
+// TestUserStatsSetRemaining ensures that setRemaining derives the remaining
+// quota from the user's tier limits and clamps it at zero.
+func TestUserStatsSetRemaining(t *testing.T) {
+	u := User{Tier: TierPremium5, ExtraStorage: skynet.GiB}
+	limits := UserLimits[TierPremium5]
+
+	// Within limits.
+	s := UserStats{
+		UploadsSizeTotal: skynet.GiB,
+		NumUploadsTotal:  10,
+	}
+	s.setRemaining(u)
+	if s.StorageRemaining != limits.Storage {
+		t.Fatalf("Expected %d storage remaining, got %d.", limits.Storage, s.StorageRemaining)
+	}
+	if s.UploadsRemaining != limits.MaxNumberUploads-10 {
+		t.Fatalf("Expected %d uploads remaining, got %d.", limits.MaxNumberUploads-10, s.UploadsRemaining)
+	}
+
+	// Over limits.
+	s = UserStats{
+		UploadsSizeTotal: u.EffectiveStorageLimit() + 1,
+		NumUploadsTotal:  int64(limits.MaxNumberUploads) + 1,
+	}
+	s.setRemaining(u)
+	if s.StorageRemaining != 0 || s.UploadsRemaining != 0 {
+		t.Fatalf("Expected no storage and uploads remaining, got %+v", s)
+	}
+}
+
+// TestStorageRunway ensures that storageRunway extrapolates the storage growth
+// correctly and handles its edge cases.
+func TestStorageRunway(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		used, limit, grown int64
+		window             time.Duration
+		expected           time.Duration
+	}{
+		// 10 GiB left at 1 GiB per day.
+		{skynet.GiB, 11 * skynet.GiB, 30 * skynet.GiB, 30 * day, 10 * day},
+		// At and over the limit.
+		{skynet.GiB, skynet.GiB, skynet.GiB, day, 0},
+		{2 * skynet.GiB, skynet.GiB, skynet.GiB, day, 0},
+		// Not growing.
+		{skynet.GiB, 2 * skynet.GiB, 0, day, StorageRunwayUnlimited},
+		{skynet.GiB, 2 * skynet.GiB, skynet.GiB, 0, StorageRunwayUnlimited},
+		// Growing so slowly that the runway doesn't fit in a duration.
+		{0, math.MaxInt64, 1, day, StorageRunwayUnlimited},
+	}
+	for i, tt := range tests {
+		r := storageRunway(tt.used, tt.limit, tt.grown, tt.window)
+		if r != tt.expected {
+			t.Errorf("Test %d: expected %v, got %v.", i, tt.expected, r)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package email
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/errors"
+)
+
+var (
+	// ErrUndeliverableEmail is returned when we try to queue an email to an
+	// address whose domain doesn't accept emails, i.e. it has no MX records.
+	ErrUndeliverableEmail = errors.New("email address is undeliverable")
+
+	// CheckMX makes Mailer verify that the recipient's domain has MX records
+	// before queueing an email for it. Its value is controlled by the
+	// ACCOUNTS_EMAIL_CHECK_MX environment variable.
+	CheckMX = false
+	// MXLookupTimeout is the longest we wait for an MX lookup. If the lookup
+	// doesn't complete in time we give the address the benefit of the doubt.
+	MXLookupTimeout = 2 * time.Second
+
+	// mxCacheTTL defines for how long we cache the result of an MX lookup.
+	mxCacheTTL = time.Hour
+)
+
+type (
+	// MXResolver looks up the MX records of a domain. It is satisfied by
+	// *net.Resolver.
+	MXResolver interface {
+		LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	}
+
+	// mxChecker checks whether domains accept emails and caches the results.
+	mxChecker struct {
+		staticResolver MXResolver
+		cache          map[string]mxCacheEntry
+		mu             sync.Mutex
+	}
+
+	// mxCacheEntry is a cached result of an MX lookup.
+	mxCacheEntry struct {
+		deliverable bool
+		expiresAt   time.Time
+	}
+)
+
+// newMXChecker creates a new mxChecker which uses the given resolver.
+func newMXChecker(r MXResolver) *mxChecker {
+	return &mxChecker{
+		staticResolver: r,
+		cache:          make(map[string]mxCacheEntry),
+	}
+}
+
+// Deliverable checks whether the domain of the given email address has MX
+// records. Lookup errors other than the domain not existing are not treated
+// as the address being undeliverable and are not cached.
+func (c *mxChecker) Deliverable(ctx context.Context, address string) bool {
+	i := strings.LastIndex(address, "@")
+	if i < 0 || i == len(address)-1 {
+		return false
+	}
+	domain := strings.ToLower(address[i+1:])
+	c.mu.Lock()
+	entry, ok := c.cache[domain]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.deliverable
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, MXLookupTimeout)
+	defer cancel()
+	mxs, err := c.staticResolver.LookupMX(ctx, domain)
+	if dnsErr, ok := err.(*net.DNSError); err != nil && !(ok && dnsErr.IsNotFound) {
+		return true
+	}
+	deliverable := err == nil && len(mxs) > 0
+	c.mu.Lock()
+	c.cache[domain] = mxCacheEntry{
+		deliverable: deliverable,
+		expiresAt:   time.Now().Add(mxCacheTTL),
+	}
+	c.mu.Unlock()
+	return deliverable
+}
@@ -0,0 +1,60 @@
+package email
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// fauxResolver is an MXResolver which knows the MX records of a fixed set of
+// domains and counts its lookups.
+type fauxResolver struct {
+	records map[string][]*net.MX
+	lookups int
+}
+
+// LookupMX implements MXResolver.
+func (r *fauxResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	mxs, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+// TestMailerCheckMX ensures that Mailer refuses to queue emails to domains
+// without MX records when CheckMX is enabled.
+func TestMailerCheckMX(t *testing.T) {
+	defer func(checkMX bool) {
+		CheckMX = checkMX
+	}(CheckMX)
+	CheckMX = true
+
+	r := &fauxResolver{records: map[string][]*net.MX{
+		"siasky.net": {{Host: "mx.siasky.net", Pref: 10}},
+		"nomx.net":   {},
+	}}
+	// We don't pass a DB because we expect the Mailer to refuse the emails
+	// before it reaches the DB.
+	m := NewCustomMailer(nil, r)
+	for _, to := range []string{"user@nonexistent.net", "user@nomx.net", "invalid"} {
+		err := m.Send(context.Background(), database.EmailMessage{To: to})
+		if !errors.Contains(err, ErrUndeliverableEmail) {
+			t.Fatalf("Expected error '%v' for %s, got '%v'.", ErrUndeliverableEmail, to, err)
+		}
+	}
+	// Domains with MX records are deliverable and the results are cached.
+	lookups := r.lookups
+	for i := 0; i < 3; i++ {
+		if !m.staticMXChecker.Deliverable(context.Background(), "user@SiaSky.net") {
+			t.Fatal("Expected the address to be deliverable.")
+		}
+	}
+	if r.lookups != lookups+1 {
+		t.Fatalf("Expected a single lookup, got %d.", r.lookups-lookups)
+	}
+}
@@ -2,9 +2,13 @@ package email
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
 )
 
 /**
@@ -18,22 +22,81 @@ running `Sender` is looping over the DB on a timer and taking care to send the
 messages waiting there.
 */
 
+var (
+	// ErrUnknownTemplate is returned when we try to send an email using a
+	// template that doesn't exist.
+	ErrUnknownTemplate = errors.New("unknown email template")
+	// ErrRecipientRateLimited is returned when we try to queue an email to an
+	// address which has already received too many emails recently.
+	ErrRecipientRateLimited = errors.New("too many emails sent to this address")
+
+	// MaxEmailsPerRecipient is the maximum number of emails we queue for a
+	// single address within RecipientRateLimitWindow. Zero disables the
+	// limit. Its value is controlled by the ACCOUNTS_EMAIL_MAX_PER_RECIPIENT
+	// environment variable.
+	//
+	// The limit is best-effort: we count and insert in separate steps, so
+	// concurrent senders may together exceed it by a few messages.
+	MaxEmailsPerRecipient = 20
+	// RecipientRateLimitWindow is the period over which we count the emails
+	// queued for a single address.
+	RecipientRateLimitWindow = time.Hour
+)
+
 // Mailer prepares messages for sending by adding them to the email queue.
 type Mailer struct {
-	staticDB *database.DB
+	staticDB        *database.DB
+	staticMXChecker *mxChecker
 }
 
 // NewMailer creates a new instance of Mailer.
 func NewMailer(db *database.DB) *Mailer {
-	return &Mailer{db}
+	return NewCustomMailer(db, net.DefaultResolver)
+}
+
+// NewCustomMailer creates a new instance of Mailer which uses the given
+// resolver for checking whether the recipients' domains accept emails.
+func NewCustomMailer(db *database.DB, r MXResolver) *Mailer {
+	return &Mailer{
+		staticDB:        db,
+		staticMXChecker: newMXChecker(r),
+	}
 }
 
 // Send queues an email message for sending. The message will be sent by Sender
-// with the next batch of emails.
+// with the next batch of emails. Messages to addresses which have received
+// more than MaxEmailsPerRecipient emails within RecipientRateLimitWindow are
+// refused with ErrRecipientRateLimited. The limit is best-effort, see
+// MaxEmailsPerRecipient. If CheckMX is enabled, messages to
+// domains without MX records are refused with ErrUndeliverableEmail.
 func (em Mailer) Send(ctx context.Context, m database.EmailMessage) error {
+	if CheckMX && !em.staticMXChecker.Deliverable(ctx, m.To) {
+		return errors.AddContext(ErrUndeliverableEmail, m.To)
+	}
+	if MaxEmailsPerRecipient > 0 {
+		n, err := em.staticDB.EmailCountSince(ctx, m.To, time.Now().UTC().Add(-RecipientRateLimitWindow))
+		if err != nil {
+			return errors.AddContext(err, "failed to check recipient's rate limit")
+		}
+		if n >= int64(MaxEmailsPerRecipient) {
+			return errors.AddContext(ErrRecipientRateLimited, fmt.Sprintf("%s received %d emails in the last %s", m.To, n, RecipientRateLimitWindow))
+		}
+	}
 	return em.staticDB.EmailCreate(ctx, m)
 }
 
+// SendScheduled queues an email generated from the given template for sending
+// at the given time. Sender won't pick the message up before that.
+func (em Mailer) SendScheduled(ctx context.Context, to types.Email, template string, at time.Time) error {
+	gen, ok := templates[template]
+	if !ok {
+		return errors.AddContext(ErrUnknownTemplate, template)
+	}
+	m := gen(to.String())
+	m.SendAt = at.UTC()
+	return em.Send(ctx, *m)
+}
+
 // SendAddressConfirmationEmail sends a new email to the given email address
 // with a link to confirm the ownership of the address.
 func (em Mailer) SendAddressConfirmationEmail(ctx context.Context, email types.Email, token string) error {
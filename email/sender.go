@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -32,6 +33,10 @@ var (
 	// from DefaultConnectionURI but can be overridden by the ACCOUNTS_EMAIL_FROM
 	// environment variable.
 	From = "noreply@siasky.net"
+	// AuditAddress is an address which receives a blind copy of every email
+	// we send. An empty value disables the audit copies. Its value is
+	// controlled by the ACCOUNTS_EMAIL_AUDIT_ADDRESS environment variable.
+	AuditAddress = ""
 
 	// PortalAddressAccounts defines the URI where we can access the accounts
 	// sub-site. The domain comes from the PORTAL_DOMAIN environment variable.
@@ -60,6 +65,17 @@ var (
 	// connection URI
 	matchPattern = regexp.MustCompile("smtps://(?P<user>.*):(?P<password>.*)@(?P<server>.*):(?P<port>\\d*)(/\\??skip_ssl_verify=(?P<skip_ssl_verify>\\w*))?")
 
+	// SendConcurrency defines the default number of emails a Sender sends
+	// concurrently. Its value is controlled by the
+	// ACCOUNTS_EMAIL_SEND_CONCURRENCY environment variable.
+	SendConcurrency = 1
+
+	// DryRun makes new Senders go through the whole sending flow without
+	// actually sending any emails. The emails are marked as processed by a dry
+	// run, so they are not retried. Its value is controlled by the
+	// ACCOUNTS_EMAIL_DRY_RUN environment variable.
+	DryRun = false
+
 	// sleepBetweenScans defines how long the sender should sleep between its
 	// sweeps of the DB.
 	sleepBetweenScans = build.Select(
@@ -75,11 +91,13 @@ type (
 	// Sender is a daemon that periodically checks the DB for emails waiting to
 	// be sent and sends them.
 	Sender struct {
-		staticConfig emailConfig
-		staticCtx    context.Context
-		staticDB     *database.DB
-		staticDeps   skymodules.SkydDependencies
-		staticLogger *logrus.Logger
+		staticConcurrency int
+		staticConfig      emailConfig
+		staticCtx         context.Context
+		staticDB          *database.DB
+		staticDeps        skymodules.SkydDependencies
+		staticDryRun      bool
+		staticLogger      *logrus.Logger
 	}
 
 	// emailConfig contains all configuration options we need in order to send
@@ -93,8 +111,18 @@ type (
 	}
 )
 
-// NewSender returns a new Sender instance.
+// NewSender returns a new Sender instance which uses the default send
+// concurrency.
 func NewSender(ctx context.Context, db *database.DB, logger *logrus.Logger, deps skymodules.SkydDependencies, emailConnURI string) (Sender, error) {
+	return NewCustomSender(ctx, db, logger, deps, emailConnURI, SendConcurrency)
+}
+
+// NewCustomSender returns a new Sender instance which sends up to concurrency
+// emails at the same time.
+func NewCustomSender(ctx context.Context, db *database.DB, logger *logrus.Logger, deps skymodules.SkydDependencies, emailConnURI string, concurrency int) (Sender, error) {
+	if concurrency < 1 {
+		return Sender{}, errors.New("send concurrency must be positive")
+	}
 	c, err := config(emailConnURI)
 	if err != nil {
 		return Sender{}, errors.AddContext(err, "failed to parse email config")
@@ -104,18 +132,27 @@ func NewSender(ctx context.Context, db *database.DB, logger *logrus.Logger, deps
 		return Sender{}, err
 	}
 	return Sender{
-		staticConfig: c,
-		staticCtx:    mongo.NewSessionContext(ctx, sess),
-		staticDB:     db,
-		staticDeps:   deps,
-		staticLogger: logger,
+		staticConcurrency: concurrency,
+		staticConfig:      c,
+		staticCtx:         mongo.NewSessionContext(ctx, sess),
+		staticDB:          db,
+		staticDeps:        deps,
+		staticDryRun:      DryRun,
+		staticLogger:      logger,
 	}, nil
 }
 
 // Start periodically scans the database for email messages waiting to be
-// sent and sending them.
+// sent and sending them. Before the first scan it repairs any messages left in
+// an inconsistent state, e.g. by a sender which crashed mid-scan.
 func (s Sender) Start() {
 	go func() {
+		r, err := s.staticDB.ReconcileEmails(s.staticCtx)
+		if err != nil {
+			s.staticLogger.Warningln(errors.AddContext(err, "failed to reconcile emails"))
+		} else if r.StaleLocks+r.SentLocks+r.InvalidAttempts > 0 {
+			s.staticLogger.Infof("Reconciled emails: released %d stale locks and %d locks of sent emails, reset %d invalid attempt counters.", r.StaleLocks, r.SentLocks, r.InvalidAttempts)
+		}
 		s.ScanAndSend(ServerLockID)
 		for {
 			select {
@@ -132,9 +169,19 @@ func (s Sender) Start() {
 // sends them.
 //
 // We lock the messages before sending them and update their SentAt field after
-// sending them. We also don't lock more than batchSize messages.
+// sending them. We also don't lock more than batchSize messages, unless the
+// sender's concurrency is higher than that, in which case we lock as many
+// messages as we can send concurrently. Each locked message is sent by exactly
+// one of the sender's workers.
+//
+// In dry-run mode the messages are not sent but marked as processed by a dry
+// run instead.
 func (s Sender) ScanAndSend(lockID string) (int, int) {
-	msgs, err := s.staticDB.EmailLockAndFetch(s.staticCtx, lockID, batchSize)
+	n := int64(batchSize)
+	if int64(s.staticConcurrency) > n {
+		n = int64(s.staticConcurrency)
+	}
+	msgs, err := s.staticDB.EmailLockAndFetch(s.staticCtx, lockID, n)
 	if err != nil {
 		s.staticLogger.Warningln(errors.AddContext(err, "failed to send email batch"))
 		return 0, 0
@@ -142,18 +189,47 @@ func (s Sender) ScanAndSend(lockID string) (int, int) {
 	if len(msgs) == 0 {
 		return 0, 0
 	}
+	if s.staticDryRun {
+		ids := make([]primitive.ObjectID, 0, len(msgs))
+		for _, m := range msgs {
+			ids = append(ids, m.ID)
+		}
+		err = s.staticDB.MarkAsSentDryRun(s.staticCtx, ids)
+		if err != nil {
+			err = errors.AddContext(err, "failed to mark emails as sent in dry run. they might get processed again")
+			s.staticLogger.Warningln(err)
+		}
+		return len(ids), 0
+	}
 	var sent []primitive.ObjectID
 	var failed []*database.EmailMessage
 	var errs []error
-	for i, m := range msgs {
-		err = s.send(m.From, m.To, m.Subject, m.Body, m.BodyMime)
-		if err != nil {
-			errs = append(errs, err)
-			failed = append(failed, &msgs[i])
-			continue
-		}
-		sent = append(sent, m.ID)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan int, len(msgs))
+	for i := range msgs {
+		queue <- i
+	}
+	close(queue)
+	for w := 0; w < s.staticConcurrency && w < len(msgs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				m := msgs[i]
+				errSend := s.send(m.From, m.To, m.Subject, m.Body, m.BodyMime)
+				mu.Lock()
+				if errSend != nil {
+					errs = append(errs, errSend)
+					failed = append(failed, &msgs[i])
+				} else {
+					sent = append(sent, m.ID)
+				}
+				mu.Unlock()
+			}
+		}()
 	}
+	wg.Wait()
 	if len(errs) > 0 {
 		err = errors.Compose(errs...)
 		err = errors.AddContext(err, "failed to send some emails")
@@ -180,13 +256,21 @@ func (s Sender) ScanAndSend(lockID string) (int, int) {
 //
 // bodyMime should be either "text/plain" or "text/html"
 func (s Sender) send(from, to, subject, body, bodyMime string) error {
+	return s.sendMultiple(newMessage(from, to, subject, body, bodyMime))
+}
+
+// newMessage builds an email message. If an AuditAddress is set, it's added as
+// a BCC recipient, so it's not visible to the other recipients.
+func newMessage(from, to, subject, body, bodyMime string) *mail.Message {
 	m := mail.NewMessage()
 	m.SetHeader("From", from)
 	m.SetHeader("To", to)
+	if AuditAddress != "" {
+		m.SetHeader("Bcc", AuditAddress)
+	}
 	m.SetHeader("Subject", subject)
 	m.SetBody(bodyMime, body)
-
-	return s.sendMultiple(m)
+	return m
 }
 
 // sendMultiple one or more email messages.
@@ -1,6 +1,7 @@
 package email
 
 import (
+	"bytes"
 	"testing"
 
 	"gitlab.com/NebulousLabs/errors"
@@ -41,3 +42,34 @@ func TestServerLockID(t *testing.T) {
 		t.Fatal("Expected ServerLockID to not be empty.")
 	}
 }
+
+// TestNewMessageAuditAddress ensures that the audit address receives a blind
+// copy of the message without being exposed to the recipient.
+func TestNewMessageAuditAddress(t *testing.T) {
+	defer func(addr string) {
+		AuditAddress = addr
+	}(AuditAddress)
+
+	// No audit address.
+	AuditAddress = ""
+	m := newMessage("from@siasky.net", "to@siasky.net", "subject", "body", "text/plain")
+	if bcc := m.GetHeader("Bcc"); len(bcc) != 0 {
+		t.Fatalf("Expected no BCC, got %v", bcc)
+	}
+	// With an audit address.
+	AuditAddress = "audit@siasky.net"
+	m = newMessage("from@siasky.net", "to@siasky.net", "subject", "body", "text/plain")
+	bcc := m.GetHeader("Bcc")
+	if len(bcc) != 1 || bcc[0] != AuditAddress {
+		t.Fatalf("Expected BCC '%s', got %v", AuditAddress, bcc)
+	}
+	// The recipient should not see the audit address.
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(AuditAddress)) {
+		t.Fatal("The audit address is exposed to the recipient.")
+	}
+}
@@ -6,6 +6,12 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/database"
 )
 
+const (
+	// TemplateCheckIn is the name of the template we use for checking in with
+	// users a few days after they sign up.
+	TemplateCheckIn = "check_in"
+)
+
 const (
 	confirmEmailSubject = "Please verify your email address"
 	confirmEmailMime    = "multipart/alternative; boundary=e31b4aa4706e10c57d31a44da59281c216fb10992b0e5b512edea805408a"
@@ -91,9 +97,43 @@ If this was you, check if you signed up using a different address.
 If this was not you, please ignore this email.
 
 --f096ee1beed49f6757a41b4bf22d1ddc10cc9480a4df9376ebac4fe4f405--
+`
+
+	checkInSubject = "How's it going?"
+	checkInMime    = "multipart/alternative; boundary=5c2d8a4f0b1e47e6a3f9d7c1b2e8f4a6d0c3b9e7f1a5d2c8b4e6f0a3d7c9"
+	checkInTempl   = `
+--5c2d8a4f0b1e47e6a3f9d7c1b2e8f4a6d0c3b9e7f1a5d2c8b4e6f0a3d7c9
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/plain; charset=UTF-8
+
+Hi,
+
+you signed up for a Skynet account a few days ago and we wanted to check in=
+ and see how it's going.
+
+If you have any questions or feedback, simply reply to this email.
+
+--5c2d8a4f0b1e47e6a3f9d7c1b2e8f4a6d0c3b9e7f1a5d2c8b4e6f0a3d7c9
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/html; charset=UTF-8
+
+Hi,
+
+you signed up for a Skynet account a few days ago and we wanted to check in=
+ and see how it's going.
+
+If you have any questions or feedback, simply reply to this email.
+
+--5c2d8a4f0b1e47e6a3f9d7c1b2e8f4a6d0c3b9e7f1a5d2c8b4e6f0a3d7c9--
 `
 )
 
+// templates maps the names of the templates which can be sent via
+// Mailer.SendScheduled to the functions that generate them.
+var templates = map[string]func(to string) *database.EmailMessage{
+	TemplateCheckIn: checkInEmail,
+}
+
 // confirmEmailEmail generates an email for confirming that the user owns the
 // given email address.
 func confirmEmailEmail(to string, token string) *database.EmailMessage {
@@ -134,3 +174,15 @@ func accountAccessAttemptedEmail(to string) *database.EmailMessage {
 		BodyMime: accountAccessAttemptedMime,
 	}
 }
+
+// checkInEmail generates an email for checking in with a user a few days after
+// they sign up.
+func checkInEmail(to string) *database.EmailMessage {
+	return &database.EmailMessage{
+		From:     From,
+		To:       to,
+		Subject:  checkInSubject,
+		Body:     checkInTempl,
+		BodyMime: checkInMime,
+	}
+}
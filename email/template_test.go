@@ -59,3 +59,20 @@ func TestAccountAccessAttemptedEmail(t *testing.T) {
 		t.Fatalf("Expected the email to go from %s, got %s", From, em.From)
 	}
 }
+
+// TestCheckInEmail ensures that the check-in email is registered as a
+// template and is going to the correct email.
+func TestCheckInEmail(t *testing.T) {
+	to := "user@siasky.net"
+	gen, ok := templates[TemplateCheckIn]
+	if !ok {
+		t.Fatal("Check-in template not registered.")
+	}
+	em := gen(to)
+	if em.To != to {
+		t.Fatalf("Expected the email to go to %s, got %s", to, em.To)
+	}
+	if em.Subject != checkInSubject {
+		t.Fatalf("Expected subject %s, got %s", checkInSubject, em.Subject)
+	}
+}
@@ -26,13 +26,25 @@ var (
 	// config is the configuration of the argon2id hasher.
 	config = argon2Config{
 		SaltLength:  16,
-		Iterations:  1,
-		Memory:      65536,
+		Iterations:  DefaultIterations,
+		Memory:      DefaultMemory,
 		Parallelism: 4,
 		KeyLength:   16,
 	}
 )
 
+const (
+	// DefaultIterations is the default number of passes over the memory
+	// argon2id makes when hashing a password.
+	DefaultIterations = 1
+	// DefaultMemory is the default amount of memory in KiB argon2id uses when
+	// hashing a password.
+	DefaultMemory = 65536
+	// minMemory is the smallest amount of memory in KiB we allow argon2id to
+	// use. Going below that makes the hashes too cheap to brute-force.
+	minMemory = 8 * 1024
+)
+
 type (
 	// Argon2HashRecord represents a password hashed with argon2id and combined
 	// with the settings used for the hash creation using the standard argon2id
@@ -50,6 +62,23 @@ type (
 	}
 )
 
+// SetCost sets the number of iterations and the amount of memory in KiB
+// argon2id uses when generating new password hashes. Hashes generated with a
+// different cost remain valid because each hash record contains the settings
+// used for its creation. This is not thread-safe and should only be called on
+// startup.
+func SetCost(iterations, memory uint32) error {
+	if iterations == 0 {
+		return errors.New("the number of iterations must be positive")
+	}
+	if memory < minMemory {
+		return fmt.Errorf("memory must be at least %d KiB", minMemory)
+	}
+	config.Iterations = iterations
+	config.Memory = memory
+	return nil
+}
+
 // Generate returns an argon2 hash record of the given data. That hash record
 // will be produced using the configuration settings in the `config` variable.
 // The hash record contains not only the hash itself but also the configuration
@@ -72,3 +72,49 @@ func TestGenerateCompare(t *testing.T) {
 		t.Fatal("Password and hash don't match")
 	}
 }
+
+// TestSetCost ensures that changing the hashing cost doesn't invalidate
+// existing hashes.
+func TestSetCost(t *testing.T) {
+	defer func() {
+		if err := SetCost(DefaultIterations, DefaultMemory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// Invalid values are rejected.
+	if err := SetCost(0, DefaultMemory); err == nil {
+		t.Fatal("Expected an error for zero iterations.")
+	}
+	if err := SetCost(DefaultIterations, minMemory-1); err == nil {
+		t.Fatal("Expected an error for too little memory.")
+	}
+	// Generate a hash with the default cost.
+	pw := string(fastrand.Bytes(32))
+	hash, err := Generate(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Increase the cost and make sure new hashes use it.
+	err = SetCost(2, 2*DefaultMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := Generate(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, _, _, err := decodeHash(hash2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac.Iterations != 2 || ac.Memory != 2*DefaultMemory {
+		t.Fatalf("Unexpected hash settings %+v", ac)
+	}
+	// Both hashes still match the password.
+	if err = Compare(pw, hash); err != nil {
+		t.Fatal("Password doesn't match the hash created with the old cost.", err)
+	}
+	if err = Compare(pw, hash2); err != nil {
+		t.Fatal("Password doesn't match the hash created with the new cost.", err)
+	}
+}
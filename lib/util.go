@@ -2,6 +2,7 @@ package lib
 
 import (
 	"encoding/hex"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -11,3 +12,14 @@ func GenerateUUID() (string, error) {
 	uid := uuid.New()
 	return hex.EncodeToString(uid[:]), nil
 }
+
+// NormalizeEmail brings the given email address to the form in which we store
+// it, so we can compare addresses regardless of how the user typed them.
+//
+// NOTE: We don't remove dots or "+" suffixes from the local part, even for
+// providers that ignore them (e.g. Gmail). Doing so would change the meaning
+// of addresses at other providers and would no longer match the addresses we
+// have already stored.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -8,11 +8,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
 	"github.com/SkynetLabs/skynet-accounts/build"
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/SkynetLabs/skynet-accounts/hash"
 	"github.com/SkynetLabs/skynet-accounts/jwt"
 	"github.com/SkynetLabs/skynet-accounts/metafetcher"
 	"github.com/joho/godotenv"
@@ -40,11 +42,32 @@ const (
 	// envEmailFrom holds the name of the environment variable that allows us to
 	// override the "from" address of our emails to users.
 	envEmailFrom = "ACCOUNTS_EMAIL_FROM"
+	// envEmailAuditAddress holds the name of the environment variable which
+	// sets an address that receives a blind copy of every email we send.
+	envEmailAuditAddress = "ACCOUNTS_EMAIL_AUDIT_ADDRESS"
+	// envEmailCheckMX holds the name of the environment variable which tells
+	// the mailer to check that the recipient's domain has MX records.
+	envEmailCheckMX = "ACCOUNTS_EMAIL_CHECK_MX"
+	// envEmailDryRun holds the name of the environment variable which tells
+	// the email sender to process emails without actually sending them.
+	envEmailDryRun = "ACCOUNTS_EMAIL_DRY_RUN"
+	// envEmailMaxPerRecipient holds the name of the environment variable
+	// which limits the number of emails we send to a single address per hour.
+	envEmailMaxPerRecipient = "ACCOUNTS_EMAIL_MAX_PER_RECIPIENT"
+	// envEmailSendConcurrency holds the name of the environment variable which
+	// defines how many emails a single sender can send concurrently.
+	envEmailSendConcurrency = "ACCOUNTS_EMAIL_SEND_CONCURRENCY"
 	// envEmailURI holds the name of the environment variable for email URI.
 	envEmailURI = "ACCOUNTS_EMAIL_URI"
 	// envLogLevel holds the name of the environment variable which defines the
 	// desired log level.
 	envLogLevel = "SKYNET_ACCOUNTS_LOG_LEVEL"
+	// envPasswordHashIterations holds the name of the environment variable
+	// which sets the number of iterations we use when hashing passwords.
+	envPasswordHashIterations = "ACCOUNTS_PASSWORD_HASH_ITERATIONS"
+	// envPasswordHashMemory holds the name of the environment variable which
+	// sets the amount of memory in KiB we use when hashing passwords.
+	envPasswordHashMemory = "ACCOUNTS_PASSWORD_HASH_MEMORY"
 	// envPortal holds the name of the environment variable for the portal to
 	// use to fetch skylinks and sign JWT tokens.
 	envPortal = "PORTAL_DOMAIN"
@@ -64,23 +87,123 @@ const (
 	// reaches that limit they can always delete some API keys in order to make
 	// space for new ones.
 	envMaxNumAPIKeysPerUser = "ACCOUNTS_MAX_NUM_API_KEYS_PER_USER" // #nosec
+	// envMinTierForAPIKeys holds the name of the environment variable which
+	// sets the lowest tier which is allowed to create API keys.
+	envMinTierForAPIKeys = "ACCOUNTS_MIN_TIER_FOR_API_KEYS" // #nosec
+	// envQuotaToleranceBytes holds the name of the environment variable which
+	// sets the number of bytes by which users can exceed their storage limit
+	// before being flagged as having exceeded their quota.
+	envQuotaToleranceBytes = "ACCOUNTS_QUOTA_TOLERANCE_BYTES"
+	// envQuotaTolerancePercent holds the name of the environment variable
+	// which sets the percentage of their storage limit by which users can
+	// exceed it before being flagged as having exceeded their quota.
+	envQuotaTolerancePercent = "ACCOUNTS_QUOTA_TOLERANCE_PERCENT"
+	// envDownloadTokenSecret holds the name of the environment variable which
+	// sets the secret used for signing download tokens for the CDN.
+	envDownloadTokenSecret = "ACCOUNTS_DOWNLOAD_TOKEN_SECRET"
+	// envSkylinkValidationMode holds the name of the environment variable
+	// which defines which skylink versions we accept in API keys. Valid values
+	// are "both", "v1" and "v2".
+	envSkylinkValidationMode = "ACCOUNTS_SKYLINK_VALIDATION_MODE"
+	// envUploadWarningThreshold holds the name of the environment variable
+	// which sets the fraction of their limits above which users get a warning
+	// when uploading.
+	envUploadWarningThreshold = "ACCOUNTS_UPLOAD_WARNING_THRESHOLD"
+	// envMaxFailedLogins holds the name of the environment variable which
+	// sets the number of consecutive failed logins after which we temporarily
+	// lock the user's account.
+	envMaxFailedLogins = "ACCOUNTS_MAX_FAILED_LOGINS"
+	// envLoginLockoutDuration holds the name of the environment variable which
+	// sets for how many seconds we lock the user's account after too many
+	// failed logins.
+	envLoginLockoutDuration = "ACCOUNTS_LOGIN_LOCKOUT_DURATION"
+	// envEmailConfirmationGracePeriod holds the name of the environment
+	// variable which sets for how many seconds after signing up users can use
+	// their account without confirming their email address.
+	envEmailConfirmationGracePeriod = "ACCOUNTS_EMAIL_CONFIRMATION_GRACE_PERIOD"
+	// envEmailConfirmationTokenTTL holds the name of the environment variable
+	// which sets for how many seconds email confirmation tokens are valid.
+	envEmailConfirmationTokenTTL = "ACCOUNTS_EMAIL_CONFIRMATION_TOKEN_TTL"
+	// envRecoveryTokenCooldown holds the name of the environment variable
+	// which sets for how many seconds users need to wait before requesting a
+	// new account recovery token.
+	envRecoveryTokenCooldown = "ACCOUNTS_RECOVERY_TOKEN_COOLDOWN"
+	// envRecoveryTokenTTL holds the name of the environment variable which
+	// sets for how many seconds account recovery tokens are valid.
+	envRecoveryTokenTTL = "ACCOUNTS_RECOVERY_TOKEN_TTL"
+	// envDowngradePolicy holds the name of the environment variable which
+	// defines what happens when users downgrade below the content they own.
+	envDowngradePolicy = "ACCOUNTS_DOWNGRADE_POLICY"
+	// envDowngradeGracePeriod holds the name of the environment variable
+	// which sets for how many seconds users who downgraded below the content
+	// they own can keep uploading under the grace-period policy.
+	envDowngradeGracePeriod = "ACCOUNTS_DOWNGRADE_GRACE_PERIOD"
+	// envSubscriptionLapseGracePeriod holds the name of the environment
+	// variable which sets for how many seconds after the end of their paid
+	// period users keep their tier before a lapsed subscription is expired.
+	envSubscriptionLapseGracePeriod = "ACCOUNTS_SUBSCRIPTION_LAPSE_GRACE_PERIOD"
+	// envSkipDBSchema holds the name of the environment variable which tells
+	// the service not to ensure the DB schema (collections and indexes) on
+	// startup. This is useful when running against a read-only replica.
+	envSkipDBSchema = "ACCOUNTS_SKIP_DB_SCHEMA"
+	// envReferrerAliases holds the name of the environment variable which
+	// defines the aliases under which we report referrers in traffic stats.
+	envReferrerAliases = "ACCOUNTS_REFERRER_ALIASES"
+	// envReferrerDenylist holds the name of the environment variable which
+	// defines the referrers whose traffic is not billed to users.
+	envReferrerDenylist = "ACCOUNTS_REFERRER_DENYLIST"
+	// envMonthlyPricePlus holds the name of the environment variable which
+	// sets the monthly price of the "plus" tier in cents.
+	envMonthlyPricePlus = "ACCOUNTS_MONTHLY_PRICE_PLUS"
+	// envMonthlyPricePro holds the name of the environment variable which
+	// sets the monthly price of the "pro" tier in cents.
+	envMonthlyPricePro = "ACCOUNTS_MONTHLY_PRICE_PRO"
+	// envMonthlyPriceExtreme holds the name of the environment variable which
+	// sets the monthly price of the "extreme" tier in cents.
+	envMonthlyPriceExtreme = "ACCOUNTS_MONTHLY_PRICE_EXTREME"
 )
 
 type (
 	// ServiceConfig represents all configuration values we expect to receive
 	// via environment variables or config files.
 	ServiceConfig struct {
-		DBCreds               database.DBCredentials
-		PortalName            string
-		PortalAddressAccounts string
-		Promoter              string
-		ServerLockID          string
-		StripeKey             string
-		JWKSFile              string
-		JWTTTL                int
-		EmailURI              string
-		EmailFrom             string
-		MaxAPIKeys            int
+		DBCreds                database.DBCredentials
+		PortalName             string
+		PortalAddressAccounts  string
+		Promoter               string
+		ServerLockID           string
+		StripeKey              string
+		JWKSFile               string
+		JWTTTL                 int
+		EmailURI               string
+		EmailFrom              string
+		EmailAuditAddress      string
+		EmailDryRun            bool
+		EmailCheckMX           bool
+		EmailMaxPerRecipient   int
+		EmailSendConcurrency   int
+		MaxAPIKeys             int
+		MinTierForAPIKeys      int
+		SkipDBSchema           bool
+		QuotaToleranceBytes    int64
+		QuotaTolerancePercent  float64
+		PasswordHashIter       uint32
+		PasswordHashMemory     uint32
+		DownloadTokenSecret    string
+		SkylinkValidationMode  string
+		UploadWarningThreshold float64
+		MaxFailedLogins        int
+		LoginLockoutDuration   time.Duration
+		EmailConfirmationGrace time.Duration
+		EmailConfirmationTTL   time.Duration
+		RecoveryTokenCooldown  time.Duration
+		RecoveryTokenTTL       time.Duration
+		DowngradePolicy        string
+		DowngradeGracePeriod   time.Duration
+		SubscriptionLapseGrace time.Duration
+		ReferrerAliases        map[string]string
+		ReferrerDenylist       map[string]struct{}
+		MonthlyPrices          map[int]int64
 	}
 )
 
@@ -209,6 +332,48 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 			config.EmailFrom = email.From
 		}
 	}
+	config.EmailAuditAddress = os.Getenv(envEmailAuditAddress)
+	if dryRunStr, exists := os.LookupEnv(envEmailDryRun); exists {
+		dryRun, err := strconv.ParseBool(dryRunStr)
+		if err != nil {
+			log.Printf("Warning: Failed to parse %s env var. Error: %s", envEmailDryRun, err.Error())
+		}
+		config.EmailDryRun = dryRun
+	}
+	if checkMXStr, exists := os.LookupEnv(envEmailCheckMX); exists {
+		checkMX, err := strconv.ParseBool(checkMXStr)
+		if err != nil {
+			log.Printf("Warning: Failed to parse %s env var. Error: %s", envEmailCheckMX, err.Error())
+		}
+		config.EmailCheckMX = checkMX
+	}
+	// Fetch the configuration for the number of emails a single address can
+	// receive per hour.
+	config.EmailMaxPerRecipient = email.MaxEmailsPerRecipient
+	if maxStr, exists := os.LookupEnv(envEmailMaxPerRecipient); exists {
+		maxPerRecipient, err := strconv.Atoi(maxStr)
+		if err != nil || maxPerRecipient < 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envEmailMaxPerRecipient, email.MaxEmailsPerRecipient)
+		} else {
+			config.EmailMaxPerRecipient = maxPerRecipient
+		}
+	}
+	// Fetch the configuration for the number of emails we send concurrently.
+	if concurrencyStr, exists := os.LookupEnv(envEmailSendConcurrency); exists {
+		concurrency, err := strconv.Atoi(concurrencyStr)
+		if err != nil {
+			log.Printf("Warning: Failed to parse %s env var. Error: %s", envEmailSendConcurrency, err.Error())
+		}
+		if concurrency > 0 {
+			config.EmailSendConcurrency = concurrency
+		} else {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envEmailSendConcurrency, email.SendConcurrency)
+			config.EmailSendConcurrency = email.SendConcurrency
+		}
+	} else {
+		// The environment doesn't specify a value, use the default.
+		config.EmailSendConcurrency = email.SendConcurrency
+	}
 	// Fetch the configuration for maximum number of API keys allowed per user.
 	if maxAPIKeysStr, exists := os.LookupEnv(envMaxNumAPIKeysPerUser); exists {
 		maxAPIKeys, err := strconv.Atoi(maxAPIKeysStr)
@@ -225,6 +390,189 @@ func parseConfiguration(logger *logrus.Logger) (ServiceConfig, error) {
 		// The environment doesn't specify a value, use the default.
 		config.MaxAPIKeys = database.MaxNumAPIKeysPerUser
 	}
+	config.MinTierForAPIKeys = database.MinTierForAPIKeys
+	if minTierStr, exists := os.LookupEnv(envMinTierForAPIKeys); exists {
+		minTier, err := strconv.Atoi(minTierStr)
+		if err != nil || minTier < database.TierAnonymous || minTier >= database.TierMaxReserved {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envMinTierForAPIKeys, database.MinTierForAPIKeys)
+		} else {
+			config.MinTierForAPIKeys = minTier
+		}
+	}
+	// Fetch the cost of hashing passwords.
+	config.PasswordHashIter = hash.DefaultIterations
+	if iterStr, exists := os.LookupEnv(envPasswordHashIterations); exists {
+		iter, err := strconv.ParseUint(iterStr, 10, 32)
+		if err != nil || iter == 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envPasswordHashIterations, hash.DefaultIterations)
+		} else {
+			config.PasswordHashIter = uint32(iter)
+		}
+	}
+	config.PasswordHashMemory = hash.DefaultMemory
+	if memStr, exists := os.LookupEnv(envPasswordHashMemory); exists {
+		mem, err := strconv.ParseUint(memStr, 10, 32)
+		if err != nil || mem == 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envPasswordHashMemory, hash.DefaultMemory)
+		} else {
+			config.PasswordHashMemory = uint32(mem)
+		}
+	}
+	// Fetch the quota tolerance.
+	if tolStr, exists := os.LookupEnv(envQuotaToleranceBytes); exists {
+		tol, err := strconv.ParseInt(tolStr, 10, 64)
+		if err != nil || tol < 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envQuotaToleranceBytes, database.QuotaToleranceBytes)
+		} else {
+			config.QuotaToleranceBytes = tol
+		}
+	}
+	if tolStr, exists := os.LookupEnv(envQuotaTolerancePercent); exists {
+		tol, err := strconv.ParseFloat(tolStr, 64)
+		if err != nil || tol < 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %f is used.", envQuotaTolerancePercent, database.QuotaTolerancePercent)
+		} else {
+			config.QuotaTolerancePercent = tol
+		}
+	}
+	config.DownloadTokenSecret = os.Getenv(envDownloadTokenSecret)
+	config.SkylinkValidationMode = database.SkylinkValidationMode
+	if mode, exists := os.LookupEnv(envSkylinkValidationMode); exists {
+		if !database.ValidSkylinkValidationMode(mode) {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %s is used.", envSkylinkValidationMode, database.SkylinkValidationMode)
+		} else {
+			config.SkylinkValidationMode = mode
+		}
+	}
+	config.UploadWarningThreshold = database.UploadWarningThreshold
+	if thStr, exists := os.LookupEnv(envUploadWarningThreshold); exists {
+		th, err := strconv.ParseFloat(thStr, 64)
+		if err != nil || th <= 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %f is used.", envUploadWarningThreshold, database.UploadWarningThreshold)
+		} else {
+			config.UploadWarningThreshold = th
+		}
+	}
+	// Fetch the account lockout configuration.
+	config.MaxFailedLogins = database.MaxFailedLoginAttempts
+	if maxStr, exists := os.LookupEnv(envMaxFailedLogins); exists {
+		maxFailed, err := strconv.Atoi(maxStr)
+		if err != nil || maxFailed < 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envMaxFailedLogins, database.MaxFailedLoginAttempts)
+		} else {
+			config.MaxFailedLogins = maxFailed
+		}
+	}
+	config.LoginLockoutDuration = database.LoginLockoutDuration
+	if durStr, exists := os.LookupEnv(envLoginLockoutDuration); exists {
+		dur, err := strconv.Atoi(durStr)
+		if err != nil || dur <= 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envLoginLockoutDuration, int(database.LoginLockoutDuration.Seconds()))
+		} else {
+			config.LoginLockoutDuration = time.Duration(dur) * time.Second
+		}
+	}
+	config.EmailConfirmationGrace = database.EmailConfirmationGracePeriod
+	if graceStr, exists := os.LookupEnv(envEmailConfirmationGracePeriod); exists {
+		grace, err := strconv.Atoi(graceStr)
+		if err != nil || grace < 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envEmailConfirmationGracePeriod, int(database.EmailConfirmationGracePeriod.Seconds()))
+		} else {
+			config.EmailConfirmationGrace = time.Duration(grace) * time.Second
+		}
+	}
+	config.EmailConfirmationTTL = database.EmailConfirmationTokenTTL
+	if ttlStr, exists := os.LookupEnv(envEmailConfirmationTokenTTL); exists {
+		ttl, err := strconv.Atoi(ttlStr)
+		if err != nil || ttl <= 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envEmailConfirmationTokenTTL, int(database.EmailConfirmationTokenTTL.Seconds()))
+		} else {
+			config.EmailConfirmationTTL = time.Duration(ttl) * time.Second
+		}
+	}
+	config.RecoveryTokenCooldown = database.RecoveryTokenCooldown
+	if cdStr, exists := os.LookupEnv(envRecoveryTokenCooldown); exists {
+		cd, err := strconv.Atoi(cdStr)
+		if err != nil || cd < 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envRecoveryTokenCooldown, int(database.RecoveryTokenCooldown.Seconds()))
+		} else {
+			config.RecoveryTokenCooldown = time.Duration(cd) * time.Second
+		}
+	}
+	config.RecoveryTokenTTL = database.RecoveryTokenTTL
+	if ttlStr, exists := os.LookupEnv(envRecoveryTokenTTL); exists {
+		ttl, err := strconv.Atoi(ttlStr)
+		if err != nil || ttl <= 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envRecoveryTokenTTL, int(database.RecoveryTokenTTL.Seconds()))
+		} else {
+			config.RecoveryTokenTTL = time.Duration(ttl) * time.Second
+		}
+	}
+	config.DowngradePolicy = database.DowngradePolicy
+	if policy, exists := os.LookupEnv(envDowngradePolicy); exists {
+		if !database.ValidDowngradePolicy(policy) {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %s is used.", envDowngradePolicy, database.DowngradePolicy)
+		} else {
+			config.DowngradePolicy = policy
+		}
+	}
+	config.DowngradeGracePeriod = database.DowngradeGracePeriod
+	if graceStr, exists := os.LookupEnv(envDowngradeGracePeriod); exists {
+		grace, err := strconv.Atoi(graceStr)
+		if err != nil || grace <= 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envDowngradeGracePeriod, int(database.DowngradeGracePeriod.Seconds()))
+		} else {
+			config.DowngradeGracePeriod = time.Duration(grace) * time.Second
+		}
+	}
+	config.SubscriptionLapseGrace = database.SubscriptionLapseGracePeriod
+	if graceStr, exists := os.LookupEnv(envSubscriptionLapseGracePeriod); exists {
+		grace, err := strconv.Atoi(graceStr)
+		if err != nil || grace < 0 {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envSubscriptionLapseGracePeriod, int(database.SubscriptionLapseGracePeriod.Seconds()))
+		} else {
+			config.SubscriptionLapseGrace = time.Duration(grace) * time.Second
+		}
+	}
+	config.ReferrerAliases = database.ReferrerAliases
+	if aliasesStr, exists := os.LookupEnv(envReferrerAliases); exists {
+		aliases, err := database.ParseReferrerAliases(aliasesStr)
+		if err != nil {
+			log.Printf("Warning: Invalid value of %s. The invalid value is ignored and no aliases are used. Error: %s", envReferrerAliases, err.Error())
+		} else {
+			config.ReferrerAliases = aliases
+		}
+	}
+	config.ReferrerDenylist = database.ReferrerDenylist
+	if denylistStr, exists := os.LookupEnv(envReferrerDenylist); exists {
+		config.ReferrerDenylist = database.ParseReferrerDenylist(denylistStr)
+	}
+	// Fetch the monthly prices of the paid tiers.
+	config.MonthlyPrices = make(map[int]int64)
+	priceEnvVars := map[int]string{
+		database.TierPremium5:  envMonthlyPricePlus,
+		database.TierPremium20: envMonthlyPricePro,
+		database.TierPremium80: envMonthlyPriceExtreme,
+	}
+	for tier, envVar := range priceEnvVars {
+		config.MonthlyPrices[tier] = database.UserLimits[tier].MonthlyPrice
+		if priceStr, exists := os.LookupEnv(envVar); exists {
+			price, err := strconv.ParseInt(priceStr, 10, 64)
+			if err != nil || price < 0 {
+				log.Printf("Warning: Invalid value of %s. The invalid value is ignored and the default value of %d is used.", envVar, database.UserLimits[tier].MonthlyPrice)
+			} else {
+				config.MonthlyPrices[tier] = price
+			}
+		}
+	}
+	// Check whether we should skip ensuring the DB schema on startup.
+	if skipSchemaStr, exists := os.LookupEnv(envSkipDBSchema); exists {
+		skipSchema, err := strconv.ParseBool(skipSchemaStr)
+		if err != nil {
+			log.Printf("Warning: Failed to parse %s env var. Error: %s", envSkipDBSchema, err.Error())
+		}
+		config.SkipDBSchema = skipSchema
+	}
 
 	return config, nil
 }
@@ -252,7 +600,38 @@ func main() {
 	jwt.AccountsJWKSFile = config.JWKSFile
 	jwt.TTL = config.JWTTTL
 	email.From = config.EmailFrom
+	email.AuditAddress = config.EmailAuditAddress
+	email.DryRun = config.EmailDryRun
+	email.CheckMX = config.EmailCheckMX
+	email.MaxEmailsPerRecipient = config.EmailMaxPerRecipient
+	email.SendConcurrency = config.EmailSendConcurrency
 	database.MaxNumAPIKeysPerUser = config.MaxAPIKeys
+	database.MinTierForAPIKeys = config.MinTierForAPIKeys
+	database.SkipDBSchema = config.SkipDBSchema
+	database.QuotaToleranceBytes = config.QuotaToleranceBytes
+	database.QuotaTolerancePercent = config.QuotaTolerancePercent
+	database.DownloadTokenSecret = config.DownloadTokenSecret
+	database.SkylinkValidationMode = config.SkylinkValidationMode
+	database.UploadWarningThreshold = config.UploadWarningThreshold
+	database.MaxFailedLoginAttempts = config.MaxFailedLogins
+	database.LoginLockoutDuration = config.LoginLockoutDuration
+	database.EmailConfirmationGracePeriod = config.EmailConfirmationGrace
+	database.RecoveryTokenCooldown = config.RecoveryTokenCooldown
+	database.RecoveryTokenTTL = config.RecoveryTokenTTL
+	database.DowngradePolicy = config.DowngradePolicy
+	database.DowngradeGracePeriod = config.DowngradeGracePeriod
+	database.SubscriptionLapseGracePeriod = config.SubscriptionLapseGrace
+	database.ReferrerAliases = config.ReferrerAliases
+	database.ReferrerDenylist = config.ReferrerDenylist
+	for tier, price := range config.MonthlyPrices {
+		limits := database.UserLimits[tier]
+		limits.MonthlyPrice = price
+		database.UserLimits[tier] = limits
+	}
+	err = hash.SetCost(config.PasswordHashIter, config.PasswordHashMemory)
+	if err != nil {
+		log.Fatal(errors.AddContext(err, "invalid password hashing cost"))
+	}
 
 	// Set up key components:
 
@@ -262,7 +641,7 @@ func main() {
 		log.Fatal(errors.AddContext(err, fmt.Sprintf("failed to load JWKS file from %s", jwt.AccountsJWKSFile)))
 	}
 	// Connect to the database.
-	db, err := database.New(ctx, config.DBCreds, logger)
+	db, err := database.New(ctx, config.DBCreds, logger, config.EmailConfirmationTTL)
 	if err != nil {
 		log.Fatal(errors.AddContext(err, "failed to connect to the DB"))
 	}
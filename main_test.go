@@ -31,6 +31,9 @@ func TestParseConfiguration(t *testing.T) {
 			envEmailURI,
 			envEmailFrom,
 			envMaxNumAPIKeysPerUser,
+			envMonthlyPricePlus,
+			envMonthlyPricePro,
+			envMonthlyPriceExtreme,
 		}
 		values := make(map[string]string)
 		for _, k := range keys {
@@ -202,6 +205,11 @@ func TestParseConfiguration(t *testing.T) {
 	if config.MaxAPIKeys != database.MaxNumAPIKeysPerUser {
 		t.Fatalf("Expected %d, got %d", database.MaxNumAPIKeysPerUser, config.MaxAPIKeys)
 	}
+	for _, tier := range []int{database.TierPremium5, database.TierPremium20, database.TierPremium80} {
+		if config.MonthlyPrices[tier] != database.UserLimits[tier].MonthlyPrice {
+			t.Fatalf("Expected price %d for tier %d, got %d", database.UserLimits[tier].MonthlyPrice, tier, config.MonthlyPrices[tier])
+		}
+	}
 
 	// Set alternative config values and test their outcomes.
 
@@ -217,6 +225,17 @@ func TestParseConfiguration(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	price := int64(2500)
+	err = os.Setenv(envMonthlyPricePro, strconv.FormatInt(price, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An invalid price is ignored and the default is used.
+	err = os.Setenv(envMonthlyPricePlus, "-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	config, err = parseConfiguration(logger)
 	if err != nil {
 		t.Fatal(err)
@@ -227,6 +246,12 @@ func TestParseConfiguration(t *testing.T) {
 	if config.MaxAPIKeys != maxKeys {
 		t.Fatalf("Expected %d, got %d", maxKeys, config.MaxAPIKeys)
 	}
+	if config.MonthlyPrices[database.TierPremium20] != price {
+		t.Fatalf("Expected %d, got %d", price, config.MonthlyPrices[database.TierPremium20])
+	}
+	if config.MonthlyPrices[database.TierPremium5] != database.UserLimits[database.TierPremium5].MonthlyPrice {
+		t.Fatalf("Expected %d, got %d", database.UserLimits[database.TierPremium5].MonthlyPrice, config.MonthlyPrices[database.TierPremium5])
+	}
 }
 
 // TestLoadDBCredentials ensures that we validate that all required environment
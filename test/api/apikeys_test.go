@@ -387,3 +387,52 @@ func testAPIKeysAcceptance(t *testing.T, at *test.AccountsTester) {
 		}
 	}
 }
+
+// testAPIKeysSkylinkValidationMode ensures that skylinks of a version which the
+// current validation mode doesn't allow are rejected with a 400 but can still
+// be removed from existing API keys.
+func testAPIKeysSkylinkValidationMode(t *testing.T, at *test.AccountsTester) {
+	name := test.DBNameForTest(t.Name())
+	email := types.NewEmail(name + "@siasky.net")
+	r, body, err := at.UserPOST(email.String(), name+"_pass")
+	if err != nil {
+		t.Fatal(err, string(body))
+	}
+	at.SetCookie(test.ExtractCookie(r))
+	defer at.ClearCredentials()
+
+	slV2 := "AQAh2vxStoSJ_M9tWcTgqebUWerCAbpMfn9xxa9E29UOuw"
+	slV1 := "AADDE7_5MJyl1DKyfbuQMY_XBOBC9bR7idiU6isp6LXxEw"
+	akr, s, err := at.UserAPIKeysPOST(api.APIKeyPOST{Public: true, Skylinks: []string{slV1, slV2}})
+	if err != nil || s != http.StatusOK {
+		t.Fatal(s, err)
+	}
+
+	defer func(mode string) {
+		database.SkylinkValidationMode = mode
+	}(database.SkylinkValidationMode)
+	database.SkylinkValidationMode = database.SkylinkValidationV2
+
+	// New keys can't refer to v1 skylinks.
+	_, s, err = at.UserAPIKeysPOST(api.APIKeyPOST{Public: true, Skylinks: []string{slV1}})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d and error %v", http.StatusBadRequest, s, err)
+	}
+	// Neither can existing ones.
+	s, err = at.UserAPIKeysPATCH(akr.ID, api.APIKeyPATCH{Add: []string{slV1}})
+	if err == nil || s != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d and error %v", http.StatusBadRequest, s, err)
+	}
+	// But v1 skylinks can still be removed.
+	s, err = at.UserAPIKeysPATCH(akr.ID, api.APIKeyPATCH{Remove: []string{slV1}})
+	if err != nil || s != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d and error %v", http.StatusNoContent, s, err)
+	}
+	ak, _, err := at.UserAPIKeysGET(akr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ak.Skylinks) != 1 || ak.Skylinks[0] != slV2 {
+		t.Fatalf("Expected only the v2 skylink to remain, got %v", ak.Skylinks)
+	}
+}
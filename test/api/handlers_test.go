@@ -67,6 +67,7 @@ func TestHandlers(t *testing.T) {
 		{name: "DeletePubKey", test: testUserDeletePubKey},
 		{name: "UserDelete", test: testUserDELETE},
 		{name: "UserLimits", test: testUserLimits},
+		{name: "UserSuspendQuota", test: testUserSuspendQuota},
 		{name: "UserDeleteUploads", test: testUserUploadsDELETE},
 		{name: "UserConfirmReconfirmEmail", test: testUserConfirmReconfirmEmailGET},
 		{name: "UserAccountRecovery", test: testUserAccountRecovery},
@@ -79,6 +80,7 @@ func TestHandlers(t *testing.T) {
 		{name: "PublicAPIKeysFlow", test: testPublicAPIKeysFlow},
 		{name: "PublicAPIKeysUsage", test: testPublicAPIKeysUsage},
 		{name: "APIKeysAcceptance", test: testAPIKeysAcceptance},
+		{name: "APIKeysSkylinkValidationMode", test: testAPIKeysSkylinkValidationMode},
 		{name: "UploadInfo", test: testUploadInfo},
 	}
 
@@ -403,15 +405,15 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.DownloadCreate(at.Ctx, *u.User, *sl, 128)
+	_, err = at.DB.DownloadCreate(at.Ctx, *u.User, *sl, 128, database.TrafficMeta{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.RegistryWriteCreate(at.Ctx, *u.User)
+	_, err = at.DB.RegistryWriteCreate(at.Ctx, *u.User, "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = at.DB.RegistryReadCreate(at.Ctx, *u.User)
+	_, err = at.DB.RegistryReadCreate(at.Ctx, *u.User, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -449,6 +451,54 @@ func testUserDELETE(t *testing.T, at *test.AccountsTester) {
 	}
 }
 
+// testUserSuspendQuota ensures that suspending a user doesn't leave them
+// flagged as having exceeded their quota once they are unsuspended.
+func testUserSuspendQuota(t *testing.T, at *test.AccountsTester) {
+	u, c, err := test.CreateUserAndLogin(at, t.Name())
+	if err != nil {
+		t.Fatal("Failed to create a user and log in:", err)
+	}
+	defer func() {
+		if err = u.Delete(at.Ctx); err != nil {
+			t.Error(errors.AddContext(err, "failed to delete user in defer"))
+		}
+	}()
+	at.SetCookie(c)
+	defer at.ClearCredentials()
+
+	err = at.DB.UserSuspend(at.Ctx, u.User, "abuse report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Track an upload well within the user's limits. This triggers the
+	// checkUserQuotas method in the background.
+	sl, _, err := test.CreateTestUpload(at.Ctx, at.DB, *u.User, skynet.KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = at.TrackUpload(sl.Skylink, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the background quota check time to run.
+	time.Sleep(time.Second)
+
+	err = at.DB.UserUnsuspend(at.Ctx, u.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := at.DB.UserByID(at.Ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.QuotaExceeded {
+		t.Fatal("Expected the user not to be flagged as over quota.")
+	}
+	if u2.IsRestricted() {
+		t.Fatal("Expected the unsuspended user not to be restricted.")
+	}
+}
+
 // testUserLimits tests the /user/limits endpoint.
 func testUserLimits(t *testing.T, at *test.AccountsTester) {
 	u, c, err := test.CreateUserAndLogin(at, t.Name())
@@ -2,10 +2,17 @@ package database
 
 import (
 	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // TestAPIKeys ensures the DB operations with API keys work as expected.
@@ -27,7 +34,7 @@ func TestAPIKeys(t *testing.T) {
 	sl2 := test.RandomSkylink()
 
 	// Create a private API key.
-	akr1, err := db.APIKeyCreate(ctx, *u, "keyname", false, nil)
+	akr1, err := db.APIKeyCreate(ctx, *u, "keyname", false, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,17 +42,17 @@ func TestAPIKeys(t *testing.T) {
 		t.Fatal("Unexpected name.")
 	}
 	// Create a private API key with skylinks. Expect to fail.
-	_, err = db.APIKeyCreate(ctx, *u, "", false, []string{sl1})
+	_, err = db.APIKeyCreate(ctx, *u, "", false, []string{sl1}, nil)
 	if err == nil {
 		t.Fatal("Managed to create a private API key with skylinks.")
 	}
 	// Create a public API key
-	akr2, err := db.APIKeyCreate(ctx, *u, "", true, []string{sl1})
+	akr2, err := db.APIKeyCreate(ctx, *u, "", true, []string{sl1}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Create a public API key without any skylinks.
-	akr3, err := db.APIKeyCreate(ctx, *u, "", true, nil)
+	akr3, err := db.APIKeyCreate(ctx, *u, "", true, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -153,3 +160,690 @@ func TestAPIKeys(t *testing.T) {
 		}
 	}
 }
+
+// TestAPIKeyPatchOtherUser ensures that a user can't patch another user's
+// public API key.
+func TestAPIKeyPatchOtherUser(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uA, err := db.UserCreate(ctx, "", "", t.Name()+"A", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uB, err := db.UserCreate(ctx, "", "", t.Name()+"B", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+	akr, err := db.APIKeyCreate(ctx, *uA, "", true, []string{sl1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// User B tries to add a skylink to user A's key.
+	err = db.APIKeyPatch(ctx, *uB, akr.ID, []string{sl2}, nil)
+	if err == nil {
+		t.Fatal("Expected to be unable to patch another user's API key.")
+	}
+	// User B tries to remove a skylink from user A's key.
+	err = db.APIKeyPatch(ctx, *uB, akr.ID, nil, []string{sl1})
+	if err == nil {
+		t.Fatal("Expected to be unable to patch another user's API key.")
+	}
+	// Make sure the key is unchanged.
+	akrA, err := db.APIKeyGet(ctx, akr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !akrA.CoversSkylink(sl1) || akrA.CoversSkylink(sl2) {
+		t.Fatalf("Expected the API key to be unchanged, got skylinks %v", akrA.Skylinks)
+	}
+	// User A can still patch their own key.
+	err = db.APIKeyPatch(ctx, *uA, akr.ID, []string{sl2}, []string{sl1})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUserCoversSkylink ensures that UserCoversSkylink correctly reports
+// whether any of the user's API keys covers a given skylink.
+func TestUserCoversSkylink(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl1 := test.RandomSkylink()
+	sl2 := test.RandomSkylink()
+
+	// Neither user has any API keys, so the skylink is not covered.
+	covered, err := db.UserCoversSkylink(ctx, u1.ID, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covered {
+		t.Fatal("Expected the skylink not to be covered.")
+	}
+	// Give the first user a public API key which covers the skylink and the
+	// second user one which doesn't.
+	_, err = db.APIKeyCreate(ctx, *u1, "", true, []string{sl1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.APIKeyCreate(ctx, *u2, "", true, []string{sl2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered, err = db.UserCoversSkylink(ctx, u1.ID, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !covered {
+		t.Fatal("Expected the skylink to be covered.")
+	}
+	covered, err = db.UserCoversSkylink(ctx, u2.ID, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covered {
+		t.Fatal("Expected the skylink not to be covered.")
+	}
+	// Give the second user a private API key. That covers all skylinks.
+	_, err = db.APIKeyCreate(ctx, *u2, "", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered, err = db.UserCoversSkylink(ctx, u2.ID, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !covered {
+		t.Fatal("Expected the skylink to be covered by the private API key.")
+	}
+	// An expired private API key doesn't cover anything.
+	u3, err := db.UserCreate(ctx, "", "", t.Name()+"3", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().UTC().Add(200 * time.Millisecond)
+	_, err = db.APIKeyCreate(ctx, *u3, "", false, nil, &exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered, err = db.UserCoversSkylink(ctx, u3.ID, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !covered {
+		t.Fatal("Expected the skylink to be covered by the private API key.")
+	}
+	time.Sleep(time.Until(exp) + 100*time.Millisecond)
+	covered, err = db.UserCoversSkylink(ctx, u3.ID, sl1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covered {
+		t.Fatal("Expected the skylink not to be covered by an expired API key.")
+	}
+	// An invalid skylink should result in an error.
+	_, err = db.UserCoversSkylink(ctx, u1.ID, "invalid skylink")
+	if !errors.Contains(err, database.ErrInvalidSkylink) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrInvalidSkylink, err)
+	}
+}
+
+// TestAPIKeyGlobalStats ensures that APIKeyGlobalStats correctly reports the
+// number of API keys and the distribution of their skylinks.
+func TestAPIKeyGlobalStats(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create two private keys and four public keys with zero, one, one and
+	// three skylinks respectively.
+	for i := 0; i < 2; i++ {
+		_, err = db.APIKeyCreate(ctx, *u, "", false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []int{0, 1, 1, 3} {
+		var skylinks []string
+		for i := 0; i < n; i++ {
+			skylinks = append(skylinks, test.RandomSkylink())
+		}
+		_, err = db.APIKeyCreate(ctx, *u, "", true, skylinks, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := db.APIKeyGlobalStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Private != 2 || stats.Public != 4 {
+		t.Fatalf("Expected %d private and %d public keys, got %d and %d.", 2, 4, stats.Private, stats.Public)
+	}
+	expected := map[int]int64{0: 1, 1: 2, 3: 1}
+	if !reflect.DeepEqual(stats.SkylinksHistogram, expected) {
+		t.Fatalf("Expected histogram %v, got %v.", expected, stats.SkylinksHistogram)
+	}
+}
+
+// TestAPIKeysByKeys ensures that APIKeysByKeys returns the records of all
+// known keys and omits unknown and malformed ones.
+func TestAPIKeysByKeys(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	akr1, err := db.APIKeyCreate(ctx, *u, "", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	akr2, err := db.APIKeyCreate(ctx, *u, "", true, []string{test.RandomSkylink()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := string(database.NewAPIKey())
+	malformed := "not an API key"
+	keys := []string{string(akr1.Key), string(akr2.Key), unknown, malformed}
+	records, err := db.APIKeysByKeys(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d.", len(records))
+	}
+	if records[string(akr1.Key)].ID != akr1.ID || records[string(akr2.Key)].ID != akr2.ID {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+	if _, ok := records[unknown]; ok {
+		t.Fatal("Unexpected record for an unknown key.")
+	}
+	if _, ok := records[malformed]; ok {
+		t.Fatal("Unexpected record for a malformed key.")
+	}
+	// Batches that are too large are rejected.
+	_, err = db.APIKeysByKeys(ctx, make([]string, database.MaxAPIKeysBatchSize+1))
+	if err == nil {
+		t.Fatal("Expected an error for a batch that is too large.")
+	}
+}
+
+// TestAPIKeyCreateMinTier ensures that APIKeyCreate respects
+// MinTierForAPIKeys.
+func TestAPIKeyCreateMinTier(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(minTier int) {
+		database.MinTierForAPIKeys = minTier
+	}(database.MinTierForAPIKeys)
+	database.MinTierForAPIKeys = database.TierPremium5
+
+	free, err := db.UserCreate(ctx, "", "", t.Name()+"free", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	premium, err := db.UserCreate(ctx, "", "", t.Name()+"premium", database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.APIKeyCreate(ctx, *free, "", false, nil, nil)
+	if !errors.Contains(err, database.ErrAPIKeyTierTooLow) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrAPIKeyTierTooLow, err)
+	}
+	_, err = db.APIKeyCreate(ctx, *premium, "", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAPIKeyCreateTierLimit ensures that APIKeyCreate respects the per-tier
+// limit on the number of API keys.
+func TestAPIKeyCreateTierLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeCap := 10
+	defer func(limits database.TierLimits) {
+		database.UserLimits[database.TierFree] = limits
+	}(database.UserLimits[database.TierFree])
+	limits := database.UserLimits[database.TierFree]
+	limits.MaxAPIKeys = freeCap
+	database.UserLimits[database.TierFree] = limits
+
+	free, err := db.UserCreate(ctx, "", "", t.Name()+"free", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	premium, err := db.UserCreate(ctx, "", "", t.Name()+"premium", database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The free user can create keys up to their tier's cap but not beyond.
+	for i := 0; i < freeCap; i++ {
+		_, err = db.APIKeyCreate(ctx, *free, "", false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.APIKeyCreate(ctx, *free, "", false, nil, nil)
+	if !errors.Contains(err, database.ErrMaxNumAPIKeysExceeded) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrMaxNumAPIKeysExceeded, err)
+	}
+	// The premium user falls back to the global limit.
+	for i := 0; i < freeCap+1; i++ {
+		_, err = db.APIKeyCreate(ctx, *premium, "", false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestAPIKeyCreateGlobalLimit ensures that users can create exactly
+// MaxNumAPIKeysPerUser API keys when their tier doesn't define its own limit.
+func TestAPIKeyCreateGlobalLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(max int) {
+		database.MaxNumAPIKeysPerUser = max
+	}(database.MaxNumAPIKeysPerUser)
+	database.MaxNumAPIKeysPerUser = 5
+
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < database.MaxNumAPIKeysPerUser; i++ {
+		_, err = db.APIKeyCreate(ctx, *u, "", false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create key %d: %v", i+1, err)
+		}
+	}
+	_, err = db.APIKeyCreate(ctx, *u, "", false, nil, nil)
+	if !errors.Contains(err, database.ErrMaxNumAPIKeysExceeded) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrMaxNumAPIKeysExceeded, err)
+	}
+	aks, err := db.APIKeyList(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aks) != database.MaxNumAPIKeysPerUser {
+		t.Fatalf("Expected %d API keys, got %d.", database.MaxNumAPIKeysPerUser, len(aks))
+	}
+}
+
+// TestStreamAPIKeys ensures that StreamAPIKeys goes over each API key exactly
+// once and stops on errors.
+func TestStreamAPIKeys(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numKeys := 150
+	created := make(map[primitive.ObjectID]bool)
+	for i := 0; i < numKeys; i++ {
+		akr, err := db.APIKeyCreate(ctx, *u, "", false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created[akr.ID] = true
+	}
+	seen := make(map[primitive.ObjectID]int)
+	err = db.StreamAPIKeys(ctx, func(akr database.APIKeyRecord) error {
+		seen[akr.ID]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != numKeys {
+		t.Fatalf("Expected %d keys, got %d.", numKeys, len(seen))
+	}
+	for id, n := range seen {
+		if !created[id] || n != 1 {
+			t.Fatalf("Expected key %s to be seen once, got %d.", id.Hex(), n)
+		}
+	}
+	// Errors returned by the callback stop the iteration.
+	errStop := errors.New("stop")
+	calls := 0
+	err = db.StreamAPIKeys(ctx, func(database.APIKeyRecord) error {
+		calls++
+		return errStop
+	})
+	if !errors.Contains(err, errStop) || calls != 1 {
+		t.Fatalf("Expected a single call and error '%v', got %d calls and '%v'.", errStop, calls, err)
+	}
+	// A cancelled context stops the iteration.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = db.StreamAPIKeys(cctx, func(database.APIKeyRecord) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Expected an error with a cancelled context.")
+	}
+}
+
+// TestUserExportAPIKeys ensures that UserExportAPIKeys exports the metadata
+// of the user's public API keys without the keys themselves.
+func TestUserExportAPIKeys(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.APIKeyCreate(ctx, *u, "private", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skylinks := []string{test.RandomSkylink(), test.RandomSkylink()}
+	exp := time.Now().UTC().Add(time.Hour)
+	pub, err := db.APIKeyCreate(ctx, *u, "public", true, skylinks, &exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exports, err := db.UserExportAPIKeys(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exports) != 1 {
+		t.Fatalf("Expected 1 exported key, got %d.", len(exports))
+	}
+	e := exports[0]
+	if e.Name != pub.Name || !reflect.DeepEqual(e.Skylinks, skylinks) || !e.CreatedAt.Equal(pub.CreatedAt) || e.ExpiresAt == nil || !e.ExpiresAt.Equal(*pub.ExpiresAt) {
+		t.Fatalf("Expected export of %+v, got %+v.", pub, e)
+	}
+	// Make sure the key itself doesn't leak into the serialized export.
+	b, err := json.Marshal(exports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), string(pub.Key)) {
+		t.Fatalf("Expected the export not to contain the key, got %s.", string(b))
+	}
+}
+
+// TestUsersWithStaleAPIKeys ensures that UsersWithStaleAPIKeys only reports
+// keys which haven't been used for longer than the given threshold.
+func TestUsersWithStaleAPIKeys(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleFor := 200 * time.Millisecond
+
+	// A key which was never used and a key which was used a while ago.
+	neverUsed, err := db.APIKeyCreate(ctx, *u1, "never used", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usedLongAgo, err := db.APIKeyCreate(ctx, *u2, "used long ago", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.APIKeyMarkUsed(ctx, usedLongAgo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An old key which was used recently.
+	usedRecently, err := db.APIKeyCreate(ctx, *u1, "used recently", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * staleFor)
+	err = db.APIKeyMarkUsed(ctx, usedRecently.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fresh key which was never used.
+	_, err = db.APIKeyCreate(ctx, *u2, "fresh", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Marking a key which doesn't exist fails.
+	err = db.APIKeyMarkUsed(ctx, primitive.NewObjectID())
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected error %v, got %v", mongo.ErrNoDocuments, err)
+	}
+
+	stale, err := db.UsersWithStaleAPIKeys(ctx, staleFor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 {
+		t.Fatalf("Expected stale keys for 2 users, got %d.", len(stale))
+	}
+	if len(stale[u1.ID]) != 1 || stale[u1.ID][0].ID != neverUsed.ID {
+		t.Fatalf("Expected only key %s for user 1, got %+v", neverUsed.ID.Hex(), stale[u1.ID])
+	}
+	if len(stale[u2.ID]) != 1 || stale[u2.ID][0].ID != usedLongAgo.ID {
+		t.Fatalf("Expected only key %s for user 2, got %+v", usedLongAgo.ID.Hex(), stale[u2.ID])
+	}
+	if stale[u2.ID][0].LastUsedAt.IsZero() {
+		t.Fatal("Expected the last use of the key to be recorded.")
+	}
+	// An invalid threshold is rejected.
+	_, err = db.UsersWithStaleAPIKeys(ctx, 0)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
+
+// TestAPIKeyExpiration ensures that API keys with an expiration time stop
+// working once it passes, while keys without one keep working.
+func TestAPIKeyExpiration(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A key without an expiration time never expires.
+	forever, err := db.APIKeyCreate(ctx, *u, "forever", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forever.ExpiresAt != nil {
+		t.Fatalf("Expected no expiration time, got %v.", forever.ExpiresAt)
+	}
+	// Keys can't be created already expired.
+	past := time.Now().UTC().Add(-time.Minute)
+	_, err = db.APIKeyCreate(ctx, *u, "past", false, nil, &past)
+	if !errors.Contains(err, database.ErrInvalidAPIKeyOperation) {
+		t.Fatalf("Expected error %v, got %v", database.ErrInvalidAPIKeyOperation, err)
+	}
+	// A key with an expiration time works until it expires.
+	exp := time.Now().UTC().Add(500 * time.Millisecond)
+	expiring, err := db.APIKeyCreate(ctx, *u, "expiring", false, nil, &exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiring.ExpiresAt == nil || !expiring.ExpiresAt.Equal(exp.Truncate(time.Millisecond)) {
+		t.Fatalf("Expected expiration time %v, got %v.", exp, expiring.ExpiresAt)
+	}
+	akr, err := db.APIKeyByKey(ctx, expiring.Key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if akr.ExpiresAt == nil || !akr.ExpiresAt.Equal(*expiring.ExpiresAt) {
+		t.Fatalf("Expected expiration time %v, got %v.", expiring.ExpiresAt, akr.ExpiresAt)
+	}
+	time.Sleep(time.Until(exp) + 100*time.Millisecond)
+	_, err = db.APIKeyByKey(ctx, expiring.Key.String())
+	if !errors.Contains(err, database.ErrAPIKeyExpired) {
+		t.Fatalf("Expected error %v, got %v", database.ErrAPIKeyExpired, err)
+	}
+	records, err := db.APIKeysByKeys(ctx, []string{forever.Key.String(), expiring.Key.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := records[expiring.Key.String()]; ok || len(records) != 1 {
+		t.Fatalf("Expected only the non-expiring key, got %+v", records)
+	}
+	_, err = db.APIKeyByKey(ctx, forever.Key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestExpiredAPIKeys ensures that ExpiredAPIKeys lists only the keys which have
+// expired, across all users, and respects the given limit.
+func TestExpiredAPIKeys(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two keys which are about to expire, one for each user.
+	exp1 := time.Now().UTC().Add(200 * time.Millisecond)
+	expired1, err := db.APIKeyCreate(ctx, *u1, "expired 1", false, nil, &exp1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp2 := exp1.Add(100 * time.Millisecond)
+	expired2, err := db.APIKeyCreate(ctx, *u2, "expired 2", false, nil, &exp2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A key which never expires and one which expires in the future.
+	_, err = db.APIKeyCreate(ctx, *u1, "forever", false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().UTC().Add(time.Hour)
+	_, err = db.APIKeyCreate(ctx, *u2, "future", false, nil, &future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(exp2) + 100*time.Millisecond)
+
+	akrs, err := db.ExpiredAPIKeys(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(akrs) != 2 || akrs[0].ID != expired1.ID || akrs[1].ID != expired2.ID {
+		t.Fatalf("Expected keys %s and %s, got %+v", expired1.ID.Hex(), expired2.ID.Hex(), akrs)
+	}
+	// The limit is respected.
+	akrs, err = db.ExpiredAPIKeys(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(akrs) != 1 || akrs[0].ID != expired1.ID {
+		t.Fatalf("Expected only key %s, got %+v", expired1.ID.Hex(), akrs)
+	}
+	// An invalid limit is rejected.
+	_, err = db.ExpiredAPIKeys(ctx, 0)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
@@ -0,0 +1,219 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// TestUserSkylinkDownloads ensures that UserSkylinkDownloads correctly reports
+// the downloads of a creator's skylink.
+func TestUserSkylinkDownloads(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := db.UserCreate(ctx, "", "", t.Name()+"creator", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, _, err := test.CreateTestUpload(ctx, db, *creator, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := test.CreateTestUpload(ctx, db, *creator, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two users download the creator's skylink and one of them also
+	// downloads another skylink.
+	_, err = db.DownloadCreate(ctx, *u1, *sl, 100, database.TrafficMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u2, *sl, 200, database.TrafficMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u2, *other, 300, database.TrafficMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now().UTC().Add(-time.Hour)
+	count, bandwidth, err := db.UserSkylinkDownloads(ctx, creator.ID, sl.Skylink, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedBandwidth := skynet.BandwidthDownloadCost(100) + skynet.BandwidthDownloadCost(200)
+	if count != 2 || bandwidth != expectedBandwidth {
+		t.Fatalf("Expected %d downloads and %d bandwidth, got %d and %d.", 2, expectedBandwidth, count, bandwidth)
+	}
+	// Users who haven't pinned the skylink don't see its downloads.
+	count, bandwidth, err = db.UserSkylinkDownloads(ctx, u1.ID, sl.Skylink, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 || bandwidth != 0 {
+		t.Fatalf("Expected no downloads, got %d and %d.", count, bandwidth)
+	}
+	// Downloads before the given time are not counted.
+	count, _, err = db.UserSkylinkDownloads(ctx, creator.ID, sl.Skylink, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("Expected no downloads, got %d.", count)
+	}
+}
+
+// TestUserBillableDownloadBandwidth ensures that UserBillableDownloadBandwidth
+// only bills the download bandwidth in excess of the tier's free allowance.
+func TestUserBillableDownloadBandwidth(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, _, err := test.CreateTestUpload(ctx, db, *u, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u, *sl, 300, database.TrafficMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bandwidth := skynet.BandwidthDownloadCost(300)
+
+	// By default downloads are free.
+	billable, err := db.UserBillableDownloadBandwidth(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if billable != 0 {
+		t.Fatalf("Expected no billable bandwidth, got %d.", billable)
+	}
+
+	defer func(limits database.TierLimits) {
+		database.UserLimits[database.TierFree] = limits
+	}(database.UserLimits[database.TierFree])
+	limits := database.UserLimits[database.TierFree]
+
+	// A user over their allowance is billed for the excess.
+	limits.FreeDownloadBandwidth = bandwidth - 100
+	database.UserLimits[database.TierFree] = limits
+	billable, err = db.UserBillableDownloadBandwidth(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if billable != 100 {
+		t.Fatalf("Expected %d billable bandwidth, got %d.", 100, billable)
+	}
+	// A user under their allowance is not billed.
+	limits.FreeDownloadBandwidth = bandwidth + 100
+	database.UserLimits[database.TierFree] = limits
+	billable, err = db.UserBillableDownloadBandwidth(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if billable != 0 {
+		t.Fatalf("Expected no billable bandwidth, got %d.", billable)
+	}
+}
+
+// TestUserDownloadedSkylinks ensures that UserDownloadedSkylinks lists each
+// skylink once, the most recently downloaded first.
+func TestUserDownloadedSkylinks(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skylinks := make([]*database.Skylink, 4)
+	for i := range skylinks {
+		skylinks[i], err = db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	download := func(sl *database.Skylink) {
+		_, err := db.DownloadCreate(ctx, *u, *sl, 100, database.TrafficMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the downloads have different timestamps.
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The first skylink is downloaded before the period we're interested in.
+	download(skylinks[0])
+	since := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	download(skylinks[1])
+	download(skylinks[2])
+	download(skylinks[3])
+	// Downloading a skylink again makes it the most recent one.
+	download(skylinks[1])
+
+	sls, err := db.UserDownloadedSkylinks(ctx, u.ID, since, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{skylinks[1].Skylink, skylinks[3].Skylink, skylinks[2].Skylink}
+	if !reflect.DeepEqual(sls, expected) {
+		t.Fatalf("Expected %v, got %v", expected, sls)
+	}
+	// The limit is respected.
+	sls, err = db.UserDownloadedSkylinks(ctx, u.ID, since, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sls, expected[:2]) {
+		t.Fatalf("Expected %v, got %v", expected[:2], sls)
+	}
+	// Downloads before the period are included if we ask for them.
+	sls, err = db.UserDownloadedSkylinks(ctx, u.ID, since.Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sls) != 4 || sls[3] != skylinks[0].Skylink {
+		t.Fatalf("Expected all 4 skylinks with %s last, got %v", skylinks[0].Skylink, sls)
+	}
+	_, err = db.UserDownloadedSkylinks(ctx, u.ID, since, 0)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
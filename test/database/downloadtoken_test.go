@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestIssueDownloadToken ensures that IssueDownloadToken only issues tokens
+// for skylinks the user can access and that those tokens can be verified.
+func TestIssueDownloadToken(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(s string) {
+		database.DownloadTokenSecret = s
+	}(database.DownloadTokenSecret)
+	database.DownloadTokenSecret = t.Name()
+
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, _, err := test.CreateTestUpload(ctx, db, *u, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A skylink the user doesn't have access to.
+	_, err = db.IssueDownloadToken(ctx, *u, test.RandomSkylink(), time.Minute)
+	if !errors.Contains(err, database.ErrSkylinkNotAccessible) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrSkylinkNotAccessible, err)
+	}
+	// A skylink the user has uploaded.
+	token, err := db.IssueDownloadToken(ctx, *u, sl.Skylink, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := db.VerifyDownloadToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != u.Sub || claims.Skylink != sl.Skylink || claims.Tier != u.Tier {
+		t.Fatalf("Unexpected claims %+v", claims)
+	}
+	// A skylink covered by one of the user's public API keys.
+	covered := test.RandomSkylink()
+	_, err = db.APIKeyCreate(ctx, *u, "", true, []string{covered}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.IssueDownloadToken(ctx, *u, covered, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Suspended users can't get tokens.
+	err = db.UserSuspend(ctx, u, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.IssueDownloadToken(ctx, *u, sl.Skylink, time.Minute)
+	if !errors.Contains(err, database.ErrAccountSuspended) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrAccountSuspended, err)
+	}
+	err = db.UserUnsuspend(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An expired token.
+	token, err = db.IssueDownloadToken(ctx, *u, sl.Skylink, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	_, err = db.VerifyDownloadToken(token)
+	if !errors.Contains(err, database.ErrDownloadTokenExpired) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrDownloadTokenExpired, err)
+	}
+}
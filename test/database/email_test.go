@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// TestEmailsSentTo ensures that EmailsSentTo returns the redacted history of
+// emails to an address, newest first.
+func TestEmailsSentTo(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := strings.ToLower(t.Name()) + "@siasky.net"
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	msgs := []database.EmailMessage{
+		{Subject: "sent", SentAt: now},
+		{Subject: "failed", FailedAttempts: database.EmailMaxSendAttempts},
+		{Subject: "dry run", SentAt: now, DryRun: true},
+		{Subject: "pending", FailedAttempts: 1},
+	}
+	for _, m := range msgs {
+		m.To = to
+		m.Body = "secret token"
+		m.BodyMime = "text/plain"
+		if err = db.EmailCreate(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An email to someone else.
+	err = db.EmailCreate(ctx, database.EmailMessage{To: "other" + to, Subject: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The address should be matched regardless of its case.
+	emails, err := db.EmailsSentTo(ctx, strings.ToUpper(to))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		subject string
+		status  string
+	}{
+		{"pending", database.EmailStatusPending},
+		{"dry run", database.EmailStatusDryRun},
+		{"failed", database.EmailStatusFailed},
+		{"sent", database.EmailStatusSent},
+	}
+	if len(emails) != len(expected) {
+		t.Fatalf("Expected %d emails, got %d.", len(expected), len(emails))
+	}
+	for i, e := range expected {
+		m := emails[i]
+		if m.Subject != e.subject || m.Status() != e.status {
+			t.Fatalf("Expected email %d to be '%s' with status %s, got '%s' with status %s", i, e.subject, e.status, m.Subject, m.Status())
+		}
+		if m.Body != "" || m.BodyMime != "" {
+			t.Fatalf("Expected email %d to be redacted, got %+v", i, m)
+		}
+	}
+	if !emails[3].SentAt.Equal(now) {
+		t.Fatalf("Expected sent at %v, got %v", now, emails[3].SentAt)
+	}
+}
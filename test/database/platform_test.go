@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+)
+
+// TestPlatformBandwidth ensures that PlatformBandwidth matches the sum of the
+// users' individual bandwidth stats.
+func TestPlatformBandwidth(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []*database.User
+	for i, size := range []int64{100, 50 * 1024 * 1024} {
+		u, err := db.UserCreate(ctx, "", "", t.Name()+string(rune('a'+i)), database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sl, _, err := test.CreateTestUpload(ctx, db, *u, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Download the skylink twice, once with a known number of bytes.
+		_, err = db.DownloadCreate(ctx, *u, *sl, 0, database.TrafficMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DownloadCreate(ctx, *u, *sl, size/2, database.TrafficMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j <= i; j++ {
+			if _, err = db.RegistryReadCreate(ctx, *u, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.RegistryWriteCreate(ctx, *u, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		users = append(users, u)
+	}
+
+	var expUpload, expDownload, expRegistry int64
+	for _, u := range users {
+		stats, err := db.UserLifetimeStats(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expUpload += stats.BandwidthUploads
+		expDownload += stats.BandwidthDownloads
+		expRegistry += stats.BandwidthRegReads + stats.BandwidthRegWrites
+	}
+	from := time.Now().UTC().Add(-time.Hour)
+	to := time.Now().UTC().Add(time.Hour)
+	upload, download, registry, err := db.PlatformBandwidth(ctx, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload != expUpload || download != expDownload || registry != expRegistry {
+		t.Fatalf("Expected %d, %d and %d, got %d, %d and %d.", expUpload, expDownload, expRegistry, upload, download, registry)
+	}
+	// Nothing happened before the window.
+	upload, download, registry, err = db.PlatformBandwidth(ctx, from.Add(-time.Hour), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload != 0 || download != 0 || registry != 0 {
+		t.Fatalf("Expected no bandwidth, got %d, %d and %d.", upload, download, registry)
+	}
+}
+
+// TestPlatformMRR ensures that PlatformMRR only counts active subscriptions
+// and multiplies them by the tier's price.
+func TestPlatformMRR(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().UTC().AddDate(0, 0, 15).Truncate(time.Millisecond)
+	past := time.Now().UTC().AddDate(0, 0, -15).Truncate(time.Millisecond)
+	subs := []database.SubscriptionUpdate{
+		// Active.
+		{Tier: database.TierPremium5, SubscribedUntil: future, SubscriptionStatus: "active"},
+		{Tier: database.TierPremium5, SubscribedUntil: future, SubscriptionStatus: "active"},
+		{Tier: database.TierPremium80, SubscribedUntil: future, SubscriptionStatus: "active"},
+		// Expired.
+		{Tier: database.TierPremium20, SubscribedUntil: past, SubscriptionStatus: "active"},
+		// Not active.
+		{Tier: database.TierPremium5, SubscribedUntil: future, SubscriptionStatus: "past_due"},
+		// Active, with the epoch as cancel_at, which is how Stripe reports
+		// that there's no scheduled cancellation.
+		{Tier: database.TierPremium20, SubscribedUntil: future, SubscriptionStatus: "active", SubscriptionCancelAt: time.Unix(0, 0).UTC()},
+		// Scheduled to be cancelled, at the end of the period or at a given
+		// time.
+		{Tier: database.TierPremium80, SubscribedUntil: future, SubscriptionStatus: "active", SubscriptionCancelAtPeriodEnd: true},
+		{Tier: database.TierPremium80, SubscribedUntil: future, SubscriptionStatus: "active", SubscriptionCancelAt: future.AddDate(0, 0, -5)},
+		// Free.
+		{Tier: database.TierFree},
+	}
+	for i, s := range subs {
+		u, err := db.UserCreate(ctx, "", "", t.Name()+strconv.Itoa(i), database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.UserSetSubscription(ctx, u, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mrr, err := db.PlatformMRR(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]int64{
+		database.TierPremium5:  2 * database.UserLimits[database.TierPremium5].MonthlyPrice,
+		database.TierPremium20: database.UserLimits[database.TierPremium20].MonthlyPrice,
+		database.TierPremium80: database.UserLimits[database.TierPremium80].MonthlyPrice,
+	}
+	if !reflect.DeepEqual(mrr, expected) {
+		t.Fatalf("Expected %v, got %v", expected, mrr)
+	}
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestEnsureDBSchema ensures that connecting to a fresh database creates all
+// indexes defined in the schema.
+func TestEnsureDBSchema(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for collName, models := range database.Schema {
+		names, err := db.IndexNames(ctx, collName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing := make(map[string]struct{}, len(names))
+		for _, name := range names {
+			existing[name] = struct{}{}
+		}
+		for _, m := range models {
+			if _, ok := existing[*m.Options.Name]; !ok {
+				t.Fatalf("Expected index '%s' to exist on collection '%s'.", *m.Options.Name, collName)
+			}
+		}
+	}
+	// Make sure the compound indexes the user stats queries and the email
+	// rate limit rely on are part of the schema.
+	expected := map[string][]string{
+		"emails":          {"to_id"},
+		"uploads":         {"user_id_timestamp"},
+		"downloads":       {"user_id_created_at"},
+		"registry_reads":  {"user_id_timestamp"},
+		"registry_writes": {"user_id_timestamp"},
+	}
+	for collName, indexes := range expected {
+		names, err := db.IndexNames(ctx, collName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range indexes {
+			found := false
+			for _, name := range names {
+				if name == idx {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("Expected index '%s' to exist on collection '%s', got %v.", idx, collName, names)
+			}
+		}
+	}
+}
+
+// TestEnsureDBSchemaDuplicates ensures that existing duplicates which prevent
+// us from creating a unique index don't prevent the service from starting and
+// that the other indexes are still created.
+func TestEnsureDBSchemaDuplicates(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	// Use a fresh DB on every run, so the users collection has no indexes
+	// when we seed the duplicates.
+	dbName := test.SanitizeName(test.DBNameForTest(t.Name()) + "_" + primitive.NewObjectID().Hex())
+	creds := test.DBTestCredentials()
+	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s", creds.User, creds.Password, creds.Host, creds.Port)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := client.Database(dbName).Drop(ctx); err != nil {
+			t.Error(err)
+		}
+		if err := client.Disconnect(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	email := t.Name() + "@siasky.net"
+	users := client.Database(dbName).Collection("users")
+	_, err = users.InsertMany(ctx, []interface{}{
+		bson.M{"email": email, "sub": t.Name() + "sub1"},
+		bson.M{"email": email, "sub": t.Name() + "sub2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := db.IndexNames(ctx, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+	}
+	if existing["email_unique_nonempty"] {
+		t.Fatal("Expected the unique email index to be missing.")
+	}
+	if !existing["sub_unique"] || !existing["pub_keys_unique"] {
+		t.Fatalf("Expected the other user indexes to exist, got %v.", names)
+	}
+}
@@ -0,0 +1,924 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SkynetLabs/skynet-accounts/database"
+	"github.com/SkynetLabs/skynet-accounts/skynet"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/test/dependencies"
+	"gitlab.com/NebulousLabs/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestUserTrafficByClient ensures that UserTrafficByClient correctly splits
+// the user's traffic by client class.
+func TestUserTrafficByClient(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browserUA := "Mozilla/5.0 (X11; Linux x86_64; rv:102.0) Gecko/20100101 Firefox/102.0"
+	cliUA := "curl/7.79.1"
+
+	// Seed two browser uploads, one CLI upload and one upload without a user
+	// agent.
+	for _, ua := range []string{browserUA, browserUA, cliUA, ""} {
+		skylink, err := db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UploadCreate(ctx, *u, "", *skylink, database.TrafficMeta{UserAgent: ua})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Seed a CLI download.
+	skylink, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u, *skylink, 128, database.TrafficMeta{UserAgent: cliUA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Seed a full CLI download. Those are recorded with zero bytes, so their
+	// size should come from the skylink.
+	fullSize := int64(1000)
+	skylink, err = db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SkylinkUpdate(ctx, skylink.ID, "full", fullSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u, *skylink, 0, database.TrafficMeta{UserAgent: cliUA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traffic, err := db.UserTrafficByClient(ctx, u.ID, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traffic) != 3 {
+		t.Fatalf("Expected %d client classes, got %d: %+v", 3, len(traffic), traffic)
+	}
+	browser := traffic[database.UserAgentClassBrowser]
+	if browser.Uploads != 2 || browser.Downloads != 0 {
+		t.Fatalf("Unexpected browser traffic: %+v", browser)
+	}
+	cli := traffic[database.UserAgentClassCLI]
+	if cli.Uploads != 1 || cli.Downloads != 2 || cli.DownloadedBytes != 128+fullSize {
+		t.Fatalf("Unexpected CLI traffic: %+v", cli)
+	}
+	unknown := traffic[database.UserAgentClassUnknown]
+	if unknown.Uploads != 1 || unknown.Downloads != 0 {
+		t.Fatalf("Unexpected unknown traffic: %+v", unknown)
+	}
+}
+
+// TestTrafficByServer ensures that TrafficByServer correctly splits the
+// portal's traffic by the server which handled it.
+func TestTrafficByServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverA := "eu-ger-1.siasky.net"
+	serverB := "us-va-1.siasky.net"
+
+	// Seed two uploads on server A, one on server B and one without a server.
+	for _, server := range []string{serverA, serverA, serverB, ""} {
+		skylink, err := db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UploadCreate(ctx, *u, "", *skylink, database.TrafficMeta{Server: server})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Seed one download on server A and two on server B.
+	downloads := []struct {
+		server string
+		bytes  int64
+	}{
+		{serverA, 100},
+		{serverB, 200},
+		{serverB, 300},
+	}
+	for _, d := range downloads {
+		skylink, err := db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DownloadCreate(ctx, *u, *skylink, d.bytes, database.TrafficMeta{Server: d.server})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	traffic, err := db.TrafficByServer(ctx, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traffic) != 3 {
+		t.Fatalf("Expected %d servers, got %d: %+v", 3, len(traffic), traffic)
+	}
+	a := traffic[serverA]
+	if a.Uploads != 2 || a.Downloads != 1 || a.DownloadedBytes != 100 {
+		t.Fatalf("Unexpected traffic for server A: %+v", a)
+	}
+	b := traffic[serverB]
+	if b.Uploads != 1 || b.Downloads != 2 || b.DownloadedBytes != 500 {
+		t.Fatalf("Unexpected traffic for server B: %+v", b)
+	}
+	unknown := traffic[database.ServerUnknown]
+	if unknown.Uploads != 1 || unknown.Downloads != 0 {
+		t.Fatalf("Unexpected unknown traffic: %+v", unknown)
+	}
+	// Nothing happened after now.
+	traffic, err = db.TrafficByServer(ctx, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traffic) != 0 {
+		t.Fatalf("Expected no traffic, got %+v", traffic)
+	}
+}
+
+// TestUserDownloadBandwidthByReferrer ensures that
+// UserDownloadBandwidthByReferrer groups the user's download bandwidth by
+// referrer and excludes registry traffic.
+func TestUserDownloadBandwidthByReferrer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refA := database.Referrer("skyapp.hns")
+	refB := database.Referrer("example.com")
+	downloads := []struct {
+		referrer database.Referrer
+		bytes    int64
+	}{
+		{refA, 100},
+		{refA, 1 << 20},
+		{refB, 300},
+		{"", 400},
+	}
+	expected := make(map[database.Referrer]int64)
+	for _, d := range downloads {
+		skylink, err := db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DownloadCreate(ctx, *u, *skylink, d.bytes, database.TrafficMeta{Referrer: d.referrer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := d.referrer
+		if ref == "" {
+			ref = database.ReferrerUnknown
+		}
+		expected[ref] += skynet.BandwidthDownloadCost(d.bytes)
+	}
+	// Registry traffic should not be counted.
+	_, err = db.RegistryReadCreate(ctx, *u, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RegistryWriteCreate(ctx, *u, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bw, err := db.UserDownloadBandwidthByReferrer(ctx, u.ID, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bw, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, bw)
+	}
+	// The breakdown should add up to the download bandwidth from the user's
+	// stats, which doesn't include registry traffic either.
+	stats, err := db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, b := range bw {
+		total += b
+	}
+	if total != stats.BandwidthDownloadsTotal {
+		t.Fatalf("Expected a total of %d, got %d.", stats.BandwidthDownloadsTotal, total)
+	}
+}
+
+// TestAnonymousTrafficByID ensures that AnonymousTrafficByID attributes
+// anonymous traffic to the anonymous ID it was recorded with.
+func TestAnonymousTrafficByID(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idA := "ip-1.2.3.4"
+	idB := "cookie-abcdef"
+	downloads := []struct {
+		user        database.User
+		anonymousID string
+		bytes       int64
+	}{
+		{database.AnonUser, idA, 100},
+		{database.AnonUser, idA, 200},
+		{database.AnonUser, idB, 300},
+		{database.AnonUser, "", 400},
+		// The anonymous ID of a registered user's download is ignored.
+		{*u, idA, 500},
+	}
+	for _, d := range downloads {
+		skylink, err := db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DownloadCreate(ctx, d.user, *skylink, d.bytes, database.TrafficMeta{AnonymousID: d.anonymousID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	skylink, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UploadCreate(ctx, database.AnonUser, "1.2.3.4", *skylink, database.TrafficMeta{AnonymousID: idA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traffic, err := db.AnonymousTrafficByID(ctx, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]database.Traffic{
+		idA:                        {Uploads: 1, Downloads: 2, DownloadedBytes: 300},
+		idB:                        {Downloads: 1, DownloadedBytes: 300},
+		database.AnonymousIDGlobal: {Downloads: 1, DownloadedBytes: 400},
+	}
+	if !reflect.DeepEqual(traffic, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, traffic)
+	}
+}
+
+// TestStreamUserTraffic ensures that StreamUserTraffic reports the traffic of
+// each user via each referrer.
+func TestStreamUserTraffic(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refA := database.Referrer("skyapp.hns")
+	refB := database.Referrer("example.com")
+	skylink, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// User 1 uploads via A, downloads via B and reads the registry via A.
+	_, err = db.UploadCreate(ctx, *u1, "", *skylink, database.TrafficMeta{Referrer: refA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u1, *skylink, 100, database.TrafficMeta{Referrer: refB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RegistryReadCreate(ctx, *u1, refA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// User 2 writes to the registry via B and without a referrer.
+	_, err = db.RegistryWriteCreate(ctx, *u2, refB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RegistryWriteCreate(ctx, *u2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[primitive.ObjectID]map[database.Referrer]database.TrafficDTO{
+		u1.ID: {
+			refA: {Referrer: refA, Uploads: 1, RegistryReads: 1, RegistryReadBandwidth: skynet.CostBandwidthRegistryRead, RegistryBandwidth: skynet.CostBandwidthRegistryRead},
+			refB: {Referrer: refB, Downloads: 1, DownloadedBytes: 100},
+		},
+		u2.ID: {
+			refB:                     {Referrer: refB, RegistryWrites: 1, RegistryWriteBandwidth: skynet.CostBandwidthRegistryWrite, RegistryBandwidth: skynet.CostBandwidthRegistryWrite},
+			database.ReferrerUnknown: {Referrer: database.ReferrerUnknown, RegistryWrites: 1, RegistryWriteBandwidth: skynet.CostBandwidthRegistryWrite, RegistryBandwidth: skynet.CostBandwidthRegistryWrite},
+		},
+	}
+	traffic := make(map[primitive.ObjectID]map[database.Referrer]database.TrafficDTO)
+	err = db.StreamUserTraffic(ctx, time.Now().UTC().AddDate(0, 0, -1), func(userID primitive.ObjectID, r database.Referrer, td database.TrafficDTO) error {
+		if traffic[userID] == nil {
+			traffic[userID] = make(map[database.Referrer]database.TrafficDTO)
+		}
+		if _, exists := traffic[userID][r]; exists {
+			t.Errorf("Referrer %s reported twice for user %s.", r, userID.Hex())
+		}
+		traffic[userID][r] = td
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(traffic, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, traffic)
+	}
+	// Errors returned by the callback stop the iteration.
+	errStop := errors.New("stop")
+	calls := 0
+	err = db.StreamUserTraffic(ctx, time.Now().UTC().AddDate(0, 0, -1), func(primitive.ObjectID, database.Referrer, database.TrafficDTO) error {
+		calls++
+		return errStop
+	})
+	if !errors.Contains(err, errStop) || calls != 1 {
+		t.Fatalf("Expected error %v after 1 call, got %v after %d calls", errStop, err, calls)
+	}
+	// A cancelled context stops the iteration.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = db.StreamUserTraffic(cctx, time.Now().UTC().AddDate(0, 0, -1), func(primitive.ObjectID, database.Referrer, database.TrafficDTO) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
+
+// TestUserDownloadReach ensures that UserDownloadReach counts the distinct
+// referrers via which the user's pinned content was downloaded.
+func TestUserDownloadReach(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := db.UserCreate(ctx, "", "", t.Name()+"creator", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fan, err := db.UserCreate(ctx, "", "", t.Name()+"fan", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The creator has no content, so there's no reach.
+	reach, err := db.UserDownloadReach(ctx, creator.ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reach != 0 {
+		t.Fatalf("Expected no reach, got %d.", reach)
+	}
+	pinned, _, err := test.CreateTestUpload(ctx, db, *creator, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpinned, _, err := test.CreateTestUpload(ctx, db, *creator, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UnpinUploads(ctx, *unpinned, *creator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Content which belongs to somebody else.
+	other, _, err := test.CreateTestUpload(ctx, db, *fan, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := []struct {
+		user     database.User
+		skylink  *database.Skylink
+		referrer database.Referrer
+	}{
+		// Three distinct referrers for the pinned skylink, one of them twice,
+		// and one download without a referrer. Anonymous downloads are never
+		// merged, so each of them is recorded with its own referrer.
+		{database.AnonUser, pinned, "skyapp.hns"},
+		{database.AnonUser, pinned, "example.com"},
+		{database.AnonUser, pinned, "example.com"},
+		{database.AnonUser, pinned, ""},
+		{*fan, pinned, "blog.example.com"},
+		// These don't count.
+		{*fan, unpinned, "unpinned.com"},
+		{*creator, other, "other.com"},
+	}
+	for _, d := range downloads {
+		_, err = db.DownloadCreate(ctx, d.user, *d.skylink, 100, database.TrafficMeta{Referrer: d.referrer})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reach, err = db.UserDownloadReach(ctx, creator.ID, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reach != 3 {
+		t.Fatalf("Expected a reach of 3, got %d.", reach)
+	}
+	// Nothing happened after now.
+	reach, err = db.UserDownloadReach(ctx, creator.ID, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reach != 0 {
+		t.Fatalf("Expected no reach, got %d.", reach)
+	}
+}
+
+// TestRegistryOpsByReferrer ensures that RegistryOpsByReferrer ranks the
+// referrers by their registry operations across all users.
+func TestRegistryOpsByReferrer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []struct {
+		user     database.User
+		referrer database.Referrer
+		reads    int
+		writes   int
+	}{
+		// Different spellings of the same referrer, across users.
+		{*u1, "https://www.abuser.com/app", 3, 2},
+		{*u2, "abuser.com", 1, 1},
+		{*u1, "skyapp.hns", 0, 4},
+		{*u2, "", 2, 0},
+		{*u2, "quiet.com", 1, 0},
+	}
+	for _, op := range ops {
+		for i := 0; i < op.reads; i++ {
+			if _, err = db.RegistryReadCreate(ctx, op.user, op.referrer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < op.writes; i++ {
+			if _, err = db.RegistryWriteCreate(ctx, op.user, op.referrer); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stats, err := db.RegistryOpsByReferrer(ctx, time.Now().UTC().AddDate(0, 0, -1), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []database.ReferrerRegistryStats{
+		{Referrer: "abuser.com", Reads: 4, Writes: 3},
+		{Referrer: "skyapp.hns", Reads: 0, Writes: 4},
+		{Referrer: database.ReferrerUnknown, Reads: 2, Writes: 0},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, stats)
+	}
+	// Nothing happened after now.
+	stats, err = db.RegistryOpsByReferrer(ctx, time.Now().UTC(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 0 {
+		t.Fatalf("Expected no stats, got %+v", stats)
+	}
+	// An invalid limit is rejected.
+	_, err = db.RegistryOpsByReferrer(ctx, time.Time{}, 0)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
+
+// TestReferrerAliases ensures that the traffic of aliased referrers is merged
+// into the traffic of their alias.
+func TestReferrerAliases(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(aliases map[string]string) {
+		database.ReferrerAliases = aliases
+	}(database.ReferrerAliases)
+	database.ReferrerAliases, err = database.ParseReferrerAliases("cdn1.app.com=app.com,cdn2.app.com=app.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := []struct {
+		referrer database.Referrer
+		bytes    int64
+	}{
+		{"https://cdn1.app.com/file", 100},
+		{"https://www.CDN2.app.com/", 200},
+		{"other.com", 300},
+	}
+	for _, d := range downloads {
+		skylink, err := db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DownloadCreate(ctx, *u, *skylink, d.bytes, database.TrafficMeta{Referrer: d.referrer})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bw, err := db.UserDownloadBandwidthByReferrer(ctx, u.ID, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[database.Referrer]int64{
+		"app.com":   skynet.BandwidthDownloadCost(100) + skynet.BandwidthDownloadCost(200),
+		"other.com": skynet.BandwidthDownloadCost(300),
+	}
+	if !reflect.DeepEqual(bw, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, bw)
+	}
+}
+
+// TestReferrerDenylist ensures that traffic via denylisted referrers is left
+// out of the user's billed stats and traffic and that an empty denylist bills
+// all traffic.
+func TestReferrerDenylist(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(denylist map[string]struct{}) {
+		database.ReferrerDenylist = denylist
+	}(database.ReferrerDenylist)
+	database.ReferrerDenylist = map[string]struct{}{}
+
+	internal := database.Referrer("https://monitor.siasky.net/check")
+	ref := database.Referrer("skyapp.hns")
+	// The user uploads and downloads once via each referrer. Each download
+	// uses its own skylink, so the downloads don't get merged.
+	for i, r := range []database.Referrer{internal, ref} {
+		skylink, err := db.Skylink(ctx, test.RandomSkylink())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UploadCreate(ctx, *u, "", *skylink, database.TrafficMeta{Referrer: r})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.DownloadCreate(ctx, *u, *skylink, int64(100*(i+1)), database.TrafficMeta{Referrer: r})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.RegistryReadCreate(ctx, *u, internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty denylist bills all traffic.
+	stats, err := db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upBW := skynet.BandwidthUploadCost(0)
+	if stats.BandwidthUploads != 2*upBW {
+		t.Fatalf("Expected upload bandwidth %d, got %d", 2*upBW, stats.BandwidthUploads)
+	}
+	downBW := skynet.BandwidthDownloadCost(100) + skynet.BandwidthDownloadCost(200)
+	if stats.NumDownloads != 2 || stats.BandwidthDownloads != downBW {
+		t.Fatalf("Expected 2 downloads and bandwidth %d, got %d and %d", downBW, stats.NumDownloads, stats.BandwidthDownloads)
+	}
+	since := time.Now().UTC().AddDate(0, 0, -1)
+	traffic, failed, err := db.UserTrafficBestEffort(ctx, u.ID, since)
+	if err != nil || len(failed) > 0 {
+		t.Fatal(err, failed)
+	}
+	if len(traffic) != 2 {
+		t.Fatalf("Expected traffic via 2 referrers, got %+v", traffic)
+	}
+
+	// Denylisting the internal referrer leaves its traffic out.
+	database.ReferrerDenylist = database.ParseReferrerDenylist("www.monitor.siasky.net")
+	stats, err = db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BandwidthUploads != upBW {
+		t.Fatalf("Expected upload bandwidth %d, got %d", upBW, stats.BandwidthUploads)
+	}
+	// The upload via the internal referrer still takes up storage.
+	if stats.NumUploads != 2 {
+		t.Fatalf("Expected 2 uploads, got %d", stats.NumUploads)
+	}
+	downBW = skynet.BandwidthDownloadCost(200)
+	if stats.NumDownloads != 1 || stats.BandwidthDownloads != downBW {
+		t.Fatalf("Expected 1 download and bandwidth %d, got %d and %d", downBW, stats.NumDownloads, stats.BandwidthDownloads)
+	}
+	traffic, failed, err = db.UserTrafficBestEffort(ctx, u.ID, since)
+	if err != nil || len(failed) > 0 {
+		t.Fatal(err, failed)
+	}
+	expected := map[database.Referrer]database.TrafficDTO{
+		ref: {Referrer: ref, Uploads: 1, Downloads: 1, DownloadedBytes: 200},
+	}
+	if !reflect.DeepEqual(traffic, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, traffic)
+	}
+	bw, err := db.UserDownloadBandwidthByReferrer(ctx, u.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bw, map[database.Referrer]int64{ref: downBW}) {
+		t.Fatalf("Expected only the bandwidth of %s, got %+v", ref, bw)
+	}
+}
+
+// TestUserTrafficBestEffort ensures that UserTrafficBestEffort returns the
+// traffic of the components which it could fetch when another one fails.
+func TestUserTrafficBestEffort(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	deps := dependencies.NewDependencyTrafficComponentFailure(database.TrafficComponentRegistryReads)
+	db, err := test.NewDatabaseWithDeps(ctx, dbName, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := database.Referrer("skyapp.hns")
+	skylink, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UploadCreate(ctx, *u, "", *skylink, database.TrafficMeta{Referrer: ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u, *skylink, 100, database.TrafficMeta{Referrer: ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RegistryReadCreate(ctx, *u, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RegistryWriteCreate(ctx, *u, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, -1)
+	traffic, failed, err := db.UserTrafficBestEffort(ctx, u.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[database.TrafficComponentRegistryReads] == nil {
+		t.Fatalf("Expected only the registry reads to fail, got %+v", failed)
+	}
+	// The registry reads are missing but everything else is there.
+	expected := map[database.Referrer]database.TrafficDTO{
+		ref: {Referrer: ref, Uploads: 1, Downloads: 1, DownloadedBytes: 100, RegistryWrites: 1, RegistryWriteBandwidth: skynet.CostBandwidthRegistryWrite, RegistryBandwidth: skynet.CostBandwidthRegistryWrite},
+	}
+	if !reflect.DeepEqual(traffic, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, traffic)
+	}
+	// The strict variant fails as a whole.
+	err = db.StreamUserTraffic(ctx, since, func(primitive.ObjectID, database.Referrer, database.TrafficDTO) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+	// An invalid user is rejected.
+	_, _, err = db.UserTrafficBestEffort(ctx, primitive.ObjectID{}, since)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
+
+// TestUserTrafficRegistryBandwidth ensures that the traffic reports the
+// registry bandwidth separately from the data bandwidth.
+func TestUserTrafficRegistryBandwidth(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := database.Referrer("skyapp.hns")
+	skylink, err := db.Skylink(ctx, test.RandomSkylink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DownloadCreate(ctx, *u, *skylink, 100, database.TrafficMeta{Referrer: ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = db.RegistryReadCreate(ctx, *u, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.RegistryWriteCreate(ctx, *u, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traffic, failed, err := db.UserTrafficBestEffort(ctx, u.ID, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil || len(failed) > 0 {
+		t.Fatal(err, failed)
+	}
+	td := traffic[ref]
+	// The downloaded data doesn't include the registry traffic.
+	if td.Downloads != 1 || td.DownloadedBytes != 100 {
+		t.Fatalf("Expected 1 download of 100 bytes, got %d of %d bytes", td.Downloads, td.DownloadedBytes)
+	}
+	if td.RegistryReadBandwidth != 2*skynet.CostBandwidthRegistryRead {
+		t.Fatalf("Expected registry read bandwidth %d, got %d", 2*skynet.CostBandwidthRegistryRead, td.RegistryReadBandwidth)
+	}
+	if td.RegistryWriteBandwidth != skynet.CostBandwidthRegistryWrite {
+		t.Fatalf("Expected registry write bandwidth %d, got %d", skynet.CostBandwidthRegistryWrite, td.RegistryWriteBandwidth)
+	}
+	if td.RegistryBandwidth != td.RegistryReadBandwidth+td.RegistryWriteBandwidth {
+		t.Fatalf("Expected combined registry bandwidth %d, got %d", td.RegistryReadBandwidth+td.RegistryWriteBandwidth, td.RegistryBandwidth)
+	}
+}
+
+// TestUserTopDownloadReferrers ensures that UserTopDownloadReferrers ranks the
+// referrers via which the user's pinned content was downloaded.
+func TestUserTopDownloadReferrers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := db.UserCreate(ctx, "", "", t.Name()+"creator", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fan, err := db.UserCreate(ctx, "", "", t.Name()+"fan", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, _, err := test.CreateTestUpload(ctx, db, *creator, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Content which belongs to somebody else.
+	other, _, err := test.CreateTestUpload(ctx, db, *fan, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Anonymous downloads are never merged, so each of them is recorded with
+	// its own referrer.
+	downloads := []struct {
+		skylink  *database.Skylink
+		referrer database.Referrer
+		count    int
+	}{
+		{pinned, "https://www.popular.com/post", 2},
+		{pinned, "popular.com", 1},
+		{pinned, "skyapp.hns", 2},
+		{pinned, "rare.com", 1},
+		{other, "other.com", 5},
+	}
+	for _, d := range downloads {
+		for i := 0; i < d.count; i++ {
+			_, err = db.DownloadCreate(ctx, database.AnonUser, *d.skylink, 100, database.TrafficMeta{Referrer: d.referrer})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	top, err := db.UserTopDownloadReferrers(ctx, creator.ID, time.Now().UTC().AddDate(0, 0, -1), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []database.TrafficDTO{
+		{Referrer: "popular.com", Downloads: 3, DownloadedBytes: 300},
+		{Referrer: "skyapp.hns", Downloads: 2, DownloadedBytes: 200},
+	}
+	if !reflect.DeepEqual(top, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, top)
+	}
+	// Nothing happened after now.
+	top, err = db.UserTopDownloadReferrers(ctx, fan.ID, time.Now().UTC(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 0 {
+		t.Fatalf("Expected no referrers, got %+v", top)
+	}
+	// An invalid limit is rejected.
+	_, err = db.UserTopDownloadReferrers(ctx, creator.ID, time.Time{}, 0)
+	if err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
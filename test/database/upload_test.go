@@ -3,11 +3,15 @@ package database
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/skynet"
 	"github.com/SkynetLabs/skynet-accounts/test"
+	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // TestUploadsByUser ensures UploadsByUser returns the correct uploads,
@@ -266,7 +270,7 @@ func TestUploadCreateAnon(t *testing.T) {
 	}
 	ctx := context.Background()
 	dbName := test.DBNameForTest(t.Name())
-	db, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil)
+	db, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -277,7 +281,7 @@ func TestUploadCreateAnon(t *testing.T) {
 	}
 	// Register an anonymous upload.
 	ip := "1.0.2.233"
-	up, err := db.UploadCreate(ctx, database.AnonUser, ip, *skylink)
+	up, err := db.UploadCreate(ctx, database.AnonUser, ip, *skylink, database.TrafficMeta{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -288,7 +292,7 @@ func TestUploadCreateAnon(t *testing.T) {
 		t.Fatalf("Expected UploaderIP '%s', got '%s'", ip, up.UploaderIP)
 	}
 	// Register an anonymous upload without an UploaderIP address.
-	up, err = db.UploadCreate(ctx, database.AnonUser, "", *skylink)
+	up, err = db.UploadCreate(ctx, database.AnonUser, "", *skylink, database.TrafficMeta{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -299,3 +303,696 @@ func TestUploadCreateAnon(t *testing.T) {
 		t.Fatalf("Expected empty UploaderIP, got '%s'", up.UploaderIP)
 	}
 }
+
+// TestSkylinkOwner ensures that SkylinkOwner returns the user with the
+// earliest pinned upload of the skylink.
+func TestSkylinkOwner(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A skylink nobody has uploaded has no owner.
+	_, err = db.SkylinkOwner(ctx, test.RandomSkylink())
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrUserNotFound, err)
+	}
+
+	// Both users upload the same skylink. The second user's upload happened
+	// earlier.
+	sl, _, err := test.CreateTestUpload(ctx, db, *u1, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, upID, err := test.RegisterTestUpload(ctx, db, *u2, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := bson.M{"$set": bson.M{"timestamp": time.Now().UTC().Add(-time.Hour)}}
+	_, err = db.UpdateUpload(ctx, upID, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := db.SkylinkOwner(ctx, sl.Skylink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.ID != u2.ID {
+		t.Fatalf("Expected owner %s, got %s.", u2.ID.Hex(), owner.ID.Hex())
+	}
+	// Once the second user unpins the skylink, the first user becomes the
+	// owner.
+	_, err = db.UnpinUploads(ctx, *sl, *u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err = db.SkylinkOwner(ctx, sl.Skylink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.ID != u1.ID {
+		t.Fatalf("Expected owner %s, got %s.", u1.ID.Hex(), owner.ID.Hex())
+	}
+}
+
+// TestUserUploadCountConsistencyCheck ensures that duplicate pins of the same
+// skylink show up as a difference between the two counts.
+func TestUserUploadCountConsistencyCheck(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upload one skylink three times and another one once.
+	sl, _, err := test.CreateTestUpload(ctx, db, *u, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err = test.RegisterTestUpload(ctx, db, *u, sl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = test.CreateTestUpload(ctx, db, *u, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggCount, directCount, err := db.UserUploadCountConsistencyCheck(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aggCount != 2 || directCount != 4 {
+		t.Fatalf("Expected counts %d and %d, got %d and %d.", 2, 4, aggCount, directCount)
+	}
+}
+
+// TestUserUploadRateBreaches ensures that UserUploadRateBreaches detects users
+// who upload faster than their tier allows.
+func TestUserUploadRateBreaches(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	window := time.Minute
+	allowed := int64(database.UserLimits[database.TierFree].UploadBandwidth) * int64(window.Seconds())
+
+	// No uploads, no breach.
+	breach, err := db.UserUploadRateBreaches(ctx, u.ID, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breach {
+		t.Fatal("Expected no breach without uploads.")
+	}
+	// Upload half of the allowance. Still no breach.
+	_, _, err = test.CreateTestUpload(ctx, db, *u, allowed/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breach, err = db.UserUploadRateBreaches(ctx, u.ID, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breach {
+		t.Fatal("Expected no breach within the allowance.")
+	}
+	// An upload that happened before the window doesn't count.
+	_, upID, err := test.CreateTestUpload(ctx, db, *u, allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := bson.M{"$set": bson.M{"timestamp": time.Now().UTC().Add(-2 * window)}}
+	_, err = db.UpdateUpload(ctx, upID, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breach, err = db.UserUploadRateBreaches(ctx, u.ID, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breach {
+		t.Fatal("Expected uploads outside the window to be ignored.")
+	}
+	// A burst that pushes the user over the allowance is detected.
+	_, _, err = test.CreateTestUpload(ctx, db, *u, allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breach, err = db.UserUploadRateBreaches(ctx, u.ID, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !breach {
+		t.Fatal("Expected a breach.")
+	}
+}
+
+// TestUserAverageUploadSize ensures that UserAverageUploadSize averages the
+// sizes of the user's unique pinned skylinks.
+func TestUserAverageUploadSize(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().UTC().Add(-time.Hour)
+	// No uploads.
+	avg, err := db.UserAverageUploadSize(ctx, u.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avg != 0 {
+		t.Fatalf("Expected 0, got %d.", avg)
+	}
+	// Upload skylinks of sizes 100 and 300. Upload the first one twice, so we
+	// make sure it's only counted once.
+	sl, _, err := test.CreateTestUpload(ctx, db, *u, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.RegisterTestUpload(ctx, db, *u, sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(ctx, db, *u, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unpinned and old uploads are not counted.
+	unpinned, _, err := test.CreateTestUpload(ctx, db, *u, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UnpinUploads(ctx, *unpinned, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, upID, err := test.CreateTestUpload(ctx, db, *u, 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := bson.M{"$set": bson.M{"timestamp": since.Add(-time.Hour)}}
+	_, err = db.UpdateUpload(ctx, upID, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avg, err = db.UserAverageUploadSize(ctx, u.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avg != 200 {
+		t.Fatalf("Expected 200, got %d.", avg)
+	}
+}
+
+// TestUserStaleUploads ensures that UserStaleUploads only suggests large
+// skylinks which haven't been uploaded recently.
+func TestUserStaleUploads(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	// upload creates an upload of the given size and optionally backdates it.
+	upload := func(size int64, isOld bool) *database.Skylink {
+		sl, upID, err := test.CreateTestUpload(ctx, db, *u, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isOld {
+			_, err = db.UpdateUpload(ctx, upID, bson.M{"$set": bson.M{"timestamp": old}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sl
+	}
+	oldLarge := upload(2000, true)
+	oldLarger := upload(3000, true)
+	upload(10, true)    // old but small
+	upload(5000, false) // large but new
+	// An old skylink which was uploaded again recently is not stale.
+	reuploaded := upload(4000, true)
+	_, _, err = test.RegisterTestUpload(ctx, db, *u, reuploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An old skylink uploaded twice is only listed once.
+	_, upID, err := test.RegisterTestUpload(ctx, db, *u, oldLarge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UpdateUpload(ctx, upID, bson.M{"$set": bson.M{"timestamp": old}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := db.UserStaleUploads(ctx, u.ID, 24*time.Hour, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 {
+		t.Fatalf("Expected 2 stale uploads, got %d: %+v", len(stale), stale)
+	}
+	if stale[0].Skylink != oldLarger.Skylink || stale[1].Skylink != oldLarge.Skylink {
+		t.Fatalf("Unexpected stale uploads %+v", stale)
+	}
+	if stale[0].Size != 3000 || stale[1].Size != 2000 {
+		t.Fatalf("Unexpected sizes %+v", stale)
+	}
+}
+
+// TestUserStatsUploadPinned ensures that UserStatsUpload reports the storage
+// taken by content the user pinned from others separately from their own
+// uploads.
+func TestUserStatsUploadPinned(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := db.UserCreate(ctx, "", "", t.Name()+"original", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinner, err := db.UserCreate(ctx, "", "", t.Name()+"pinner", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The original uploader uploads a skylink which the pinner later pins.
+	sharedSize := int64(1024)
+	shared, _, err := test.CreateTestUpload(ctx, db, *original, sharedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pinID, err := test.RegisterTestUpload(ctx, db, *pinner, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pinner also uploads content of their own.
+	ownSize := int64(2048)
+	_, ownID, err := test.CreateTestUpload(ctx, db, *pinner, ownSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := db.UploadByID(ctx, pinID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin.PinnedFrom.IsZero() {
+		t.Fatal("Expected the pin to record the original upload.")
+	}
+	own, err := db.UploadByID(ctx, ownID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !own.PinnedFrom.IsZero() {
+		t.Fatalf("Expected the user's own upload not to be pinned from another, got %s.", own.PinnedFrom.Hex())
+	}
+
+	since := time.Now().UTC().Add(-time.Hour)
+	stats, err := db.UserStatsUpload(ctx, pinner.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SizeTotal != sharedSize+ownSize || stats.PinnedSizeTotal != sharedSize {
+		t.Fatalf("Expected total size %d of which %d pinned, got %d and %d.", sharedSize+ownSize, sharedSize, stats.SizeTotal, stats.PinnedSizeTotal)
+	}
+	if stats.Size != sharedSize+ownSize || stats.PinnedSize != sharedSize {
+		t.Fatalf("Expected period size %d of which %d pinned, got %d and %d.", sharedSize+ownSize, sharedSize, stats.Size, stats.PinnedSize)
+	}
+	stats, err = db.UserStatsUpload(ctx, original.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SizeTotal != sharedSize || stats.PinnedSizeTotal != 0 {
+		t.Fatalf("Expected total size %d with nothing pinned, got %d and %d.", sharedSize, stats.SizeTotal, stats.PinnedSizeTotal)
+	}
+}
+
+// TestUserUploadsToday ensures that UserUploadsToday only counts the pinned
+// uploads made since midnight in the given timezone.
+func TestUserUploadsToday(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use a timezone far from UTC, so its day boundary differs from UTC's.
+	tz := time.FixedZone("UTC+10", 10*60*60)
+	now := time.Now().In(tz)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, tz)
+	// upload creates an upload with the given timestamp.
+	upload := func(ts time.Time) primitive.ObjectID {
+		_, upID, err := test.CreateTestUpload(ctx, db, *u, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UpdateUpload(ctx, upID, bson.M{"$set": bson.M{"timestamp": ts.UTC()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return upID
+	}
+	upload(midnight)
+	upload(now)
+	upload(midnight.Add(-time.Second))
+	upload(midnight.Add(-12 * time.Hour))
+	// Unpinned uploads are not counted.
+	unpinned := upload(now)
+	_, err = db.UpdateUpload(ctx, unpinned, bson.M{"$set": bson.M{"unpinned": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.UserUploadsToday(ctx, u.ID, tz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected %d uploads today, got %d.", 2, n)
+	}
+}
+
+// TestUserPinChurn ensures that UserPinChurn counts the pins and unpins in
+// the given period.
+func TestUserPinChurn(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An old upload which is unpinned now counts as an unpin but not as a
+	// pin.
+	oldSl, oldID, err := test.CreateTestUpload(ctx, db, *u, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UpdateUpload(ctx, oldID, bson.M{"$set": bson.M{"timestamp": time.Now().UTC().Add(-48 * time.Hour)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pin three skylinks and unpin one of them.
+	var sls []*database.Skylink
+	for i := 0; i < 3; i++ {
+		sl, _, err := test.CreateTestUpload(ctx, db, *u, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sls = append(sls, sl)
+	}
+	for _, sl := range []*database.Skylink{oldSl, sls[0]} {
+		if _, err = db.UnpinUploads(ctx, *sl, *u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pinned, unpinned, err := db.UserPinChurn(ctx, u.ID, time.Now().UTC().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned != 3 || unpinned != 2 {
+		t.Fatalf("Expected 3 pins and 2 unpins, got %d and %d.", pinned, unpinned)
+	}
+	// Nothing happened after now.
+	pinned, unpinned, err = db.UserPinChurn(ctx, u.ID, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned != 0 || unpinned != 0 {
+		t.Fatalf("Expected no pins or unpins, got %d and %d.", pinned, unpinned)
+	}
+}
+
+// TestUserStorageRunway ensures that UserStorageRunway extrapolates the user's
+// recent storage growth.
+func TestUserStorageRunway(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// upload creates an upload of the given size with the given timestamp.
+	upload := func(size int64, ts time.Time) {
+		_, upID, err := test.CreateTestUpload(ctx, db, *u, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.UpdateUpload(ctx, upID, bson.M{"$set": bson.M{"timestamp": ts.UTC()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := 24 * time.Hour
+	now := time.Now().UTC()
+
+	// A user without any uploads isn't growing.
+	r, err := db.UserStorageRunway(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != database.StorageRunwayUnlimited {
+		t.Fatalf("Expected unlimited runway, got %v.", r)
+	}
+
+	// An old upload counts towards the used storage but not towards the
+	// growth.
+	upload(100*skynet.GiB, now.Add(-2*database.StorageRunwayWindow))
+	r, err = db.UserStorageRunway(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != database.StorageRunwayUnlimited {
+		t.Fatalf("Expected unlimited runway, got %v.", r)
+	}
+
+	// Grow by 1 GiB per day over the entire window.
+	days := int(database.StorageRunwayWindow / day)
+	for i := 0; i < days; i++ {
+		upload(skynet.GiB, now.Add(-time.Duration(i)*day-time.Hour))
+	}
+	limit := database.UserLimits[database.TierPremium5].Storage
+	used := 100*skynet.GiB + int64(days)*skynet.GiB
+	expected := time.Duration((limit-used)/skynet.GiB) * day
+	r, err = db.UserStorageRunway(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r < expected-time.Minute || r > expected+time.Minute {
+		t.Fatalf("Expected a runway of about %v, got %v.", expected, r)
+	}
+
+	// A user who is over their limit has no runway left.
+	upload(limit, now)
+	r, err = db.UserStorageRunway(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 0 {
+		t.Fatalf("Expected no runway, got %v.", r)
+	}
+}
+
+// TestUserStatsUploadQuotaExempt ensures that quota exempt skylinks don't
+// count towards the user's storage but still count towards their bandwidth.
+func TestUserStatsUploadQuotaExempt(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exemptSize := int64(10 * skynet.GiB)
+	regularSize := int64(skynet.MiB)
+	exempt, _, err := test.CreateTestUpload(ctx, db, *u, exemptSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(ctx, db, *u, regularSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SkylinkSetQuotaExempt(ctx, exempt.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Marking a skylink which doesn't exist fails.
+	err = db.SkylinkSetQuotaExempt(ctx, primitive.NewObjectID(), true)
+	if !errors.Contains(err, database.ErrInvalidSkylink) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrInvalidSkylink, err)
+	}
+
+	stats, err := db.UserStatsUpload(ctx, u.ID, time.Now().UTC().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SizeTotal != regularSize || stats.Size != regularSize {
+		t.Fatalf("Expected size %d, got %d (total %d).", regularSize, stats.Size, stats.SizeTotal)
+	}
+	if stats.RawStorageUsedTotal != skynet.RawStorageUsed(regularSize) {
+		t.Fatalf("Expected raw storage %d, got %d.", skynet.RawStorageUsed(regularSize), stats.RawStorageUsedTotal)
+	}
+	expectedBW := skynet.BandwidthUploadCost(exemptSize) + skynet.BandwidthUploadCost(regularSize)
+	if stats.BandwidthTotal != expectedBW || stats.Bandwidth != expectedBW {
+		t.Fatalf("Expected bandwidth %d, got %d (total %d).", expectedBW, stats.Bandwidth, stats.BandwidthTotal)
+	}
+
+	// Once the exemption is lifted, the skylink counts again.
+	err = db.SkylinkSetQuotaExempt(ctx, exempt.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = db.UserStatsUpload(ctx, u.ID, time.Now().UTC().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SizeTotal != exemptSize+regularSize {
+		t.Fatalf("Expected size %d, got %d.", exemptSize+regularSize, stats.SizeTotal)
+	}
+}
+
+// TestUserStorageAsOf ensures that UserStorageAsOf reconstructs the user's
+// storage at different points in the past.
+func TestUserStorageAsOf(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	// upload creates an upload of the given size at the given time and
+	// optionally marks it as unpinned.
+	upload := func(size int64, at time.Time, unpinned bool, unpinnedAt time.Time) {
+		_, upID, err := test.CreateTestUpload(ctx, db, *u, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := bson.M{"timestamp": at}
+		if unpinned {
+			set["unpinned"] = true
+		}
+		if !unpinnedAt.IsZero() {
+			set["unpinned_at"] = unpinnedAt
+		}
+		_, err = db.UpdateUpload(ctx, upID, bson.M{"$set": set})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Uploaded three days ago and still pinned.
+	upload(skynet.MiB, now.Add(-72*time.Hour), false, time.Time{})
+	// Uploaded three days ago and unpinned a day and a half ago.
+	upload(2*skynet.MiB, now.Add(-72*time.Hour), true, now.Add(-36*time.Hour))
+	// Uploaded thirty hours ago and still pinned.
+	upload(4*skynet.MiB, now.Add(-30*time.Hour), false, time.Time{})
+	// Unpinned before we tracked the time of unpinning, so never counted.
+	upload(8*skynet.MiB, now.Add(-72*time.Hour), true, time.Time{})
+
+	tests := []struct {
+		at       time.Time
+		expected int64
+	}{
+		{now.Add(-96 * time.Hour), 0},
+		{now.Add(-60 * time.Hour), skynet.RawStorageUsed(skynet.MiB) + skynet.RawStorageUsed(2*skynet.MiB)},
+		{now.Add(-12 * time.Hour), skynet.RawStorageUsed(skynet.MiB) + skynet.RawStorageUsed(4*skynet.MiB)},
+	}
+	for _, tt := range tests {
+		storage, err := db.UserStorageAsOf(ctx, u.ID, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if storage != tt.expected {
+			t.Fatalf("Expected storage %d at %v, got %d.", tt.expected, tt.at, storage)
+		}
+	}
+}
@@ -3,7 +3,12 @@ package database
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,7 +21,9 @@ import (
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"gitlab.com/NebulousLabs/errors"
 	"gitlab.com/NebulousLabs/fastrand"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.sia.tech/siad/crypto"
 )
 
@@ -67,6 +74,316 @@ func TestUserByEmail(t *testing.T) {
 	}
 }
 
+// TestUserByEmailNormalized ensures that we find users by email regardless of
+// the case or surrounding whitespace of the address we look up.
+func TestUserByEmailNormalized(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := db.UserCreate(ctx, types.NewEmail(" John.Doe@GMail.com "), t.Name()+"password", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "john.doe@gmail.com" {
+		t.Fatalf("Expected the email to be stored normalized, got '%s'.", u.Email)
+	}
+	// Look the user up using differently formatted versions of the same
+	// address. We cast directly to types.Email in order to bypass the
+	// normalization done by types.NewEmail.
+	lookups := []types.Email{
+		"john.doe@gmail.com",
+		"JOHN.DOE@gmail.com",
+		" John.Doe@GMAIL.COM\t",
+	}
+	for _, e := range lookups {
+		u2, err := db.UserByEmail(ctx, e)
+		if err != nil {
+			t.Fatalf("Failed to find user by '%s': %v", e, err)
+		}
+		if u2.ID != u.ID {
+			t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u2.ID.Hex())
+		}
+	}
+	// We don't strip dots from the local part, so this is a different address.
+	_, err = db.UserByEmail(ctx, "johndoe@gmail.com")
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserNotFound, err)
+	}
+	// Emails set directly on the user are normalized when saving.
+	u.Email = "Jane.Doe@GMail.com"
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByEmail(ctx, "jane.doe@gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID || u2.Email != "jane.doe@gmail.com" {
+		t.Fatalf("Unexpected user %+v", u2)
+	}
+}
+
+// TestUserByEmailLegacyMixedCase ensures that we find users whose emails were
+// stored before we started normalizing them.
+func TestUserByEmailLegacyMixedCase(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"password", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Store a mixed-case email directly in the DB, the way it was stored
+	// before we normalized emails. The DB API always normalizes them.
+	creds := test.DBTestCredentials()
+	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s", creds.User, creds.Password, creds.Host, creds.Port)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := client.Disconnect(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	legacy := "Legacy.User@Example.com"
+	users := client.Database(test.SanitizeName(dbName)).Collection("users")
+	_, err = users.UpdateOne(ctx, bson.M{"_id": u.ID}, bson.M{"$set": bson.M{"email": legacy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// We cast directly to types.Email in order to bypass the normalization
+	// done by types.NewEmail.
+	for _, e := range []types.Email{"legacy.user@example.com", "LEGACY.USER@EXAMPLE.COM", types.Email(legacy)} {
+		u2, err := db.UserByEmail(ctx, e)
+		if err != nil {
+			t.Fatalf("Failed to find user by '%s': %v", e, err)
+		}
+		if u2.ID != u.ID {
+			t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u2.ID.Hex())
+		}
+	}
+	// Other addresses are still not found.
+	_, err = db.UserByEmail(ctx, "other.user@example.com")
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserNotFound, err)
+	}
+}
+
+// TestUserByEmailMultipleUsers ensures that UserByEmail reports duplicate
+// emails instead of picking one of the users.
+func TestUserByEmailMultipleUsers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	// Use a fresh DB on every run because we drop one of its indexes.
+	dbName := test.SanitizeName(test.DBNameForTest(t.Name()) + "_" + primitive.NewObjectID().Hex())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := test.DBTestCredentials()
+	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s", creds.User, creds.Password, creds.Host, creds.Port)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := client.Database(dbName).Drop(ctx); err != nil {
+			t.Error(err)
+		}
+		if err := client.Disconnect(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	u1, err := db.UserCreate(ctx, email, t.Name()+"password", t.Name()+"sub1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"sub2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single match behaves as before.
+	u, err := db.UserByEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != u1.ID {
+		t.Fatalf("Expected user %s, got %s.", u1.ID.Hex(), u.ID.Hex())
+	}
+	// Drop the unique index on emails, so we can give the second user the
+	// same email.
+	_, err = client.Database(dbName).Collection("users").Indexes().DropOne(ctx, "email_unique_nonempty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2.Email = email
+	err = db.UserSave(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByEmail(ctx, email)
+	if !errors.Contains(err, database.ErrMultipleUsersFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrMultipleUsersFound, err)
+	}
+}
+
+// TestUserByRecoveryToken ensures that UserByRecoveryToken handles zero, one
+// and multiple matches, as well as empty and expired tokens.
+func TestUserByRecoveryToken(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByRecoveryToken(ctx, "")
+	if !errors.Contains(err, database.ErrInvalidToken) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrInvalidToken, err)
+	}
+	token := t.Name() + "token"
+	_, err = db.UserByRecoveryToken(ctx, token)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrUserNotFound, err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"sub1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1.RecoveryToken = token
+	u1.RecoveryTokenExpiration = time.Now().UTC().Add(time.Hour)
+	if err = db.UserSave(ctx, u1); err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserByRecoveryToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != u1.ID {
+		t.Fatalf("Expected user %s, got %s.", u1.ID.Hex(), u.ID.Hex())
+	}
+	// An expired token is rejected.
+	u1.RecoveryTokenExpiration = time.Now().UTC().Add(-time.Second)
+	if err = db.UserSave(ctx, u1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByRecoveryToken(ctx, token)
+	if !errors.Contains(err, database.ErrInvalidToken) || !strings.Contains(err.Error(), "token expired") {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrInvalidToken, err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"sub2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2.RecoveryToken = token
+	u2.RecoveryTokenExpiration = time.Now().UTC().Add(time.Hour)
+	if err = db.UserSave(ctx, u2); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByRecoveryToken(ctx, token)
+	if !errors.Contains(err, database.ErrMultipleUsersFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrMultipleUsersFound, err)
+	}
+}
+
+// TestUserGenerateRecoveryToken ensures that UserGenerateRecoveryToken
+// enforces RecoveryTokenCooldown and sets the expiration of the tokens it
+// issues.
+func TestUserGenerateRecoveryToken(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCooldown, oldTTL := database.RecoveryTokenCooldown, database.RecoveryTokenTTL
+	defer func() {
+		database.RecoveryTokenCooldown = oldCooldown
+		database.RecoveryTokenTTL = oldTTL
+	}()
+	database.RecoveryTokenCooldown = time.Second
+
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := db.UserGenerateRecoveryToken(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk == "" || u.RecoveryToken != tk || u.RecoveryTokenCreatedAt.IsZero() {
+		t.Fatalf("Expected the user to hold the new token, got '%s' created at %v.", u.RecoveryToken, u.RecoveryTokenCreatedAt)
+	}
+	if !u.RecoveryTokenExpiration.Equal(u.RecoveryTokenCreatedAt.Add(database.RecoveryTokenTTL)) {
+		t.Fatalf("Expected the token to expire after %v, got %v.", database.RecoveryTokenTTL, u.RecoveryTokenExpiration)
+	}
+	u2, err := db.UserByRecoveryToken(ctx, tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u2.ID.Hex())
+	}
+	// Requesting a new token right away fails and keeps the old token.
+	_, err = db.UserGenerateRecoveryToken(ctx, u)
+	if !errors.Contains(err, database.ErrRecoveryTokenCooldown) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrRecoveryTokenCooldown, err)
+	}
+	if u.RecoveryToken != tk {
+		t.Fatal("Expected the token to remain unchanged.")
+	}
+	// Once the cooldown passes we can get a new token and the old one stops
+	// working.
+	time.Sleep(database.RecoveryTokenCooldown)
+	tk2, err := db.UserGenerateRecoveryToken(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk2 == tk {
+		t.Fatal("Expected a new token.")
+	}
+	_, err = db.UserByRecoveryToken(ctx, tk)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserNotFound, err)
+	}
+	// Tokens are rejected once they expire.
+	database.RecoveryTokenTTL = time.Millisecond
+	database.RecoveryTokenCooldown = 0
+	tk3, err := db.UserGenerateRecoveryToken(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, err = db.UserByRecoveryToken(ctx, tk3)
+	if !errors.Contains(err, database.ErrInvalidToken) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrInvalidToken, err)
+	}
+}
+
 // TestUserByID ensures UserByID works as expected.
 func TestUserByID(t *testing.T) {
 	if testing.Short() {
@@ -361,7 +678,7 @@ func TestUserCreateEmailConfirmation(t *testing.T) {
 	}
 	ctx := context.Background()
 	dbName := test.DBNameForTest(t.Name())
-	db, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil)
+	db, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -388,6 +705,69 @@ func TestUserCreateEmailConfirmation(t *testing.T) {
 	}
 }
 
+// TestEmailConfirmationTokenTTL ensures that the DB's email confirmation token
+// TTL is used when creating users and confirmation tokens.
+func TestEmailConfirmationTokenTTL(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	// Negative TTLs are rejected.
+	_, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil, -time.Hour)
+	if err == nil {
+		t.Fatal("Expected an error for a negative TTL.")
+	}
+	// The default is used when no TTL is given.
+	db, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.EmailConfirmationTokenTTL() != database.EmailConfirmationTokenTTL {
+		t.Fatalf("Expected TTL %v, got %v.", database.EmailConfirmationTokenTTL, db.EmailConfirmationTokenTTL())
+	}
+
+	ttl := 7 * 24 * time.Hour
+	db, err = database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// expectExpiration checks that the given expiration is ttl after a time
+	// between from and now.
+	expectExpiration := func(exp, from time.Time) {
+		from = from.Add(ttl).Truncate(time.Millisecond)
+		to := time.Now().UTC().Add(ttl)
+		if exp.Before(from) || exp.After(to) {
+			t.Fatalf("Expected the expiration to be between %v and %v, got %v.", from, to, exp)
+		}
+	}
+	before := time.Now().UTC()
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectExpiration(u.EmailConfirmationTokenExpiration, before)
+
+	before = time.Now().UTC()
+	pk := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	u, err = db.UserCreatePK(ctx, types.NewEmail(t.Name()+"pk@siasky.net"), "", t.Name()+"pksub", pk, database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectExpiration(u.EmailConfirmationTokenExpiration, before)
+
+	before = time.Now().UTC()
+	_, err = db.UserCreateEmailConfirmation(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectExpiration(u.EmailConfirmationTokenExpiration, before)
+}
+
 // TestUserDelete ensures UserDelete works as expected.
 func TestUserDelete(t *testing.T) {
 	if testing.Short() {
@@ -473,6 +853,22 @@ func TestUserSave(t *testing.T) {
 	if u1.Tier != u.Tier {
 		t.Fatalf("Expected tier '%d', got '%d'.", u.Tier, u1.Tier)
 	}
+	// Case: save a user with an email that belongs to another user.
+	u2 := &database.User{
+		ID:    primitive.NewObjectID(),
+		Email: types.NewEmail(username + "_other@siasky.net"),
+		Sub:   t.Name() + "sub2",
+		Tier:  database.TierFree,
+	}
+	err = db.UserSave(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2.Email = u.Email
+	err = db.UserSave(ctx, u2)
+	if !errors.Contains(err, database.ErrUserAlreadyExists) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrUserAlreadyExists, err)
+	}
 }
 
 // TestUserSetStripeID ensures that UserSetStripeID works as expected.
@@ -519,7 +915,7 @@ func TestUserPubKey(t *testing.T) {
 	}
 	ctx := context.Background()
 	dbName := test.DBNameForTest(t.Name())
-	db, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil)
+	db, err := database.NewCustomDB(ctx, dbName, test.DBTestCredentials(), nil, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -597,55 +993,36 @@ func TestUserPubKey(t *testing.T) {
 	if len(u4.PubKeys) > 0 {
 		t.Fatal("Expected zero pubkeys.")
 	}
-}
-
-// TestUserSetTier ensures that UserSetTier works as expected.
-func TestUserSetTier(t *testing.T) {
-	if testing.Short() {
-		t.SkipNow()
-	}
-	ctx := context.Background()
-	dbName := test.DBNameForTest(t.Name())
-	db, err := test.NewDatabase(ctx, dbName)
+	// Adding a pubkey which belongs to another user fails.
+	other, err := db.UserCreate(ctx, "", "", t.Name()+"other", database.TierFree)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Create a test user with the respective StripeID.
-	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	err = db.UserPubKeyAdd(ctx, *other, pk1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func(user *database.User) {
-		err = db.UserDelete(ctx, user)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}(u)
-	err = db.UserSetTier(ctx, u, database.TierPremium80)
-	if err != nil {
-		t.Fatal(err)
+	err = db.UserPubKeyAdd(ctx, *u, pk1)
+	if !errors.Contains(err, database.ErrPubKeyInUse) {
+		t.Fatalf("Expected error %v, got %v", database.ErrPubKeyInUse, err)
 	}
-	u2, err := db.UserByID(ctx, u.ID)
+	u5, err := db.UserByID(ctx, u.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if u2.Tier != database.TierPremium80 {
-		t.Fatalf("Expected tier %d got %d.\n", database.TierPremium80, u2.Tier)
-	}
-	// Set the tier of a non-existent user. Expect this to fail.
-	sub, _ := lib.GenerateUUID()
-	uNon := &database.User{
-		Email: types.Email(t.Name() + "_non@siasky.net"),
-		Sub:   sub,
+	if u5.HasKey(pk1) {
+		t.Fatal("Expected the pubkey not to be added.")
 	}
-	err = db.UserSetTier(ctx, uNon, database.TierPremium80)
-	if err == nil || !errors.Contains(err, mongo.ErrNoDocuments) {
-		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	// Re-adding a pubkey the user already has is not a conflict.
+	err = db.UserPubKeyAdd(ctx, *other, pk1)
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-// TestUserStats ensures we report accurate statistics for users.
-func TestUserStats(t *testing.T) {
+// TestUserPubKeyMethods tests UserAddPubKey, UserRemovePubKey and
+// UserPromotePubKey, as well as the pubkey conflict reported by UserSave.
+func TestUserPubKeyMethods(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
 	}
@@ -655,21 +1032,170 @@ func TestUserStats(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Add a test user.
-	sub := string(fastrand.Bytes(test.UserSubLen))
-	u, err := db.UserCreate(ctx, "user@example.com", "", sub, database.TierPremium5)
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	testUploadSizeSmall := int64(1 + fastrand.Intn(4*skynet.MiB-1))
-	testUploadSizeBig := int64(4*skynet.MiB + 1 + fastrand.Intn(4*skynet.MiB))
-	expectedUploadBandwidth := int64(0)
-	expectedDownloadBandwidth := int64(0)
-
-	// Create a small upload.
-	skylinkSmall, _, err := test.CreateTestUpload(ctx, db, *u, testUploadSizeSmall)
+	other, err := db.UserCreate(ctx, "", "", t.Name()+"other", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk1 := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	pk2 := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	pk3 := database.PubKey(fastrand.Bytes(database.PubKeySize))
+
+	// checkKeys makes sure that both the given user struct and the user in
+	// the DB have the expected pubkeys in the expected order.
+	checkKeys := func(u *database.User, keys, associated []database.PubKey) {
+		t.Helper()
+		fromDB, err := db.UserByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, uu := range []*database.User{u, fromDB} {
+			if len(uu.PubKeys) != len(keys) || len(uu.AssociatedPubKeys) != len(associated) {
+				t.Fatalf("Expected pubkeys %v and associated pubkeys %v, got %v and %v.", keys, associated, uu.PubKeys, uu.AssociatedPubKeys)
+			}
+			for i := range keys {
+				if !bytes.Equal(uu.PubKeys[i], keys[i]) {
+					t.Fatalf("Expected pubkeys %v, got %v.", keys, uu.PubKeys)
+				}
+			}
+			for i := range associated {
+				if !bytes.Equal(uu.AssociatedPubKeys[i], associated[i]) {
+					t.Fatalf("Expected associated pubkeys %v, got %v.", associated, uu.AssociatedPubKeys)
+				}
+			}
+		}
+	}
+
+	// Keys are appended in the order in which they were added and adding a
+	// key twice doesn't change anything.
+	for _, pk := range []database.PubKey{pk1, pk2, pk3, pk1} {
+		err = db.UserAddPubKey(ctx, u, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkKeys(u, []database.PubKey{pk1, pk2, pk3}, nil)
+	// Promote the last key to the front.
+	err = db.UserPromotePubKey(ctx, u, pk3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(u, []database.PubKey{pk3, pk1, pk2}, nil)
+	// Remove a key. It's remembered among the associated keys.
+	err = db.UserRemovePubKey(ctx, u, pk1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(u, []database.PubKey{pk3, pk2}, []database.PubKey{pk1})
+	// A key the user doesn't have can be neither removed nor promoted.
+	err = db.UserRemovePubKey(ctx, u, pk1)
+	if !errors.Contains(err, database.ErrPubKeyNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrPubKeyNotFound, err)
+	}
+	err = db.UserPromotePubKey(ctx, u, pk1)
+	if !errors.Contains(err, database.ErrPubKeyNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrPubKeyNotFound, err)
+	}
+	checkKeys(u, []database.PubKey{pk3, pk2}, []database.PubKey{pk1})
+	// Another user can claim neither a current nor an associated key.
+	for _, pk := range []database.PubKey{pk2, pk1} {
+		err = db.UserAddPubKey(ctx, other, pk)
+		if !errors.Contains(err, database.ErrPubKeyInUse) {
+			t.Fatalf("Expected error '%v', got '%v'.", database.ErrPubKeyInUse, err)
+		}
+	}
+	checkKeys(other, nil, nil)
+	// Saving a user with another user's key reports the pubkey conflict
+	// rather than claiming that the user already exists.
+	clash := *other
+	clash.PubKeys = []database.PubKey{pk3}
+	err = db.UserSave(ctx, &clash)
+	if !errors.Contains(err, database.ErrPubKeyInUse) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrPubKeyInUse, err)
+	}
+	// A clash on another unique index is still reported as an existing user.
+	clash = *other
+	clash.Sub = u.Sub
+	err = db.UserSave(ctx, &clash)
+	if !errors.Contains(err, database.ErrUserAlreadyExists) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrUserAlreadyExists, err)
+	}
+}
+
+// TestUserSetTier ensures that UserSetTier works as expected.
+func TestUserSetTier(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create a test user with the respective StripeID.
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(user *database.User) {
+		err = db.UserDelete(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(u)
+	err = db.UserSetTier(ctx, u, database.TierPremium80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.Tier != database.TierPremium80 {
+		t.Fatalf("Expected tier %d got %d.\n", database.TierPremium80, u2.Tier)
+	}
+	// Set the tier of a non-existent user. Expect this to fail.
+	sub, _ := lib.GenerateUUID()
+	uNon := &database.User{
+		Email: types.Email(t.Name() + "_non@siasky.net"),
+		Sub:   sub,
+	}
+	err = db.UserSetTier(ctx, uNon, database.TierPremium80)
+	if err == nil || !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+}
+
+// TestUserStats ensures we report accurate statistics for users.
+func TestUserStats(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a test user.
+	sub := string(fastrand.Bytes(test.UserSubLen))
+	u, err := db.UserCreate(ctx, "user@example.com", "", sub, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testUploadSizeSmall := int64(1 + fastrand.Intn(4*skynet.MiB-1))
+	testUploadSizeBig := int64(4*skynet.MiB + 1 + fastrand.Intn(4*skynet.MiB))
+	expectedUploadBandwidth := int64(0)
+	expectedDownloadBandwidth := int64(0)
+
+	// Create a small upload.
+	skylinkSmall, _, err := test.CreateTestUpload(ctx, db, *u, testUploadSizeSmall)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -721,7 +1247,7 @@ func TestUserStats(t *testing.T) {
 
 	// Register a small download.
 	smallDownload := int64(1 + fastrand.Intn(4*skynet.MiB))
-	_, err = db.DownloadCreate(ctx, *u, *skylinkSmall, smallDownload)
+	_, err = db.DownloadCreate(ctx, *u, *skylinkSmall, smallDownload, database.TrafficMeta{})
 	if err != nil {
 		t.Fatal("Failed to download.", err)
 	}
@@ -749,7 +1275,7 @@ func TestUserStats(t *testing.T) {
 	}
 	// Register a big download.
 	bigDownload := int64(100*skynet.MiB + fastrand.Intn(4*skynet.MiB))
-	_, err = db.DownloadCreate(ctx, *u, *skylinkBig, bigDownload)
+	_, err = db.DownloadCreate(ctx, *u, *skylinkBig, bigDownload, database.TrafficMeta{})
 	if err != nil {
 		t.Fatal("Failed to download.", err)
 	}
@@ -769,7 +1295,7 @@ func TestUserStats(t *testing.T) {
 	}
 
 	// Register a registry read.
-	_, err = db.RegistryReadCreate(ctx, *u)
+	_, err = db.RegistryReadCreate(ctx, *u, "")
 	if err != nil {
 		t.Fatal("Failed to register a registry read.", err)
 	}
@@ -788,7 +1314,7 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegReads, stats.BandwidthRegReads/skynet.MiB)
 	}
 	// Register a registry read.
-	_, err = db.RegistryReadCreate(ctx, *u)
+	_, err = db.RegistryReadCreate(ctx, *u, "")
 	if err != nil {
 		t.Fatal("Failed to register a registry read.", err)
 	}
@@ -808,7 +1334,7 @@ func TestUserStats(t *testing.T) {
 	}
 
 	// Register a registry write.
-	_, err = db.RegistryWriteCreate(ctx, *u)
+	_, err = db.RegistryWriteCreate(ctx, *u, "")
 	if err != nil {
 		t.Fatal("Failed to register a registry write.", err)
 	}
@@ -827,7 +1353,7 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegWrites, stats.BandwidthRegWrites/skynet.MiB)
 	}
 	// Register a registry write.
-	_, err = db.RegistryWriteCreate(ctx, *u)
+	_, err = db.RegistryWriteCreate(ctx, *u, "")
 	if err != nil {
 		t.Fatal("Failed to register a registry write.", err)
 	}
@@ -846,3 +1372,1860 @@ func TestUserStats(t *testing.T) {
 			stats.BandwidthRegWrites, stats.BandwidthRegWrites/skynet.MiB)
 	}
 }
+
+// TestUserLifetimeStats ensures we report accurate lifetime statistics for
+// users, regardless of their current billing period.
+func TestUserLifetimeStats(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a test user.
+	sub := string(fastrand.Bytes(test.UserSubLen))
+	u, err := db.UserCreate(ctx, "user@example.com", "", sub, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizeOld := int64(1 + fastrand.Intn(4*skynet.MiB-1))
+	sizeNew := int64(1 + fastrand.Intn(4*skynet.MiB-1))
+
+	// Create an upload and move it to a previous billing period.
+	skylinkOld, upID, err := test.CreateTestUpload(ctx, db, *u, sizeOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := bson.M{"$set": bson.M{"timestamp": time.Now().UTC().AddDate(0, -2, 0)}}
+	_, err = db.UpdateUpload(ctx, upID, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create an upload in the current period.
+	_, _, err = test.CreateTestUpload(ctx, db, *u, sizeNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upload the old skylink again. This should not count towards the size.
+	_, _, err = test.RegisterTestUpload(ctx, db, *u, skylinkOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.UserStats(ctx, *u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lifetime, err := db.UserLifetimeStats(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime.NumUploads != 3 || lifetime.NumUploadsTotal != 3 {
+		t.Fatalf("Expected %d lifetime uploads, got %d (total %d).", 3, lifetime.NumUploads, lifetime.NumUploadsTotal)
+	}
+	if lifetime.UploadsSize != sizeOld+sizeNew {
+		t.Fatalf("Expected lifetime uploads size of %d, got %d.", sizeOld+sizeNew, lifetime.UploadsSize)
+	}
+	if lifetime.NumUploads <= stats.NumUploads {
+		t.Fatalf("Expected lifetime uploads %d to exceed the period's %d.", lifetime.NumUploads, stats.NumUploads)
+	}
+	if lifetime.UploadsSize <= stats.UploadsSize {
+		t.Fatalf("Expected lifetime uploads size %d to exceed the period's %d.", lifetime.UploadsSize, stats.UploadsSize)
+	}
+	if lifetime.BandwidthUploads <= stats.BandwidthUploads {
+		t.Fatalf("Expected lifetime upload bandwidth %d to exceed the period's %d.", lifetime.BandwidthUploads, stats.BandwidthUploads)
+	}
+	// The period stats' totals should match the lifetime stats.
+	if stats.NumUploadsTotal != lifetime.NumUploads || stats.UploadsSizeTotal != lifetime.UploadsSize {
+		t.Fatalf("Expected period totals to match lifetime stats, got %+v and %+v.", stats, lifetime)
+	}
+	// The remaining quota covers the user's entire history, so both report
+	// the same.
+	expectedStorage := u.EffectiveStorageLimit() - (sizeOld + sizeNew)
+	if stats.StorageRemaining != expectedStorage || lifetime.StorageRemaining != expectedStorage {
+		t.Fatalf("Expected %d storage remaining, got %d and %d.", expectedStorage, stats.StorageRemaining, lifetime.StorageRemaining)
+	}
+	expectedUploads := database.UserLimits[database.TierPremium5].MaxNumberUploads - 3
+	if stats.UploadsRemaining != expectedUploads || lifetime.UploadsRemaining != expectedUploads {
+		t.Fatalf("Expected %d uploads remaining, got %d and %d.", expectedUploads, stats.UploadsRemaining, lifetime.UploadsRemaining)
+	}
+}
+
+// TestFindUsersWithBrokenStats ensures that we can detect users whose stats
+// fail to compute.
+func TestFindUsersWithBrokenStats(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uGood, err := db.UserCreate(ctx, "", "", t.Name()+"good", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uBad, err := db.UserCreate(ctx, "", "", t.Name()+"bad", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(ctx, db, *uGood, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create an upload for the bad user and corrupt its timestamp.
+	_, upID, err := test.CreateTestUpload(ctx, db, *uBad, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UpdateUpload(ctx, upID, bson.M{"$set": bson.M{"timestamp": "not a timestamp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.ValidateUserStats(ctx, uGood.ID); err != nil {
+		t.Fatal("Expected the good user's stats to be valid, got", err)
+	}
+	if err = db.ValidateUserStats(ctx, uBad.ID); err == nil {
+		t.Fatal("Expected the bad user's stats to be invalid.")
+	}
+	broken, err := db.FindUsersWithBrokenStats(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, id := range broken {
+		if id == uGood.ID {
+			t.Fatal("The good user was flagged as broken.")
+		}
+		if id == uBad.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Expected the bad user to be flagged as broken.")
+	}
+}
+
+// TestUserSetExtraStorage ensures that UserSetExtraStorage works as expected.
+func TestUserSetExtraStorage(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Negative values are not allowed.
+	err = db.UserSetExtraStorage(ctx, u, -1)
+	if err == nil {
+		t.Fatal("Expected an error for negative extra storage.")
+	}
+	extra := 10 * skynet.TiB
+	err = db.UserSetExtraStorage(ctx, u, int64(extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.ExtraStorage != int64(extra) {
+		t.Fatalf("Expected extra storage %d, got %d.", extra, u1.ExtraStorage)
+	}
+	expectedLimit := database.UserLimits[database.TierFree].Storage + int64(extra)
+	if u1.EffectiveStorageLimit() != expectedLimit {
+		t.Fatalf("Expected storage limit %d, got %d.", expectedLimit, u1.EffectiveStorageLimit())
+	}
+	// Non-existent user.
+	uNon := &database.User{ID: primitive.NewObjectID()}
+	err = db.UserSetExtraStorage(ctx, uNon, 1)
+	if !errors.Contains(err, mongo.ErrNoDocuments) {
+		t.Fatalf("Expected '%v', got '%v'", mongo.ErrNoDocuments, err)
+	}
+}
+
+// TestUserSetRegistryDelay ensures that UserSetRegistryDelay sets and clears
+// the user's custom registry delay.
+func TestUserSetRegistryDelay(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tierDelay := database.UserLimits[database.TierFree].RegistryDelay
+	// Negative values are not allowed.
+	negative := -1
+	err = db.UserSetRegistryDelay(ctx, u, &negative)
+	if err == nil {
+		t.Fatal("Expected an error for a negative delay.")
+	}
+	// Set a custom delay.
+	delay := tierDelay + 100
+	err = db.UserSetRegistryDelay(ctx, u, &delay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := db.UserRegistryDelay(u1); d != delay {
+		t.Fatalf("Expected registry delay %d, got %d.", delay, d)
+	}
+	// Clear the custom delay.
+	err = db.UserSetRegistryDelay(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.RegistryDelayOverride != nil {
+		t.Fatalf("Expected no custom delay, got %d.", *u1.RegistryDelayOverride)
+	}
+	if d := db.UserRegistryDelay(u1); d != tierDelay {
+		t.Fatalf("Expected registry delay %d, got %d.", tierDelay, d)
+	}
+}
+
+// TestUserSetActivePubKey ensures that UserSetActivePubKey moves the given
+// pubkey to the front of the user's set without losing any keys.
+func TestUserSetActivePubKey(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]database.PubKey, 3)
+	for i := range keys {
+		keys[i] = fastrand.Bytes(database.PubKeySize)
+	}
+	u.PubKeys = keys
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Activating a key the user doesn't have fails.
+	err = db.UserSetActivePubKey(ctx, u, fastrand.Bytes(database.PubKeySize))
+	if !errors.Contains(err, database.ErrPubKeyNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrPubKeyNotFound, err)
+	}
+	// Activate the last key.
+	err = db.UserSetActivePubKey(ctx, u, keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []database.PubKey{keys[2], keys[0], keys[1]}
+	if len(u1.PubKeys) != len(expected) {
+		t.Fatalf("Expected %d pubkeys, got %d.", len(expected), len(u1.PubKeys))
+	}
+	for i := range expected {
+		if !bytes.Equal(u1.PubKeys[i], expected[i]) {
+			t.Fatalf("Unexpected pubkey at position %d.", i)
+		}
+	}
+	// The in-memory user is updated as well.
+	if !bytes.Equal(u.PubKeys[0], keys[2]) || len(u.PubKeys) != len(keys) {
+		t.Fatal("Expected the user's pubkeys to be reordered.")
+	}
+}
+
+// TestUsersCrossingUsageThreshold ensures that UsersCrossingUsageThreshold
+// returns only the users who have reached the threshold and haven't been
+// notified about it yet.
+func TestUsersCrossingUsageThreshold(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := database.UserLimits[database.TierPremium5].Storage
+	// Create users at 50%, 85% and 100% of their storage limit.
+	usage := map[string]int64{
+		"low":  limit / 2,
+		"high": limit / 100 * 85,
+		"full": limit,
+	}
+	users := make(map[string]*database.User)
+	for name, size := range usage {
+		u, err := db.UserCreate(ctx, "", "", t.Name()+name, database.TierPremium5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = test.CreateTestUpload(ctx, db, *u, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[name] = u
+	}
+	// assertUsers checks that UsersCrossingUsageThreshold returns exactly the
+	// expected users.
+	assertUsers := func(threshold float64, expected ...string) {
+		us, err := db.UsersCrossingUsageThreshold(ctx, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(us) != len(expected) {
+			t.Fatalf("Expected %d users at threshold %.2f, got %d.", len(expected), threshold, len(us))
+		}
+		found := make(map[primitive.ObjectID]bool)
+		for _, u := range us {
+			found[u.ID] = true
+		}
+		for _, name := range expected {
+			if !found[users[name].ID] {
+				t.Fatalf("Expected user '%s' at threshold %.2f.", name, threshold)
+			}
+		}
+	}
+
+	assertUsers(0.8, "high", "full")
+	assertUsers(1, "full")
+	// Notify the users who crossed 80%. They shouldn't be returned for that
+	// threshold again but the full user should still be returned for 100%.
+	for _, name := range []string{"high", "full"} {
+		err = db.UserSetLastNotifiedThreshold(ctx, users[name], 0.8)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertUsers(0.8)
+	assertUsers(1, "full")
+	// Once the full user is notified about 100%, nobody is left.
+	err = db.UserSetLastNotifiedThreshold(ctx, users["full"], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUsers(0.8)
+	assertUsers(1)
+}
+
+// TestBackfillMissingSubs ensures that BackfillMissingSubs gives a unique sub
+// to users who don't have one.
+func TestBackfillMissingSubs(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.UserCreate(ctx, "", "", t.Name()+"other", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remove the user's sub.
+	u.Sub = ""
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.BackfillMissingSubs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 fixed user, got %d.", n)
+	}
+	u1, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u1.Sub) != 32 || u1.Sub == other.Sub {
+		t.Fatalf("Expected a new unique sub, got '%s'.", u1.Sub)
+	}
+	u2, err := db.UserBySub(ctx, u1.Sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u2.ID.Hex())
+	}
+	// The other user's sub is untouched.
+	o, err := db.UserByID(ctx, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Sub != other.Sub {
+		t.Fatalf("Expected sub '%s', got '%s'.", other.Sub, o.Sub)
+	}
+	// Nothing left to fix.
+	n, err = db.BackfillMissingSubs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected 0 fixed users, got %d.", n)
+	}
+}
+
+// TestUserByIDConfirmed ensures that UserByIDConfirmed only returns users who
+// have confirmed their email address.
+func TestUserByIDConfirmed(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.IsEmailConfirmed() {
+		t.Fatal("Expected a new user's email to be unconfirmed.")
+	}
+	_, err = db.UserByIDConfirmed(ctx, u.ID)
+	if !errors.Contains(err, database.ErrEmailNotConfirmed) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrEmailNotConfirmed, err)
+	}
+	_, err = db.UserConfirmEmail(ctx, u.EmailConfirmationToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserByIDConfirmed(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u1.ID.Hex())
+	}
+	// Unknown users are reported as such.
+	_, err = db.UserByIDConfirmed(ctx, primitive.NewObjectID())
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrUserNotFound, err)
+	}
+}
+
+// TestUserEmailConfirmationFunnel ensures that UserEmailConfirmationFunnel
+// counts the users in each confirmation state.
+func TestUserEmailConfirmationFunnel(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two users with pending confirmations, one of which confirms.
+	for i := 0; i < 2; i++ {
+		name := t.Name() + strconv.Itoa(i)
+		_, err = db.UserCreate(ctx, types.NewEmail(name+"@siasky.net"), name+"pass", name+"sub", database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"confirmed@siasky.net"), t.Name()+"pass", t.Name()+"confirmed", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserConfirmEmail(ctx, u.EmailConfirmationToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three users without an email.
+	for i := 0; i < 3; i++ {
+		_, err = db.UserCreate(ctx, "", "", t.Name()+"noemail"+strconv.Itoa(i), database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	confirmed, pending, noEmail, err := db.UserEmailConfirmationFunnel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed != 1 || pending != 2 || noEmail != 3 {
+		t.Fatalf("Expected 1 confirmed, 2 pending and 3 without email, got %d, %d and %d.", confirmed, pending, noEmail)
+	}
+}
+
+// TestUserLoginLockout ensures that users get locked out after too many
+// failed logins and can log in again once the lock expires.
+func TestUserLoginLockout(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(maxAttempts int, dur time.Duration) {
+		database.MaxFailedLoginAttempts = maxAttempts
+		database.LoginLockoutDuration = dur
+	}(database.MaxFailedLoginAttempts, database.LoginLockoutDuration)
+	database.MaxFailedLoginAttempts = 3
+	database.LoginLockoutDuration = time.Second
+
+	pass := t.Name() + "pass"
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), pass, t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failed attempt followed by a successful one resets the count.
+	if err = db.UserVerifyPassword(ctx, u, "wrong"); err == nil {
+		t.Fatal("Expected an error for a wrong password.")
+	}
+	if err = db.UserVerifyPassword(ctx, u, pass); err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.FailedLoginAttempts != 0 {
+		t.Fatalf("Expected 0 failed attempts, got %d.", u1.FailedLoginAttempts)
+	}
+	// Fail enough times to get locked out.
+	for i := 0; i < database.MaxFailedLoginAttempts; i++ {
+		err = db.UserVerifyPassword(ctx, u1, "wrong")
+		if err == nil || errors.Contains(err, database.ErrAccountLocked) {
+			t.Fatalf("Expected a wrong password error, got '%v'.", err)
+		}
+	}
+	// Even the correct password is refused while the account is locked.
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserVerifyPassword(ctx, u2, pass)
+	if !errors.Contains(err, database.ErrAccountLocked) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrAccountLocked, err)
+	}
+	// Once the lock expires, the user can log in again.
+	time.Sleep(database.LoginLockoutDuration + 100*time.Millisecond)
+	err = db.UserVerifyPassword(ctx, u2, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u3, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u3.LockedUntil.IsZero() || u3.FailedLoginAttempts != 0 {
+		t.Fatalf("Expected the lock to be cleared, got %v and %d.", u3.LockedUntil, u3.FailedLoginAttempts)
+	}
+}
+
+// TestUserUncancelSubscription ensures that UserUncancelSubscription reverts
+// scheduled cancellations and reports when there is nothing to revert.
+func TestUserUncancelSubscription(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No pending cancellation.
+	err = db.UserUncancelSubscription(ctx, u)
+	if !errors.Contains(err, database.ErrNoPendingCancellation) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrNoPendingCancellation, err)
+	}
+	// Schedule a cancellation and revert it.
+	u.SubscriptionCancelAt = time.Now().UTC().Add(24 * time.Hour).Truncate(time.Millisecond)
+	u.SubscriptionCancelAtPeriodEnd = true
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserUncancelSubscription(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u1.SubscriptionCancelAt.IsZero() || u1.SubscriptionCancelAtPeriodEnd {
+		t.Fatalf("Expected no pending cancellation, got %v and %t.", u1.SubscriptionCancelAt, u1.SubscriptionCancelAtPeriodEnd)
+	}
+	if u1.Tier != database.TierPremium5 {
+		t.Fatalf("Expected tier %d, got %d.", database.TierPremium5, u1.Tier)
+	}
+	// Reverting again is an error.
+	err = db.UserUncancelSubscription(ctx, u1)
+	if !errors.Contains(err, database.ErrNoPendingCancellation) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrNoPendingCancellation, err)
+	}
+}
+
+// TestUserPubKeyAddConcurrent ensures that only one of several users who
+// concurrently add the same pubkey gets it.
+func TestUserPubKeyAddConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	n := 5
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		u, err := db.UserCreate(ctx, "", "", fmt.Sprintf("%s%d", t.Name(), i), database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, u database.User) {
+			defer wg.Done()
+			errs[i] = db.UserPubKeyAdd(ctx, u, pk)
+		}(i, *u)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		if !errors.Contains(err, database.ErrPubKeyInUse) {
+			t.Fatalf("Expected error %v, got %v", database.ErrPubKeyInUse, err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("Expected exactly one user to get the pubkey, got %d.", succeeded)
+	}
+}
+
+// TestUserByAnyPubKey ensures that users can be found by pubkeys they have
+// removed from their account.
+func TestUserByAnyPubKey(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	_, err = db.UserByAnyPubKey(ctx, pk)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrUserNotFound, err)
+	}
+	err = db.UserPubKeyAdd(ctx, *u, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserByAnyPubKey(ctx, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u1.ID.Hex())
+	}
+	// Remove the key. The user can no longer be found by their active keys
+	// but can still be found by their associated ones.
+	err = db.UserPubKeyRemove(ctx, *u, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserByPubKey(ctx, pk)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrUserNotFound, err)
+	}
+	u2, err := db.UserByAnyPubKey(ctx, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u2.ID.Hex())
+	}
+	if len(u2.PubKeys) != 0 || len(u2.AssociatedPubKeys) != 1 || !bytes.Equal(u2.AssociatedPubKeys[0], pk) {
+		t.Fatalf("Unexpected pubkeys %v and associated pubkeys %v.", u2.PubKeys, u2.AssociatedPubKeys)
+	}
+	// Another user can't claim a key which is associated with this user.
+	other, err := db.UserCreate(ctx, "", "", t.Name()+"other", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserPubKeyAdd(ctx, *other, pk)
+	if !errors.Contains(err, database.ErrPubKeyInUse) {
+		t.Fatalf("Expected error %v, got %v", database.ErrPubKeyInUse, err)
+	}
+	// Re-adding the key removes it from the associated keys, so the user is
+	// not reported as having an orphaned active key.
+	err = db.UserPubKeyAdd(ctx, *u, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u3, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u3.PubKeys) != 1 || !bytes.Equal(u3.PubKeys[0], pk) || len(u3.AssociatedPubKeys) != 0 {
+		t.Fatalf("Unexpected pubkeys %v and associated pubkeys %v.", u3.PubKeys, u3.AssociatedPubKeys)
+	}
+	orphaned, err := db.FindUsersWithOrphanedActiveKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range orphaned {
+		if id == u.ID {
+			t.Fatal("Expected the user not to have an orphaned active key.")
+		}
+	}
+}
+
+// TestUserRegistryRatio ensures that UserRegistryRatio reports the correct
+// counts and ratio.
+func TestUserRegistryRatio(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), "pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().UTC().Add(-time.Hour)
+
+	// No registry usage yields a zero ratio.
+	reads, writes, ratio, err := db.UserRegistryRatio(ctx, u.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads != 0 || writes != 0 || ratio != 0 {
+		t.Fatalf("Expected 0 reads, 0 writes and ratio 0, got %d, %d and %f.", reads, writes, ratio)
+	}
+	// Reads without writes yield an infinite ratio.
+	for i := 0; i < 6; i++ {
+		if _, err = db.RegistryReadCreate(ctx, *u, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, ratio, err = db.UserRegistryRatio(ctx, u.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsInf(ratio, 1) {
+		t.Fatalf("Expected +Inf, got %f.", ratio)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err = db.RegistryWriteCreate(ctx, *u, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reads, writes, ratio, err = db.UserRegistryRatio(ctx, u.ID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads != 6 || writes != 4 || ratio != 1.5 {
+		t.Fatalf("Expected 6 reads, 4 writes and ratio 1.5, got %d, %d and %f.", reads, writes, ratio)
+	}
+	// Nothing happened after now.
+	reads, writes, _, err = db.UserRegistryRatio(ctx, u.ID, time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads != 0 || writes != 0 {
+		t.Fatalf("Expected no reads or writes, got %d and %d.", reads, writes)
+	}
+}
+
+// TestFindSharedPubKeys ensures that FindSharedPubKeys detects pubkeys which
+// are attached to more than one user.
+func TestFindSharedPubKeys(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u1, err := db.UserCreate(ctx, "", "", t.Name()+"sub1", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := db.UserCreate(ctx, "", "", t.Name()+"sub2", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u3, err := db.UserCreate(ctx, "", "", t.Name()+"sub3", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	unique := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	for _, u := range []*database.User{u1, u2} {
+		if err = db.UserPubKeyAdd(ctx, *u, shared); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.UserPubKeyAdd(ctx, *u3, unique); err != nil {
+		t.Fatal(err)
+	}
+	clusters, err := db.FindSharedPubKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Find the cluster of our users and make sure the third user is not in
+	// any cluster.
+	var found bool
+	for _, c := range clusters {
+		ids := make(map[primitive.ObjectID]struct{})
+		for _, id := range c {
+			ids[id] = struct{}{}
+		}
+		if _, ok := ids[u3.ID]; ok {
+			t.Fatalf("User %s doesn't share a pubkey but was reported in %v.", u3.ID.Hex(), c)
+		}
+		_, ok1 := ids[u1.ID]
+		_, ok2 := ids[u2.ID]
+		if ok1 && ok2 && len(c) == 2 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected a cluster of users %s and %s, got %v.", u1.ID.Hex(), u2.ID.Hex(), clusters)
+	}
+}
+
+// TestRepairPubKeyOrdering ensures that we can detect users whose active
+// pubkey is one they've removed and repair their pubkey ordering.
+func TestRepairPubKeyOrdering(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	active := database.PubKey(fastrand.Bytes(database.PubKeySize))
+	for _, pk := range []database.PubKey{removed, active} {
+		if err = db.UserPubKeyAdd(ctx, *u, pk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.UserPubKeyRemove(ctx, *u, removed); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a buggy save which restores the removed pubkey in front of
+	// the active one.
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.PubKeys = []database.PubKey{removed, active}
+	if err = db.UserSave(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	orphaned, err := db.FindUsersWithOrphanedActiveKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphaned) != 1 || orphaned[0] != u.ID {
+		t.Fatalf("Expected user %s to be reported, got %v.", u.ID.Hex(), orphaned)
+	}
+	// Repair the ordering.
+	err = db.RepairPubKeyOrdering(ctx, u.ID, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.PubKeys) != 2 || !bytes.Equal(u.PubKeys[0], active) {
+		t.Fatalf("Expected the active pubkey to be first, got %v.", u.PubKeys)
+	}
+	orphaned, err = db.FindUsersWithOrphanedActiveKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphaned) != 0 {
+		t.Fatalf("Expected no users to be reported, got %v.", orphaned)
+	}
+	// Repairing with a key the user doesn't have fails.
+	err = db.RepairPubKeyOrdering(ctx, u.ID, database.PubKey(fastrand.Bytes(database.PubKeySize)))
+	if !errors.Contains(err, database.ErrPubKeyNotFound) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrPubKeyNotFound, err)
+	}
+}
+
+// TestUserSetCustomTier ensures that we can register a custom tier and assign
+// users to it.
+func TestUserSetCustomTier(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enterprise := database.TierMaxReserved
+	// The tier is rejected before it's registered.
+	err = db.UserSetTier(ctx, u, enterprise)
+	if !errors.Contains(err, database.ErrInvalidTier) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrInvalidTier, err)
+	}
+	// Custom tiers need to be registered in order.
+	err = database.RegisterTier(enterprise+1, database.TierLimits{})
+	if !errors.Contains(err, database.ErrInvalidTier) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrInvalidTier, err)
+	}
+	limits := database.UserLimits[database.TierPremium80]
+	limits.TierName = "enterprise"
+	limits.Storage *= 10
+	err = database.RegisterTier(enterprise, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(database.UserLimits, enterprise)
+
+	err = db.UserSetTier(ctx, u, enterprise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Tier != enterprise {
+		t.Fatalf("Expected tier %d, got %d.", enterprise, u.Tier)
+	}
+	if l := u.EffectiveStorageLimit(); l != limits.Storage {
+		t.Fatalf("Expected storage limit %d, got %d.", limits.Storage, l)
+	}
+	if name := database.UserLimits[u.Tier].TierName; name != "enterprise" {
+		t.Fatalf("Expected tier name 'enterprise', got '%s'.", name)
+	}
+}
+
+// TestUserApplyReferralCredit ensures that referral credits increase the
+// user's storage limit, that concurrent applications are all counted and that
+// the balance never goes negative.
+func TestUserApplyReferralCredit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseLimit := u.EffectiveStorageLimit()
+	credit := int64(skynet.GiB)
+	err = db.UserApplyReferralCredit(ctx, u, credit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ReferralCredits != credit || u.EffectiveStorageLimit() != baseLimit+credit {
+		t.Fatalf("Expected %d credits and limit %d, got %d and %d.", credit, baseLimit+credit, u.ReferralCredits, u.EffectiveStorageLimit())
+	}
+	// Apply credits in parallel and make sure none of them are lost.
+	numParallel := 20
+	var wg sync.WaitGroup
+	for i := 0; i < numParallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each goroutine works with its own copy of the user.
+			uCopy := *u
+			if err := db.UserApplyReferralCredit(ctx, &uCopy, credit); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	u, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := credit * int64(numParallel+1)
+	if u.ReferralCredits != expected {
+		t.Fatalf("Expected %d credits, got %d.", expected, u.ReferralCredits)
+	}
+	// Revoking more credits than the user has fails and doesn't change the
+	// balance.
+	err = db.UserApplyReferralCredit(ctx, u, -expected-1)
+	if !errors.Contains(err, database.ErrNegativeReferralCredits) {
+		t.Fatalf("Expected error '%v', got '%v'.", database.ErrNegativeReferralCredits, err)
+	}
+	err = db.UserApplyReferralCredit(ctx, u, -expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ReferralCredits != 0 || u.EffectiveStorageLimit() != baseLimit {
+		t.Fatalf("Expected no credits and limit %d, got %d and %d.", baseLimit, u.ReferralCredits, u.EffectiveStorageLimit())
+	}
+}
+
+// TestUsersByTier ensures that UsersByTier returns the users of the given tier
+// in stable pages.
+func TestUsersByTier(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid tiers and paging parameters are rejected.
+	_, _, err = db.UsersByTier(ctx, database.TierAnonymous, 0, 10)
+	if !errors.Contains(err, database.ErrInvalidTier) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrInvalidTier, err)
+	}
+	_, _, err = db.UsersByTier(ctx, len(database.UserLimits), 0, 10)
+	if !errors.Contains(err, database.ErrInvalidTier) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrInvalidTier, err)
+	}
+	_, _, err = db.UsersByTier(ctx, database.TierPremium80, -1, 10)
+	if err == nil {
+		t.Fatal("Expected an error for a negative offset.")
+	}
+	_, _, err = db.UsersByTier(ctx, database.TierPremium80, 0, 0)
+	if err == nil {
+		t.Fatal("Expected an error for a zero page size.")
+	}
+
+	// Seed a few premium users and a few free ones.
+	var premium []primitive.ObjectID
+	for i := 0; i < 5; i++ {
+		u, err := db.UserCreate(ctx, "", "", t.Name()+"premium"+strconv.Itoa(i), database.TierPremium80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		premium = append(premium, u.ID)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = db.UserCreate(ctx, "", "", t.Name()+"free"+strconv.Itoa(i), database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Walk the premium users two at a time.
+	var seen []primitive.ObjectID
+	for offset := 0; offset < 6; offset += 2 {
+		users, total, err := db.UsersByTier(ctx, database.TierPremium80, offset, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != len(premium) {
+			t.Fatalf("Expected a total of %d, got %d.", len(premium), total)
+		}
+		expected := len(premium) - offset
+		if expected > 2 {
+			expected = 2
+		}
+		if len(users) != expected {
+			t.Fatalf("Expected %d users at offset %d, got %d.", expected, offset, len(users))
+		}
+		for _, u := range users {
+			if u.Tier != database.TierPremium80 {
+				t.Fatalf("Expected tier %d, got %d.", database.TierPremium80, u.Tier)
+			}
+			seen = append(seen, u.ID)
+		}
+	}
+	// IDs are generated in increasing order, so we expect to see the users in
+	// the order in which we created them.
+	if !reflect.DeepEqual(seen, premium) {
+		t.Fatalf("Expected %v, got %v.", premium, seen)
+	}
+	// An offset past the end returns an empty page but the correct total.
+	users, total, err := db.UsersByTier(ctx, database.TierPremium80, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 || total != len(premium) {
+		t.Fatalf("Expected an empty page and a total of %d, got %d users and a total of %d.", len(premium), len(users), total)
+	}
+}
+
+// TestUserSetSubscription ensures that UserSetSubscription only updates the
+// subscription-related fields and doesn't clobber concurrent changes to the
+// rest of the user's record.
+func TestUserSetSubscription(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid tiers are rejected.
+	err = db.UserSetSubscription(ctx, u, database.SubscriptionUpdate{Tier: database.TierAnonymous})
+	if !errors.Contains(err, database.ErrInvalidTier) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrInvalidTier, err)
+	}
+
+	// Add pubkeys while concurrently updating their subscription using a copy of the user which doesn't know about
+	// these changes.
+	stale := *u
+	numKeys := 5
+	var wg sync.WaitGroup
+	for i := 0; i < numKeys; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pk := database.PubKey(fastrand.Bytes(database.PubKeySize))
+			if err := db.UserPubKeyAdd(ctx, *u, pk); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	su := database.SubscriptionUpdate{
+		Tier:                          database.TierPremium20,
+		SubscribedUntil:               time.Now().UTC().AddDate(0, 1, 0).Truncate(time.Millisecond),
+		SubscriptionStatus:            "active",
+		SubscriptionCancelAt:          time.Now().UTC().AddDate(0, 1, 0).Truncate(time.Millisecond),
+		SubscriptionCancelAtPeriodEnd: true,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := db.UserSetSubscription(ctx, &stale, su); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	if stale.Tier != su.Tier || stale.SubscriptionStatus != su.SubscriptionStatus {
+		t.Fatalf("Expected the passed user to be updated, got %+v", stale)
+	}
+
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.Tier != su.Tier ||
+		!u2.SubscribedUntil.Equal(su.SubscribedUntil) ||
+		u2.SubscriptionStatus != su.SubscriptionStatus ||
+		!u2.SubscriptionCancelAt.Equal(su.SubscriptionCancelAt) ||
+		u2.SubscriptionCancelAtPeriodEnd != su.SubscriptionCancelAtPeriodEnd {
+		t.Fatalf("Unexpected subscription %+v", u2)
+	}
+	if len(u2.PubKeys) != numKeys {
+		t.Fatalf("Expected %d pubkeys, got %d.", numKeys, len(u2.PubKeys))
+	}
+}
+
+// TestUserDeactivate ensures that deactivated users are hidden from the
+// UserBy* lookups but are kept in the DB and can be reactivated.
+func TestUserDeactivate(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := types.NewEmail(t.Name() + "@siasky.net")
+	sub := t.Name() + "sub"
+	u, err := db.UserCreate(ctx, email, t.Name()+"password", sub, database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.UserDeactivate(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Deleted || u.DeletedAt.IsZero() {
+		t.Fatalf("Expected the user to be marked as deactivated, got %+v", u)
+	}
+	// The regular lookups don't find the user.
+	_, err = db.UserBySub(ctx, sub)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserNotFound, err)
+	}
+	_, err = db.UserByID(ctx, u.ID)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserNotFound, err)
+	}
+	_, err = db.UserByEmail(ctx, email)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserNotFound, err)
+	}
+	// The user still exists and is found by the admin lookups.
+	u2, err := db.UserBySubIncludingDeactivated(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID || !u2.Deleted || !u2.DeletedAt.Equal(u.DeletedAt) {
+		t.Fatalf("Unexpected user %+v", u2)
+	}
+	u2, err = db.UserByIDIncludingDeactivated(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID {
+		t.Fatalf("Expected user %s, got %s.", u.ID.Hex(), u2.ID.Hex())
+	}
+	// Nobody can register with the same email or sub in the meantime.
+	_, err = db.UserCreate(ctx, email, t.Name()+"password", t.Name()+"sub2", database.TierFree)
+	if !errors.Contains(err, database.ErrUserAlreadyExists) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserAlreadyExists, err)
+	}
+	_, err = db.UserCreate(ctx, "", "", sub, database.TierFree)
+	if !errors.Contains(err, database.ErrUserAlreadyExists) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserAlreadyExists, err)
+	}
+
+	// Reactivate the user.
+	err = db.UserReactivate(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err = db.UserBySub(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.ID != u.ID || u2.Deleted || !u2.DeletedAt.IsZero() {
+		t.Fatalf("Unexpected user %+v", u2)
+	}
+	// Users who don't exist can't be deactivated.
+	err = db.UserDeactivate(ctx, &database.User{ID: primitive.NewObjectID()})
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrUserNotFound, err)
+	}
+}
+
+// TestUsersCreateBatch ensures that UsersCreateBatch inserts new users and
+// skips the ones whose email or sub is already taken.
+func TestUsersCreateBatch(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"existing@siasky.net"), "", t.Name()+"existing", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid records fail the entire batch.
+	_, err = db.UsersCreateBatch(ctx, []*database.User{{Sub: ""}})
+	if err == nil {
+		t.Fatal("Expected an error for an empty sub.")
+	}
+	_, err = db.UsersCreateBatch(ctx, []*database.User{{Sub: t.Name() + "invalid", Email: "not an email"}})
+	if err == nil {
+		t.Fatal("Expected an error for an invalid email.")
+	}
+
+	users := []*database.User{
+		// New users, with and without an email.
+		{Sub: t.Name() + "1", Email: types.Email(t.Name() + "1@SIASKY.net"), Tier: database.TierPremium5},
+		{Sub: t.Name() + "2"},
+		{Sub: t.Name() + "3"},
+		// Taken by an existing user.
+		{Sub: existing.Sub},
+		{Sub: t.Name() + "4", Email: existing.Email},
+		// Taken by a user earlier in the batch.
+		{Sub: t.Name() + "1"},
+		{Sub: t.Name() + "5", Email: types.NewEmail(t.Name() + "1@siasky.net")},
+	}
+	created, err := db.UsersCreateBatch(ctx, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != len(users) {
+		t.Fatalf("Expected %d results, got %d.", len(users), len(created))
+	}
+	for i, u := range created {
+		expectCreated := i < 3
+		if (u != nil) != expectCreated {
+			t.Fatalf("User %d: expected created to be %t, got %+v", i, expectCreated, u)
+		}
+		if u == nil {
+			continue
+		}
+		u2, err := db.UserBySub(ctx, users[i].Sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u2.ID != u.ID || u2.Tier != users[i].Tier || u2.CreatedAt.IsZero() {
+			t.Fatalf("User %d: unexpected user in the DB %+v", i, u2)
+		}
+	}
+	// The email was normalized.
+	u, err := db.UserByEmail(ctx, types.NewEmail(t.Name()+"1@siasky.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != created[0].ID {
+		t.Fatalf("Expected user %s, got %s.", created[0].ID.Hex(), u.ID.Hex())
+	}
+	// Importing the same users again skips all of them.
+	again := []*database.User{{Sub: t.Name() + "1"}, {Sub: t.Name() + "2"}}
+	created, err = db.UsersCreateBatch(ctx, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created[0] != nil || created[1] != nil {
+		t.Fatalf("Expected all users to be skipped, got %+v", created)
+	}
+}
+
+// BenchmarkUsersCreate compares creating users one by one to creating them in
+// batches.
+func BenchmarkUsersCreate(b *testing.B) {
+	ctx := context.Background()
+	dbName := test.DBNameForTest(b.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	batchSize := 100
+	newUsers := func(prefix string) []*database.User {
+		users := make([]*database.User, 0, batchSize)
+		for i := 0; i < batchSize; i++ {
+			sub := prefix + strconv.Itoa(i)
+			users = append(users, &database.User{Sub: sub, Email: types.NewEmail(sub + "@siasky.net")})
+		}
+		return users
+	}
+	b.Run("Loop", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, u := range newUsers(b.Name() + strconv.Itoa(n)) {
+				_, err := db.UserCreate(ctx, u.Email, "", u.Sub, database.TierFree)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_, err := db.UsersCreateBatch(ctx, newUsers(b.Name()+strconv.Itoa(n)))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestUserRegenerateEmailConfirmationToken ensures that we can issue a new
+// email confirmation token to users who haven't confirmed their email yet.
+func TestUserRegenerateEmailConfirmationToken(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), t.Name()+"pass", t.Name()+"sub", database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the current token expire.
+	oldToken := u.EmailConfirmationToken
+	u.EmailConfirmationTokenExpiration = time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	err = db.UserSave(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk, err := db.UserRegenerateEmailConfirmationToken(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk == "" || tk == oldToken || u.EmailConfirmationToken != tk {
+		t.Fatalf("Expected a new token, got '%s' (old '%s', user '%s').", tk, oldToken, u.EmailConfirmationToken)
+	}
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.EmailConfirmationToken != tk || !u2.EmailConfirmationTokenExpiration.Equal(u.EmailConfirmationTokenExpiration) {
+		t.Fatalf("Expected token '%s' expiring at %v, got %+v", tk, u.EmailConfirmationTokenExpiration, u2)
+	}
+	if !u2.EmailConfirmationTokenExpiration.After(time.Now().UTC()) {
+		t.Fatalf("Expected the token to expire in the future, got %v.", u2.EmailConfirmationTokenExpiration)
+	}
+	// The new token confirms the email.
+	_, err = db.UserConfirmEmail(ctx, tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once confirmed, we can't issue new tokens.
+	u2, err = db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UserRegenerateEmailConfirmationToken(ctx, u2)
+	if !errors.Contains(err, database.ErrEmailAlreadyConfirmed) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrEmailAlreadyConfirmed, err)
+	}
+	// Not even with a stale copy of the user.
+	_, err = db.UserRegenerateEmailConfirmationToken(ctx, u)
+	if !errors.Contains(err, database.ErrEmailAlreadyConfirmed) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrEmailAlreadyConfirmed, err)
+	}
+}
+
+// TestApplyDowngrade ensures that ApplyDowngrade moves the user to the new tier
+// and records the enforcement required by each downgrade policy.
+func TestApplyDowngrade(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPolicy := database.DowngradePolicy
+	defer func() { database.DowngradePolicy = oldPolicy }()
+
+	// Downgrading to an invalid tier fails.
+	u, err := db.UserCreate(ctx, "", "", t.Name()+"invalid", database.TierPremium20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ApplyDowngrade(ctx, u, database.TierAnonymous)
+	if !errors.Contains(err, database.ErrInvalidTier) {
+		t.Fatalf("Expected error %v, got %v.", database.ErrInvalidTier, err)
+	}
+
+	// A user within the limits of their new tier is not restricted.
+	u, err = db.UserCreate(ctx, "", "", t.Name()+"within", database.TierPremium20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(ctx, db, *u, skynet.GiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.DowngradePolicy = database.DowngradePolicyImmediateReadOnly
+	res, err := db.ApplyDowngrade(ctx, u, database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Overage != 0 || !res.ReadOnlyFrom.IsZero() {
+		t.Fatalf("Expected no enforcement, got %+v", res)
+	}
+
+	// A user over the limits of their new tier is restricted according to
+	// the policy.
+	size := int64(2 * skynet.TiB)
+	overage := size - database.UserLimits[database.TierPremium5].Storage
+	tests := []struct {
+		policy   string
+		readOnly bool
+		grace    bool
+	}{
+		{policy: database.DowngradePolicyGracePeriod, grace: true},
+		{policy: database.DowngradePolicyImmediateReadOnly, readOnly: true},
+		{policy: database.DowngradePolicyFlagOnly},
+	}
+	for _, tt := range tests {
+		database.DowngradePolicy = tt.policy
+		u, err = db.UserCreate(ctx, "", "", t.Name()+tt.policy, database.TierPremium20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = test.CreateTestUpload(ctx, db, *u, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = db.ApplyDowngrade(ctx, u, database.TierPremium5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Overage != overage || res.Policy != tt.policy {
+			t.Fatalf("Policy %s: expected overage %d, got %+v", tt.policy, overage, res)
+		}
+		u2, err := db.UserByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u2.Tier != database.TierPremium5 || !u2.QuotaExceeded {
+			t.Fatalf("Policy %s: expected tier %d and exceeded quota, got tier %d and %t.", tt.policy, database.TierPremium5, u2.Tier, u2.QuotaExceeded)
+		}
+		now := time.Now().UTC()
+		if u2.IsReadOnly(now) != tt.readOnly {
+			t.Fatalf("Policy %s: expected read-only %t, got %t.", tt.policy, tt.readOnly, u2.IsReadOnly(now))
+		}
+		if tt.grace && !u2.IsReadOnly(now.Add(database.DowngradeGracePeriod+time.Minute)) {
+			t.Fatalf("Policy %s: expected the user to be read-only after the grace period.", tt.policy)
+		}
+		if !tt.readOnly && !tt.grace && !u2.ReadOnlyFrom.IsZero() {
+			t.Fatalf("Policy %s: expected no read-only period, got %v.", tt.policy, u2.ReadOnlyFrom)
+		}
+		_, _, err = db.UserCanUpload(ctx, u2)
+		if tt.readOnly != errors.Contains(err, database.ErrAccountReadOnly) {
+			t.Fatalf("Policy %s: expected read-only %t, got error %v.", tt.policy, tt.readOnly, err)
+		}
+		if tt.readOnly != u2.IsRestricted() {
+			t.Fatalf("Policy %s: expected restricted %t, got %t.", tt.policy, tt.readOnly, u2.IsRestricted())
+		}
+		// Upgrading again lifts the read-only period.
+		err = db.UserSetTier(ctx, u2, database.TierPremium20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u3, err := db.UserByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !u3.ReadOnlyFrom.IsZero() {
+			t.Fatalf("Policy %s: expected the read-only period to be lifted, got %v.", tt.policy, u3.ReadOnlyFrom)
+		}
+		_, _, err = db.UserCanUpload(ctx, u3)
+		if errors.Contains(err, database.ErrAccountReadOnly) {
+			t.Fatalf("Policy %s: expected the user not to be read-only.", tt.policy)
+		}
+	}
+	// Re-subscribing lifts the read-only period as well.
+	database.DowngradePolicy = database.DowngradePolicyImmediateReadOnly
+	u, err = db.UserCreate(ctx, "", "", t.Name()+"resubscribe", database.TierPremium20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = test.CreateTestUpload(ctx, db, *u, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ApplyDowngrade(ctx, u, database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserSetSubscription(ctx, u, database.SubscriptionUpdate{Tier: database.TierPremium20, SubscriptionStatus: "active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u4, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u4.ReadOnlyFrom.IsZero() {
+		t.Fatalf("Expected the read-only period to be lifted, got %v.", u4.ReadOnlyFrom)
+	}
+}
+
+// TestUserSuspend ensures that suspending a user blocks their uploads and
+// unsuspending them restores their access.
+func TestUserSuspend(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.UserCreate(ctx, "", "", t.Name(), database.TierPremium5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reason := "abuse report"
+	err = db.UserSuspend(ctx, u, reason)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The suspended user can still be fetched, so they can access their data.
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u2.Suspended || u2.SuspendedReason != reason {
+		t.Fatalf("Expected the user to be suspended for '%s', got %t and '%s'.", reason, u2.Suspended, u2.SuspendedReason)
+	}
+	p, _, err := db.UserCanUpload(ctx, u2)
+	if !errors.Contains(err, database.ErrAccountSuspended) || p != database.UploadDenied {
+		t.Fatalf("Expected error %v and denied upload, got %v and %d.", database.ErrAccountSuspended, err, p)
+	}
+	if db.UserConcurrencyLimit(u2) != database.UserLimits[database.TierAnonymous].MaxConcurrentRequests {
+		t.Fatal("Expected the suspended user to get the anonymous concurrency limit.")
+	}
+
+	err = db.UserUnsuspend(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u3, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u3.Suspended || u3.SuspendedReason != "" {
+		t.Fatalf("Expected the user not to be suspended, got %t and '%s'.", u3.Suspended, u3.SuspendedReason)
+	}
+	p, _, err = db.UserCanUpload(ctx, u3)
+	if err != nil || p != database.UploadAllowed {
+		t.Fatalf("Expected the upload to be allowed, got %v and %d.", err, p)
+	}
+	// Suspending a user who doesn't exist fails.
+	err = db.UserSuspend(ctx, &database.User{ID: primitive.NewObjectID()}, reason)
+	if !errors.Contains(err, database.ErrUserNotFound) {
+		t.Fatalf("Expected error %v, got %v", database.ErrUserNotFound, err)
+	}
+}
+
+// TestUserChangePassword ensures that UserChangePassword changes the user's
+// password and invalidates the tokens issued before the change.
+func TestUserChangePassword(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPass := t.Name() + "pass"
+	u, err := db.UserCreate(ctx, types.NewEmail(t.Name()+"@siasky.net"), oldPass, t.Name(), database.TierFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// JWTs have a precision of one second.
+	issuedBefore := time.Now().UTC().Truncate(time.Second).Add(-time.Second)
+	if !u.IsTokenValid(issuedBefore) {
+		t.Fatal("Expected the token to be valid before the password change.")
+	}
+
+	newPass := t.Name() + "newpass"
+	err = db.UserChangePassword(ctx, u, newPass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuedAfter := time.Now().UTC().Truncate(time.Second)
+	u2, err := db.UserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.IsTokenValid(issuedBefore) {
+		t.Fatal("Expected a token issued before the password change to be invalid.")
+	}
+	if !u2.IsTokenValid(issuedAfter) {
+		t.Fatal("Expected a token issued after the password change to be valid.")
+	}
+	if err = db.UserVerifyPassword(ctx, u2, newPass); err != nil {
+		t.Fatal("Expected the new password to work.", err)
+	}
+	if err = db.UserVerifyPassword(ctx, u2, oldPass); err == nil {
+		t.Fatal("Expected the old password to stop working.")
+	}
+	// Empty passwords are rejected.
+	if err = db.UserChangePassword(ctx, u, ""); err == nil {
+		t.Fatal("Expected an error.")
+	}
+}
+
+// TestExpireLapsedSubscriptions ensures that ExpireLapsedSubscriptions only
+// downgrades users whose subscription lapsed without being renewed.
+func TestExpireLapsedSubscriptions(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	lapsedAt := now.Add(-database.SubscriptionLapseGracePeriod - 24*time.Hour)
+	tests := []struct {
+		name       string
+		sub        database.SubscriptionUpdate
+		downgraded bool
+	}{
+		{
+			name:       "canceled",
+			sub:        database.SubscriptionUpdate{Tier: database.TierPremium20, SubscribedUntil: lapsedAt, SubscriptionStatus: "canceled"},
+			downgraded: true,
+		},
+		{
+			name:       "cancelAtPeriodEnd",
+			sub:        database.SubscriptionUpdate{Tier: database.TierPremium5, SubscribedUntil: lapsedAt, SubscriptionStatus: "active", SubscriptionCancelAtPeriodEnd: true},
+			downgraded: true,
+		},
+		// An auto-renewing subscription whose renewal we haven't processed.
+		{
+			name: "renewing",
+			sub:  database.SubscriptionUpdate{Tier: database.TierPremium20, SubscribedUntil: lapsedAt, SubscriptionStatus: "active"},
+		},
+		// A subscription whose payment is still being retried.
+		{
+			name: "pastDue",
+			sub:  database.SubscriptionUpdate{Tier: database.TierPremium20, SubscribedUntil: lapsedAt, SubscriptionStatus: "past_due"},
+		},
+		// A subscription which ended recently, so it's still in its grace
+		// period.
+		{
+			name: "grace",
+			sub:  database.SubscriptionUpdate{Tier: database.TierPremium20, SubscribedUntil: now.Add(-time.Hour), SubscriptionStatus: "canceled"},
+		},
+		// A user promoted without a subscription.
+		{
+			name: "manual",
+			sub:  database.SubscriptionUpdate{Tier: database.TierPremium20},
+		},
+		// A user who is already on the free tier.
+		{
+			name: "free",
+			sub:  database.SubscriptionUpdate{Tier: database.TierFree, SubscribedUntil: lapsedAt, SubscriptionStatus: "canceled"},
+		},
+	}
+	users := make(map[string]*database.User)
+	for _, tt := range tests {
+		u, err := db.UserCreate(ctx, "", "", t.Name()+tt.name, database.TierFree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.UserSetSubscription(ctx, u, tt.sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[tt.name] = u
+	}
+
+	n, err := db.ExpireLapsedSubscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 downgraded users, got %d", n)
+	}
+	for _, tt := range tests {
+		u, err := db.UserByID(ctx, users[tt.name].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.downgraded {
+			if u.Tier != tt.sub.Tier || len(u.TierChanges) != 0 {
+				t.Fatalf("Expected user '%s' to keep tier %d, got tier %d and changes %+v", tt.name, tt.sub.Tier, u.Tier, u.TierChanges)
+			}
+			continue
+		}
+		if u.Tier != database.TierFree {
+			t.Fatalf("Expected user '%s' to be downgraded, got tier %d", tt.name, u.Tier)
+		}
+		if len(u.TierChanges) != 1 {
+			t.Fatalf("Expected user '%s' to have one tier change, got %+v", tt.name, u.TierChanges)
+		}
+		tc := u.TierChanges[0]
+		if tc.From != tt.sub.Tier || tc.To != database.TierFree || tc.Reason != database.TierChangeReasonSubscriptionLapsed {
+			t.Fatalf("Unexpected tier change for user '%s': %+v", tt.name, tc)
+		}
+	}
+	// Running it again doesn't downgrade anyone else.
+	n, err = db.ExpireLapsedSubscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("Expected no downgraded users, got %d", n)
+	}
+}
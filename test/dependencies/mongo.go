@@ -19,6 +19,11 @@ type (
 		remainingFailures uint
 		mu                sync.Mutex
 	}
+	// DependencyTrafficComponentFailure causes fetching the given component
+	// of a user's traffic by referrer to fail.
+	DependencyTrafficComponentFailure struct {
+		component string
+	}
 	// DependencyUserPutMongoDelay causes the `PUT /user` endpoint to add a delay before
 	// writing to Mongo.
 	DependencyUserPutMongoDelay struct{}
@@ -54,3 +59,17 @@ func (d *DependencyUserPutMongoDelay) Disrupt(s string) bool {
 func NewDependencyUserPutMongoDelay() lib.Dependencies {
 	return &DependencyMongoWriteConflictN{}
 }
+
+// Disrupt causes fetching the dependency's component of a user's traffic by
+// referrer to fail.
+func (d *DependencyTrafficComponentFailure) Disrupt(s string) bool {
+	return s == "DependencyTrafficComponentFailure"+d.component
+}
+
+// NewDependencyTrafficComponentFailure returns a new
+// DependencyTrafficComponentFailure which causes fetching the given component
+// of a user's traffic by referrer to fail, e.g.
+// database.TrafficComponentRegistryReads.
+func NewDependencyTrafficComponentFailure(component string) lib.Dependencies {
+	return &DependencyTrafficComponentFailure{component: component}
+}
@@ -0,0 +1,61 @@
+package email
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SkynetLabs/skynet-accounts/email"
+	"github.com/SkynetLabs/skynet-accounts/test"
+	"github.com/SkynetLabs/skynet-accounts/types"
+	"gitlab.com/NebulousLabs/errors"
+)
+
+// TestMailerRecipientRateLimit ensures that Mailer refuses to queue more than
+// MaxEmailsPerRecipient emails to the same address.
+func TestMailerRecipientRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	defer func(limit int) {
+		email.MaxEmailsPerRecipient = limit
+	}(email.MaxEmailsPerRecipient)
+	email.MaxEmailsPerRecipient = 3
+
+	m := email.NewMailer(db)
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	for i := 0; i < email.MaxEmailsPerRecipient; i++ {
+		err = m.SendAccountAccessAttemptedEmail(ctx, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = m.SendAccountAccessAttemptedEmail(ctx, to)
+	if !errors.Contains(err, email.ErrRecipientRateLimited) {
+		t.Fatalf("Expected error '%v', got '%v'.", email.ErrRecipientRateLimited, err)
+	}
+	// Other addresses are not affected.
+	err = m.SendAccountAccessAttemptedEmail(ctx, types.NewEmail(t.Name()+"other@siasky.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Disabling the limit allows more emails.
+	email.MaxEmailsPerRecipient = 0
+	err = m.SendAccountAccessAttemptedEmail(ctx, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,10 +9,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/SkynetLabs/skynet-accounts/database"
 	"github.com/SkynetLabs/skynet-accounts/email"
 	"github.com/SkynetLabs/skynet-accounts/test"
 	"github.com/SkynetLabs/skynet-accounts/types"
 	"github.com/sirupsen/logrus"
+	"gitlab.com/NebulousLabs/errors"
+	"gitlab.com/SkynetLabs/skyd/skymodules"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.sia.tech/siad/build"
@@ -108,6 +111,12 @@ func TestContendingSenders(t *testing.T) {
 			t.Fatal("Failed to purge email collection:", err)
 		}
 	}()
+	// Lift the per-recipient limit, so we can queue all messages to the same
+	// address.
+	defer func(limit int) {
+		email.MaxEmailsPerRecipient = limit
+	}(email.MaxEmailsPerRecipient)
+	email.MaxEmailsPerRecipient = 0
 	targetAddr := types.NewEmail(t.Name() + "@siasky.net")
 	numMsgs := 200
 	// count will hold the total number of messages sent.
@@ -173,3 +182,293 @@ func TestContendingSenders(t *testing.T) {
 		t.Fatalf("Expected %d messages to be sent, got %d.", numMsgs, count)
 	}
 }
+
+// TestSenderConcurrency ensures that senders which send emails concurrently
+// still send each email exactly once.
+func TestSenderConcurrency(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	// Lift the per-recipient limit, so we can queue all messages to the same
+	// address.
+	defer func(limit int) {
+		email.MaxEmailsPerRecipient = limit
+	}(email.MaxEmailsPerRecipient)
+	email.MaxEmailsPerRecipient = 0
+	targetAddr := types.NewEmail(t.Name() + "@siasky.net")
+	numMsgs := 200
+	// Build up a backlog of messages.
+	m := email.NewMailer(db)
+	for i := 0; i < numMsgs; i++ {
+		err = m.SendAddressConfirmationEmail(ctx, targetAddr, targetAddr.String())
+		if err != nil {
+			t.Fatal("Failed to send email.", err)
+		}
+	}
+	// count will hold the total number of messages sent.
+	var count int32
+	var wg sync.WaitGroup
+	// Start a few contending senders with a high concurrency and let them
+	// drain the backlog.
+	for i := 0; i < 3; i++ {
+		s, err := email.NewCustomSender(ctx, db, test.NewDiscardLogger(), &test.DependencySkipSendingEmails{}, test.FauxEmailURI, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverID := t.Name() + strconv.Itoa(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				success, failure := s.ScanAndSend(serverID)
+				sum := success + failure
+				if sum == 0 {
+					return
+				}
+				atomic.AddInt32(&count, int32(sum))
+			}
+		}()
+	}
+	wg.Wait()
+	if int(count) != numMsgs {
+		t.Fatalf("Expected %d messages to be sent, got %d.", numMsgs, count)
+	}
+	// Make sure all messages are marked as sent.
+	_, emails, err := db.FindEmails(ctx, bson.M{"to": targetAddr}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != numMsgs {
+		t.Fatalf("Expected %d emails in the DB, got %d.", numMsgs, len(emails))
+	}
+	for _, e := range emails {
+		if e.SentAt.IsZero() || e.FailedAttempts > 0 {
+			t.Fatalf("Expected email %s to be sent exactly once.", e.ID.Hex())
+		}
+	}
+}
+
+// TestSenderDryRun ensures that a dry-run sender marks emails as processed by
+// a dry run without sending them and doesn't retry them.
+func TestSenderDryRun(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	defer func(dryRun bool) {
+		email.DryRun = dryRun
+	}(email.DryRun)
+	email.DryRun = true
+	// We use the production dependencies, so any attempt to actually send
+	// the emails to the faux server would fail and get recorded.
+	s, err := email.NewSender(ctx, db, test.NewDiscardLogger(), &skymodules.SkynetDependencies{}, test.FauxEmailURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	m := email.NewMailer(db)
+	numMsgs := 3
+	for i := 0; i < numMsgs; i++ {
+		err = m.SendAddressConfirmationEmail(ctx, to, t.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	success, failure := s.ScanAndSend(t.Name())
+	if success != numMsgs || failure != 0 {
+		t.Fatalf("Expected %d successes and no failures, got %d and %d.", numMsgs, success, failure)
+	}
+	_, emails, err := db.FindEmails(ctx, bson.M{"to": to}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != numMsgs {
+		t.Fatalf("Expected %d emails in the DB, got %d.", numMsgs, len(emails))
+	}
+	for _, e := range emails {
+		if !e.DryRun || e.SentAt.IsZero() || e.FailedAttempts > 0 {
+			t.Fatalf("Expected email %s to be marked as a dry run, got %+v", e.ID.Hex(), e)
+		}
+	}
+	// The emails are not picked up again.
+	success, failure = s.ScanAndSend(t.Name())
+	if success != 0 || failure != 0 {
+		t.Fatalf("Expected no emails to be processed, got %d and %d.", success, failure)
+	}
+}
+
+// TestSenderScheduled ensures that scheduled emails are not sent before their
+// time and are sent after it.
+func TestSenderScheduled(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	s, err := email.NewSender(ctx, db, test.NewDiscardLogger(), &test.DependencySkipSendingEmails{}, test.FauxEmailURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := types.NewEmail(t.Name() + "@siasky.net")
+	m := email.NewMailer(db)
+	// Unknown templates are rejected.
+	err = m.SendScheduled(ctx, to, "not-a-template", time.Now())
+	if !errors.Contains(err, email.ErrUnknownTemplate) {
+		t.Fatalf("Expected error '%v', got '%v'.", email.ErrUnknownTemplate, err)
+	}
+	sendAt := time.Now().UTC().Add(2 * time.Second)
+	err = m.SendScheduled(ctx, to, email.TemplateCheckIn, sendAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The email is not due yet, so it shouldn't be sent.
+	success, failure := s.ScanAndSend(t.Name())
+	if success != 0 || failure != 0 {
+		t.Fatalf("Expected no emails to be sent, got %d and %d.", success, failure)
+	}
+	time.Sleep(time.Until(sendAt))
+	err = build.Retry(10, 200*time.Millisecond, func() error {
+		success, failure = s.ScanAndSend(t.Name())
+		if success != 1 || failure != 0 {
+			return fmt.Errorf("expected 1 email to be sent, got %d and %d", success, failure)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, emails, err := db.FindEmails(ctx, bson.M{"to": to}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].SentAt.Before(sendAt) {
+		t.Fatalf("Expected one email sent after %v, got %+v", sendAt, emails)
+	}
+}
+
+// TestReconcileEmails ensures that ReconcileEmails repairs email records left
+// in an inconsistent state and leaves the rest alone.
+func TestReconcileEmails(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	ctx := context.Background()
+	dbName := test.DBNameForTest(t.Name())
+	db, err := test.NewDatabase(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.PurgeEmailCollection(ctx); err != nil {
+		t.Fatal("Failed to purge email collection:", err)
+	}
+	defer func() {
+		if _, err = db.PurgeEmailCollection(ctx); err != nil {
+			t.Fatal("Failed to purge email collection:", err)
+		}
+	}()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	msgs := map[string]database.EmailMessage{
+		// Locked by a crashed server without a lock time.
+		"nolocktime": {LockedBy: "crashed"},
+		// Locked by a crashed server a long time ago.
+		"expired": {LockedBy: "crashed", LockedAt: now.Add(-time.Hour)},
+		// Currently being sent by a live server.
+		"live": {LockedBy: "live", LockedAt: now},
+		// Sent but never unlocked.
+		"sent": {LockedBy: "crashed", LockedAt: now, SentAt: now},
+		// With a negative attempts counter.
+		"negative": {FailedAttempts: -2},
+		// Perfectly fine.
+		"fine": {FailedAttempts: 1},
+	}
+	for name, m := range msgs {
+		m.To = name + "@siasky.net"
+		if err = db.EmailCreate(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := db.ReconcileEmails(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StaleLocks != 2 || r.SentLocks != 1 || r.InvalidAttempts != 1 {
+		t.Fatalf("Unexpected report %+v", r)
+	}
+	_, emails, err := db.FindEmails(ctx, bson.M{}, &options.FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != len(msgs) {
+		t.Fatalf("Expected %d emails, got %d.", len(msgs), len(emails))
+	}
+	for _, m := range emails {
+		switch m.To {
+		case "nolocktime@siasky.net", "expired@siasky.net", "sent@siasky.net":
+			if m.LockedBy != "" || !m.LockedAt.IsZero() {
+				t.Fatalf("Expected %s to be unlocked, got %+v", m.To, m)
+			}
+		case "live@siasky.net":
+			if m.LockedBy != "live" || !m.LockedAt.Equal(now) {
+				t.Fatalf("Expected %s to remain locked, got %+v", m.To, m)
+			}
+		case "negative@siasky.net":
+			if m.FailedAttempts != 0 {
+				t.Fatalf("Expected %s to have no failed attempts, got %+v", m.To, m)
+			}
+		case "fine@siasky.net":
+			if m.FailedAttempts != 1 || m.LockedBy != "" {
+				t.Fatalf("Expected %s to remain unchanged, got %+v", m.To, m)
+			}
+		default:
+			t.Fatalf("Unexpected email %+v", m)
+		}
+	}
+	// There's nothing left to repair.
+	r, err = db.ReconcileEmails(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StaleLocks != 0 || r.SentLocks != 0 || r.InvalidAttempts != 0 {
+		t.Fatalf("Expected nothing to be repaired, got %+v", r)
+	}
+}
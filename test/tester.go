@@ -13,6 +13,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/SkynetLabs/skynet-accounts/api"
@@ -52,6 +53,9 @@ type (
 		FollowRedirects bool
 
 		cancel context.CancelFunc
+		// mu guards the cookie, which concurrent requests might replace, see
+		// UserPUT.
+		mu sync.Mutex
 	}
 )
 
@@ -68,12 +72,12 @@ func ExtractCookie(r *http.Response) *http.Cookie {
 
 // NewDatabase returns a new DB connection based on the passed parameters.
 func NewDatabase(ctx context.Context, dbName string) (*database.DB, error) {
-	return database.NewCustomDB(ctx, SanitizeName(dbName), DBTestCredentials(), NewDiscardLogger(), nil)
+	return database.NewCustomDB(ctx, SanitizeName(dbName), DBTestCredentials(), NewDiscardLogger(), nil, 0)
 }
 
 // NewDatabaseWithDeps returns a new DB connection with custom dependencies.
 func NewDatabaseWithDeps(ctx context.Context, dbName string, deps lib.Dependencies) (*database.DB, error) {
-	return database.NewCustomDB(ctx, SanitizeName(dbName), DBTestCredentials(), NewDiscardLogger(), deps)
+	return database.NewCustomDB(ctx, SanitizeName(dbName), DBTestCredentials(), NewDiscardLogger(), deps, 0)
 }
 
 // NewAccountsTester creates and starts a new AccountsTester service.
@@ -304,9 +308,11 @@ func (at *AccountsTester) executeRequest(req *http.Request) (*http.Response, []b
 	if at.APIKey != "" {
 		req.Header.Set(api.APIKeyHeader, at.APIKey)
 	}
+	at.mu.Lock()
 	if at.Cookie != nil {
 		req.Header.Set("Cookie", at.Cookie.String())
 	}
+	at.mu.Unlock()
 	if at.Token != "" {
 		req.Header.Set("Authorization", "Bearer "+at.Token)
 	}
@@ -503,7 +509,9 @@ func (at *AccountsTester) UserPOST(emailAddr, password string) (*http.Response,
 	return at.post("/user", nil, params)
 }
 
-// UserPUT is a helper method which updates the entire user record.
+// UserPUT is a helper method which updates the entire user record. Like a
+// browser, it replaces the tester's cookie with the fresh one returned by the
+// service, which stays valid after a password change.
 //
 // NOTE: The Body of the returned response is already read and closed.
 func (at *AccountsTester) UserPUT(email, password, stipeID string) (api.UserGET, int, error) {
@@ -517,6 +525,13 @@ func (at *AccountsTester) UserPUT(email, password, stipeID string) (api.UserGET,
 	}
 	var resp api.UserGET
 	r, err := at.Request(http.MethodPut, "/user", nil, b, nil, &resp)
+	if c := ExtractCookie(r); err == nil && c != nil {
+		at.mu.Lock()
+		if at.Cookie != nil {
+			at.Cookie = c
+		}
+		at.mu.Unlock()
+	}
 	return resp, r.StatusCode, err
 }
 
@@ -789,7 +804,7 @@ func (at *AccountsTester) StripePricesGET() ([]api.StripePrice, int, error) {
 
 // PromoterSetTierPOST performs a `POST /promoter/settier/:sub`
 func (at *AccountsTester) PromoterSetTierPOST(sub string, tier int) (int, error) {
-	body := api.PromoterSetTierPOST{tier}
+	body := api.PromoterSetTierPOST{Tier: tier}
 	bodyBytes, err := json.Marshal(body)
 	if err != nil {
 		return http.StatusInternalServerError, err